@@ -0,0 +1,398 @@
+package filekv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// archiveFileName 是历史目录中归档文件的文件名，以 . 开头，所以遍历历史记录文件时会跳过它
+	archiveFileName = ".archive"
+	// archiveMagic 是归档文件的第一行
+	archiveMagic = "FILEKV-ARCHIVE/1\n"
+)
+
+// errInvalidArchive 表示归档文件的格式不对
+var errInvalidArchive = errors.New("invalid archive file")
+
+// archiveEntry 是归档文件的索引中的一项，Offset 是内容相对于数据区开头的偏移
+type archiveEntry struct {
+	Version string            `json:"version"`
+	Offset  int64             `json:"offset"`
+	Size    int64             `json:"size"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// ArchiveKey 把键除了最新一个以外的所有历史记录（包括分页中的和它们的元数据）打包到历史目录中的一个归档文件中，
+// 然后删除这些单独的文件，适合很少被读取的键，以节省 inode。已经有归档文件时把新的历史记录合并进去。
+// 归档文件的格式为：第一行 "FILEKV-ARCHIVE/1"，第二行为索引的字节数，然后是 JSON 格式的索引（版本号、偏移、大小和元数据），
+// 最后是依次存放的各个版本的内容。
+// 最新的历史记录和分页时一样留在默认目录中，所以 Set 不受影响，新的历史记录仍然是单独的文件。
+// GetHistories、GetByVersion、GetPrevVersion、GetNextVersion、GetFirstVersion、GetHistoriesLimited 等方法
+// 会透明地读取归档中的历史记录，AnalyzeDuplication、KeyStorageBreakdown、RecentChanges、DistinctMetaKeys 和
+// FindEmptyVersions 等统计也包括它们；修改归档中的历史记录（SetMeta、UpdateMeta、清理历史记录）之前会先用 UnarchiveKey 还原它们。
+func (f *FileKVStore) ArchiveKey(ctx context.Context, key string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return err
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	historyDir := f.keyToHistoryPath(key)
+	defer f.pages.invalidate(historyDir)
+
+	loose, err := f.readLooseHistories(ctx, historyDir)
+	if err != nil {
+		return err
+	}
+	if len(loose) > 0 {
+		// 保留最新的一个
+		loose = loose[:len(loose)-1]
+	}
+	if len(loose) == 0 {
+		return nil
+	}
+
+	archived, dataStart, err := f.readArchiveIndex(historyDir)
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	var index []archiveEntry
+	add := func(version string, content []byte, meta map[string]string) {
+		index = append(index, archiveEntry{
+			Version: version,
+			Offset:  int64(data.Len()),
+			Size:    int64(len(content)),
+			Meta:    meta,
+		})
+		data.Write(content)
+	}
+
+	isLoose := make(map[string]struct{}, len(loose))
+	for _, version := range loose {
+		isLoose[version.Version] = struct{}{}
+	}
+	for _, entry := range archived {
+		if _, ok := isLoose[entry.Version]; ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		content, err := f.readArchivedContent(historyDir, dataStart, entry)
+		if err != nil {
+			return err
+		}
+		add(entry.Version, content, entry.Meta)
+	}
+	for _, version := range loose {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		historyFile := filepath.Join(historyDir, version.Name)
+		content, err := f.fsys.ReadFile(historyFile)
+		if err != nil {
+			return errorWrap(err, "reading history file '"+historyFile+"'")
+		}
+		var meta map[string]string
+		if version.hasMeta {
+			if meta, err = f.readProperties(historyFile + metaSuffix); err != nil {
+				return err
+			}
+		}
+		add(version.Version, content, meta)
+	}
+	sort.Slice(index, func(i, j int) bool {
+		return compareVersions(index[i].Version, index[j].Version) < 0
+	})
+
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return errorWrap(err, "encoding archive index of '"+key+"'")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(archiveMagic)
+	buf.WriteString(strconv.Itoa(len(indexData)))
+	buf.WriteString("\n")
+	buf.Write(indexData)
+	buf.Write(data.Bytes())
+
+	// 先写好归档文件再删除单独的文件，中途失败时两处都有的版本在读取时只算一次
+	if err := f.writeFileAtomic(filepath.Join(historyDir, archiveFileName), buf.Bytes()); err != nil {
+		return errorWrap(err, "writing archive of '"+key+"'")
+	}
+	pageDirs := map[string]struct{}{}
+	for _, version := range loose {
+		historyFile := filepath.Join(historyDir, version.Name)
+		if err := f.fsys.Remove(historyFile); err != nil && !os.IsNotExist(err) {
+			return errorWrap(err, "removing archived history file '"+historyFile+"'")
+		}
+		if version.hasMeta {
+			if err := f.fsys.Remove(historyFile + metaSuffix); err != nil && !os.IsNotExist(err) {
+				return errorWrap(err, "removing archived meta file '"+historyFile+metaSuffix+"'")
+			}
+		}
+		if dir := filepath.Dir(historyFile); dir != historyDir {
+			pageDirs[dir] = struct{}{}
+		}
+	}
+	for dir := range pageDirs {
+		// 分页中还有其它文件时删除失败，保留它
+		_ = f.fsys.Remove(dir)
+	}
+	return nil
+}
+
+// UnarchiveKey 把 ArchiveKey 打包的历史记录还原为单独的文件，并删除归档文件，键没有归档时什么也不做
+// 还原的历史记录都放在默认目录中，下次 Fsck 时会重新分页
+func (f *FileKVStore) UnarchiveKey(ctx context.Context, key string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return err
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	return f.unarchiveIf(ctx, f.keyToHistoryPath(key), nil)
+}
+
+// unarchiveIf 在归档中有 match 返回 true 的版本时还原整个归档，match 为 nil 时总是还原
+// 还原的文件在删除归档文件之前和它同时存在，所以先按它们的大小检查 WithMaxStoreBytes 的限额
+func (f *FileKVStore) unarchiveIf(ctx context.Context, historyDir string, match func(entry archiveEntry) bool) error {
+	archived, dataStart, err := f.readArchiveIndex(historyDir)
+	if err != nil || len(archived) == 0 {
+		return err
+	}
+	if match != nil {
+		matched := false
+		for _, entry := range archived {
+			if match(entry) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil
+		}
+	}
+	defer f.pages.invalidate(historyDir)
+
+	var size int64
+	for _, entry := range archived {
+		size += entry.Size
+	}
+	if _, err := f.reserveQuotaBytes(ctx, "restoring archive '"+historyDir+"'", size); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			// 可能已经还原了一部分，下次写入时重新统计
+			f.quota.invalidate()
+		}
+	}()
+
+	for _, entry := range archived {
+		content, err := f.readArchivedContent(historyDir, dataStart, entry)
+		if err != nil {
+			return err
+		}
+		historyFile := filepath.Join(historyDir, entry.Version)
+		if len(entry.Meta) > 0 {
+			if err := f.writeProperties(historyFile+metaSuffix, entry.Meta); err != nil {
+				return err
+			}
+		}
+		if err := f.writeFileAtomic(historyFile, content); err != nil {
+			return errorWrap(err, "restoring archived version '"+entry.Version+"'")
+		}
+	}
+	archiveFile := filepath.Join(historyDir, archiveFileName)
+	var archiveSize int64
+	if st, err := f.fsys.Stat(archiveFile); err == nil {
+		archiveSize = st.Size()
+	}
+	if err := f.fsys.Remove(archiveFile); err != nil && !os.IsNotExist(err) {
+		return errorWrap(err, "removing archive file")
+	}
+	committed = true
+	f.releaseQuota(archiveSize)
+	return nil
+}
+
+// readArchiveIndex 读取历史目录中归档文件的索引，返回索引和数据区在文件中的偏移，没有归档文件时返回 nil
+func (f *FileKVStore) readArchiveIndex(historyDir string) ([]archiveEntry, int64, error) {
+	archiveFile := filepath.Join(historyDir, archiveFileName)
+	file, err := f.fsys.Open(archiveFile)
+	if err != nil {
+		if isNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, errorWrap(err, "opening archive file '"+archiveFile+"'")
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, err := r.ReadString('\n')
+	if err != nil || magic != archiveMagic {
+		return nil, 0, errorWrap(errInvalidArchive, "reading archive file '"+archiveFile+"'")
+	}
+	sizeLine, err := r.ReadString('\n')
+	if err != nil {
+		return nil, 0, errorWrap(errInvalidArchive, "reading archive file '"+archiveFile+"'")
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(sizeLine, "\n"))
+	if err != nil || size < 0 {
+		return nil, 0, errorWrap(errInvalidArchive, "reading archive file '"+archiveFile+"'")
+	}
+	indexData := make([]byte, size)
+	if _, err := io.ReadFull(r, indexData); err != nil {
+		return nil, 0, errorWrap(errInvalidArchive, "reading archive index of '"+archiveFile+"'")
+	}
+	var index []archiveEntry
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return nil, 0, errorWrap(err, "decoding archive index of '"+archiveFile+"'")
+	}
+	return index, int64(len(magic) + len(sizeLine) + size), nil
+}
+
+// readArchivedContent 读取归档中一个版本的内容（变换之前的原始内容）
+func (f *FileKVStore) readArchivedContent(historyDir string, dataStart int64, entry archiveEntry) ([]byte, error) {
+	archiveFile := filepath.Join(historyDir, archiveFileName)
+	file, err := f.fsys.Open(archiveFile)
+	if err != nil {
+		return nil, errorWrap(err, "opening archive file '"+archiveFile+"'")
+	}
+	defer file.Close()
+
+	content := make([]byte, entry.Size)
+	offset := dataStart + entry.Offset
+	if ra, ok := file.(io.ReaderAt); ok {
+		_, err = ra.ReadAt(content, offset)
+	} else if _, err = io.CopyN(io.Discard, file, offset); err == nil {
+		_, err = io.ReadFull(file, content)
+	}
+	if err != nil {
+		return nil, errorWrap(err, "reading version '"+entry.Version+"' from archive file '"+archiveFile+"'")
+	}
+	return content, nil
+}
+
+// findArchivedVersion 在归档中查找版本，返回它的原始内容，ok 表示是否找到
+func (f *FileKVStore) findArchivedVersion(historyDir, version string) ([]byte, bool, error) {
+	archived, dataStart, err := f.readArchiveIndex(historyDir)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, entry := range archived {
+		if entry.Version == version {
+			content, err := f.readArchivedContent(historyDir, dataStart, entry)
+			return content, err == nil, err
+		}
+	}
+	return nil, false, nil
+}
+
+// mergeArchivedHistories 把归档中的版本合并到 loose 中并按版本排序，两处都有的版本只保留 loose 中的
+func (f *FileKVStore) mergeArchivedHistories(historyDir string, loose []Version) ([]Version, error) {
+	archived, _, err := f.readArchiveIndex(historyDir)
+	if err != nil || len(archived) == 0 {
+		return loose, err
+	}
+
+	isLoose := make(map[string]struct{}, len(loose))
+	for _, version := range loose {
+		isLoose[version.Version] = struct{}{}
+	}
+	versions := loose
+	for _, entry := range archived {
+		if _, ok := isLoose[entry.Version]; ok {
+			continue
+		}
+		versions = append(versions, entry.version())
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i].Version, versions[j].Version) < 0
+	})
+	return versions, nil
+}
+
+// version 返回归档中的这个版本的版本信息
+func (entry archiveEntry) version() Version {
+	return Version{
+		Name:     entry.Version,
+		Version:  entry.Version,
+		Meta:     entry.Meta,
+		Pinned:   isPinnedMeta(entry.Meta),
+		hasMeta:  len(entry.Meta) > 0,
+		archived: true,
+	}
+}
+
+// historyContents 读取 readHistories 返回的版本的原始内容，版本可能在归档中。
+// 归档的索引在第一次读取归档中的版本时读取，之后不再重复读取，所以遍历所有的版本时只读取一次索引
+type historyContents struct {
+	f          *FileKVStore
+	historyDir string
+
+	loaded    bool
+	archived  map[string]archiveEntry
+	dataStart int64
+}
+
+func (f *FileKVStore) newHistoryContents(historyDir string) *historyContents {
+	return &historyContents{f: f, historyDir: historyDir}
+}
+
+// read 读取一个版本的原始内容
+func (h *historyContents) read(version Version) ([]byte, error) {
+	if !version.archived {
+		return h.f.fsys.ReadFile(filepath.Join(h.historyDir, version.Name))
+	}
+	if !h.loaded {
+		index, dataStart, err := h.f.readArchiveIndex(h.historyDir)
+		if err != nil {
+			return nil, err
+		}
+		h.archived = make(map[string]archiveEntry, len(index))
+		for _, entry := range index {
+			h.archived[entry.Version] = entry
+		}
+		h.dataStart, h.loaded = dataStart, true
+	}
+	entry, ok := h.archived[version.Version]
+	if !ok {
+		return nil, errorWrap(os.ErrNotExist, "version '"+version.Version+"' is no longer archived")
+	}
+	return h.f.readArchivedContent(h.historyDir, h.dataStart, entry)
+}
+
+// readHistoryMeta 读取 readHistories 返回的一个版本的元数据，归档中的版本的元数据已经在 version.Meta 中
+func (f *FileKVStore) readHistoryMeta(historyDir string, version Version) (map[string]string, error) {
+	if version.archived || !version.hasMeta {
+		return version.Meta, nil
+	}
+	meta, err := f.readProperties(filepath.Join(historyDir, version.Name+metaSuffix))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errorWrap(err, "reading meta file")
+	}
+	return meta, nil
+}
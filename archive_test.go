@@ -0,0 +1,258 @@
+package filekv
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// checkArchivedValues 检查所有版本都能读出来，内容为 "value-<i>"
+func checkArchivedValues(t *testing.T, store *FileKVStore, key string, versions []string) {
+	t.Helper()
+	ctx := context.Background()
+
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != len(versions) {
+		t.Fatalf("expected %d histories, got %d", len(versions), len(histories))
+	}
+	for i, version := range versions {
+		if histories[i].Version != version {
+			t.Fatalf("history %d: expected version %s, got %s", i, version, histories[i].Version)
+		}
+		value, err := store.GetByVersion(ctx, key, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "value-" + strconv.Itoa(i); string(value) != expected {
+			t.Fatalf("version %s: expected %q, got %q", version, expected, value)
+		}
+	}
+}
+
+func TestFileKVStore_ArchiveKey(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithMaxHistoryCount(3))
+	ctx := context.Background()
+	key := "test/archive"
+	historyDir := filepath.Join(tempDir, ".history", "test", "archive.h")
+
+	var versions []string
+	for i := 0; i < 8; i++ {
+		version, err := store.Set(ctx, key, []byte("value-"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := store.SetMeta(ctx, key, versions[2], map[string]string{"author": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	// 先分页，归档时分页中的历史记录也要打包
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.ArchiveKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只剩下归档文件和最新的历史记录
+	entries, err := os.ReadDir(historyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 || names[0] != archiveFileName || names[1] != versions[7] {
+		t.Fatalf("expected only the archive and the newest version, got %v", names)
+	}
+
+	checkArchivedValues(t, store, key, versions)
+
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if histories[2].Meta["author"] != "alice" {
+		t.Errorf("expected archived meta to be kept, got %v", histories[2].Meta)
+	}
+	sized, err := store.GetHistoriesWithSizes(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range sized {
+		if h.Size != int64(len("value-0")) {
+			t.Errorf("version %s: expected size %d, got %d", h.Version, len("value-0"), h.Size)
+		}
+	}
+
+	// 导航、解析版本和流式读取也能找到归档中的版本
+	prev, err := store.GetPrevVersion(ctx, key, versions[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev.Version != versions[3] {
+		t.Errorf("expected previous version %s, got %s", versions[3], prev.Version)
+	}
+	prevValue, cur, _, _, err := store.GetVersionPair(ctx, key, versions[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(prevValue) != "value-0" || string(cur) != "value-1" {
+		t.Errorf("unexpected version pair %q, %q", prevValue, cur)
+	}
+	if resolved, err := store.ResolveVersion(ctx, key, versions[0]); err != nil || resolved != versions[0] {
+		t.Errorf("expected %s, got %s, %v", versions[0], resolved, err)
+	}
+	r, err := store.OpenReaderByVersion(ctx, key, versions[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "value-5" {
+		t.Errorf("expected %q, got %q", "value-5", data)
+	}
+
+	// 从新到旧遍历的方法和 GetFirstVersion 也能看到归档中的版本
+	first, err := store.GetFirstVersion(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != versions[0] {
+		t.Errorf("expected first version %s, got %s", versions[0], first.Version)
+	}
+	limited, truncated, err := store.GetHistoriesLimited(ctx, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated || len(limited) != len(versions) {
+		t.Fatalf("expected %d histories, got %d (truncated %v)", len(versions), len(limited), truncated)
+	}
+	for i, h := range limited {
+		if expected := versions[len(versions)-1-i]; h.Version != expected {
+			t.Errorf("history %d: expected version %s, got %s", i, expected, h.Version)
+		}
+	}
+	limited, truncated, err = store.GetHistoriesLimited(ctx, key, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || len(limited) != 3 || limited[2].Version != versions[5] {
+		t.Errorf("unexpected limited histories %v (truncated %v)", limited, truncated)
+	}
+	latest, latestVersion, err := store.GetLatestByMeta(ctx, key, "author", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(latest) != "value-2" || latestVersion.Version != versions[2] {
+		t.Errorf("expected %s with %q, got %s with %q", versions[2], "value-2", latestVersion.Version, latest)
+	}
+
+	// 归档之后 Set 照常追加新的版本
+	version, err := store.Set(ctx, key, []byte("value-8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions = append(versions, version)
+	checkArchivedValues(t, store, key, versions)
+
+	// 再次归档时合并到已有的归档中，Fsck 不会破坏归档
+	if err := store.ArchiveKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkArchivedValues(t, store, key, versions)
+
+	// 修改归档中版本的元数据时先还原归档
+	if err := store.UpdateMeta(ctx, key, versions[2], map[string]string{"reviewed": "yes"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(historyDir, archiveFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected the archive to be restored, got %v", err)
+	}
+	histories, err = store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta := histories[2].Meta; meta["author"] != "alice" || meta["reviewed"] != "yes" {
+		t.Errorf("unexpected meta %v", histories[2].Meta)
+	}
+	checkArchivedValues(t, store, key, versions)
+}
+
+func TestFileKVStore_ArchiveKeyCleanup(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "cleanup"
+
+	var versions []string
+	for i := 0; i < 6; i++ {
+		version, err := store.Set(ctx, key, []byte("value-"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := store.ArchiveKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// 清理归档中的历史记录
+	if err := store.CleanupHistoriesByCount(ctx, key, 3); err != nil {
+		t.Fatal(err)
+	}
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, versions[3:])
+	for i, version := range versions[3:] {
+		value, err := store.GetByVersion(ctx, key, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "value-" + strconv.Itoa(i+3); string(value) != expected {
+			t.Errorf("expected %q, got %q", expected, value)
+		}
+	}
+
+	// UnarchiveKey 把历史记录还原为单独的文件
+	if err := store.ArchiveKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UnarchiveKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	historyDir := filepath.Join(tempDir, ".history", "cleanup.h")
+	for _, version := range versions[3:] {
+		if _, err := os.Stat(filepath.Join(historyDir, version)); err != nil {
+			t.Errorf("expected version %s to be restored: %v", version, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(historyDir, archiveFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected the archive to be removed, got %v", err)
+	}
+
+	// 只读模式下不能归档
+	store.readOnly = true
+	if err := store.ArchiveKey(ctx, key); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cabify/timex"
+)
+
+// ErrBackgroundRunning 表示后台任务已经在运行
+var ErrBackgroundRunning = errors.New("background loop is already running")
+
+// RetentionPolicy 历史记录的保留策略
+type RetentionPolicy struct {
+	// MaxAge 超过此时间的历史记录将被清理，为 0 时不按时间清理
+	MaxAge time.Duration
+	// MaxCount 每个键最多保留的历史记录数，为 0 时不按数量清理
+	MaxCount int
+}
+
+// BackgroundConfig 后台任务的配置
+type BackgroundConfig struct {
+	// ReapInterval 按 RetentionPolicy 清理历史记录的间隔，为 0 时不清理
+	ReapInterval time.Duration
+	// FsckInterval 执行 Fsck 的间隔，为 0 时不执行
+	FsckInterval time.Duration
+	// RetentionPolicy 清理历史记录时使用的保留策略
+	RetentionPolicy RetentionPolicy
+	// OnError 后台任务出错时的回调，为 nil 时忽略错误
+	OnError func(err error)
+}
+
+type backgroundLoop struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartBackground 启动后台任务，定期清理历史记录和执行 Fsck
+// 每个 store 同时只能运行一个后台任务，当 ctx 结束或调用 Close 时后台任务停止
+func (f *FileKVStore) StartBackground(ctx context.Context, config BackgroundConfig) error {
+	f.bgMu.Lock()
+	defer f.bgMu.Unlock()
+
+	if f.bg != nil {
+		select {
+		case <-f.bg.done:
+		default:
+			return ErrBackgroundRunning
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	loop := &backgroundLoop{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	f.bg = loop
+
+	go func() {
+		defer close(loop.done)
+		f.runBackground(ctx, config)
+	}()
+	return nil
+}
+
+func (f *FileKVStore) runBackground(ctx context.Context, config BackgroundConfig) {
+	var reapC, fsckC <-chan time.Time
+	if config.ReapInterval > 0 {
+		ticker := timex.NewTicker(config.ReapInterval)
+		defer ticker.Stop()
+		reapC = ticker.C()
+	}
+	if config.FsckInterval > 0 {
+		ticker := timex.NewTicker(config.FsckInterval)
+		defer ticker.Stop()
+		fsckC = ticker.C()
+	}
+
+	onError := func(err error) {
+		// 停止时被中断的任务不算出错
+		if err != nil && ctx.Err() == nil && config.OnError != nil {
+			config.OnError(err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reapC:
+			onError(f.applyRetentionPolicy(ctx, config.RetentionPolicy))
+		case <-fsckC:
+			onError(f.Fsck(ctx))
+		}
+	}
+}
+
+// applyRetentionPolicy 对所有的键执行保留策略
+func (f *FileKVStore) applyRetentionPolicy(ctx context.Context, policy RetentionPolicy) error {
+	if policy.MaxAge <= 0 && policy.MaxCount <= 0 {
+		return nil
+	}
+
+	keys, err := f.ListKeys(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	var errList []error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if policy.MaxAge > 0 {
+			if err := f.CleanupHistoriesByTime(ctx, key, policy.MaxAge); err != nil {
+				errList = append(errList, err)
+			}
+		}
+		if policy.MaxCount > 0 {
+			if err := f.CleanupHistoriesByCount(ctx, key, policy.MaxCount); err != nil {
+				errList = append(errList, err)
+			}
+		}
+	}
+
+	if len(errList) > 0 {
+		if len(errList) == 1 {
+			return errList[0]
+		}
+		return errors.Join(errList...)
+	}
+	return nil
+}
+
+// Close 停止后台任务并等待它退出
+func (f *FileKVStore) Close() error {
+	f.bgMu.Lock()
+	loop := f.bg
+	f.bg = nil
+	f.bgMu.Unlock()
+
+	if loop != nil {
+		loop.cancel()
+		<-loop.done
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cabify/timex/timextest"
+)
+
+func TestFileKVStore_StartBackground(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-background-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mockedtimex := timextest.Mock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer mockedtimex.TearDown()
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/background"
+
+	for i := 0; i < 5; i++ {
+		if _, err := store.Set(ctx, key, []byte("version "+string(rune('0'+i)))); err != nil {
+			t.Fatal(err)
+		}
+		mockedtimex.SetNow(mockedtimex.Now().Add(time.Second))
+	}
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		".history/orphan.h/1672531200000000000": []byte("orphan"),
+	})
+
+	var errs []error
+	err = store.StartBackground(ctx, BackgroundConfig{
+		ReapInterval:    time.Minute,
+		FsckInterval:    time.Hour,
+		RetentionPolicy: RetentionPolicy{MaxCount: 2},
+		OnError:         func(err error) { errs = append(errs, err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reapTicker := <-mockedtimex.NewTickerCalls
+	if reapTicker.Duration != time.Minute {
+		t.Fatalf("expected reap interval %v, got %v", time.Minute, reapTicker.Duration)
+	}
+	fsckTicker := <-mockedtimex.NewTickerCalls
+	if fsckTicker.Duration != time.Hour {
+		t.Fatalf("expected fsck interval %v, got %v", time.Hour, fsckTicker.Duration)
+	}
+
+	if err := store.StartBackground(ctx, BackgroundConfig{}); !errors.Is(err, ErrBackgroundRunning) {
+		t.Fatalf("expected ErrBackgroundRunning, got %v", err)
+	}
+
+	// 第二次 Tick 返回时，第一次触发的任务一定已经执行完了
+	reapTicker.Mock.Tick(mockedtimex.Now())
+	reapTicker.Mock.Tick(mockedtimex.Now())
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 2 {
+		t.Fatalf("expected 2 histories after reaping, got %d", len(histories))
+	}
+
+	fsckTicker.Mock.Tick(mockedtimex.Now())
+	fsckTicker.Mock.Tick(mockedtimex.Now())
+	if _, err := os.Stat(filepath.Join(tempDir, ".history", "orphan.h")); !os.IsNotExist(err) {
+		t.Fatalf("expected orphaned history to be removed by fsck, got %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-reapTicker.Mock.StoppedChan()
+	<-fsckTicker.Mock.StoppedChan()
+	if len(errs) != 0 {
+		t.Fatalf("unexpected background errors: %v", errs)
+	}
+
+	// 通过 ctx 停止后台任务
+	cancelCtx, cancel := context.WithCancel(ctx)
+	if err := store.StartBackground(cancelCtx, BackgroundConfig{ReapInterval: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	reapTicker = <-mockedtimex.NewTickerCalls
+	cancel()
+	<-reapTicker.Mock.StoppedChan()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,468 @@
+package filekv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cabify/timex"
+)
+
+// Entry 是 GetEntries 返回的一个键的值和版本
+type Entry struct {
+	Key     string
+	Value   []byte
+	Version string
+	// Err 为读取该键时出现的错误，键不存在时为 ErrKeyNotFound
+	Err error
+}
+
+// GetEntries 获取多个键的最新值和版本，返回结果的顺序和 keys 一致
+// 单个键出错（如不存在）时只记录在对应 Entry 的 Err 中，不会中断整个调用
+func (f *FileKVStore) GetEntries(ctx context.Context, keys []string) ([]Entry, error) {
+	entries := make([]Entry, len(keys))
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		entries[i].Key = key
+		value, err := f.Get(ctx, key)
+		if err != nil {
+			entries[i].Err = err
+			continue
+		}
+		entries[i].Value = value
+
+		lastVersion, err := f.GetLastVersion(ctx, key)
+		if err != nil {
+			if !errors.Is(err, ErrVersionNotFound) {
+				entries[i].Err = err
+			}
+			continue
+		}
+		entries[i].Version = lastVersion.Version
+	}
+	return entries, nil
+}
+
+// getManyWorkers 是 GetMany 同时读取的键的个数
+const getManyWorkers = 8
+
+// GetMany 并发地获取多个键的最新值，返回键到值的映射，适合在网络文件系统上一次读取很多键
+// 最多 getManyWorkers 个键同时读取，每读取一个键之前检查 ctx，ctx 被取消时返回 ctx 的错误。
+// 不存在的键不在结果中，不算错误；其它错误（如读取失败或者键不合法）用 errors.Join 合并后返回，
+// 这时结果中仍然包含读取成功的键。
+func (f *FileKVStore) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	var (
+		mu      sync.Mutex
+		result  = make(map[string][]byte, len(keys))
+		errList []error
+		wg      sync.WaitGroup
+	)
+	keyCh := make(chan string)
+	for i := 0; i < getManyWorkers && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyCh {
+				if ctx.Err() != nil {
+					continue
+				}
+				value, err := f.Get(ctx, key)
+
+				mu.Lock()
+				if err == nil {
+					result[key] = value
+				} else if !errors.Is(err, ErrKeyNotFound) {
+					errList = append(errList, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		keyCh <- key
+	}
+	close(keyCh)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(errList) > 0 {
+		return result, errors.Join(errList...)
+	}
+	return result, nil
+}
+
+// ExistsMulti 检查多个键是否存在，返回键到是否存在的映射，每个键各做一次 Stat
+// 和 Exists 一样，只有子键的命名空间（目录）不算存在；有不合法的键时返回错误
+func (f *FileKVStore) ExistsMulti(ctx context.Context, keys []string) (map[string]bool, error) {
+	result := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, ok := result[key]; ok {
+			continue
+		}
+		exists, err := f.Exists(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = exists
+	}
+	return result, nil
+}
+
+// ExistsMultiWithPrefix 和 ExistsMulti 相同，但是只遍历一次 prefix 下的所有键，
+// 适合 keys 密集地分布在同一个前缀下的情况，不以 prefix 开头的键仍然逐个 Stat
+func (f *FileKVStore) ExistsMultiWithPrefix(ctx context.Context, prefix string, keys []string) (map[string]bool, error) {
+	for _, key := range keys {
+		if err := f.validateKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	existing := map[string]struct{}{}
+	err := f.walkKeys(ctx, prefix, func(key string) error {
+		existing[key] = struct{}{}
+		return nil
+	})
+	if err != nil && !isNotExist(err) {
+		return nil, err
+	}
+
+	result := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			exists, err := f.Exists(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = exists
+			continue
+		}
+		_, exists := existing[key]
+		result[key] = exists
+	}
+	return result, nil
+}
+
+// SetMany 用同一个时间戳写入多个键，返回每个键新的版本（值没有变化时为空串），这样相关的键的版本号相同，便于之后关联
+// 和 PutAll 不同，它逐个调用 SetWithTimestamp，不会回滚：部分键写入失败时返回已经写入的键的版本，
+// 以及用 errors.Join 合并的所有失败的错误，调用者可以据此判断哪些键写入成功了
+func (f *FileKVStore) SetMany(ctx context.Context, entries map[string][]byte) (map[string]string, error) {
+	if f.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	timestamp := time.Unix(0, timex.Now().UnixNano())
+	versions := make(map[string]string, len(keys))
+	var errList []error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			errList = append(errList, err)
+			break
+		}
+		version, err := f.SetWithTimestamp(ctx, key, entries[key], timestamp)
+		if err != nil {
+			errList = append(errList, errorWrap(err, "setting key '"+key+"'"))
+			continue
+		}
+		versions[key] = version
+	}
+	if len(errList) > 0 {
+		return versions, errors.Join(errList...)
+	}
+	return versions, nil
+}
+
+// putAllState 记录 PutAll 修改一个键之前的状态，用于回滚
+type putAllState struct {
+	key     string
+	existed bool
+	value   []byte
+	// headMarker 是历史目录中 .head 文件的内容，没有时为 nil
+	headMarker []byte
+	version    string
+	modified   bool
+	// createdDirs 是写入之前还不存在的主数据文件和历史目录的各级目录，从深到浅排列
+	createdDirs []string
+	// historyEntries 是新的键（如删除时保留了历史记录）写入之前历史目录中已有的文件名，
+	// set 失败时没有返回版本，回滚时删除不在其中的文件
+	historyEntries map[string]struct{}
+}
+
+// PutAll 写入多个键，要么全部成功，要么全部回滚，返回每个键新的版本（值没有变化时为空串）
+// 回滚时删除本次调用创建的键和历史记录，已经存在的键恢复为调用之前的值
+// 调用期间会按键名的顺序锁住所有的键
+func (f *FileKVStore) PutAll(ctx context.Context, entries map[string][]byte) (map[string]string, error) {
+	if f.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		if err := f.validateKey(key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	unlock := f.lockKeys(keys...)
+	defer unlock()
+
+	timestamp := timex.Now()
+	states := make([]putAllState, 0, len(keys))
+	versions := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			f.rollbackPutAll(ctx, states)
+			return nil, err
+		}
+
+		value, err := f.fsys.ReadFile(f.keyToPath(key))
+		if err != nil && !os.IsNotExist(err) {
+			f.rollbackPutAll(ctx, states)
+			return nil, f.wrapSetKeyErr(err, key, "reading key")
+		}
+		state := putAllState{key: key, existed: err == nil, value: value}
+		historyDir := f.keyToHistoryPath(key)
+		state.headMarker, err = f.fsys.ReadFile(filepath.Join(historyDir, headMarkerName))
+		if err != nil && !isNotExist(err) {
+			f.rollbackPutAll(ctx, states)
+			return nil, errorWrap(err, "reading head marker of '"+key+"'")
+		}
+		if err := f.recordPutAllDirs(&state, historyDir); err != nil {
+			f.rollbackPutAll(ctx, states)
+			return nil, err
+		}
+
+		state.version, err = f.set(ctx, key, entries[key], timestamp, nil)
+		// set 失败时可能已经写了一部分，也需要回滚
+		state.modified = err != nil || state.version != ""
+		states = append(states, state)
+		if err != nil {
+			f.rollbackPutAll(ctx, states)
+			return nil, errorWrap(err, "putting key '"+key+"'")
+		}
+		versions[key] = state.version
+	}
+	return versions, nil
+}
+
+// rollbackPutAll 把 PutAll 修改过的键恢复为调用之前的状态，回滚时的错误会被忽略
+func (f *FileKVStore) rollbackPutAll(ctx context.Context, states []putAllState) {
+	// 删除了写入的文件，下次写入时重新统计已经占用的字节数
+	defer f.quota.invalidate()
+
+	for i := len(states) - 1; i >= 0; i-- {
+		state := states[i]
+		if !state.modified {
+			continue
+		}
+
+		historyDir := f.keyToHistoryPath(state.key)
+		if state.version != "" {
+			historyFile := filepath.Join(historyDir, state.version)
+			_ = f.fsys.Remove(historyFile + metaSuffix)
+			_ = f.fsys.Remove(historyFile)
+			f.pages.invalidate(historyDir)
+		}
+		markerFile := filepath.Join(historyDir, headMarkerName)
+		if state.headMarker != nil {
+			_ = f.writeFileAtomic(markerFile, state.headMarker)
+		} else {
+			_ = f.fsys.Remove(markerFile)
+		}
+
+		dataFile := f.keyToPath(state.key)
+		if state.existed {
+			_ = f.writeFileAtomicWithDir(dataFile, state.value)
+			_ = f.rebuildRecentIndex(ctx, state.key)
+		} else {
+			_ = f.fsys.Remove(dataFile)
+			_ = f.fsys.Remove(dataFile + recentSuffix)
+			if state.version == "" && state.historyEntries != nil {
+				f.removeNewHistoryEntries(historyDir, state.historyEntries)
+			}
+		}
+
+		for _, dir := range state.createdDirs {
+			if dir == historyDir {
+				// 历史目录是本次创建的，其中的文件都是 set 写入的
+				_ = f.fsys.RemoveAll(dir)
+				f.pages.invalidate(dir)
+				continue
+			}
+			// 父目录中可能有同时写入的其它键，不是空目录时 Remove 会失败
+			_ = f.fsys.Remove(dir)
+		}
+	}
+}
+
+// recordPutAllDirs 在 PutAll 写入键之前记录还不存在的各级目录，以及新的键的历史目录中已有的文件，用于回滚
+func (f *FileKVStore) recordPutAllDirs(state *putAllState, historyDir string) error {
+	dataDirs, err := f.missingDirs(filepath.Dir(f.keyToPath(state.key)))
+	if err != nil {
+		return err
+	}
+	historyDirs, err := f.missingDirs(historyDir)
+	if err != nil {
+		return err
+	}
+	state.createdDirs = append(dataDirs, historyDirs...)
+	if state.existed || len(historyDirs) > 0 {
+		return nil
+	}
+
+	entries, err := f.fsys.ReadDir(historyDir)
+	if err != nil {
+		return errorWrap(err, "reading history directory of '"+state.key+"'")
+	}
+	state.historyEntries = make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		state.historyEntries[entry.Name()] = struct{}{}
+	}
+	return nil
+}
+
+// missingDirs 返回 dir 和它的各级父目录中还不存在的目录，从深到浅排列，不包括数据目录本身
+func (f *FileKVStore) missingDirs(dir string) ([]string, error) {
+	rootDir := filepath.Clean(f.rootDir)
+	var dirs []string
+	for dir != rootDir && dir != filepath.Dir(dir) {
+		_, err := f.fsys.Stat(dir)
+		if err == nil {
+			break
+		}
+		if !isNotExist(err) {
+			return nil, errorWrap(err, "checking directory '"+dir+"'")
+		}
+		dirs = append(dirs, dir)
+		dir = filepath.Dir(dir)
+	}
+	return dirs, nil
+}
+
+// removeNewHistoryEntries 删除历史目录中不在 existing 中的文件，它们是失败的 set 留下的
+func (f *FileKVStore) removeNewHistoryEntries(historyDir string, existing map[string]struct{}) {
+	entries, err := f.fsys.ReadDir(historyDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if _, ok := existing[entry.Name()]; !ok {
+			_ = f.fsys.RemoveAll(filepath.Join(historyDir, entry.Name()))
+		}
+	}
+	f.pages.invalidate(historyDir)
+}
+
+// ReadConsistent 在同时锁住所有键的情况下读取它们的当前值，返回键到值的映射和代表这组值的令牌
+// 读取期间对这些键的写入（Set、PutAll 等）都会等待，所以读到的值属于同一个时刻，不会一部分是旧值一部分是新值。
+// 不存在的键不在返回的映射中，它的不存在也记录在令牌中。令牌只和键、最新版本和内容有关，和 keys 的顺序无关，
+// 可以用 HasChangedSince 检查这组键之后是否被修改过，如发现变化后重新读取。
+func (f *FileKVStore) ReadConsistent(ctx context.Context, keys []string) (map[string][]byte, string, error) {
+	values := make(map[string][]byte, len(keys))
+	token, err := f.snapshotToken(ctx, keys, values)
+	if err != nil {
+		return nil, "", err
+	}
+	return values, token, nil
+}
+
+// HasChangedSince 检查 keys 中是否有键在 ReadConsistent 返回 token 之后被修改、创建或删除了
+// keys 必须和调用 ReadConsistent 时的键相同（顺序可以不同），否则总是返回 true
+func (f *FileKVStore) HasChangedSince(ctx context.Context, keys []string, token string) (bool, error) {
+	current, err := f.snapshotToken(ctx, keys, nil)
+	if err != nil {
+		return false, err
+	}
+	return current != token, nil
+}
+
+// snapshotToken 锁住所有的键后计算它们的令牌，values 不为 nil 时同时把存在的键的值保存到 values 中
+// 令牌是按键名排序后，每个键的键名、最新版本、是否存在和当前值的 sha256 的摘要
+func (f *FileKVStore) snapshotToken(ctx context.Context, keys []string, values map[string][]byte) (string, error) {
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if err := f.validateKey(key); err != nil {
+			return "", err
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	unlock := f.lockKeys(sorted...)
+	defer unlock()
+
+	token := sha256.New()
+	var lenBuf [binary.MaxVarintLen64]byte
+	writeField := func(b []byte) {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+		token.Write(lenBuf[:n])
+		token.Write(b)
+	}
+	for _, key := range sorted {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		value, err := f.Get(ctx, key)
+		exists := err == nil
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return "", err
+		}
+		version := ""
+		if exists {
+			if version, err = lastVersionOf(ctx, f, key); err != nil {
+				return "", err
+			}
+			if values != nil {
+				values[key] = value
+			}
+		}
+
+		writeField([]byte(key))
+		writeField([]byte(version))
+		if exists {
+			sum := sha256.Sum256(value)
+			writeField(sum[:])
+		} else {
+			writeField(nil)
+		}
+	}
+	return hex.EncodeToString(token.Sum(nil)), nil
+}
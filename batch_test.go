@@ -0,0 +1,518 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestFileKVStore_GetEntries(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-entries-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	versions := map[string]string{}
+	for _, key := range []string{"b", "a", "c/d"} {
+		version, err := store.Set(ctx, key, []byte("value of "+key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions[key] = version
+	}
+
+	keys := []string{"c/d", "missing", "a", "b", "a"}
+	entries, err := store.GetEntries(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(keys) {
+		t.Fatalf("expected %d entries, got %d", len(keys), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Key != keys[i] {
+			t.Fatalf("expected key %q at %d, got %q", keys[i], i, entry.Key)
+		}
+		if entry.Key == "missing" {
+			if !errors.Is(entry.Err, ErrKeyNotFound) {
+				t.Fatalf("expected ErrKeyNotFound, got %v", entry.Err)
+			}
+			if entry.Value != nil {
+				t.Fatalf("expected nil value, got %q", entry.Value)
+			}
+			continue
+		}
+		if entry.Err != nil {
+			t.Fatal(entry.Err)
+		}
+		if string(entry.Value) != "value of "+entry.Key {
+			t.Fatalf("unexpected value for %q: %q", entry.Key, entry.Value)
+		}
+		if entry.Version != versions[entry.Key] {
+			t.Fatalf("expected version %q for %q, got %q", versions[entry.Key], entry.Key, entry.Version)
+		}
+	}
+}
+
+func TestFileKVStore_ExistsMulti(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-exists-multi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	for _, key := range []string{"users/a", "users/b", "users/group/c", "other"} {
+		if _, err := store.Set(ctx, key, []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// users/group 只是命名空间，不算存在
+	keys := []string{"users/a", "users/missing", "users/group", "users/group/c", "other", "absent", "users/a"}
+	expected := map[string]bool{
+		"users/a":       true,
+		"users/missing": false,
+		"users/group":   false,
+		"users/group/c": true,
+		"other":         true,
+		"absent":        false,
+	}
+
+	for name, fn := range map[string]func() (map[string]bool, error){
+		"ExistsMulti":           func() (map[string]bool, error) { return store.ExistsMulti(ctx, keys) },
+		"ExistsMultiWithPrefix": func() (map[string]bool, error) { return store.ExistsMultiWithPrefix(ctx, "users/", keys) },
+	} {
+		result, err := fn()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(result) != len(expected) {
+			t.Fatalf("%s: expected %d results, got %v", name, len(expected), result)
+		}
+		for key, exists := range expected {
+			if result[key] != exists {
+				t.Fatalf("%s: expected %q exists=%v, got %v", name, key, exists, result[key])
+			}
+		}
+	}
+
+	if _, err := store.ExistsMulti(ctx, []string{"a", "../b"}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+	if _, err := store.ExistsMultiWithPrefix(ctx, "users/", []string{"users/.h"}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestFileKVStore_PutAll(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-putall-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fsys := &faultFS{FS: osFS{}}
+	store := NewFileKVStore(tempDir, WithFS(fsys))
+	ctx := context.Background()
+
+	existingVersion, err := store.Set(ctx, "b", []byte("old b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第三个键（按键名排序）写入失败时全部回滚
+	errInjected := errors.New("injected failure")
+	fsys.writeFileErr = func(name string) error {
+		// 写入 c/d 的主数据文件（包括临时文件）时失败
+		if filepath.Dir(name) == filepath.Join(tempDir, "c") {
+			return errInjected
+		}
+		return nil
+	}
+	entries := map[string][]byte{
+		"a":   []byte("new a"),
+		"b":   []byte("new b"),
+		"c/d": []byte("new c/d"),
+		"e":   []byte("new e"),
+	}
+	if _, err := store.PutAll(ctx, entries); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected failure, got %v", err)
+	}
+	fsys.writeFileErr = nil
+
+	for _, key := range []string{"a", "c/d", "e"} {
+		exists, err := store.Exists(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatalf("expected %q to be rolled back", key)
+		}
+		histories, err := store.GetHistories(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(histories) != 0 {
+			t.Fatalf("expected no histories for %q, got %v", key, histories)
+		}
+	}
+	value, err := store.Get(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "old b" {
+		t.Fatalf("expected %q to be restored, got %q", "old b", value)
+	}
+	histories, err := store.GetHistories(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{existingVersion})
+
+	// 全部成功
+	versions, err := store.PutAll(ctx, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != len(entries) {
+		t.Fatalf("expected %d versions, got %v", len(entries), versions)
+	}
+	for key, expected := range entries {
+		value, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != string(expected) {
+			t.Fatalf("expected %q for %q, got %q", expected, key, value)
+		}
+		if versions[key] == "" {
+			t.Fatalf("expected new version for %q", key)
+		}
+	}
+}
+
+// listTree 返回目录下所有的文件和目录（目录以 / 结尾）的相对路径，用于比较回滚前后的目录树
+func listTree(t *testing.T, dir string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			rel += "/"
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestFileKVStore_PutAllRollbackTree(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	fsys := &faultFS{FS: osFS{}}
+	store := NewFileKVStore(tempDir, WithFS(fsys), WithRecentIndexSize(3))
+
+	if _, err := store.Set(ctx, "b", []byte("old b")); err != nil {
+		t.Fatal(err)
+	}
+	// k 被删除了但是保留了历史记录，再次写入时它的历史目录已经存在
+	if _, err := store.Set(ctx, "k", []byte("old k")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "k", false); err != nil {
+		t.Fatal(err)
+	}
+	before := listTree(t, tempDir)
+
+	errInjected := errors.New("injected failure")
+	for _, failing := range []string{"z/y/x", "k"} {
+		// 写入失败的键的主数据文件时失败，这时 set 没有返回版本，它创建的目录和历史记录也要删除
+		fsys.renameErr = func(oldpath, newpath string) error {
+			if newpath == filepath.Join(tempDir, filepath.FromSlash(failing)) {
+				return errInjected
+			}
+			return nil
+		}
+		entries := map[string][]byte{
+			"a/b/c": []byte("new a/b/c"),
+			"b":     []byte("new b"),
+			failing: []byte("new " + failing),
+		}
+		if _, err := store.PutAll(ctx, entries); !errors.Is(err, errInjected) {
+			t.Fatalf("%s: expected injected failure, got %v", failing, err)
+		}
+		fsys.renameErr = nil
+
+		if after := listTree(t, tempDir); !reflect.DeepEqual(before, after) {
+			t.Fatalf("%s: expected the tree to be restored\nbefore: %v\nafter:  %v", failing, before, after)
+		}
+	}
+}
+
+func TestFileKVStore_ReadConsistent(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-read-consistent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	keys := []string{"config/b", "config/a", "config/missing"}
+
+	if _, err := store.PutAll(ctx, map[string][]byte{"config/a": []byte("0"), "config/b": []byte("0")}); err != nil {
+		t.Fatal(err)
+	}
+	values, token, err := store.ReadConsistent(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || string(values["config/a"]) != "0" || string(values["config/b"]) != "0" {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	// 没有修改时令牌不变，和键的顺序无关
+	changed, err := store.HasChangedSince(ctx, []string{"config/missing", "config/a", "config/b"}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("expected no change")
+	}
+
+	// 修改、创建或删除任何一个键后都能发现
+	for _, modify := range []func() error{
+		func() error { _, err := store.Set(ctx, "config/a", []byte("1")); return err },
+		func() error { _, err := store.Set(ctx, "config/missing", []byte("new")); return err },
+		func() error { return store.Delete(ctx, "config/b", false) },
+		func() error {
+			return os.WriteFile(filepath.Join(tempDir, "config", "a"), []byte("external"), 0644)
+		},
+	} {
+		_, token, err := store.ReadConsistent(ctx, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := modify(); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := store.HasChangedSince(ctx, keys, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changed {
+			t.Fatal("expected change to be detected")
+		}
+	}
+
+	// 并发的 PutAll 总是同时修改两个键，读到的两个值总是属于同一代
+	if _, err := store.PutAll(ctx, map[string][]byte{"config/a": []byte("0"), "config/b": []byte("0")}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 200; i++ {
+			generation := []byte(strconv.Itoa(i))
+			if _, err := store.PutAll(ctx, map[string][]byte{"config/a": generation, "config/b": generation}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for finished := false; !finished; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			finished = true
+		default:
+		}
+
+		values, _, err := store.ReadConsistent(ctx, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(values["config/a"]) != string(values["config/b"]) {
+			t.Fatalf("torn read: %q and %q", values["config/a"], values["config/b"])
+		}
+	}
+
+	// 写入全部结束后读到最后一代，之后令牌不再变化
+	values, token, err = store.ReadConsistent(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values["config/a"]) != "200" || string(values["config/b"]) != "200" {
+		t.Fatalf("expected the last generation, got %v", values)
+	}
+	changed, err = store.HasChangedSince(ctx, keys, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("expected no change after writes finished")
+	}
+}
+
+func TestFileKVStore_GetMany(t *testing.T) {
+	store := NewFileKVStore(t.TempDir())
+	ctx := context.Background()
+
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := "config/" + strconv.Itoa(i)
+		if _, err := store.Set(ctx, key, []byte("value-"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	// 不存在的键不在结果中，重复的键只读取一次
+	values, err := store.GetMany(ctx, append(keys, "config/missing", keys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(keys) {
+		t.Fatalf("expected %d values, got %d", len(keys), len(values))
+	}
+	for i, key := range keys {
+		if expected := "value-" + strconv.Itoa(i); string(values[key]) != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, values[key])
+		}
+	}
+
+	// 其它错误合并后返回，同时返回读取成功的键
+	values, err = store.GetMany(ctx, []string{keys[1], "../invalid", "config"})
+	if !errors.Is(err, ErrInvalidKey) || !errors.Is(err, ErrKeyIsNamespace) {
+		t.Fatalf("expected joined ErrInvalidKey and ErrKeyIsNamespace, got %v", err)
+	}
+	if string(values[keys[1]]) != "value-1" {
+		t.Errorf("expected the readable key in the result, got %v", values)
+	}
+
+	// ctx 被取消时返回 ctx 的错误
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.GetMany(cancelled, keys); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func BenchmarkGetMany_Serial(b *testing.B) {
+	store, keys := newGetManyBenchStore(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			value, err := store.Get(ctx, key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			values[key] = value
+		}
+	}
+}
+
+func BenchmarkGetMany_Concurrent(b *testing.B) {
+	store, keys := newGetManyBenchStore(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetMany(ctx, keys); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func newGetManyBenchStore(b *testing.B) (*FileKVStore, []string) {
+	store := NewFileKVStore(b.TempDir())
+	ctx := context.Background()
+	keys := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		key := "config/" + strconv.Itoa(i)
+		if _, err := store.Set(ctx, key, []byte("value-"+strconv.Itoa(i))); err != nil {
+			b.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return store, keys
+}
+
+func TestFileKVStore_SetMany(t *testing.T) {
+	store := NewFileKVStore(t.TempDir())
+	ctx := context.Background()
+
+	if _, err := store.Set(ctx, "app/b", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 所有的键使用同一个版本号，值没有变化的键为空串
+	versions, err := store.SetMany(ctx, map[string][]byte{
+		"app/a": []byte("a"),
+		"app/b": []byte("b"),
+		"app/c": []byte("c"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions["app/a"] == "" || versions["app/a"] != versions["app/c"] || versions["app/b"] != "" {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	for _, key := range []string{"app/a", "app/c"} {
+		last, err := store.GetLastVersion(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last.Version != versions[key] {
+			t.Errorf("%s: expected version %s, got %s", key, versions[key], last.Version)
+		}
+	}
+
+	// 部分失败时返回已经写入的版本和合并的错误
+	versions, err = store.SetMany(ctx, map[string][]byte{
+		"app/a":      []byte("a2"),
+		"../invalid": []byte("x"),
+		"app/c/d":    []byte("conflict"),
+	})
+	if !errors.Is(err, ErrInvalidKey) || !errors.Is(err, ErrKeyConflict) {
+		t.Fatalf("expected joined ErrInvalidKey and ErrKeyConflict, got %v", err)
+	}
+	if len(versions) != 1 || versions["app/a"] == "" {
+		t.Fatalf("expected only app/a to be written, got %v", versions)
+	}
+	value, err := store.Get(ctx, "app/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "a2" {
+		t.Errorf("expected %q, got %q", "a2", value)
+	}
+}
@@ -0,0 +1,152 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ImportSession 批量导入会话
+// AddVersion 只写入历史记录，不更新主数据文件也不整理分页目录，
+// 在 Finish 时统一把每个键的最后一个版本写回主数据文件并整理历史记录，
+// 以此分摊大量导入时的整理开销。
+// 注意：在 Finish 之前，主数据文件可能还是旧值。
+type ImportSession struct {
+	store *FileKVStore
+	// key -> 本次会话中最后写入的历史记录文件
+	lastFiles map[string]string
+	finished  bool
+}
+
+// BeginImport 开始一个批量导入会话
+func (f *FileKVStore) BeginImport(ctx context.Context) (*ImportSession, error) {
+	if f.readOnly {
+		return nil, ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &ImportSession{
+		store:     f,
+		lastFiles: make(map[string]string),
+	}, nil
+}
+
+// AddVersion 以指定的时间戳为 key 添加一个历史版本
+// 当 value 和上一个版本相等时，不产生历史记录，返回值中 version 返回空串
+func (s *ImportSession) AddVersion(key string, value []byte, timestamp time.Time) (string, error) {
+	if s.finished {
+		return "", errors.New("import session is already finished")
+	}
+	f := s.store
+	if err := f.validateKey(key); err != nil {
+		return "", err
+	}
+
+	value = f.normalizeValue(value)
+
+	lastFile, ok := s.lastFiles[key]
+	if !ok {
+		lastFile = f.keyToPath(key)
+	}
+	lastValue, err := f.fsys.ReadFile(lastFile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errorWrap(err, "reading file for comparison")
+	}
+	if err == nil {
+		if lastValue, err = f.decodeValue(key, lastValue); err != nil {
+			return "", err
+		}
+	}
+	if f.isSameValue(lastValue, value) {
+		return "", nil
+	}
+	value, err = f.encodeValue(key, value)
+	if err != nil {
+		return "", err
+	}
+
+	timestampStr, historyFile, err := f.uniqueHistoryFile(f.keyToHistoryPath(key), timestamp.UnixNano())
+	if err != nil {
+		return "", err
+	}
+	// 只写入历史记录，主数据文件在 Finish 时替换，那时重新统计
+	reserved, err := f.reserveQuotaBytes(context.Background(), "importing key '"+key+"'", int64(len(value)))
+	if err != nil {
+		return "", err
+	}
+	// 和 Set 一样先写默认的元数据再写历史记录
+	var metaFile string
+	if meta := f.newVersionMeta(context.Background(), nil); len(meta) > 0 {
+		metaFile = historyFile + metaSuffix
+		if err := f.writeProperties(metaFile, meta); err != nil {
+			f.releaseQuota(reserved)
+			return "", err
+		}
+	}
+	if err := f.writeFileWithDir(historyFile, value); err != nil {
+		if metaFile != "" {
+			_ = f.fsys.Remove(metaFile)
+		}
+		f.releaseQuota(reserved)
+		return "", errorWrap(err, "writing history file")
+	}
+	s.lastFiles[key] = historyFile
+	return timestampStr, nil
+}
+
+// Finish 结束导入会话，更新每个键的主数据文件，并整理它们的历史记录目录
+func (s *ImportSession) Finish(ctx context.Context) error {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+
+	f := s.store
+	// 主数据文件被替换了，下次写入时重新统计已经占用的字节数
+	defer f.quota.invalidate()
+
+	var errList []error
+	for key, lastFile := range s.lastFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		value, err := f.fsys.ReadFile(lastFile)
+		if err != nil {
+			errList = append(errList, errorWrap(err, "reading last history of '"+key+"'"))
+			continue
+		}
+		// 最后添加的版本不一定是最新的
+		historyDir := f.keyToHistoryPath(key)
+		unmark, err := f.markHead(historyDir, filepath.Base(lastFile))
+		if err != nil {
+			errList = append(errList, err)
+			continue
+		}
+		if err := f.writeFileAtomicWithDir(f.keyToPath(key), value); err != nil {
+			errList = append(errList, errorWrap(err, "writing file of '"+key+"'"))
+			continue
+		}
+		if unmark {
+			f.unmarkHead(historyDir)
+		}
+		if err := f.organizeHistoriesIfNeeded(key, historyDir); err != nil {
+			errList = append(errList, err)
+		}
+		if err := f.rebuildRecentIndex(ctx, key); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	s.lastFiles = nil
+
+	if len(errList) > 0 {
+		if len(errList) == 1 {
+			return errList[0]
+		}
+		return errors.Join(errList...)
+	}
+	return nil
+}
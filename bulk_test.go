@@ -0,0 +1,87 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestImportSession_MatchesIncrementalLayout(t *testing.T) {
+	importDir, err := os.MkdirTemp("", "filekv-import-session-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importDir)
+
+	incrementalDir, err := os.MkdirTemp("", "filekv-import-incremental-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(incrementalDir)
+
+	ctx := context.Background()
+	importStore := NewFileKVStore(importDir)
+	incrementalStore := NewFileKVStore(incrementalDir)
+
+	session, err := importStore.BeginImport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"bulk/a", "bulk/b", "bulk/sub/c"}
+	baseTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	count := 10000
+	for i := 0; i < count; i++ {
+		key := keys[i%len(keys)]
+		timestamp := baseTime.Add(time.Duration(i) * time.Second)
+		// 同一个键每两次写入相同的值，验证去重逻辑
+		value := []byte("value " + strconv.Itoa(i/len(keys)/2))
+
+		importedVersion, err := session.AddVersion(key, value, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		incrementalVersion, err := incrementalStore.SetWithTimestamp(ctx, key, value, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if importedVersion != incrementalVersion {
+			t.Fatalf("version mismatch at %d: import %q, incremental %q", i, importedVersion, incrementalVersion)
+		}
+	}
+
+	if err := session.Finish(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := incrementalStore.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	incrementalFiles, err := getAllFiles(incrementalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, importDir, incrementalFiles)
+
+	for _, file := range incrementalFiles {
+		expected, err := os.ReadFile(filepath.Join(incrementalDir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := os.ReadFile(filepath.Join(importDir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Fatalf("content mismatch for %s: expected %q, got %q", file, expected, actual)
+		}
+	}
+
+	if _, err := session.AddVersion(keys[0], []byte("late"), baseTime); err == nil {
+		t.Fatal("expected error when adding to a finished session")
+	}
+}
@@ -3,15 +3,25 @@ package filekv
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
+	"sync"
 	"time"
 )
 
-// CachedFileKVStore implements the KeyValueStore interface with caching
+// CachedFileKVStore implements the KeyValueStore interface with caching.
+// It is safe for concurrent use by multiple goroutines.
 type CachedFileKVStore struct {
 	store KeyValueStore
+
+	// mu guards cache. Writes hold it across the call to the underlying store,
+	// so the cache never ends up holding a value older than the store's.
+	mu    sync.RWMutex
 	cache map[string][]byte
 }
 
+var _ KeyValueStore = (*CachedFileKVStore)(nil)
+
 func NewCachedFileKVStore(store KeyValueStore) *CachedFileKVStore {
 	return &CachedFileKVStore{
 		store: store,
@@ -20,6 +30,17 @@ func NewCachedFileKVStore(store KeyValueStore) *CachedFileKVStore {
 }
 
 func (c *CachedFileKVStore) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.RLock()
+	val, ok := c.cache[key]
+	c.mu.RUnlock()
+	if ok {
+		return val, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another goroutine may have filled the cache while we were waiting
 	if val, ok := c.cache[key]; ok {
 		return val, nil
 	}
@@ -39,6 +60,9 @@ func (c *CachedFileKVStore) GetByVersion(ctx context.Context, key string, versio
 }
 
 func (c *CachedFileKVStore) Set(ctx context.Context, key string, value []byte) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if val, ok := c.cache[key]; ok {
 		if bytes.Equal(val, value) {
 			return "", nil
@@ -59,6 +83,9 @@ func (c *CachedFileKVStore) Set(ctx context.Context, key string, value []byte) (
 }
 
 func (c *CachedFileKVStore) SetWithTimestamp(ctx context.Context, key string, value []byte, timestamp time.Time) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	version, err := c.store.SetWithTimestamp(ctx, key, value, timestamp)
 	if err != nil {
 		return "", err
@@ -81,6 +108,9 @@ func (c *CachedFileKVStore) UpdateMeta(ctx context.Context, key, version string,
 }
 
 func (c *CachedFileKVStore) Delete(ctx context.Context, key string, removeHistories bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	err := c.store.Delete(ctx, key, removeHistories)
 	if err != nil {
 		return err
@@ -93,7 +123,10 @@ func (c *CachedFileKVStore) Delete(ctx context.Context, key string, removeHistor
 
 func (c *CachedFileKVStore) Exists(ctx context.Context, key string) (bool, error) {
 	// Check cache first
-	if _, ok := c.cache[key]; ok {
+	c.mu.RLock()
+	_, ok := c.cache[key]
+	c.mu.RUnlock()
+	if ok {
 		return true, nil
 	}
 
@@ -131,3 +164,45 @@ func (c *CachedFileKVStore) CleanupHistoriesByCount(ctx context.Context, key str
 func (c *CachedFileKVStore) Fsck(ctx context.Context) error {
 	return c.store.Fsck(ctx)
 }
+
+// Flush forces any pending writes to the underlying store.
+// Writes go through to the underlying store immediately, so there is nothing
+// pending today and Flush is a no-op; it is safe to call any number of times.
+func (c *CachedFileKVStore) Flush(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Sync refreshes the cached entries from the underlying store, which picks up
+// changes made to the underlying store behind the cache's back. Keys that no
+// longer exist are dropped from the cache.
+func (c *CachedFileKVStore) Sync(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.cache {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		val, err := c.store.Get(ctx, key)
+		if err != nil {
+			delete(c.cache, key)
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+			return err
+		}
+		c.cache[key] = val
+	}
+	return nil
+}
+
+// Close flushes pending writes and closes the underlying store if it is an io.Closer.
+func (c *CachedFileKVStore) Close() error {
+	if err := c.Flush(context.Background()); err != nil {
+		return err
+	}
+	if closer, ok := c.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
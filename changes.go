@@ -0,0 +1,119 @@
+package filekv
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ChangeRecord 是 RecentChanges 返回的一次修改
+type ChangeRecord struct {
+	Key       string
+	Version   string
+	Timestamp time.Time
+	Meta      map[string]string
+
+	counter    int
+	historyDir string
+	history    Version
+}
+
+// before 判断 r 是否比 other 更早，时间戳相同时按冲突计数和键名排序
+func (r *ChangeRecord) before(other *ChangeRecord) bool {
+	if !r.Timestamp.Equal(other.Timestamp) {
+		return r.Timestamp.Before(other.Timestamp)
+	}
+	if r.counter != other.counter {
+		return r.counter < other.counter
+	}
+	return r.Key < other.Key
+}
+
+// changeHeap 是按时间排序的小顶堆，堆顶是最早的修改
+type changeHeap []*ChangeRecord
+
+func (h changeHeap) Len() int            { return len(h) }
+func (h changeHeap) Less(i, j int) bool  { return h[i].before(h[j]) }
+func (h changeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *changeHeap) Push(x interface{}) { *h = append(*h, x.(*ChangeRecord)) }
+func (h *changeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+// RecentChanges 返回整个存储中最近的 limit 次修改，按时间从早到晚排序
+// 它扫描所有现存键的历史记录（包括归档中的），用一个大小为 limit 的堆保留最新的记录，内存占用只和 limit 有关，
+// 只有最后保留下来的记录才会读取元数据。已删除的键不在结果中。
+func (f *FileKVStore) RecentChanges(ctx context.Context, limit int) ([]ChangeRecord, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	keys, err := f.ListKeys(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	h := make(changeHeap, 0, limit)
+	var errList []error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		historyDir := f.keyToHistoryPath(key)
+		histories, err := f.readHistories(ctx, historyDir)
+		if err != nil {
+			errList = append(errList, err)
+			continue
+		}
+		for _, version := range histories {
+			ts, counter, err := parseVersion(version.Version)
+			if err != nil {
+				continue
+			}
+			record := &ChangeRecord{
+				Key:        key,
+				Version:    version.Version,
+				Timestamp:  time.Unix(0, ts).UTC(),
+				counter:    counter,
+				historyDir: historyDir,
+				history:    version,
+			}
+			if len(h) < limit {
+				heap.Push(&h, record)
+			} else if h[0].before(record) {
+				h[0] = record
+				heap.Fix(&h, 0)
+			}
+		}
+	}
+
+	if len(errList) > 0 {
+		if len(errList) == 1 {
+			return nil, errList[0]
+		}
+		return nil, errors.Join(errList...)
+	}
+
+	sort.Slice(h, func(i, j int) bool {
+		return h[i].before(h[j])
+	})
+
+	changes := make([]ChangeRecord, len(h))
+	for i, record := range h {
+		meta, err := f.readHistoryMeta(record.historyDir, record.history)
+		if err != nil {
+			return nil, err
+		}
+		record.Meta = meta
+		changes[i] = *record
+	}
+	return changes, nil
+}
@@ -0,0 +1,113 @@
+package filekv
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileKVStore_RecentChanges(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-changes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	// 三个键交替写入，每个键 4 个版本，时间戳各不相同
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := []string{"a", "dir/b", "dir/c"}
+	var expected []string
+	for i := 0; i < 4; i++ {
+		for j, key := range keys {
+			timestamp := base.Add(time.Duration(i*len(keys)+j) * time.Second)
+			version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, key+"@"+version)
+		}
+	}
+	// 和 dir/c 的最后一个版本时间戳相同的冲突记录
+	collided, err := store.SetWithTimestamp(ctx, "dir/c", []byte("collided"), base.Add(11*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "dir/c@"+collided)
+	if err := store.SetMeta(ctx, "dir/b", "head", map[string]string{"author": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := store.RecentChanges(ctx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 5 {
+		t.Fatalf("expected 5 changes, got %d", len(changes))
+	}
+	for i, change := range changes {
+		if got := change.Key + "@" + change.Version; got != expected[len(expected)-5+i] {
+			t.Fatalf("change %d: expected %q, got %q", i, expected[len(expected)-5+i], got)
+		}
+	}
+	if !changes[0].Timestamp.Equal(base.Add(8 * time.Second)) {
+		t.Fatalf("unexpected timestamp %v", changes[0].Timestamp)
+	}
+	if changes[2].Key != "dir/b" || changes[2].Meta["author"] != "test" {
+		t.Fatalf("expected meta of dir/b head, got %v", changes[2])
+	}
+
+	// limit 大于记录总数时返回所有的记录
+	changes, err = store.RecentChanges(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d", len(expected), len(changes))
+	}
+	for i, change := range changes {
+		if got := change.Key + "@" + change.Version; got != expected[i] {
+			t.Fatalf("change %d: expected %q, got %q", i, expected[i], got)
+		}
+	}
+
+	// 归档之后结果不变，归档中的版本的元数据也能读到
+	firstOfA := strings.TrimPrefix(expected[0], "a@")
+	if err := store.SetMeta(ctx, "a", firstOfA, map[string]string{"author": "archived"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := store.ArchiveKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes, err = store.RecentChanges(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes after archiving, got %d", len(expected), len(changes))
+	}
+	for i, change := range changes {
+		if got := change.Key + "@" + change.Version; got != expected[i] {
+			t.Fatalf("change %d after archiving: expected %q, got %q", i, expected[i], got)
+		}
+	}
+	if changes[0].Meta["author"] != "archived" {
+		t.Fatalf("expected meta of the archived version, got %v", changes[0].Meta)
+	}
+
+	changes, err = store.RecentChanges(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("expected no changes, got %d", len(changes))
+	}
+}
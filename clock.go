@@ -0,0 +1,93 @@
+package filekv
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cabify/timex"
+)
+
+// ClockRegressionMode 决定系统时钟回拨时 Set 的行为，见 WithClockRegression
+type ClockRegressionMode int
+
+const (
+	// ClockRegressionIgnore 不检查时钟回拨，新的版本可能比已有的版本更早（默认）
+	ClockRegressionIgnore ClockRegressionMode = iota
+	// ClockRegressionMonotonic 时钟回拨时把时间戳调整为上一次的时间戳加 1 纳秒，保证版本单调递增
+	ClockRegressionMonotonic
+	// ClockRegressionError 时钟回拨时返回 ErrClockRegression
+	ClockRegressionError
+)
+
+// WithClockRegression 设置检测系统时钟回拨的方式
+// 检测时在内存中记录每个键最后一次由 Set 和 SetWithMeta 按当前时间生成的时间戳，不会在重启后保留，
+// 键被删除时它的记录也被删除，改名时记录跟着改名。
+// SetWithTimestamp 使用调用者指定的时间戳（如导入历史数据），既不检查也不记录。
+func WithClockRegression(mode ClockRegressionMode) Option {
+	return func(s *FileKVStore) {
+		s.clock.mode = mode
+	}
+}
+
+// keyClock 为每个键记录最后一次生成的时间戳，用于检测时钟回拨
+// 记录以键的锁的名字（见 lockName）为索引，所以只有大小写不同的键共用一个记录，和它们共用一个文件一致
+type keyClock struct {
+	mode ClockRegressionMode
+
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// now 返回键的新版本使用的时间戳，name 是键的锁的名字，调用者必须持有键的锁
+func (c *keyClock) now(name, key string) (time.Time, error) {
+	now := timex.Now()
+	if c.mode == ClockRegressionIgnore {
+		return now, nil
+	}
+
+	c.mu.Lock()
+	last, ok := c.last[name]
+	c.mu.Unlock()
+	if !ok || now.UnixNano() >= last {
+		return now, nil
+	}
+	if c.mode == ClockRegressionError {
+		return time.Time{}, errorWrap(ErrClockRegression, "setting key '"+key+"': clock is "+
+			strconv.FormatInt(last-now.UnixNano(), 10)+"ns behind the last version")
+	}
+	return time.Unix(0, last+1), nil
+}
+
+// issued 记录锁的名字为 name 的键已经用 timestamp 生成了新版本
+func (c *keyClock) issued(name string, timestamp time.Time) {
+	if c.mode == ClockRegressionIgnore {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last == nil {
+		c.last = map[string]int64{}
+	}
+	c.last[name] = timestamp.UnixNano()
+}
+
+// forget 删除键的记录，在键被删除时调用，以免记录随着写过的键无限增长
+func (c *keyClock) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.last, name)
+}
+
+// move 在键改名时把它的记录移到新的名字下，改名后的键的历史记录就是原来的键的
+func (c *keyClock) move(oldName, newName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.last[oldName]
+	if !ok {
+		return
+	}
+	delete(c.last, oldName)
+	c.last[newName] = last
+}
@@ -0,0 +1,142 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cabify/timex/timextest"
+)
+
+func TestFileKVStore_ClockRegression(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-clock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	initialTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	mockedtimex := timextest.Mock(initialTime)
+	defer mockedtimex.TearDown()
+
+	ctx := context.Background()
+
+	// 单调模式：时钟回拨后时间戳被调整为上一次加 1 纳秒
+	store := NewFileKVStore(tempDir, WithClockRegression(ClockRegressionMonotonic))
+	key := "test/monotonic"
+	first, err := store.Set(ctx, key, []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockedtimex.SetNow(initialTime.Add(-time.Hour))
+	second, err := store.SetWithMeta(ctx, key, []byte("value2"), map[string]string{"author": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strconv.FormatInt(initialTime.UnixNano()+1, 10); second != expected {
+		t.Fatalf("expected version %q, got %q", expected, second)
+	}
+	third, err := store.Set(ctx, key, []byte("value3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strconv.FormatInt(initialTime.UnixNano()+2, 10); third != expected {
+		t.Fatalf("expected version %q, got %q", expected, third)
+	}
+	last, err := store.GetLastVersion(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Version != third {
+		t.Fatalf("expected last version %q, got %q", third, last.Version)
+	}
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{first, second, third})
+
+	// 指定时间戳的写入（如导入）不受影响
+	imported, err := store.SetWithTimestamp(ctx, "test/import", []byte("old"), initialTime.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strconv.FormatInt(initialTime.Add(-24*time.Hour).UnixNano(), 10); imported != expected {
+		t.Fatalf("expected version %q, got %q", expected, imported)
+	}
+	if _, err := store.Set(ctx, "test/import", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 报错模式：时钟回拨时返回 ErrClockRegression，值不变
+	mockedtimex.SetNow(initialTime)
+	store = NewFileKVStore(tempDir, WithClockRegression(ClockRegressionError))
+	key = "test/error"
+	if _, err := store.Set(ctx, key, []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	mockedtimex.SetNow(initialTime.Add(-time.Second))
+	if _, err := store.Set(ctx, key, []byte("value2")); !errors.Is(err, ErrClockRegression) {
+		t.Fatalf("expected ErrClockRegression, got %v", err)
+	}
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value1" {
+		t.Fatalf("expected %q, got %q", "value1", value)
+	}
+
+	// 时钟恢复后可以继续写入
+	mockedtimex.SetNow(initialTime.Add(time.Second))
+	if _, err := store.Set(ctx, key, []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 默认不检查时钟回拨
+	store = NewFileKVStore(tempDir)
+	mockedtimex.SetNow(initialTime.Add(-time.Hour))
+	version, err := store.Set(ctx, key, []byte("value3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strconv.FormatInt(initialTime.Add(-time.Hour).UnixNano(), 10); version != expected {
+		t.Fatalf("expected version %q, got %q", expected, version)
+	}
+}
+
+func TestFileKVStore_ClockRegressionForget(t *testing.T) {
+	initialTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	mockedtimex := timextest.Mock(initialTime)
+	defer mockedtimex.TearDown()
+
+	store := NewFileKVStore(t.TempDir(), WithClockRegression(ClockRegressionError), WithCaseInsensitive(true))
+	ctx := context.Background()
+
+	if _, err := store.Set(ctx, "Old", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	// 改名后记录跟着改名，只有大小写不同的键共用一个记录
+	if err := store.Rename(ctx, "Old", "New"); err != nil {
+		t.Fatal(err)
+	}
+	mockedtimex.SetNow(initialTime.Add(-time.Second))
+	if _, err := store.Set(ctx, "new", []byte("value2")); !errors.Is(err, ErrClockRegression) {
+		t.Fatalf("expected ErrClockRegression, got %v", err)
+	}
+
+	// 删除后记录也被删除
+	if err := store.Delete(ctx, "New", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.clock.last) != 0 {
+		t.Fatalf("expected no clock entries, got %v", store.clock.last)
+	}
+	if _, err := store.Set(ctx, "New", []byte("value3")); err != nil {
+		t.Fatal(err)
+	}
+}
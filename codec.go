@@ -0,0 +1,30 @@
+package filekv
+
+// KeyCodec 把逻辑上的键映射为数据目录下的相对路径（用 / 分隔），以及反过来把路径解码为键，
+// 用于和有固定文件布局的外部系统互通，如把键 "a/b" 保存为 "a/b.json"。
+// 它只影响主数据文件（以及和它放在一起的 .keymeta、.recent 文件）的路径，历史记录依然按逻辑上的键保存。
+// EncodeKey 的结果必须是合法的相对路径，并且 DecodeKey(EncodeKey(key)) 必须返回 key。
+type KeyCodec interface {
+	// EncodeKey 返回键对应的相对路径
+	EncodeKey(key string) string
+	// DecodeKey 返回相对路径对应的键，路径不是用 EncodeKey 生成的时返回 false，这样的文件不会被列出
+	DecodeKey(relPath string) (string, bool)
+}
+
+// IdentityKeyCodec 是默认的 KeyCodec，键就是相对路径
+type IdentityKeyCodec struct{}
+
+func (IdentityKeyCodec) EncodeKey(key string) string {
+	return key
+}
+
+func (IdentityKeyCodec) DecodeKey(relPath string) (string, bool) {
+	return relPath, true
+}
+
+// WithKeyCodec 设置键和主数据文件路径之间的映射，默认为 IdentityKeyCodec
+func WithKeyCodec(codec KeyCodec) Option {
+	return func(s *FileKVStore) {
+		s.keyCodec = codec
+	}
+}
@@ -0,0 +1,115 @@
+package filekv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// jsonKeyCodec 把键保存为 <key>.json
+type jsonKeyCodec struct{}
+
+func (jsonKeyCodec) EncodeKey(key string) string {
+	return key + ".json"
+}
+
+func (jsonKeyCodec) DecodeKey(relPath string) (string, bool) {
+	return strings.CutSuffix(relPath, ".json")
+}
+
+func TestFileKVStore_KeyCodec(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-codec-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir, WithKeyCodec(jsonKeyCodec{}))
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "dir/b", "dir/sub/c"} {
+		if _, err := store.Set(ctx, key, []byte(`{"key":"`+key+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Set(ctx, "dir/b", []byte(`{"key":"dir/b","v":2}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 主数据文件按编码后的路径保存
+	data, err := os.ReadFile(filepath.Join(tempDir, "dir", "b.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"key":"dir/b","v":2}` {
+		t.Fatalf("unexpected content %q", data)
+	}
+	value, err := store.Get(ctx, "dir/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != string(data) {
+		t.Fatalf("expected %q, got %q", data, value)
+	}
+
+	// 外部系统写入的不符合编码的文件不会被列出
+	if err := os.WriteFile(filepath.Join(tempDir, "dir", "README"), []byte("readme"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 列出的是解码后的键
+	keys, err := store.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "a,dir/b,dir/sub/c" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	keys, err = store.ListKeys(ctx, "dir/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "dir/b,dir/sub/c" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	for _, key := range keys {
+		exists, err := store.Exists(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatalf("expected listed key %q to exist", key)
+		}
+	}
+
+	// 历史记录按逻辑上的键保存，Fsck 不会把它们当作孤立的历史记录
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	histories, err := store.GetHistories(ctx, "dir/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 2 {
+		t.Fatalf("expected 2 histories, got %d", len(histories))
+	}
+
+	if err := store.Delete(ctx, "dir/b", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "dir", "b.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected encoded file to be removed, got %v", err)
+	}
+
+	// 默认的 IdentityKeyCodec 不改变键
+	var codec KeyCodec = IdentityKeyCodec{}
+	if key, ok := codec.DecodeKey(codec.EncodeKey("x/y")); !ok || key != "x/y" {
+		t.Fatalf("expected identity round trip, got %q, %v", key, ok)
+	}
+}
@@ -0,0 +1,311 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CompactReport 是 Compact 的结果
+type CompactReport struct {
+	// EmptyDirsRemoved 删除的空目录数
+	EmptyDirsRemoved int
+	// PagesMerged 合并未满的分页后减少的分页目录数
+	PagesMerged int
+	// SidecarsRemoved 删除的悬空附属文件数，即对应的键或版本已经不存在的 .keymeta、.recent 和 .meta 文件
+	SidecarsRemoved int
+	// BytesReclaimed 删除的文件的总字节数
+	BytesReclaimed int64
+	// InodesReclaimed 删除的文件和目录的总数
+	InodesReclaimed int
+}
+
+// Compact 整理整个存储以回收空间，适合在大量删除之后执行
+// 它删除悬空的附属文件，合并未满的分页目录，最后删除所有的空目录。
+// 和 Fsck 不同，它不修复一致性问题，只回收空间。
+func (f *FileKVStore) Compact(ctx context.Context) (*CompactReport, error) {
+	if f.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	report := &CompactReport{}
+	historyRoot := filepath.Join(f.rootDir, historyDirConst)
+
+	if err := f.removeDanglingKeySidecars(ctx, report); err != nil {
+		return report, err
+	}
+
+	var errList []error
+	err := f.walkHistoryDirs(ctx, historyRoot, func(key, historyDir string) error {
+		if err := f.removeDanglingMetas(historyDir, report); err != nil {
+			errList = append(errList, err)
+			return nil
+		}
+		if err := f.validateKey(key); err != nil {
+			return nil
+		}
+		merged, err := f.mergePages(key, historyDir)
+		report.PagesMerged += merged
+		report.InodesReclaimed += merged
+		if err != nil {
+			errList = append(errList, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if _, err := f.removeEmptyDirs(ctx, f.rootDir, report); err != nil {
+		errList = append(errList, err)
+	}
+
+	if len(errList) > 0 {
+		if len(errList) == 1 {
+			return report, errList[0]
+		}
+		return report, errors.Join(errList...)
+	}
+	return report, nil
+}
+
+// removeFileForCompact 删除一个文件并记录到 report 中
+func (f *FileKVStore) removeFileForCompact(filePath string, report *CompactReport) error {
+	st, err := f.fsys.Stat(filePath)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return errorWrap(err, "checking file '"+filePath+"'")
+	}
+	if err := f.fsys.Remove(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errorWrap(err, "removing file '"+filePath+"'")
+	}
+	report.SidecarsRemoved++
+	report.BytesReclaimed += st.Size()
+	report.InodesReclaimed++
+	return nil
+}
+
+// removeDanglingKeySidecars 删除键已经不存在的 .keymeta 和 .recent 文件
+func (f *FileKVStore) removeDanglingKeySidecars(ctx context.Context, report *CompactReport) error {
+	var sidecars []string
+	err := fs.WalkDir(f.fsys, f.rootDir, func(pa string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errorWrap(err, "walking directory '"+pa+"'")
+		}
+		if pa == f.rootDir {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), keyMetaSuffix) || strings.HasSuffix(d.Name(), recentSuffix) {
+			sidecars = append(sidecars, pa)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sidecar := range sidecars {
+		dataFile := strings.TrimSuffix(strings.TrimSuffix(sidecar, keyMetaSuffix), recentSuffix)
+		st, err := f.fsys.Stat(dataFile)
+		if err == nil && !st.IsDir() {
+			continue
+		}
+		if err != nil && !isNotExist(err) {
+			return errorWrap(err, "checking file '"+dataFile+"'")
+		}
+		if err := f.removeFileForCompact(sidecar, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDanglingMetas 删除历史目录（包括分页目录）中版本已经不存在的 .meta 文件
+func (f *FileKVStore) removeDanglingMetas(historyDir string, report *CompactReport) error {
+	dirs := []string{historyDir}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		entries, err := f.fsys.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errorWrap(err, "reading history path")
+		}
+		names := map[string]struct{}{}
+		for _, entry := range entries {
+			names[entry.Name()] = struct{}{}
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				if dir == historyDir && strings.HasPrefix(entry.Name(), pagePrefix) {
+					dirs = append(dirs, filepath.Join(dir, entry.Name()))
+				}
+				continue
+			}
+			if !strings.HasSuffix(entry.Name(), metaSuffix) {
+				continue
+			}
+			if _, ok := names[strings.TrimSuffix(entry.Name(), metaSuffix)]; ok {
+				continue
+			}
+			if err := f.removeFileForCompact(filepath.Join(dir, entry.Name()), report); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergePages 当分页目录的个数多于放下其中所有历史记录所需的个数时，重新分页，返回减少的分页目录数
+// 先把分页中的历史记录移回默认目录，再由 organizeHistoriesIfNeeded 重新分页，
+// 中途失败时历史记录要么在默认目录中，要么在原来的分页中，都可以被正常读取
+func (f *FileKVStore) mergePages(key, historyDir string) (int, error) {
+	unlock := f.lockKey(key)
+	defer unlock()
+	defer f.pages.invalidate(historyDir)
+
+	pages, records, err := f.countPages(historyDir)
+	if err != nil {
+		return 0, err
+	}
+	needed := (records + f.maxHistoryCount - 1) / f.maxHistoryCount
+	if len(pages) <= needed {
+		return 0, nil
+	}
+
+	for _, page := range pages {
+		pageDir := filepath.Join(historyDir, page)
+		entries, err := f.fsys.ReadDir(pageDir)
+		if err != nil {
+			return 0, errorWrap(err, "reading page directory")
+		}
+		for _, entry := range entries {
+			oldPath := filepath.Join(pageDir, entry.Name())
+			newPath := filepath.Join(historyDir, entry.Name())
+			if err := f.fsys.Rename(oldPath, newPath); err != nil {
+				return 0, errorWrap(err, "moving history file from "+oldPath+" to "+newPath)
+			}
+		}
+		if err := f.fsys.Remove(pageDir); err != nil {
+			return 0, errorWrap(err, "removing page directory")
+		}
+	}
+
+	if err := f.organizeHistoriesIfNeeded(key, historyDir); err != nil {
+		return 0, err
+	}
+	after, _, err := f.countPages(historyDir)
+	if err != nil {
+		return 0, err
+	}
+	if len(after) >= len(pages) {
+		return 0, nil
+	}
+	return len(pages) - len(after), nil
+}
+
+// countPages 返回历史目录下的分页目录，以及这些分页中历史记录的总数
+func (f *FileKVStore) countPages(historyDir string) ([]string, int, error) {
+	entries, err := f.fsys.ReadDir(historyDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, errorWrap(err, "reading history path")
+	}
+
+	var pages []string
+	records := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), pagePrefix) {
+			continue
+		}
+		pages = append(pages, entry.Name())
+
+		pageEntries, err := f.fsys.ReadDir(filepath.Join(historyDir, entry.Name()))
+		if err != nil {
+			return nil, 0, errorWrap(err, "reading page directory")
+		}
+		for _, pageEntry := range pageEntries {
+			if pageEntry.IsDir() || strings.HasPrefix(pageEntry.Name(), ".") || strings.HasSuffix(pageEntry.Name(), metaSuffix) {
+				continue
+			}
+			records++
+		}
+	}
+	return pages, records, nil
+}
+
+// removeEmptyDirs 从下往上删除 dir 下所有的空目录，返回 dir 本身是否为空
+// 数据根目录和历史根目录本身不会被删除，数据根目录下除历史根目录以外的隐藏目录不属于存储，会被跳过
+func (f *FileKVStore) removeEmptyDirs(ctx context.Context, dir string, report *CompactReport) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	entries, err := f.fsys.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errorWrap(err, "reading directory '"+dir+"'")
+	}
+
+	remaining := len(entries)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if dir == f.rootDir && strings.HasPrefix(entry.Name(), ".") && entry.Name() != historyDirConst {
+			continue
+		}
+		subDir := filepath.Join(dir, entry.Name())
+		empty, err := f.removeEmptyDirs(ctx, subDir, report)
+		if err != nil {
+			return false, err
+		}
+		if !empty || subDir == filepath.Join(f.rootDir, historyDirConst) {
+			continue
+		}
+		if err := f.fsys.Remove(subDir); err != nil {
+			if os.IsNotExist(err) {
+				remaining--
+				continue
+			}
+			// 可能刚好有新的文件写入了，这时不算错误
+			if subEntries, readErr := f.fsys.ReadDir(subDir); readErr == nil && len(subEntries) > 0 {
+				continue
+			}
+			return false, errorWrap(err, "removing empty directory '"+subDir+"'")
+		}
+		if strings.HasPrefix(entry.Name(), pagePrefix) {
+			f.pages.invalidate(dir)
+		}
+		report.EmptyDirsRemoved++
+		report.InodesReclaimed++
+		remaining--
+	}
+	return remaining == 0, nil
+}
@@ -0,0 +1,148 @@
+package filekv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFileKVStore_Compact(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-compact-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 分页的键：3 个满的分页加上默认目录中最新的一个记录
+	pagedKey := "paged"
+	versions := writePagedHistories(t, tempDir, pagedKey, 3*defaultMaxHistoryCount+1)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	var keys []string
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 4; j++ {
+			key := "tenants/t" + strconv.Itoa(i) + "/cfg/k" + strconv.Itoa(j)
+			for n := 0; n < 2; n++ {
+				if _, err := store.Set(ctx, key, []byte("value "+strconv.Itoa(n))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	// 大量删除之后留下空目录
+	for _, key := range keys[:16] {
+		if err := store.Delete(ctx, key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 悬空的附属文件
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"tenants/t4/cfg/gone.keymeta":         []byte("owner=test\n"),
+		".history/tenants/t4/cfg/k0.h/1.meta": []byte("author=test\n"),
+	})
+	// 删除每个分页中的前 150 个记录，留下 3 个未满的分页
+	remaining := []string{}
+	for page := 0; page < 3; page++ {
+		pageVersions := versions[page*defaultMaxHistoryCount : (page+1)*defaultMaxHistoryCount]
+		pageDir := filepath.Join(tempDir, ".history", pagedKey+".h", pagePrefix+pageVersions[0])
+		for _, version := range pageVersions[:150] {
+			if err := os.Remove(filepath.Join(pageDir, version)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		remaining = append(remaining, pageVersions[150:]...)
+	}
+	remaining = append(remaining, versions[len(versions)-1])
+
+	report, err := store.Compact(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SidecarsRemoved != 2 {
+		t.Fatalf("expected 2 sidecars removed, got %d", report.SidecarsRemoved)
+	}
+	if report.BytesReclaimed != int64(len("owner=test\n")+len("author=test\n")) {
+		t.Fatalf("unexpected bytes reclaimed %d", report.BytesReclaimed)
+	}
+	if report.PagesMerged != 3 {
+		t.Fatalf("expected 3 pages merged, got %d", report.PagesMerged)
+	}
+	if report.EmptyDirsRemoved == 0 {
+		t.Fatal("expected empty directories to be removed")
+	}
+	if report.InodesReclaimed != report.EmptyDirsRemoved+report.PagesMerged+report.SidecarsRemoved {
+		t.Fatalf("unexpected inodes reclaimed %d", report.InodesReclaimed)
+	}
+
+	// 除了根目录，不再有空目录
+	var emptyDirs []string
+	err = filepath.WalkDir(tempDir, func(pa string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || pa == tempDir || pa == filepath.Join(tempDir, ".history") {
+			return nil
+		}
+		entries, err := os.ReadDir(pa)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			emptyDirs = append(emptyDirs, pa)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emptyDirs) != 0 {
+		t.Fatalf("unexpected empty directories: %v", emptyDirs)
+	}
+	for _, dir := range []string{"tenants/t0", ".history/tenants/t0"} {
+		if _, err := os.Stat(filepath.Join(tempDir, dir)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", dir, err)
+		}
+	}
+
+	// 剩下的键和历史记录都不受影响
+	listed, err := store.ListKeys(ctx, "tenants/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != strings.Join(keys[16:], ",") {
+		t.Fatalf("unexpected keys: %v", listed)
+	}
+	histories, err := store.GetHistories(ctx, pagedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, remaining)
+	for _, version := range remaining {
+		value, err := store.GetByVersion(ctx, pagedKey, version)
+		if err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+		if string(value) != version {
+			t.Fatalf("expected %q, got %q", version, value)
+		}
+	}
+
+	// 再执行一次没有可以回收的空间
+	report, err = store.Compact(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != (CompactReport{}) {
+		t.Fatalf("expected empty report, got %+v", report)
+	}
+}
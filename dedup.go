@@ -0,0 +1,33 @@
+package filekv
+
+import "bytes"
+
+// Deduplicator tracks the last content seen for each key and reports whether
+// new content differs from it. ImportGitRepo uses it to skip unchanged files,
+// and it can preprocess any version stream before the versions are committed.
+type Deduplicator struct {
+	lastContent map[string][]byte
+}
+
+// NewDeduplicator creates an empty Deduplicator
+func NewDeduplicator() *Deduplicator {
+	return &Deduplicator{
+		lastContent: make(map[string][]byte),
+	}
+}
+
+// Add records content as the last content of key and reports whether it
+// differs from the previous content. The first content of a key is always changed.
+func (d *Deduplicator) Add(key string, content []byte) (changed bool) {
+	if lastBytes, ok := d.lastContent[key]; ok && bytes.Equal(lastBytes, content) {
+		return false
+	}
+	d.lastContent[key] = content
+	return true
+}
+
+// Forget drops the last content of key, so that the next Add for key reports
+// a change. Use it when committing the content reported as changed failed.
+func (d *Deduplicator) Forget(key string) {
+	delete(d.lastContent, key)
+}
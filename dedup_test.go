@@ -0,0 +1,36 @@
+package filekv
+
+import "testing"
+
+func TestDeduplicator(t *testing.T) {
+	dedup := NewDeduplicator()
+
+	for i, step := range []struct {
+		key     string
+		content string
+		changed bool
+	}{
+		{"a", "v1", true},
+		{"a", "v1", false},
+		{"b", "v1", true}, // 每个键独立比较
+		{"a", "v2", true},
+		{"a", "v2", false},
+		{"a", "v1", true}, // 只和上一次的内容比较
+		{"b", "v1", false},
+		{"a", "", true},
+		{"a", "", false},
+	} {
+		if changed := dedup.Add(step.key, []byte(step.content)); changed != step.changed {
+			t.Fatalf("step %d: Add(%q, %q) expected changed=%v, got %v", i, step.key, step.content, step.changed, changed)
+		}
+	}
+
+	// Forget 之后下一次总是认为有变化
+	dedup.Forget("b")
+	if !dedup.Add("b", []byte("v1")) {
+		t.Fatal("expected change after Forget")
+	}
+	if dedup.Add("b", []byte("v1")) {
+		t.Fatal("expected no change")
+	}
+}
@@ -0,0 +1,227 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+)
+
+// DiffOp 是 DiffLine 的类型
+type DiffOp int
+
+const (
+	// DiffEqual 行在两个版本中相同
+	DiffEqual DiffOp = iota
+	// DiffInsert 行只在新的版本中
+	DiffInsert
+	// DiffDelete 行只在旧的版本中
+	DiffDelete
+	// DiffBinary 表示两个版本中有二进制的内容（含有 0 字节），无法按行比较，这时 diff 只有这一个 DiffLine
+	DiffBinary
+)
+
+// DiffLine 是按行比较两个版本的结果中的一行，Text 不包括行尾的换行符
+type DiffLine struct {
+	Op   DiffOp
+	Text string
+}
+
+// String 返回类似 diff 输出的一行，如 "+ text"、"- text" 和 "  text"
+func (l DiffLine) String() string {
+	switch l.Op {
+	case DiffInsert:
+		return "+ " + l.Text
+	case DiffDelete:
+		return "- " + l.Text
+	case DiffBinary:
+		return "binary content differs"
+	default:
+		return "  " + l.Text
+	}
+}
+
+// Diff 按行比较键的两个版本，版本为 head 时表示当前值
+// 有一个版本是二进制的内容时返回只有一个 DiffBinary 的结果，两个版本相同时返回的行都是 DiffEqual
+func (f *FileKVStore) Diff(ctx context.Context, key, fromVersion, toVersion string) ([]DiffLine, error) {
+	from, err := f.GetByVersion(ctx, key, fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	to, err := f.GetByVersion(ctx, key, toVersion)
+	if err != nil {
+		return nil, err
+	}
+	return diffContents(from, to), nil
+}
+
+// StreamDiffs 按版本升序遍历一次键的历史记录，对每一对相邻的版本调用 fn，参数为两个版本号和它们之间按行比较的结果
+// 只在内存中保留前一个版本的内容，适合历史记录很多的键；fn 返回错误时停止遍历并返回该错误
+// 只有一个版本时不调用 fn，键没有历史记录时返回的错误和 GetLastVersion 相同
+func (f *FileKVStore) StreamDiffs(ctx context.Context, key string, fn func(fromVer, toVer string, diff []DiffLine) error) error {
+	if err := f.validateKey(key); err != nil {
+		return err
+	}
+
+	historyDir := f.keyToHistoryPath(key)
+	versions, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return f.noHistoryErr(key)
+	}
+
+	contents := f.newHistoryContents(historyDir)
+	var prev []byte
+	prevVersion := ""
+	for _, version := range versions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		content, err := contents.read(version)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// 可能在遍历期间被清理了
+				continue
+			}
+			return errorWrap(err, "reading history '"+version.Version+"' of '"+key+"'")
+		}
+		content, err = f.decodeValue(key, content)
+		if err != nil {
+			return err
+		}
+
+		if prevVersion != "" {
+			if err := fn(prevVersion, version.Version, diffContents(prev, content)); err != nil {
+				return err
+			}
+		}
+		prev, prevVersion = content, version.Version
+	}
+	return nil
+}
+
+// diffContents 按行比较两个值，有二进制的内容时只比较是否相同
+func diffContents(from, to []byte) []DiffLine {
+	if bytes.IndexByte(from, 0) >= 0 || bytes.IndexByte(to, 0) >= 0 {
+		if bytes.Equal(from, to) {
+			return nil
+		}
+		return []DiffLine{{Op: DiffBinary}}
+	}
+	return diffLines(splitLines(from), splitLines(to))
+}
+
+// splitLines 按 "\n" 分割值，最后一行的换行符（以及 "\r\n" 中的 "\r"）不保留在行中
+func splitLines(value []byte) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(value), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// diffLines 用 Myers 算法计算从 a 到 b 的最短编辑序列
+// 使用线性空间的版本：找到最短编辑路径中间的一段 snake，然后分别计算它前后的两部分，
+// 所以内存和输入的行数成正比，而不是和编辑距离的平方成正比
+func diffLines(a, b []string) []DiffLine {
+	return appendDiff(make([]DiffLine, 0, len(a)+len(b)), a, b)
+}
+
+// appendDiff 把从 a 到 b 的编辑序列追加到 result 中，相同的前缀和后缀不参与计算
+func appendDiff(result []DiffLine, a, b []string) []DiffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	for _, line := range a[:prefix] {
+		result = append(result, DiffLine{Op: DiffEqual, Text: line})
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	switch {
+	case len(midA) == 0:
+		for _, line := range midB {
+			result = append(result, DiffLine{Op: DiffInsert, Text: line})
+		}
+	case len(midB) == 0:
+		for _, line := range midA {
+			result = append(result, DiffLine{Op: DiffDelete, Text: line})
+		}
+	default:
+		x, y := middleSnake(midA, midB)
+		result = appendDiff(result, midA[:x], midB[:y])
+		result = appendDiff(result, midA[x:], midB[y:])
+	}
+	for _, line := range a[len(a)-suffix:] {
+		result = append(result, DiffLine{Op: DiffEqual, Text: line})
+	}
+	return result
+}
+
+// middleSnake 同时从起点向前和从终点向后搜索，返回两个方向的路径重叠处的点 (x, y)，
+// 它在一条最短编辑路径上，并且把问题分成两个编辑距离都更小的部分
+// a 和 b 都不为空，并且首行和末行都不相同
+func middleSnake(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	delta := n - m
+	odd := delta%2 != 0
+
+	// forward[offset+k] 是对角线 k 上从起点走得最远的 x，backward[offset+k] 是从终点往回走的距离
+	offset := maxD + 1
+	forward := make([]int, 2*maxD+3)
+	backward := make([]int, 2*maxD+3)
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+
+			// 对角线 k 对应反向的对角线 delta-k，它在第 d-1 步中已经到达
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && x+backward[offset+c] >= n {
+				return x, y
+			}
+		}
+
+		for c := -d; c <= d; c += 2 {
+			var u int
+			if c == -d || (c != d && backward[offset+c-1] < backward[offset+c+1]) {
+				u = backward[offset+c+1]
+			} else {
+				u = backward[offset+c-1] + 1
+			}
+			v := u - c
+			for u < n && v < m && a[n-1-u] == b[m-1-v] {
+				u++
+				v++
+			}
+			backward[offset+c] = u
+
+			if k := delta - c; !odd && k >= -d && k <= d && forward[offset+k]+u >= n {
+				return forward[offset+k], forward[offset+k] - k
+			}
+		}
+	}
+
+	// 不会到这里，为了安全退化成删除所有的行再插入所有的行
+	return n, 0
+}
@@ -0,0 +1,172 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func diffStrings(diff []DiffLine) []string {
+	lines := make([]string, 0, len(diff))
+	for _, line := range diff {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+func TestFileKVStore_StreamDiffs(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileKVStore(t.TempDir())
+	key := "test/diffs"
+
+	contents := []string{
+		"a\nb\nc\n",
+		"a\nB\nc\n",
+		"a\nB\nc\nd\n",
+		"B\nc\nd\n",
+		"bin\x00ary",
+		"text\n",
+	}
+	var versions []string
+	for _, content := range contents {
+		version, err := store.Set(ctx, key, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+
+	type step struct {
+		from, to string
+		diff     []string
+	}
+	expected := []step{
+		{versions[0], versions[1], []string{"  a", "- b", "+ B", "  c"}},
+		{versions[1], versions[2], []string{"  a", "  B", "  c", "+ d"}},
+		{versions[2], versions[3], []string{"- a", "  B", "  c", "  d"}},
+		{versions[3], versions[4], []string{"binary content differs"}},
+		{versions[4], versions[5], []string{"binary content differs"}},
+	}
+
+	var steps []step
+	err := store.StreamDiffs(ctx, key, func(fromVer, toVer string, diff []DiffLine) error {
+		steps = append(steps, step{fromVer, toVer, diffStrings(diff)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("expected %v, got %v", expected, steps)
+	}
+
+	// 和单独调用 Diff 的结果相同
+	diff, err := store.Diff(ctx, key, versions[2], versions[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diffStrings(diff), expected[2].diff) {
+		t.Errorf("expected %v, got %v", expected[2].diff, diffStrings(diff))
+	}
+	diff, err = store.Diff(ctx, key, versions[0], "head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"- a", "- b", "- c", "+ text"}; !reflect.DeepEqual(diffStrings(diff), want) {
+		t.Errorf("expected %v, got %v", want, diffStrings(diff))
+	}
+
+	// fn 返回错误时停止
+	errStop := errors.New("stop")
+	calls := 0
+	err = store.StreamDiffs(ctx, key, func(fromVer, toVer string, diff []DiffLine) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || calls != 1 {
+		t.Errorf("expected to stop after the first call, got %v after %d calls", err, calls)
+	}
+
+	if err := store.StreamDiffs(ctx, "missing", func(string, string, []DiffLine) error { return nil }); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, r.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + r.Intn(4)))
+		}
+		return lines
+	}
+
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		diff := diffLines(a, b)
+
+		// 去掉插入的行得到 a，去掉删除的行得到 b
+		var gotA, gotB []string
+		edits := 0
+		for _, line := range diff {
+			if line.Op != DiffInsert {
+				gotA = append(gotA, line.Text)
+			}
+			if line.Op != DiffDelete {
+				gotB = append(gotB, line.Text)
+			}
+			if line.Op != DiffEqual {
+				edits++
+			}
+		}
+		if strings.Join(gotA, ",") != strings.Join(a, ",") || strings.Join(gotB, ",") != strings.Join(b, ",") {
+			t.Fatalf("diff of %v and %v does not reproduce them: %v", a, b, diffStrings(diff))
+		}
+
+		// 编辑次数是最少的：等于 len(a)+len(b)-2*LCS
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		if want := len(a) + len(b) - 2*lcs[0][0]; edits != want {
+			t.Fatalf("diff of %v and %v has %d edits, expected %d: %v", a, b, edits, want, diffStrings(diff))
+		}
+	}
+}
+
+func TestDiffLinesMemory(t *testing.T) {
+	// 两个完全不同的值的编辑距离是 len(a)+len(b)，内存不能和它的平方成正比
+	a := make([]string, 2000)
+	b := make([]string, 2000)
+	for i := range a {
+		a[i] = "a" + strconv.Itoa(i)
+		b[i] = "b" + strconv.Itoa(i)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	diff := diffLines(a, b)
+	runtime.ReadMemStats(&after)
+
+	if len(diff) != len(a)+len(b) {
+		t.Fatalf("expected %d lines, got %d", len(a)+len(b), len(diff))
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("expected less than 16MB allocated, got %d bytes", allocated)
+	}
+}
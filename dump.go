@@ -0,0 +1,274 @@
+package filekv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// dumpMagic 是 Dump 输出的开头，后面跟一个字节的格式版本号
+const dumpMagic = "FILEKVDUMP"
+
+// dumpFormatVersion 是 Dump 输出的格式版本，Load 拒绝读取更高版本的格式
+// 版本 2 增加了当前值的记录
+const dumpFormatVersion = 2
+
+const (
+	dumpRecordEnd     = 0
+	dumpRecordVersion = 1
+	dumpRecordHead    = 2
+)
+
+// Dump 把整个存储以二进制格式写入 w，可以用 Load 读回，适合在脚本中通过管道传递存储的内容
+// 格式是：魔数 "FILEKVDUMP"，一个字节的格式版本号，然后是若干条记录，最后以一个字节 0 结束。
+// 每条记录以一个字节 1 开头，后面依次是键、版本号、元数据和内容，字符串和内容都以 uvarint 长度为前缀，
+// 元数据是 uvarint 的个数加上按键名排序的键值对。每个键的历史版本按时间升序输出，
+// 没有历史记录的键输出一条版本号为空的记录，内容为当前值。
+// 当前值和时间最新的历史记录不同时（如用 SetWithTimestamp 写入了更早的时间戳，或者主数据文件被外部修改），
+// 在这个键的历史版本之后再输出一条当前值的记录，它以一个字节 2 开头，后面是键和内容。
+// 和 StreamHistoryJSONL 不同，它可以流式处理任意的二进制值，不需要 base64 编码。
+func (f *FileKVStore) Dump(ctx context.Context, w io.Writer) error {
+	keys, err := f.ListKeys(ctx, "")
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(dumpMagic)
+	bw.WriteByte(dumpFormatVersion)
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	writeUvarint := func(n uint64) {
+		bw.Write(lenBuf[:binary.PutUvarint(lenBuf[:], n)])
+	}
+	writeBytes := func(b []byte) {
+		writeUvarint(uint64(len(b)))
+		bw.Write(b)
+	}
+	writeHead := func(key string, content []byte) {
+		bw.WriteByte(dumpRecordHead)
+		writeBytes([]byte(key))
+		writeBytes(content)
+	}
+	writeRecord := func(key, version string, meta map[string]string, content []byte) {
+		bw.WriteByte(dumpRecordVersion)
+		writeBytes([]byte(key))
+		writeBytes([]byte(version))
+		names := make([]string, 0, len(meta))
+		for name := range meta {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeUvarint(uint64(len(names)))
+		for _, name := range names {
+			writeBytes([]byte(name))
+			writeBytes([]byte(meta[name]))
+		}
+		writeBytes(content)
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		histories, err := f.GetHistories(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(histories) == 0 {
+			content, err := f.Get(ctx, key)
+			if err != nil {
+				if errors.Is(err, ErrKeyNotFound) {
+					continue // 键在遍历之后被删除了
+				}
+				return err
+			}
+			writeRecord(key, "", nil, content)
+			continue
+		}
+		var last []byte
+		for _, history := range histories {
+			content, err := f.GetByVersion(ctx, key, history.Version)
+			if err != nil {
+				return err
+			}
+			writeRecord(key, history.Version, history.Meta, content)
+			last = content
+		}
+
+		// 直接读取主数据文件，WithTreatEmptyAsAbsent 时空的当前值也要比较
+		head, err := f.readKeyFile(key)
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+			return err
+		}
+		if head, err = f.decodeValue(key, head); err != nil {
+			return err
+		}
+		if !bytes.Equal(head, last) {
+			writeHead(key, head)
+		}
+	}
+
+	bw.WriteByte(dumpRecordEnd)
+	if err := bw.Flush(); err != nil {
+		return errorWrap(err, "writing dump")
+	}
+	return nil
+}
+
+// Load 读取 Dump 输出的内容，按原来的时间戳把每个版本和它的元数据写入存储
+// 版本号由存储重新生成，和 ReplayHistory 一样，和上一个版本相同的值不会产生新的版本。
+// 当前值的记录在键的所有版本之后，直接写入主数据文件，不产生新的版本。
+func (f *FileKVStore) Load(ctx context.Context, r io.Reader) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, len(dumpMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return errorWrap(err, "reading dump header")
+	}
+	if string(header[:len(dumpMagic)]) != dumpMagic {
+		return errors.New("reading dump header: not a filekv dump")
+	}
+	if header[len(dumpMagic)] > dumpFormatVersion {
+		return errors.New("reading dump header: unsupported format version")
+	}
+
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		// 按实际读到的数据增长，损坏的长度不会导致一次分配过大的内存
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, br, int64(n)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	readRecord := func() (key, version string, meta map[string]string, content []byte, err error) {
+		var b []byte
+		if b, err = readBytes(); err != nil {
+			return
+		}
+		key = string(b)
+		if b, err = readBytes(); err != nil {
+			return
+		}
+		version = string(b)
+		count, err := binary.ReadUvarint(br)
+		if err != nil {
+			return
+		}
+		for i := uint64(0); i < count; i++ {
+			var name, value []byte
+			if name, err = readBytes(); err != nil {
+				return
+			}
+			if value, err = readBytes(); err != nil {
+				return
+			}
+			if meta == nil {
+				meta = map[string]string{}
+			}
+			meta[string(name)] = string(value)
+		}
+		content, err = readBytes()
+		return
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		recordType, err := br.ReadByte()
+		if err != nil {
+			return errorWrap(err, "reading dump record")
+		}
+		if recordType == dumpRecordEnd {
+			return nil
+		}
+		if recordType == dumpRecordHead {
+			key, err := readBytes()
+			if err != nil {
+				return errorWrap(unexpectedEOF(err), "reading dump record")
+			}
+			content, err := readBytes()
+			if err != nil {
+				return errorWrap(unexpectedEOF(err), "reading dump record")
+			}
+			if err := f.loadHead(string(key), content); err != nil {
+				return errorWrap(err, "loading current value of '"+string(key)+"'")
+			}
+			continue
+		}
+		if recordType != dumpRecordVersion {
+			return errors.New("reading dump record: unknown record type")
+		}
+
+		key, version, meta, content, err := readRecord()
+		if err != nil {
+			return errorWrap(unexpectedEOF(err), "reading dump record")
+		}
+
+		var newVersion string
+		if version == "" {
+			newVersion, err = f.Set(ctx, key, content)
+		} else {
+			ts, _, parseErr := parseVersion(version)
+			if parseErr != nil {
+				return errorWrap(parseErr, "parsing version '"+version+"' of '"+key+"'")
+			}
+			newVersion, err = f.SetWithTimestamp(ctx, key, content, time.Unix(0, ts))
+		}
+		if err != nil {
+			return errorWrap(err, "loading version '"+version+"' of '"+key+"'")
+		}
+		if newVersion != "" && len(meta) > 0 {
+			if err := f.SetMeta(ctx, key, newVersion, meta); err != nil {
+				return errorWrap(err, "loading meta of version '"+version+"' of '"+key+"'")
+			}
+		}
+	}
+}
+
+// unexpectedEOF 把记录中间遇到的 io.EOF 转换为 io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// loadHead 把键的主数据文件直接改为 value，不产生新的历史记录
+func (f *FileKVStore) loadHead(key string, value []byte) error {
+	if err := f.validateKey(key); err != nil {
+		return err
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	data, err := f.encodeValue(key, value)
+	if err != nil {
+		return err
+	}
+	defer f.quota.invalidate()
+	if err := f.writeFileAtomicWithDir(f.keyToPath(key), data); err != nil {
+		return errorWrap(err, "writing file of '"+key+"'")
+	}
+	return nil
+}
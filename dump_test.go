@@ -0,0 +1,161 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileKVStore_DumpLoad(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-dump-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	src := NewFileKVStore(filepath.Join(tempDir, "src"))
+	ctx := context.Background()
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	binaryValue := []byte{0x00, 0xff, 0x01, '\n', 0x00}
+	versions := map[string][]string{}
+	for i, value := range [][]byte{[]byte("text"), binaryValue, {}} {
+		version, err := src.SetWithTimestamp(ctx, "bin/key", value, timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions["bin/key"] = append(versions["bin/key"], version)
+	}
+	if err := src.SetMeta(ctx, "bin/key", versions["bin/key"][1], map[string]string{"author": "test", "note": "a = b"}); err != nil {
+		t.Fatal(err)
+	}
+	version, err := src.SetWithTimestamp(ctx, "other", []byte("other value"), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions["other"] = append(versions["other"], version)
+
+	// 没有历史记录的键
+	if err := os.WriteFile(filepath.Join(tempDir, "src", "nohistory"), []byte("head only"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 当前值不是时间最新的历史记录：写入了更早的时间戳，或者主数据文件被外部修改
+	for i, value := range []string{"newer", "older"} {
+		version, err := src.SetWithTimestamp(ctx, "outoforder", []byte(value), timestamp.Add(time.Duration(10-5*i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions["outoforder"] = append([]string{version}, versions["outoforder"]...)
+	}
+	version, err = src.SetWithTimestamp(ctx, "edited", []byte("stored"), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions["edited"] = append(versions["edited"], version)
+	if err := os.WriteFile(filepath.Join(tempDir, "src", "edited"), []byte("edited externally"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Dump(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte(dumpMagic)) {
+		t.Fatal("expected dump to start with the magic header")
+	}
+
+	dst := NewFileKVStore(filepath.Join(tempDir, "dst"))
+	if err := dst.Load(ctx, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := dst.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "bin/key,edited,nohistory,other,outoforder" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	for key, expected := range versions {
+		srcHistories, err := src.GetHistories(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dstHistories, err := dst.GetHistories(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkHistories(t, dstHistories, expected)
+		for i := range srcHistories {
+			srcValue, err := src.GetByVersion(ctx, key, srcHistories[i].Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dstValue, err := dst.GetByVersion(ctx, key, dstHistories[i].Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(srcValue, dstValue) {
+				t.Fatalf("%s@%s: expected %q, got %q", key, srcHistories[i].Version, srcValue, dstValue)
+			}
+			if len(srcHistories[i].Meta) != len(dstHistories[i].Meta) {
+				t.Fatalf("%s@%s: expected meta %v, got %v", key, srcHistories[i].Version, srcHistories[i].Meta, dstHistories[i].Meta)
+			}
+			for name, value := range srcHistories[i].Meta {
+				if dstHistories[i].Meta[name] != value {
+					t.Fatalf("%s@%s: expected meta %v, got %v", key, srcHistories[i].Version, srcHistories[i].Meta, dstHistories[i].Meta)
+				}
+			}
+		}
+	}
+	// 当前值和原来的一样
+	for _, key := range keys {
+		srcValue, err := src.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dstValue, err := dst.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(srcValue, dstValue) {
+			t.Fatalf("%s: expected current value %q, got %q", key, srcValue, dstValue)
+		}
+	}
+	value, err := dst.Get(ctx, "nohistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "head only" {
+		t.Fatalf("expected %q, got %q", "head only", value)
+	}
+
+	// 导入的存储再次 Dump 时保留了元数据和二进制内容
+	var again bytes.Buffer
+	if err := dst.Dump(ctx, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(again.Bytes(), []byte("a = b")) || !bytes.Contains(again.Bytes(), binaryValue) {
+		t.Fatal("expected dumped meta and binary value in the second dump")
+	}
+
+	// 不是 Dump 的输出、格式版本过高或者被截断时报错
+	for name, data := range map[string][]byte{
+		"magic":     []byte("NOTADUMP!!!"),
+		"version":   append([]byte(dumpMagic), dumpFormatVersion+1),
+		"truncated": buf.Bytes()[:buf.Len()-3],
+	} {
+		if err := NewFileKVStore(filepath.Join(tempDir, "bad-"+name)).Load(ctx, bytes.NewReader(data)); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
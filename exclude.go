@@ -0,0 +1,72 @@
+package filekv
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+// ListKeysExcluding 和 ListKeys 相同，但是不列出和 excludes 中任何一个模式匹配的键
+// 模式是相对于数据根目录、用 / 分隔的 glob，每一段的语法和 path.Match 相同，另外 "**" 匹配任意多段（包括零段），
+// 如 "**/*.tmp" 排除所有以 .tmp 结尾的键。以 / 结尾的模式只匹配目录，如 "cache/" 排除 cache 目录下的所有键，
+// 匹配的目录在遍历时被整个跳过，不会再读取它的内容。
+func (f *FileKVStore) ListKeysExcluding(ctx context.Context, prefix string, excludes []string) ([]string, error) {
+	var dirPatterns, keyPatterns [][]string
+	for _, pattern := range excludes {
+		isDir := strings.HasSuffix(pattern, "/")
+		parts := strings.Split(strings.TrimSuffix(pattern, "/"), "/")
+		for _, part := range parts {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, errorWrap(err, "invalid exclude pattern '"+pattern+"'")
+			}
+		}
+		dirPatterns = append(dirPatterns, parts)
+		if !isDir {
+			keyPatterns = append(keyPatterns, parts)
+		}
+	}
+
+	matchAny := func(patterns [][]string, name string) bool {
+		parts := strings.Split(name, "/")
+		for _, pattern := range patterns {
+			if matchGlobParts(pattern, parts) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var keys []string
+	err := f.walkKeysSkipping(ctx, prefix, func(dir string) bool {
+		return matchAny(dirPatterns, dir)
+	}, func(key string) error {
+		if !matchAny(keyPatterns, key) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// matchGlobParts 检查按 / 分割的 name 是否和按 / 分割的模式匹配，模式中的 "**" 匹配任意多段
+func matchGlobParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
@@ -2,9 +2,14 @@ package filekv
 
 import (
 	"context"
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -611,6 +616,262 @@ func TestCachedFileKVStore(t *testing.T) {
 	}
 }
 
+func TestCachedFileKVStore_SetWithTimestamp(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-cached-timestamp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	key := "test/cached"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// CachedFileKVStore 和 FileKVStore 的 SetWithTimestamp 都使用 time.Time
+	fileStore := NewFileKVStore(tempDir)
+	var store KeyValueStore = NewCachedFileKVStore(fileStore)
+
+	version, err := store.SetWithTimestamp(ctx, key, []byte("value1"), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1672531200000000000" {
+		t.Fatalf("expected version %q, got %q", "1672531200000000000", version)
+	}
+	if _, err := store.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// 通过缓存写入的新值要更新缓存
+	if _, err := store.SetWithTimestamp(ctx, key, []byte("value2"), timestamp.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value2" {
+		t.Fatalf("expected %q, got %q", "value2", value)
+	}
+
+	histories, err := fileStore.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{"1672531200000000000", "1672531201000000000"})
+}
+
+func TestCachedFileKVStore_FlushAndSync(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-cached-flush-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	fileStore := NewFileKVStore(tempDir)
+	store := NewCachedFileKVStore(fileStore)
+
+	if _, err := store.Set(ctx, "a", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, "b", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flush 可以重复调用，写入已经在底层存储中
+	for i := 0; i < 2; i++ {
+		if err := store.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value, err := fileStore.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value1" {
+		t.Fatalf("expected %q, got %q", "value1", value)
+	}
+
+	// 绕过缓存修改底层存储，Sync 之后缓存被刷新
+	if _, err := fileStore.Set(ctx, "a", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileStore.Delete(ctx, "b", true); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := store.Get(ctx, "a"); string(value) != "value1" {
+		t.Fatalf("expected stale cached value %q, got %q", "value1", value)
+	}
+	if err := store.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	value, err = store.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value2" {
+		t.Fatalf("expected %q, got %q", "value2", value)
+	}
+	exists, err := store.Exists(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("expected deleted key to be dropped from cache")
+	}
+
+	// Close 调用 Flush，可以重复调用
+	for i := 0; i < 2; i++ {
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCachedFileKVStore_Concurrent(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-cached-concurrent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cachedStore := NewCachedFileKVStore(NewFileKVStore(tempDir))
+	ctx := context.Background()
+	key := "test/concurrent"
+
+	// 50 个 goroutine 同时读写同一个键，用 go test -race 运行时不应该报告数据竞争
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				value := []byte("value " + strconv.Itoa(i%5))
+				var err error
+				switch j % 5 {
+				case 0, 1:
+					_, err = cachedStore.Set(ctx, key, value)
+				case 2:
+					_, err = cachedStore.Get(ctx, key)
+					if errors.Is(err, ErrKeyNotFound) {
+						err = nil
+					}
+				case 3:
+					_, err = cachedStore.Exists(ctx, key)
+				case 4:
+					if i%10 == 0 {
+						err = cachedStore.Delete(ctx, key, false)
+					} else {
+						_, err = cachedStore.SetWithTimestamp(ctx, key, value, time.Now())
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// 缓存中的值和存储中的值一致
+	if _, err := cachedStore.Set(ctx, key, []byte("final")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := cachedStore.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := cachedStore.store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "final" || string(stored) != "final" {
+		t.Fatalf("expected %q, got cached %q and stored %q", "final", value, stored)
+	}
+}
+
+func TestKeyValueStore_Implementations(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-interface-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	stores := map[string]KeyValueStore{
+		"file":   NewFileKVStore(filepath.Join(tempDir, "file")),
+		"cached": NewCachedFileKVStore(NewFileKVStore(filepath.Join(tempDir, "cached"))),
+	}
+	for name, store := range stores {
+		key := "dir/key"
+		if _, err := store.SetWithTimestamp(ctx, key, []byte("value1"), timestamp); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := store.Set(ctx, key, []byte("value2")); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := store.UpdateMeta(ctx, key, "head", map[string]string{"author": "test"}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		value, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(value) != "value2" {
+			t.Fatalf("%s: expected %q, got %q", name, "value2", value)
+		}
+		value, err = store.GetByVersion(ctx, key, "1672531200000000000")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(value) != "value1" {
+			t.Fatalf("%s: expected %q, got %q", name, "value1", value)
+		}
+
+		keys, err := store.ListKeys(ctx, "dir")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(keys) != 1 || keys[0] != key {
+			t.Fatalf("%s: unexpected keys %v", name, keys)
+		}
+		last, err := store.GetLastVersion(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if last.Meta["author"] != "test" {
+			t.Fatalf("%s: unexpected meta %v", name, last.Meta)
+		}
+		if err := store.Fsck(ctx); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if err := store.Delete(ctx, key, true); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		exists, err := store.Exists(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if exists {
+			t.Fatalf("%s: expected key to be deleted", name)
+		}
+	}
+}
+
 func TestFileKVStore_WithCompareFunc(t *testing.T) {
 	// 创建临时目录
 	tempDir, err := os.MkdirTemp("", "filekv-comparefunc-test")
@@ -707,3 +968,1891 @@ func TestFileKVStore_WithCompareFunc(t *testing.T) {
 		}
 	})
 }
+
+func TestFileKVStore_SentinelErrors(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-errors-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	if _, err := store.Set(ctx, "ns/key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		fn       func() error
+		expected error
+	}{
+		{"Get_InvalidKey", func() error { _, err := store.Get(ctx, "/abs"); return err }, ErrInvalidKey},
+		{"Set_InvalidKey", func() error { _, err := store.Set(ctx, "a/.hidden", nil); return err }, ErrInvalidKey},
+		{"Exists_InvalidKey", func() error { _, err := store.Exists(ctx, "a.h/b"); return err }, ErrInvalidKey},
+		{"Get_KeyNotFound", func() error { _, err := store.Get(ctx, "missing"); return err }, ErrKeyNotFound},
+		{"Get_ParentIsFile", func() error { _, err := store.Get(ctx, "ns/key/child"); return err }, ErrKeyNotFound},
+		{"Get_KeyIsNamespace", func() error { _, err := store.Get(ctx, "ns"); return err }, ErrKeyIsNamespace},
+		{"Set_KeyIsNamespace", func() error { _, err := store.Set(ctx, "ns", []byte("v")); return err }, ErrKeyIsNamespace},
+		{"Delete_KeyIsNamespace", func() error { return store.Delete(ctx, "ns", false) }, ErrKeyIsNamespace},
+		{"GetByVersion_VersionNotFound", func() error { _, err := store.GetByVersion(ctx, "ns/key", "1"); return err }, ErrVersionNotFound},
+		{"GetByVersion_MissingKey", func() error { _, err := store.GetByVersion(ctx, "missing", "1"); return err }, ErrKeyNotFound},
+		{"SetMeta_VersionNotFound", func() error { return store.SetMeta(ctx, "ns/key", "1", nil) }, ErrVersionNotFound},
+		{"UpdateMeta_VersionNotFound", func() error { return store.UpdateMeta(ctx, "ns/key", "1", nil) }, ErrVersionNotFound},
+		{"GetLastVersion_VersionNotFound", func() error { _, err := store.GetLastVersion(ctx, "missing"); return err }, ErrVersionNotFound},
+		{"GetPrevVersion_VersionNotFound", func() error { _, err := store.GetPrevVersion(ctx, "ns/key", "head"); return err }, ErrVersionNotFound},
+		{"GetNextVersion_VersionNotFound", func() error { _, err := store.GetNextVersion(ctx, "ns/key", "1"); return err }, ErrVersionNotFound},
+		{"SetMeta_KeyNotFound", func() error { return store.SetMeta(ctx, "missing", "head", nil) }, ErrKeyNotFound},
+		{"Delete_KeyHasChildren", func() error { return store.Delete(ctx, "ns", true) }, ErrKeyHasChildren},
+		{"Get_KeyHasChildren", func() error { _, err := store.Get(ctx, "ns"); return err }, ErrKeyHasChildren},
+		{"GetByVersion_KeyHasChildren", func() error { _, err := store.GetByVersion(ctx, "ns", "head"); return err }, ErrKeyHasChildren},
+		{"GetByVersion_HeadKeyNotFound", func() error { _, err := store.GetByVersion(ctx, "missing", "head"); return err }, ErrKeyNotFound},
+		// 键和历史记录都不存在时，版本相关的方法同时匹配 ErrKeyNotFound 和 ErrVersionNotFound
+		{"GetLastVersion_KeyNotFound", func() error { _, err := store.GetLastVersion(ctx, "missing"); return err }, ErrKeyNotFound},
+		{"GetPrevVersion_KeyNotFound", func() error { _, err := store.GetPrevVersion(ctx, "missing", "head"); return err }, ErrKeyNotFound},
+		{"GetPrevVersion_MissingKeyVersionNotFound", func() error { _, err := store.GetPrevVersion(ctx, "missing", "head"); return err }, ErrVersionNotFound},
+		{"GetNextVersion_KeyNotFound", func() error { _, err := store.GetNextVersion(ctx, "missing", "1"); return err }, ErrKeyNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.fn()
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+
+	// 不存在类的错误依然兼容 os.ErrNotExist
+	_, err = store.Get(ctx, "missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected error to match os.ErrNotExist, got %v", err)
+	}
+	// 但不是直接返回底层的 *fs.PathError
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		t.Fatalf("expected a wrapped ErrKeyNotFound, got %#v", pathErr)
+	}
+	_, err = store.GetLastVersion(ctx, "missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected error to match os.ErrNotExist, got %v", err)
+	}
+
+	// 键存在但是没有历史记录时只是版本不存在
+	if err := os.WriteFile(filepath.Join(tempDir, "external"), []byte("v"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetLastVersion(ctx, "external")
+	if !errors.Is(err, ErrVersionNotFound) || errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected only ErrVersionNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_GetByVersionCollidedTimestamp(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-collided-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/collided"
+
+	initialTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	timextest.Mocked(initialTime, func(mockedtimex *timextest.TestImplementation) {
+		// 同一个时间戳写入三个不同的值
+		var versions []string
+		for i := 0; i < 3; i++ {
+			version, err := store.Set(ctx, key, []byte("version "+string(rune('0'+i))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			versions = append(versions, version)
+		}
+		timestamp := "1672531200000000000"
+		expectedVersions := []string{timestamp, timestamp + "_0001", timestamp + "_0002"}
+		for i := range versions {
+			if versions[i] != expectedVersions[i] {
+				t.Fatalf("expected version %q, got %q", expectedVersions[i], versions[i])
+			}
+		}
+
+		lastVersion, err := store.GetLastVersion(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastVersion.Version != versions[2] {
+			t.Fatalf("expected last version %q, got %q", versions[2], lastVersion.Version)
+		}
+
+		value, err := store.GetByVersion(ctx, key, versions[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "version 1" {
+			t.Fatalf("expected %q, got %q", "version 1", value)
+		}
+
+		// 删除不带后缀的记录后，用裸时间戳查询应解析到 "_0001"
+		if err := store.CleanupHistoriesByCount(ctx, key, 2); err != nil {
+			t.Fatal(err)
+		}
+		value, err = store.GetByVersion(ctx, key, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "version 1" {
+			t.Fatalf("expected %q, got %q", "version 1", value)
+		}
+
+		if _, err := store.GetByVersion(ctx, key, "1672531201000000000"); !errors.Is(err, ErrVersionNotFound) {
+			t.Fatalf("expected ErrVersionNotFound, got %v", err)
+		}
+
+		// GetVersionPair 用同样的方式解析裸时间戳
+		prev, cur, prevVer, curVer, err := store.GetVersionPair(ctx, key, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev != nil || prevVer != nil || string(cur) != "version 1" || curVer.Version != versions[1] {
+			t.Fatalf("unexpected pair for %q: %q, %q, %v, %v", timestamp, prev, cur, prevVer, curVer)
+		}
+	})
+}
+
+func TestFileKVStore_GetByVersionFullName(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-fullname-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"key1": []byte("value2"),
+		".history/key1.h/p_1672531200000000000/1672531200000000000": []byte("value1"),
+		".history/key1.h/1672531201000000000":                       []byte("value2"),
+	})
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	histories, err := store.GetHistories(ctx, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 2 {
+		t.Fatalf("expected 2 histories, got %d", len(histories))
+	}
+
+	// 用 Name 和 Version 都可以查到同一个历史记录
+	for _, version := range []string{histories[0].Name, histories[0].Version} {
+		value, err := store.GetByVersion(ctx, "key1", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "value1" {
+			t.Fatalf("expected %q for %q, got %q", "value1", version, value)
+		}
+	}
+}
+
+func TestFileKVStore_NoCollisionSuffix(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-no-suffix-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	timestampStr := "1672531200000000000"
+
+	// 默认加上计数后缀
+	store := NewFileKVStore(tempDir)
+	if _, err := store.SetWithTimestamp(ctx, "suffix", []byte("value1"), timestamp); err != nil {
+		t.Fatal(err)
+	}
+	version, err := store.SetWithTimestamp(ctx, "suffix", []byte("value2"), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != timestampStr+"_0001" {
+		t.Fatalf("expected version %q, got %q", timestampStr+"_0001", version)
+	}
+
+	// 快速失败模式下返回 ErrVersionExists，不写入任何东西
+	store = NewFileKVStore(tempDir, WithNoCollisionSuffix(true))
+	if _, err := store.SetWithTimestamp(ctx, "failfast", []byte("value1"), timestamp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetWithTimestamp(ctx, "failfast", []byte("value2"), timestamp); !errors.Is(err, ErrVersionExists) {
+		t.Fatalf("expected ErrVersionExists, got %v", err)
+	}
+	value, err := store.Get(ctx, "failfast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value1" {
+		t.Fatalf("expected value %q, got %q", "value1", value)
+	}
+	histories, err := store.GetHistories(ctx, "failfast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{timestampStr})
+
+	// 调用者换一个时间戳后可以成功写入
+	version, err = store.SetWithTimestamp(ctx, "failfast", []byte("value2"), timestamp.Add(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1672531200000000001" {
+		t.Fatalf("expected version %q, got %q", "1672531200000000001", version)
+	}
+}
+
+func TestFileKVStore_CollidedVersionsMonotonic(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-monotonic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/monotonic"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	for i := 0; i < 15; i++ {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	// 下一纳秒的记录必须排在所有冲突记录之后
+	version, err := store.SetWithTimestamp(ctx, key, []byte("next"), timestamp.Add(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions = append(versions, version)
+
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != len(versions) {
+		t.Fatalf("expected %d histories, got %d", len(versions), len(histories))
+	}
+	for i := range versions {
+		if histories[i].Version != versions[i] {
+			t.Fatalf("expected version %q at %d, got %q", versions[i], i, histories[i].Version)
+		}
+	}
+
+	for i := 1; i < len(versions); i++ {
+		prev, err := store.GetPrevVersion(ctx, key, versions[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev.Version != versions[i-1] {
+			t.Fatalf("expected prev of %q to be %q, got %q", versions[i], versions[i-1], prev.Version)
+		}
+		next, err := store.GetNextVersion(ctx, key, versions[i-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.Version != versions[i] {
+			t.Fatalf("expected next of %q to be %q, got %q", versions[i-1], versions[i], next.Version)
+		}
+	}
+
+	lastVersion, err := store.GetLastVersion(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastVersion.Version != versions[len(versions)-1] {
+		t.Fatalf("expected last version %q, got %q", versions[len(versions)-1], lastVersion.Version)
+	}
+}
+
+func TestFileKVStore_CapHistoriesPerKey(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-cap-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	counts := map[string]int{
+		"top":         3,
+		"a/b":         6,
+		"a/c/d/e":     10,
+		"paged/key/x": defaultMaxHistoryCount + 10,
+	}
+	versions := map[string][]string{}
+	for key, count := range counts {
+		for i := 0; i < count; i++ {
+			version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			versions[key] = append(versions[key], version)
+		}
+	}
+
+	// 固定的版本不会被删除
+	if err := store.PinVersion(ctx, "a/c/d/e", versions["a/c/d/e"][0]); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.CapHistoriesPerKey(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{
+		"a/b":         2,
+		"a/c/d/e":     5,
+		"paged/key/x": defaultMaxHistoryCount + 6,
+	}
+	if len(removed) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, removed)
+	}
+	for key, count := range expected {
+		if removed[key] != count {
+			t.Fatalf("expected %d removed for %q, got %d", count, key, removed[key])
+		}
+	}
+
+	checkHistories(t, mustGetHistories(t, store, "top"), versions["top"])
+	checkHistories(t, mustGetHistories(t, store, "a/b"), versions["a/b"][2:])
+	checkHistories(t, mustGetHistories(t, store, "a/c/d/e"),
+		append([]string{versions["a/c/d/e"][0]}, versions["a/c/d/e"][6:]...))
+	checkHistories(t, mustGetHistories(t, store, "paged/key/x"), versions["paged/key/x"][defaultMaxHistoryCount+6:])
+
+	// 再次执行时没有需要删除的记录
+	removed, err = store.CapHistoriesPerKey(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("expected nothing removed, got %v", removed)
+	}
+}
+
+func mustGetHistories(t *testing.T, store *FileKVStore, key string) []Version {
+	t.Helper()
+	histories, err := store.GetHistories(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return histories
+}
+
+func TestFileKVStore_ResolveVersion(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-resolve-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/resolve"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	for i := 0; i < 3; i++ {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	// 同一时间戳的冲突版本
+	collided, err := store.SetWithTimestamp(ctx, key, []byte("collided"), timestamp.Add(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions = append(versions, collided)
+
+	for input, expected := range map[string]string{
+		"head":       versions[3],
+		"HEAD":       versions[3],
+		"head~0":     versions[3],
+		"head~1":     versions[2],
+		"HEAD~3":     versions[0],
+		versions[0]:  versions[0],
+		versions[3]:  versions[3],
+		"":           versions[3],
+		"head~1 ":    "",
+		"head~-1":    "",
+		"head~4":     "",
+		"head~abc":   "",
+		"1234567890": "",
+	} {
+		version, err := store.ResolveVersion(ctx, key, input)
+		if expected == "" {
+			if !errors.Is(err, ErrVersionNotFound) {
+				t.Fatalf("%q: expected ErrVersionNotFound, got %q, %v", input, version, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if version != expected {
+			t.Fatalf("%q: expected %q, got %q", input, expected, version)
+		}
+	}
+
+	// 已经被移到分页子目录中的版本
+	for i := 0; i < defaultMaxHistoryCount; i++ {
+		if _, err := store.SetWithTimestamp(ctx, key, []byte("more "+strconv.Itoa(i)), timestamp.Add(time.Duration(10+i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version, err := store.ResolveVersion(ctx, key, versions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != versions[0] {
+		t.Fatalf("expected %q, got %q", versions[0], version)
+	}
+
+	if _, err := store.ResolveVersion(ctx, "test/missing", "head"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_ModTime(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-modtime-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/modtime"
+
+	if _, err := store.ModTime(ctx, key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if _, err := store.Set(ctx, key, []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	// 把修改时间调到过去，避免文件系统时间精度的影响
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(tempDir, key), past, past); err != nil {
+		t.Fatal(err)
+	}
+	mtime1, err := store.ModTime(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := mtime1.Sub(past); d > time.Second || d < -time.Second {
+		t.Fatalf("expected mtime %v, got %v", past, mtime1)
+	}
+
+	if _, err := store.Set(ctx, key, []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	mtime2, err := store.ModTime(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mtime2.After(mtime1) {
+		t.Fatalf("expected mtime to advance after Set, got %v then %v", mtime1, mtime2)
+	}
+
+	if _, err := store.ModTime(ctx, "test"); !errors.Is(err, ErrKeyIsNamespace) {
+		t.Fatalf("expected ErrKeyIsNamespace, got %v", err)
+	}
+}
+
+func TestFileKVStore_Stat(t *testing.T) {
+	tempDir := t.TempDir()
+	fsys := &readFileRecordFS{FS: osFS{}}
+	store := NewFileKVStore(tempDir, WithFS(fsys))
+	ctx := context.Background()
+	key := "test/stat"
+
+	if _, err := store.Stat(ctx, key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if _, err := store.Set(ctx, key, []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	version, err := store.Set(ctx, key, []byte("value-22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(tempDir, key), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.files = nil
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Exists || info.Size != int64(len("value-22")) || info.Version != version {
+		t.Errorf("unexpected info %+v, expected version %s", info, version)
+	}
+	// 不读取值本身
+	for _, name := range fsys.files {
+		if name == filepath.Join(tempDir, key) {
+			t.Errorf("expected the data file not to be read, got reads %v", fsys.files)
+		}
+	}
+	if d := info.ModTime.Sub(past); d > time.Second || d < -time.Second {
+		t.Errorf("expected mtime %v, got %v", past, info.ModTime)
+	}
+
+	// 没有历史记录的键版本为空串
+	if err := os.WriteFile(filepath.Join(tempDir, "test", "external"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err = store.Stat(ctx, "test/external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Exists || info.Size != 3 || info.Version != "" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	if _, err := store.Stat(ctx, "test"); !errors.Is(err, ErrKeyIsNamespace) {
+		t.Fatalf("expected ErrKeyIsNamespace, got %v", err)
+	}
+}
+
+func TestFileKVStore_GetHistoriesWithHead(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-withhead-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/withhead"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	for i := 0; i < 3; i++ {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+
+	histories, head, err := store.GetHistoriesWithHead(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, versions)
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(head) != string(value) {
+		t.Fatalf("expected head %q, got %q", value, head)
+	}
+
+	// 并发写入时返回的当前值总是对应返回的最后一个历史记录
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 3; i < 200; i++ {
+			if _, err := store.Set(ctx, key, []byte("value "+strconv.Itoa(i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		histories, head, err := store.GetHistoriesWithHead(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "value " + strconv.Itoa(len(histories)-1); string(head) != expected {
+			t.Fatalf("expected head %q with %d histories, got %q", expected, len(histories), head)
+		}
+	}
+	wg.Wait()
+
+	if _, _, err := store.GetHistoriesWithHead(ctx, "test/missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_GetVersionPair(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-pair-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/pair"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	for i := 0; i < 3; i++ {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+
+	if err := store.SetMeta(ctx, key, versions[0], map[string]string{"author": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMeta(ctx, key, versions[1], map[string]string{"author": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 中间的版本，同时返回两个版本的元数据
+	prev, cur, prevVer, curVer, err := store.GetVersionPair(ctx, key, versions[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(prev) != "value 0" || string(cur) != "value 1" {
+		t.Fatalf("unexpected contents: %q, %q", prev, cur)
+	}
+	if prevVer == nil || prevVer.Version != versions[0] || curVer.Version != versions[1] {
+		t.Fatalf("unexpected versions: %v, %v", prevVer, curVer)
+	}
+	if prevVer.Meta["author"] != "alice" || curVer.Meta["author"] != "bob" {
+		t.Fatalf("unexpected meta: %v, %v", prevVer.Meta, curVer.Meta)
+	}
+
+	// head
+	prev, cur, prevVer, curVer, err = store.GetVersionPair(ctx, key, "head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(prev) != "value 1" || string(cur) != "value 2" || prevVer.Version != versions[1] || curVer.Version != versions[2] {
+		t.Fatalf("unexpected pair for head: %q, %q", prev, cur)
+	}
+
+	// 第一个版本没有前一个版本
+	prev, cur, prevVer, curVer, err = store.GetVersionPair(ctx, key, versions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != nil || prevVer != nil {
+		t.Fatalf("expected no predecessor, got %q, %v", prev, prevVer)
+	}
+	if string(cur) != "value 0" || curVer.Version != versions[0] {
+		t.Fatalf("unexpected current: %q, %v", cur, curVer)
+	}
+
+	if _, _, _, _, err := store.GetVersionPair(ctx, key, "1234567890"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_RestoreHead(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-restore-head-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/restore"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 意外删除主数据文件（连同它的目录）后 Get 失败
+	if err := os.RemoveAll(filepath.Join(tempDir, "test")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	version, err := store.RestoreHead(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1672531202000000000" {
+		t.Fatalf("expected version %q, got %q", "1672531202000000000", version)
+	}
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value 2" {
+		t.Fatalf("expected %q, got %q", "value 2", value)
+	}
+
+	// 恢复不产生新的历史记录
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 3 {
+		t.Fatalf("expected 3 histories, got %d", len(histories))
+	}
+
+	if _, err := store.RestoreHead(ctx, "test/missing"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_ListKeysWithSeparator(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-separator-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	for _, key := range []string{"a/b/c", "a/d", "e"} {
+		if _, err := store.Set(ctx, key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		sep      rune
+		prefix   string
+		expected []string
+	}{
+		{sep: '/', prefix: "", expected: []string{"a/b/c", "a/d", "e"}},
+		{sep: '/', prefix: "a/b", expected: []string{"a/b/c"}},
+		{sep: '\\', prefix: "", expected: []string{"a\\b\\c", "a\\d", "e"}},
+		{sep: '\\', prefix: "a\\b", expected: []string{"a\\b\\c"}},
+		{sep: '\\', prefix: "a/", expected: []string{"a\\b\\c", "a\\d"}},
+	} {
+		keys, err := store.ListKeysWithSeparator(ctx, test.prefix, test.sep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != strings.Join(test.expected, ",") {
+			t.Fatalf("sep=%q prefix=%q: expected %v, got %v", test.sep, test.prefix, test.expected, keys)
+		}
+	}
+
+	if _, err := store.ListKeysWithSeparator(ctx, "", ':'); err == nil {
+		t.Fatal("expected error for unsupported separator")
+	}
+}
+
+func TestFileKVStore_GetRaw(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-getraw-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/raw"
+
+	if _, err := store.Set(ctx, key, []byte("raw value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 值按原样保存，编码为 identity
+	data, encoding, err := store.GetRaw(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != EncodingIdentity {
+		t.Fatalf("expected encoding %q, got %q", EncodingIdentity, encoding)
+	}
+	if string(data) != "raw value" {
+		t.Fatalf("expected %q, got %q", "raw value", data)
+	}
+
+	if _, _, err := store.GetRaw(ctx, "test/missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_InvalidKeys(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-invalid-keys-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	store := NewFileKVStore(tempDir)
+	for _, key := range []string{"dir/a", "dir/z"} {
+		if _, err := store.Set(ctx, key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 在外部创建的文件名不合法的文件
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"dir/p_external": []byte("external"),
+		"dir/backup.h":   []byte("external"),
+	})
+	if _, err := store.Get(ctx, "dir/p_external"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+
+	// 默认列出不合法的键，它们也不会让同一个目录中后面的键被跳过
+	keys, err := store.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "dir/a,dir/backup.h,dir/p_external,dir/z" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	skipping := NewFileKVStore(tempDir, WithSkipInvalidKeys(true))
+	keys, err = skipping.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "dir/a,dir/z" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	for _, s := range []*FileKVStore{store, skipping} {
+		invalid, err := s.ListInvalidKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(invalid)
+		if strings.Join(invalid, ",") != "dir/backup.h,dir/p_external" {
+			t.Fatalf("unexpected invalid keys: %v", invalid)
+		}
+	}
+}
+
+func TestFileKVStore_GetLastVersionNonNumeric(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-ulid-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 外部工具写入的以 ULID 为版本号的历史记录，按字符串排序即为时间顺序
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"ulid": []byte("v3"),
+		".history/ulid.h/01BX5ZZKBKACTAV9WEVGEMMVRZ":      []byte("v2"),
+		".history/ulid.h/01ARZ3NDEKTSV4RRFFQ69G5FAV":      []byte("v1"),
+		".history/ulid.h/01BX5ZZKBKACTAV9WEVGEMMVS0":      []byte("v3"),
+		".history/ulid.h/01BX5ZZKBKACTAV9WEVGEMMVS0.meta": []byte("author=test\n"),
+	})
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	lastVersion, err := store.GetLastVersion(ctx, "ulid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastVersion.Version != "01BX5ZZKBKACTAV9WEVGEMMVS0" {
+		t.Fatalf("expected version %q, got %q", "01BX5ZZKBKACTAV9WEVGEMMVS0", lastVersion.Version)
+	}
+	if lastVersion.Meta["author"] != "test" {
+		t.Fatalf("unexpected meta %v", lastVersion.Meta)
+	}
+
+	// 数字的版本仍然按时间戳和冲突计数比较
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1672531200000000000", "1672531200000000000_0001", -1},
+		{"1672531200000000000_0002", "1672531200000000000_0001", 1},
+		{"999999999", "1672531200000000000", -1},
+		{"01ARZ3NDEKTSV4RRFFQ69G5FAV", "01BX5ZZKBKACTAV9WEVGEMMVRZ", -1},
+	} {
+		if got := compareVersions(test.a, test.b); (got > 0) != (test.expected > 0) || (got < 0) != (test.expected < 0) {
+			t.Fatalf("compareVersions(%q, %q): expected %d, got %d", test.a, test.b, test.expected, got)
+		}
+	}
+}
+
+func TestFileKVStore_NumericVersionOrder(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-version-order-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 按字符串排序时 "100_1" 在 "1000" 之前、"99" 在 "100" 之后，按数字比较时不是
+	key := "order"
+	expected := []string{"99", "100", "100_1", "100_0002", "999", "1000", "1000_1", "10000"}
+	historyDir := filepath.Join(tempDir, ".history", key+".h")
+	if err := os.MkdirAll(historyDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range expected {
+		if err := os.WriteFile(filepath.Join(historyDir, version), []byte(version), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "order"), []byte(expected[len(expected)-1]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, history := range histories {
+		versions = append(versions, history.Version)
+	}
+	if strings.Join(versions, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, versions)
+	}
+
+	// 前后版本的导航使用相同的顺序
+	for i, version := range expected {
+		prev, err := store.GetPrevVersion(ctx, key, version)
+		if i == 0 {
+			if !errors.Is(err, ErrVersionNotFound) {
+				t.Fatalf("%s: expected no previous version, got %v, %v", version, prev, err)
+			}
+		} else if err != nil || prev.Version != expected[i-1] {
+			t.Fatalf("%s: expected previous version %q, got %v, %v", version, expected[i-1], prev, err)
+		}
+
+		next, err := store.GetNextVersion(ctx, key, version)
+		if i == len(expected)-1 {
+			if !errors.Is(err, ErrVersionNotFound) {
+				t.Fatalf("%s: expected no next version, got %v, %v", version, next, err)
+			}
+		} else if err != nil || next.Version != expected[i+1] {
+			t.Fatalf("%s: expected next version %q, got %v, %v", version, expected[i+1], next, err)
+		}
+	}
+	last, err := store.GetLastVersion(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Version != "10000" {
+		t.Fatalf("expected last version %q, got %q", "10000", last.Version)
+	}
+
+	// 按个数清理时保留最新的版本
+	if err := store.CleanupHistoriesByCount(ctx, key, 3); err != nil {
+		t.Fatal(err)
+	}
+	histories, err = store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, expected[len(expected)-3:])
+}
+
+func TestFileKVStore_GetConsistent(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-consistent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/consistent"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if _, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value, err := store.GetConsistent(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value 1" {
+		t.Fatalf("expected %q, got %q", "value 1", value)
+	}
+
+	// 模拟写入历史记录之后、更新主数据文件之前中断
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		".history/test/consistent.h/1672531202000000000": []byte("value 2"),
+	})
+	if _, err := store.GetConsistent(ctx, key); !errors.Is(err, ErrInconsistentHead) {
+		t.Fatalf("expected ErrInconsistentHead, got %v", err)
+	}
+	// Get 不检查，仍然返回旧的值
+	value, err = store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value 1" {
+		t.Fatalf("expected %q, got %q", "value 1", value)
+	}
+
+	// 修复之后一致
+	if _, err := store.RestoreHead(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	value, err = store.GetConsistent(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value 2" {
+		t.Fatalf("expected %q, got %q", "value 2", value)
+	}
+
+	// 写入更早的时间戳之后，当前值是最后写入的版本而不是最新的版本
+	if _, err := store.SetWithTimestamp(ctx, key, []byte("backdated"), timestamp.Add(500*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	value, err = store.GetConsistent(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "backdated" {
+		t.Fatalf("expected %q, got %q", "backdated", value)
+	}
+	// RestoreHead 恢复的也是最后写入的版本
+	if err := os.Remove(filepath.Join(tempDir, key)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RestoreHead(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	value, err = store.GetConsistent(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "backdated" {
+		t.Fatalf("expected %q, got %q", "backdated", value)
+	}
+
+	// 再按顺序写入之后又是最新的版本，不再需要 .head 文件
+	if _, err := store.SetWithTimestamp(ctx, key, []byte("value 3"), timestamp.Add(3*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if value, err = store.GetConsistent(ctx, key); err != nil || string(value) != "value 3" {
+		t.Fatalf("expected %q, got %q, %v", "value 3", value, err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, ".history", key+".h", headMarkerName)); !os.IsNotExist(err) {
+		t.Fatalf("expected the head marker to be removed, got %v", err)
+	}
+
+	if _, err := store.GetConsistent(ctx, "test/missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_GetHistoriesLimited(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-limited-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	key := "limited"
+	versions := writePagedHistories(t, tempDir, key, 2*defaultMaxHistoryCount+50)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	if err := store.UpdateMeta(ctx, key, "head", map[string]string{"author": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		maxRecords int
+		count      int
+		truncated  bool
+	}{
+		{maxRecords: 5, count: 5, truncated: true},
+		{maxRecords: 260, count: 260, truncated: true},
+		{maxRecords: len(versions), count: len(versions), truncated: false},
+		{maxRecords: 0, count: len(versions), truncated: false},
+	} {
+		histories, truncated, err := store.GetHistoriesLimited(ctx, key, test.maxRecords)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(histories) != test.count || truncated != test.truncated {
+			t.Fatalf("maxRecords=%d: expected %d histories (truncated=%v), got %d (truncated=%v)",
+				test.maxRecords, test.count, test.truncated, len(histories), truncated)
+		}
+		// 从新到旧排列
+		for i, history := range histories {
+			if expected := versions[len(versions)-1-i]; history.Version != expected {
+				t.Fatalf("maxRecords=%d: expected version %q at %d, got %q", test.maxRecords, expected, i, history.Version)
+			}
+		}
+		if histories[0].Meta["author"] != "test" {
+			t.Fatalf("expected meta of the newest version, got %v", histories[0].Meta)
+		}
+	}
+
+	// 分页中的记录可以用返回的版本读取
+	histories, _, err := store.GetHistoriesLimited(ctx, key, 260)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := histories[len(histories)-1]
+	value, err := store.GetByVersion(ctx, key, last.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != last.Version {
+		t.Fatalf("expected %q, got %q", last.Version, value)
+	}
+}
+
+func TestFileKVStore_ListKeysExcluding(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-exclude-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	for _, key := range []string{
+		"app/config",
+		"app/config.tmp",
+		"app/sub/data.tmp",
+		"app/sub/data",
+		"cache/a",
+		"cache/deep/b",
+		"other/cache/c",
+		"root.tmp",
+	} {
+		if _, err := store.Set(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		excludes []string
+		expected []string
+	}{
+		{
+			excludes: nil,
+			expected: []string{"app/config", "app/config.tmp", "app/sub/data", "app/sub/data.tmp", "cache/a", "cache/deep/b", "other/cache/c", "root.tmp"},
+		},
+		{
+			// 排除任意层级的 .tmp 文件
+			excludes: []string{"**/*.tmp"},
+			expected: []string{"app/config", "app/sub/data", "cache/a", "cache/deep/b", "other/cache/c"},
+		},
+		{
+			// 以 / 结尾的模式只排除相对于根目录的目录
+			excludes: []string{"cache/"},
+			expected: []string{"app/config", "app/config.tmp", "app/sub/data", "app/sub/data.tmp", "other/cache/c", "root.tmp"},
+		},
+		{
+			excludes: []string{"**/cache/", "app/sub"},
+			expected: []string{"app/config", "app/config.tmp", "root.tmp"},
+		},
+		{
+			excludes: []string{"app/*"},
+			expected: []string{"cache/a", "cache/deep/b", "other/cache/c", "root.tmp"},
+		},
+	} {
+		keys, err := store.ListKeysExcluding(ctx, "", test.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != strings.Join(test.expected, ",") {
+			t.Fatalf("excludes=%v: expected %v, got %v", test.excludes, test.expected, keys)
+		}
+	}
+
+	// 被排除的目录不会被读取
+	unreadable := filepath.Join(tempDir, "cache", "deep")
+	if err := os.Chmod(unreadable, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(unreadable, 0755)
+	if os.Getuid() != 0 {
+		if _, err := store.ListKeysExcluding(ctx, "", nil); err == nil {
+			t.Fatal("expected error reading unreadable directory")
+		}
+	}
+	keys, err := store.ListKeysExcluding(ctx, "", []string{"cache/deep/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 7 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	if _, err := store.ListKeysExcluding(ctx, "", []string{"[a-"}); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
+
+func TestFileKVStore_GetByVersionNotFound(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-version-notfound-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	if _, err := store.Set(ctx, "test/key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 键不存在时返回 ErrKeyNotFound
+	_, err = store.GetByVersion(ctx, "test/missing", "1672531200000000000")
+	if !errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 键存在但版本不存在时返回 ErrVersionNotFound
+	_, err = store.GetByVersion(ctx, "test/key", "1672531200000000000")
+	if !errors.Is(err, ErrVersionNotFound) || errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+
+	// 键被删除但保留了历史记录时，历史中不存在的版本依然是 ErrVersionNotFound
+	if err := store.Delete(ctx, "test/key", false); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetByVersion(ctx, "test/key", "1672531200000000000")
+	if !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+
+	// 连同历史记录一起删除后返回 ErrKeyNotFound
+	if _, err := store.Set(ctx, "test/other", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "test/other", true); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetByVersion(ctx, "test/other", "1672531200000000000")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_KeyConflict(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-conflict-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	// 先写值，再把它当作命名空间
+	if _, err := store.Set(ctx, "a", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a/b", "a/b/c"} {
+		_, err := store.Set(ctx, key, []byte("child"))
+		if !errors.Is(err, ErrKeyConflict) {
+			t.Fatalf("%s: expected ErrKeyConflict, got %v", key, err)
+		}
+		if !strings.Contains(err.Error(), "'a' is a value") {
+			t.Fatalf("%s: expected error to name the conflicting key, got %v", key, err)
+		}
+	}
+	if _, err := store.PutAll(ctx, map[string][]byte{"a/b": []byte("child")}); !errors.Is(err, ErrKeyConflict) {
+		t.Fatalf("expected ErrKeyConflict, got %v", err)
+	}
+
+	// 先写命名空间，再把它当作值
+	if _, err := store.Set(ctx, "ns/key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Set(ctx, "ns", []byte("value"))
+	if !errors.Is(err, ErrKeyConflict) || !errors.Is(err, ErrKeyIsNamespace) {
+		t.Fatalf("expected ErrKeyConflict and ErrKeyIsNamespace, got %v", err)
+	}
+
+	// 冲突的写入不会修改已有的值
+	value, err := store.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value" {
+		t.Fatalf("expected %q, got %q", "value", value)
+	}
+
+	// 读取时父路径是值依然返回 ErrKeyNotFound
+	if _, err := store.Get(ctx, "a/b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_Equal(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-equal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	large := []byte(strings.Repeat("0123456789", 2000))
+	largeChanged := append([]byte{}, large...)
+	largeChanged[len(largeChanged)-1] = 'x'
+
+	for key, value := range map[string][]byte{
+		"a":             []byte("same"),
+		"b":             []byte("same"),
+		"c":             []byte("diff"),
+		"d":             []byte("longer value"),
+		"large/a":       large,
+		"large/b":       large,
+		"large/changed": largeChanged,
+	} {
+		if _, err := store.Set(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		keyA, keyB string
+		expected   bool
+	}{
+		{"a", "b", true},
+		{"a", "a", true},
+		{"a", "c", false},
+		{"a", "d", false},
+		{"large/a", "large/b", true},
+		{"large/a", "large/changed", false},
+	} {
+		equal, err := store.Equal(ctx, test.keyA, test.keyB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if equal != test.expected {
+			t.Fatalf("Equal(%q, %q): expected %v, got %v", test.keyA, test.keyB, test.expected, equal)
+		}
+	}
+
+	if _, err := store.Equal(ctx, "a", "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := store.Equal(ctx, "missing", "a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := store.Equal(ctx, "a", "large"); !errors.Is(err, ErrKeyIsNamespace) {
+		t.Fatalf("expected ErrKeyIsNamespace, got %v", err)
+	}
+
+	// 设置了 WithCompareFunc 时用它比较
+	store = NewFileKVStore(tempDir, WithCompareFunc(func(a, b []byte) bool {
+		return strings.EqualFold(string(a), string(b))
+	}))
+	if _, err := store.Set(ctx, "upper", []byte("SAME")); err != nil {
+		t.Fatal(err)
+	}
+	equal, err := store.Equal(ctx, "a", "upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal {
+		t.Fatal("expected values to be equal by compare func")
+	}
+	if _, err := store.Equal(ctx, "a", "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_GetHistoriesWithSizes(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-sizes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/sizes"
+
+	// 超过 defaultMaxHistoryCount 个版本，Fsck 后部分历史记录会被移到分页目录中
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	sizes := map[string]int64{}
+	for i := 0; i < defaultMaxHistoryCount+50; i++ {
+		value := strings.Repeat("x", i+1)
+		version, err := store.SetWithTimestamp(ctx, key, []byte(value), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[version] = int64(len(value))
+	}
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	histories, err := store.GetHistoriesWithSizes(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != len(sizes) {
+		t.Fatalf("expected %d histories, got %d", len(sizes), len(histories))
+	}
+	paged := 0
+	for _, history := range histories {
+		if strings.Contains(history.Name, "/") {
+			paged++
+		}
+		if history.Size != sizes[history.Version] {
+			t.Fatalf("version %s: expected size %d, got %d", history.Version, sizes[history.Version], history.Size)
+		}
+	}
+	if paged == 0 {
+		t.Fatal("expected some histories in page directories")
+	}
+
+	// GetHistories 不填写大小
+	histories, err = store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, history := range histories {
+		if history.Size != 0 {
+			t.Fatalf("expected size 0 from GetHistories, got %d", history.Size)
+		}
+	}
+}
+
+func TestFileKVStore_GetFirstVersion(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-first-version-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	// 平铺的历史记录
+	key := "test/flat"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	for i := 0; i < 5; i++ {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := store.SetMeta(ctx, key, versions[0], map[string]string{"author": "creator"}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.GetFirstVersion(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != versions[0] || first.Meta["author"] != "creator" {
+		t.Fatalf("expected first version %q with meta, got %+v", versions[0], first)
+	}
+
+	// 分页的历史记录
+	pagedKey := "test/paged"
+	pagedVersions := writePagedHistories(t, tempDir, pagedKey, defaultMaxHistoryCount*2+50)
+	if err := store.SetMeta(ctx, pagedKey, pagedVersions[0], map[string]string{"author": "creator"}); err != nil {
+		t.Fatal(err)
+	}
+	first, err = store.GetFirstVersion(ctx, pagedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != pagedVersions[0] || first.Meta["author"] != "creator" {
+		t.Fatalf("expected first version %q with meta, got %+v", pagedVersions[0], first)
+	}
+	if !strings.HasPrefix(first.Name, pagePrefix) {
+		t.Fatalf("expected first version in a page directory, got %q", first.Name)
+	}
+	value, err := store.GetByVersion(ctx, pagedKey, first.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != pagedVersions[0] {
+		t.Fatalf("expected %q, got %q", pagedVersions[0], value)
+	}
+
+	if _, err := store.GetFirstVersion(ctx, "test/missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_CleanupHistoriesByTimeBoundary(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-cleanup-time-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mockedtimex := timextest.Mock(now)
+	defer mockedtimex.TearDown()
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/cleanup"
+	maxAge := time.Hour
+	cutoff := now.Add(-maxAge)
+
+	// 版本号是纳秒时间戳，早于截止时间的版本被删除，正好等于截止时间的保留，带计数后缀的版本按时间戳比较
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		suffixed  bool
+		kept      bool
+	}{
+		{name: "a day before", timestamp: cutoff.Add(-24 * time.Hour)},
+		{name: "1s before", timestamp: cutoff.Add(-time.Second)},
+		{name: "1ns before", timestamp: cutoff.Add(-time.Nanosecond)},
+		{name: "1ns before suffixed", timestamp: cutoff.Add(-time.Nanosecond), suffixed: true},
+		{name: "at cutoff", timestamp: cutoff, kept: true},
+		{name: "at cutoff suffixed", timestamp: cutoff, suffixed: true, kept: true},
+		{name: "1ns after", timestamp: cutoff.Add(time.Nanosecond), kept: true},
+		{name: "now", timestamp: now, kept: true},
+	}
+	versions := make([]string, len(tests))
+	for i, test := range tests {
+		version, err := store.SetWithTimestamp(ctx, key, []byte(test.name), test.timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.suffixed != strings.Contains(version, "_") {
+			t.Fatalf("%s: unexpected version %q", test.name, version)
+		}
+		versions[i] = version
+	}
+
+	if err := store.CleanupHistoriesByTime(ctx, key, maxAge); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for i, test := range tests {
+		if test.kept {
+			expected = append(expected, versions[i])
+		}
+	}
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, expected)
+}
+
+func TestFileKVStore_GetLatestByMeta(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-latest-by-meta-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	// 交错标记不同通道的版本
+	key := "test/release"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	channels := []string{"stable", "beta", "stable", "nightly", "beta", "", "nightly"}
+	var versions []string
+	for i, channel := range channels {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("release "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+		if channel != "" {
+			if err := store.SetMeta(ctx, key, version, map[string]string{"channel": channel}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for channel, index := range map[string]int{"stable": 2, "beta": 4, "nightly": 6} {
+		value, version, err := store.GetLatestByMeta(ctx, key, "channel", channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version.Version != versions[index] || version.Meta["channel"] != channel {
+			t.Fatalf("%s: expected version %q, got %+v", channel, versions[index], version)
+		}
+		if expected := "release " + strconv.Itoa(index); string(value) != expected {
+			t.Fatalf("%s: expected %q, got %q", channel, expected, value)
+		}
+	}
+
+	if _, _, err := store.GetLatestByMeta(ctx, key, "channel", "lts"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+	if _, _, err := store.GetLatestByMeta(ctx, "test/missing", "channel", "stable"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 分页的历史记录：匹配的版本在较早的分页中，找到后不再读取更早的分页
+	pagedKey := "test/paged"
+	pagedVersions := writePagedHistories(t, tempDir, pagedKey, defaultMaxHistoryCount*3+50)
+	target := pagedVersions[defaultMaxHistoryCount+10]
+	if err := store.SetMeta(ctx, pagedKey, target, map[string]string{"channel": "stable"}); err != nil {
+		t.Fatal(err)
+	}
+	oldestPage := filepath.Join(tempDir, ".history", pagedKey+".h", pagePrefix+pagedVersions[0])
+	readDirFS := &readDirRecordFS{FS: osFS{}}
+	recorded := NewFileKVStore(tempDir, WithFS(readDirFS))
+	value, version, err := recorded.GetLatestByMeta(ctx, pagedKey, "channel", "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != target || string(value) != target {
+		t.Fatalf("expected version %q, got %+v with value %q", target, version, value)
+	}
+	for _, dir := range readDirFS.dirs {
+		if dir == oldestPage {
+			t.Fatalf("expected the oldest page not to be read, read %v", readDirFS.dirs)
+		}
+	}
+}
+
+// readDirRecordFS 记录所有通过 ReadDir 读取的目录
+type readDirRecordFS struct {
+	FS
+	dirs []string
+}
+
+func (r *readDirRecordFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	r.dirs = append(r.dirs, name)
+	return r.FS.ReadDir(name)
+}
+
+// readFileRecordFS 记录所有被 ReadFile 的文件
+type readFileRecordFS struct {
+	FS
+	files []string
+}
+
+func (r *readFileRecordFS) ReadFile(name string) ([]byte, error) {
+	r.files = append(r.files, name)
+	return r.FS.ReadFile(name)
+}
+
+func TestFileKVStore_DeleteExisting(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-delete-existing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	for _, removeHistories := range []bool{false, true} {
+		key := "test/key_" + strconv.FormatBool(removeHistories)
+		if _, err := store.Set(ctx, key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+
+		// 存在的键被删除时返回 true
+		deleted, err := store.DeleteExisting(ctx, key, removeHistories)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !deleted {
+			t.Fatalf("removeHistories=%v: expected the existing key to be deleted", removeHistories)
+		}
+		if exists, err := store.Exists(ctx, key); err != nil || exists {
+			t.Fatalf("removeHistories=%v: expected key to be deleted, exists=%v, err=%v", removeHistories, exists, err)
+		}
+		_, err = os.Stat(filepath.Join(tempDir, ".history", key+".h"))
+		if removeHistories != os.IsNotExist(err) {
+			t.Fatalf("removeHistories=%v: unexpected history directory state: %v", removeHistories, err)
+		}
+
+		// 再次删除时不存在的键返回 false，Delete 仍然返回 nil
+		deleted, err = store.DeleteExisting(ctx, key, removeHistories)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted {
+			t.Fatalf("removeHistories=%v: expected a missing key not to be deleted", removeHistories)
+		}
+		if err := store.Delete(ctx, key, removeHistories); err != nil {
+			t.Fatalf("removeHistories=%v: expected Delete of a missing key to succeed, got %v", removeHistories, err)
+		}
+	}
+
+	// 有子键的键和 Delete 一样返回错误
+	if _, err := store.Set(ctx, "parent/child", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := store.DeleteExisting(ctx, "parent", true); deleted || !errors.Is(err, ErrKeyIsNamespace) {
+		t.Fatalf("expected ErrKeyIsNamespace, got %v, %v", deleted, err)
+	}
+}
+
+func TestFileKVStore_TreatEmptyAsAbsent(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-empty-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	key := "test/empty"
+	if _, err := NewFileKVStore(tempDir).Set(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileKVStore(tempDir).Set(ctx, key, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 默认空值是合法的值
+	store := NewFileKVStore(tempDir)
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != 0 {
+		t.Fatalf("expected empty value, got %q", value)
+	}
+	exists, err := store.Exists(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("expected empty value to exist")
+	}
+
+	// 空值被当作已删除
+	store = NewFileKVStore(tempDir, WithTreatEmptyAsAbsent(true))
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	exists, err = store.Exists(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("expected empty value to be absent")
+	}
+
+	// 历史记录依然保留
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 2 {
+		t.Fatalf("expected 2 histories, got %d", len(histories))
+	}
+
+	// 写入非空值后又可以读取
+	if _, err := store.Set(ctx, key, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	value, err = store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "again" {
+		t.Fatalf("expected %q, got %q", "again", value)
+	}
+}
+
+func TestFileKVStore_Restore(t *testing.T) {
+	store := NewFileKVStore(t.TempDir())
+	ctx := context.Background()
+	key := "test/revert"
+
+	var versions []string
+	for i := 0; i < 3; i++ {
+		version, err := store.Set(ctx, key, []byte("value "+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+
+	// 回滚产生一个新的历史记录，中间的版本都保留
+	restored, err := store.Restore(ctx, key, versions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored == "" || compareVersions(restored, versions[2]) <= 0 {
+		t.Fatalf("expected a new version after %s, got %q", versions[2], restored)
+	}
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value 0" {
+		t.Errorf("expected %q, got %q", "value 0", value)
+	}
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, append(versions, restored))
+
+	// 内容和当前值相同时不产生新的版本
+	if version, err := store.Restore(ctx, key, restored); err != nil || version != "" {
+		t.Errorf("expected no new version, got %q, %v", version, err)
+	}
+	if _, err := store.Restore(ctx, key, "1"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected ErrVersionNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package filekv
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FS 是 FileKVStore 访问文件系统的接口，默认直接使用 os 包
+// 可以用 WithFS 替换它，例如在测试中注入故障
+type FS interface {
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	MkdirAll(path string, perm fs.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+}
+
+// ChtimesFS 是可选的接口，FS 实现它时可以直接修改文件的访问时间和修改时间
+// 没有实现时需要修改时间的地方会重写文件内容
+type ChtimesFS interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// LinkFS 是可选的接口，FS 实现它时可以创建硬链接，用于 WithLinkHistory
+type LinkFS interface {
+	Link(oldname, newname string) error
+}
+
+// CreateFS 是可选的接口，FS 实现它时可以流式地写入文件，用于 SetFromReader
+// 没有实现时 SetFromReader 先把整个值读到内存中再写入
+type CreateFS interface {
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+}
+
+// WithFS 设置 FileKVStore 使用的文件系统
+func WithFS(fsys FS) Option {
+	return func(s *FileKVStore) {
+		s.fsys = fsys
+	}
+}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// readOnlyFS 把标准库的 fs.FS 适配为 FS，所有写操作都返回 ErrReadOnly
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+// toFSPath 把 FileKVStore 内部用 filepath 拼接的路径转换为 fs.FS 使用的 / 分隔的路径
+func toFSPath(name string) string {
+	return filepath.ToSlash(filepath.Clean(name))
+}
+
+func (r readOnlyFS) Open(name string) (fs.File, error) {
+	return r.fsys.Open(toFSPath(name))
+}
+
+func (r readOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, toFSPath(name))
+}
+
+func (r readOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(r.fsys, toFSPath(name))
+}
+
+func (r readOnlyFS) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(r.fsys, toFSPath(name))
+}
+
+func (r readOnlyFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return &fs.PathError{Op: "write", Path: name, Err: ErrReadOnly}
+}
+
+func (r readOnlyFS) MkdirAll(path string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: path, Err: ErrReadOnly}
+}
+
+func (r readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: ErrReadOnly}
+}
+
+func (r readOnlyFS) RemoveAll(path string) error {
+	return &fs.PathError{Op: "remove", Path: path, Err: ErrReadOnly}
+}
+
+func (r readOnlyFS) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrReadOnly}
+}
+
+// NewReadOnlyKVStore 基于 fs.FS（如 embed.FS 或 zip 文件）创建一个只读的存储
+// rootPrefix 是存储在 fsys 中的根目录，为空时表示 fsys 的根目录
+// 所有的读方法都从 fsys 读取，所有的写方法都返回 ErrReadOnly
+func NewReadOnlyKVStore(fsys fs.FS, rootPrefix string) KeyValueStore {
+	if rootPrefix == "" {
+		rootPrefix = "."
+	}
+	s := NewFileKVStore(rootPrefix, WithFS(readOnlyFS{fsys: fsys}))
+	s.readOnly = true
+	return s
+}
@@ -0,0 +1,151 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sort"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadOnlyKVStore(t *testing.T) {
+	fsys := fstest.MapFS{
+		"data/config/a": {Data: []byte("value2")},
+		"data/config/b": {Data: []byte("other")},
+		"data/.history/config/a.h/1672531200000000000":      {Data: []byte("value1")},
+		"data/.history/config/a.h/1672531201000000000":      {Data: []byte("value2")},
+		"data/.history/config/a.h/1672531201000000000.meta": {Data: []byte("author=test\n")},
+	}
+	store := NewReadOnlyKVStore(fsys, "data")
+	ctx := context.Background()
+
+	value, err := store.Get(ctx, "config/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value2" {
+		t.Fatalf("expected %q, got %q", "value2", value)
+	}
+
+	value, err = store.GetByVersion(ctx, "config/a", "1672531200000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value1" {
+		t.Fatalf("expected %q, got %q", "value1", value)
+	}
+
+	if _, err := store.Get(ctx, "config/missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	exists, err := store.Exists(ctx, "config/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("expected key to exist")
+	}
+
+	keys, err := store.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "config/a" || keys[1] != "config/b" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	histories, err := store.GetHistories(ctx, "config/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{"1672531200000000000", "1672531201000000000"})
+	if histories[1].Meta["author"] != "test" {
+		t.Fatalf("expected meta author=test, got %v", histories[1].Meta)
+	}
+
+	lastVersion, err := store.GetLastVersion(ctx, "config/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastVersion.Version != "1672531201000000000" {
+		t.Fatalf("expected last version %q, got %q", "1672531201000000000", lastVersion.Version)
+	}
+
+	for name, fn := range map[string]func() error{
+		"Set":        func() error { _, err := store.Set(ctx, "config/a", []byte("new")); return err },
+		"SetSame":    func() error { _, err := store.Set(ctx, "config/a", []byte("value2")); return err },
+		"SetMeta":    func() error { return store.SetMeta(ctx, "config/a", "head", nil) },
+		"UpdateMeta": func() error { return store.UpdateMeta(ctx, "config/a", "head", nil) },
+		"Delete":     func() error { return store.Delete(ctx, "config/a", true) },
+		"Cleanup":    func() error { return store.CleanupHistoriesByCount(ctx, "config/a", 1) },
+		"Fsck":       func() error { return store.Fsck(ctx) },
+	} {
+		if err := fn(); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+
+	// rootPrefix 为空时使用 fsys 的根目录
+	rootStore := NewReadOnlyKVStore(fstest.MapFS{"key": {Data: []byte("v")}}, "")
+	keys, err = rootStore.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+// faultFS 包装一个 FS，用于在测试中注入写入故障
+type faultFS struct {
+	FS
+	// writeFileErr 返回非 nil 时 WriteFile 失败
+	writeFileErr func(name string) error
+	// renameErr 返回非 nil 时 Rename 失败
+	renameErr func(oldpath, newpath string) error
+	// writeLimit 返回非负数 n 时 WriteFile 只写入前 n 个字节然后失败，模拟写到一半时崩溃
+	writeLimit func(name string) int
+	// removeErr 返回非 nil 时 Remove 失败
+	removeErr func(name string) error
+}
+
+// errShortWrite 是 faultFS 只写入了一部分时返回的错误
+var errShortWrite = errors.New("short write")
+
+func (f *faultFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if f.writeFileErr != nil {
+		if err := f.writeFileErr(name); err != nil {
+			return err
+		}
+	}
+	if f.writeLimit != nil {
+		if n := f.writeLimit(name); n >= 0 && n < len(data) {
+			if err := f.FS.WriteFile(name, data[:n], perm); err != nil {
+				return err
+			}
+			return errShortWrite
+		}
+	}
+	return f.FS.WriteFile(name, data, perm)
+}
+
+func (f *faultFS) Rename(oldpath, newpath string) error {
+	if f.renameErr != nil {
+		if err := f.renameErr(oldpath, newpath); err != nil {
+			return err
+		}
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func (f *faultFS) Remove(name string) error {
+	if f.removeErr != nil {
+		if err := f.removeErr(name); err != nil {
+			return err
+		}
+	}
+	return f.FS.Remove(name)
+}
@@ -0,0 +1,178 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cabify/timex"
+)
+
+// FsckIncremental 的各个阶段，按执行的顺序排列，和 Fsck 的各个步骤对应
+const (
+	fsckPhaseOrphans  = "orphans"  // 8.2: 删除孤立的历史记录
+	fsckPhaseOrganize = "organize" // 8.1 和 8.6: 组织历史记录的分页
+	fsckPhaseEnsure   = "ensure"   // 8.3: 确保每个存在的键都有历史记录
+	fsckPhaseIndex    = "index"    // 8.5: 重建最近版本索引
+	fsckPhaseEmpty    = "empty"    // 8.4: 报告内容为空的历史记录，只在设置了 WithFsckWarningFunc 时执行
+	fsckPhaseQuota    = "quota"    // 8.7: 重新统计已经占用的字节数，不按键处理
+)
+
+var fsckPhases = []string{fsckPhaseOrphans, fsckPhaseOrganize, fsckPhaseEnsure, fsckPhaseIndex, fsckPhaseEmpty, fsckPhaseQuota}
+
+// FsckIncremental 分多次执行 Fsck，每次最多运行 budget 的时间，用于一个维护窗口内完成不了 Fsck 的大存储
+// 第一次调用时 cursor 为空，之后传入上一次返回的 nextCursor，全部完成时 done 为 true（这时 nextCursor 为空）。
+// 每次至少处理一个键，budget 不大于 0 时每次只处理一个键。所有的增量执行完后的效果和执行一次 Fsck 相同，
+// 每个阶段都按键的顺序处理，游标记录了阶段和最后处理完的键，所以在两次调用之间新增或删除的键也能被正确处理。
+// 返回错误时 nextCursor 仍然有效：致命错误时它指向出错的键之前，可以修复后从它重试；
+// 这次处理的键的警告（设置了 WithIgnoreWarning 时）在处理完后一起返回，这时可以直接从 nextCursor 继续。
+// 这次处理的键中内容为空的历史记录和 Fsck 一样交给 WithFsckWarningFunc 设置的函数，不会返回错误。
+// 每个阶段开始处理时都要重新列出所有的键，不会并发处理，WithFsckConcurrency 对它无效。
+// 和 Fsck 一样，同一时间只有一次增量在执行，见 WithFsckNoWait。
+func (f *FileKVStore) FsckIncremental(ctx context.Context, budget time.Duration, cursor string) (nextCursor string, done bool, err error) {
+	if f.readOnly {
+		return cursor, false, ErrReadOnly
+	}
+	unlock, err := f.lockFsck()
+	if err != nil {
+		return cursor, false, err
+	}
+	defer unlock()
+
+	phase, lastKey := fsckPhaseOrphans, ""
+	if cursor != "" {
+		idx := strings.Index(cursor, ":")
+		if idx < 0 {
+			return cursor, false, errors.New("invalid fsck cursor '" + cursor + "'")
+		}
+		phase, lastKey = cursor[:idx], cursor[idx+1:]
+	}
+	phaseIndex := -1
+	for i, p := range fsckPhases {
+		if p == phase {
+			phaseIndex = i
+		}
+	}
+	if phaseIndex < 0 {
+		return cursor, false, errors.New("invalid fsck cursor '" + cursor + "'")
+	}
+
+	deadline := timex.Now().Add(budget)
+	processed := 0
+	var warnings []error
+	emptyVersions := map[string][]string{}
+
+	// finish 报告这次发现的空历史记录，返回这次执行的警告
+	finish := func(nextCursor string, done bool) (string, bool, error) {
+		if len(emptyVersions) > 0 {
+			f.fsckWarningFunc(emptyVersionsError(emptyVersions))
+		}
+		if len(warnings) == 0 {
+			return nextCursor, done, nil
+		}
+		if len(warnings) == 1 {
+			return nextCursor, done, warnings[0]
+		}
+		return nextCursor, done, errors.Join(warnings...)
+	}
+
+	for ; phaseIndex < len(fsckPhases); phaseIndex++ {
+		phase = fsckPhases[phaseIndex]
+
+		if phase == fsckPhaseQuota {
+			if err := f.reconcileQuota(ctx); err != nil {
+				return phase + ":", false, err
+			}
+			continue
+		}
+		if phase == fsckPhaseEmpty && f.fsckWarningFunc == nil {
+			continue
+		}
+
+		keys, fn, err := f.fsckPhaseKeys(ctx, phase, emptyVersions)
+		if err != nil {
+			return phase + ":" + lastKey, false, err
+		}
+		start := sort.SearchStrings(keys, lastKey)
+		if start < len(keys) && keys[start] == lastKey {
+			start++
+		}
+
+		for _, key := range keys[start:] {
+			if processed > 0 && !timex.Now().Before(deadline) {
+				return finish(phase+":"+lastKey, false)
+			}
+			if err := ctx.Err(); err != nil {
+				return phase + ":" + lastKey, false, err
+			}
+
+			errs, err := fn(key)
+			warnings = append(warnings, errs...)
+			if err != nil {
+				return phase + ":" + lastKey, false, err
+			}
+			lastKey = key
+			processed++
+		}
+		lastKey = ""
+	}
+	return finish("", true)
+}
+
+// fsckPhaseKeys 返回 FsckIncremental 的一个阶段要处理的键（已排序）和处理一个键的函数
+func (f *FileKVStore) fsckPhaseKeys(ctx context.Context, phase string, emptyVersions map[string][]string) ([]string, func(key string) ([]error, error), error) {
+	if phase == fsckPhaseOrphans {
+		historyDirs := map[string]string{}
+		var keys []string
+		err := f.walkHistoryDirs(ctx, filepath.Join(f.rootDir, historyDirConst), func(key, historyDir string) error {
+			historyDirs[key] = historyDir
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		sort.Strings(keys)
+
+		// 只有大小写不同的历史目录的个数
+		foldCounts := map[string]int{}
+		if f.caseInsensitive {
+			for _, key := range keys {
+				foldCounts[strings.ToLower(key)]++
+			}
+		}
+		return keys, func(key string) ([]error, error) {
+			return f.removeOrphanedHistory(ctx, key, historyDirs[key], foldCounts)
+		}, nil
+	}
+
+	keys, err := f.ListKeys(ctx, "")
+	if err != nil {
+		return nil, nil, errorWrap(err, "listing all keys from main directory")
+	}
+	sort.Strings(keys)
+
+	switch phase {
+	case fsckPhaseOrganize:
+		return keys, f.organizeKeyHistories, nil
+	case fsckPhaseEnsure:
+		return keys, func(key string) ([]error, error) {
+			return f.ensureKeyHistory(ctx, key)
+		}, nil
+	case fsckPhaseIndex:
+		return keys, func(key string) ([]error, error) {
+			return nil, f.rebuildRecentIndex(ctx, key)
+		}, nil
+	default:
+		return keys, func(key string) ([]error, error) {
+			versions, errs := f.findKeyEmptyVersions(ctx, key)
+			if len(versions) > 0 {
+				emptyVersions[key] = versions
+			}
+			return errs, nil
+		}, nil
+	}
+}
@@ -2,9 +2,14 @@ package filekv
 
 import (
 	"context"
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -150,6 +155,141 @@ func TestFileKVStore_Fsck_RemoveOrphanedHistories(t *testing.T) {
 	t.Log("Fsck successfully removed orphaned histories")
 }
 
+// 测试 Fsck 功能：不区分大小写时，只有大小写不同的历史记录不会被当作孤立的记录删除
+func TestFileKVStore_Fsck_CaseCollision(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-case-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"Config/App": []byte("app"),
+		".history/config/app.h/1672531200000000000": []byte("app"),
+		"foo":                                   []byte("foo"),
+		".history/foo.h/1672531201000000000":    []byte("foo"),
+		".history/Foo.h/1672531200000000000":    []byte("Foo"),
+		".history/orphan.h/1672531200000000000": []byte("orphan"),
+	})
+
+	store := NewFileKVStore(tempDir, WithCaseInsensitive(true), WithIgnoreWarning(true))
+	ctx := context.Background()
+	err = store.Fsck(ctx)
+	if !errors.Is(err, ErrCaseCollision) {
+		t.Fatalf("expected ErrCaseCollision, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "'Foo'") {
+		t.Fatalf("expected collision of 'Foo' to be reported, got %v", err)
+	}
+
+	// 有歧义的 Foo.h 和只是大小写不同的 config/app.h 都被保留，真正孤立的记录被删除
+	// 警告不中止 Fsck，在区分大小写的文件系统上 8.3 还会为 Config/App 在 Config/App.h 中创建历史记录
+	for _, name := range []string{
+		"Config/App",
+		".history/config/app.h/1672531200000000000",
+		"foo",
+		".history/foo.h/1672531201000000000",
+		".history/Foo.h/1672531200000000000",
+	} {
+		if _, err := os.Stat(filepath.Join(tempDir, name)); err != nil {
+			t.Fatalf("expected %s to be kept: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, ".history", "orphan.h")); !os.IsNotExist(err) {
+		t.Fatalf("expected the orphaned history to be removed, got %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(tempDir, ".history", "Config")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 默认区分大小写，config/app.h 没有对应的键
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		".history/orphan.h/1672531200000000000": []byte("orphan"),
+	})
+	if warnings, err := NewFileKVStore(tempDir).removeOrphanedHistories(ctx, filepath.Join(tempDir, historyDirConst)); err != nil || len(warnings) != 0 {
+		t.Fatal(warnings, err)
+	}
+	checkFiles(t, tempDir, []string{
+		"Config/App",
+		"foo",
+		".history/foo.h/1672531201000000000",
+	})
+}
+
+// 测试 Fsck 功能：没有设置 WithIgnoreWarning 时，有歧义的历史记录也只是警告，Fsck 会完成其它的步骤
+func TestFileKVStore_Fsck_CaseCollisionContinues(t *testing.T) {
+	tempDir := t.TempDir()
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"foo":                                   []byte("foo"),
+		".history/foo.h/1672531201000000000":    []byte("foo"),
+		".history/Foo.h/1672531200000000000":    []byte("Foo"),
+		".history/orphan.h/1672531200000000000": []byte("orphan"),
+		"nohistory":                             []byte("value"),
+	})
+
+	store := NewFileKVStore(tempDir, WithCaseInsensitive(true))
+	ctx := context.Background()
+	if err := store.Fsck(ctx); !errors.Is(err, ErrCaseCollision) {
+		t.Fatalf("expected ErrCaseCollision, got %v", err)
+	}
+
+	// 孤立的记录被删除，没有历史记录的键也创建了历史记录（8.3）
+	histories, err := store.GetHistories(ctx, "nohistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 1 {
+		t.Fatalf("expected Fsck to create a history for nohistory, got %v", histories)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, ".history", "orphan.h")); !os.IsNotExist(err) {
+		t.Fatalf("expected the orphaned history to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, ".history", "Foo.h", "1672531200000000000")); err != nil {
+		t.Fatalf("expected the ambiguous history to be kept: %v", err)
+	}
+}
+
+// 测试 Fsck 功能：设置 WithRestoreHeadOnFsck 时恢复缺失的主数据文件，而不是删除历史记录
+func TestFileKVStore_Fsck_RestoreHead(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-restore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"key1":                                []byte("value1"),
+		".history/key1.h/1672531200000000000": []byte("value1"),
+		".history/dir/key2.h/1672531200000000000": []byte("old"),
+		".history/dir/key2.h/1672531201000000000": []byte("value2"),
+	})
+	// 空的历史目录没有可以恢复的内容，仍然被删除
+	if err := os.MkdirAll(filepath.Join(tempDir, ".history", "empty.h"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewFileKVStore(tempDir, WithRestoreHeadOnFsck(true))
+	ctx := context.Background()
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, tempDir, []string{
+		"key1",
+		".history/key1.h/1672531200000000000",
+		"dir/key2",
+		".history/dir/key2.h/1672531200000000000",
+		".history/dir/key2.h/1672531201000000000",
+	})
+	value, err := store.Get(ctx, "dir/key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value2" {
+		t.Fatalf("expected %q, got %q", "value2", value)
+	}
+}
+
 // 测试 Fsck 功能：为没有历史记录的键创建初始历史记录
 func TestFileKVStore_Fsck_CreateMissingHistories(t *testing.T) {
 	// 创建临时目录
@@ -206,6 +346,45 @@ func TestFileKVStore_Fsck_CreateMissingHistories(t *testing.T) {
 	})
 }
 
+// 测试 Fsck 功能：设置了 WithTreatEmptyAsAbsent 时值为空的键不是孤立的，也会为它创建历史记录
+func TestFileKVStore_Fsck_TreatEmptyAsAbsent(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithTreatEmptyAsAbsent(true))
+	ctx := context.Background()
+
+	v1, err := store.Set(ctx, "empty", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := store.Set(ctx, "empty", []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有历史记录的空值
+	if err := os.WriteFile(filepath.Join(tempDir, "nohistory"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+
+	histories, err := store.GetHistories(ctx, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{v1, v2})
+
+	histories, err = store.GetHistories(ctx, "nohistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 1 {
+		t.Fatalf("expected 1 history for the empty key, got %d", len(histories))
+	}
+}
+
 // 测试 Fsck 功能：历史记录过多，需要组织成子目录
 func TestFileKVStore_Fsck_OrganizeHistories(t *testing.T) {
 	// 创建临时目录
@@ -278,12 +457,12 @@ func TestFileKVStore_Fsck_OrganizeHistories(t *testing.T) {
 	expectedFiles = append(expectedFiles, key)
 
 	currentHistories := versions
-	for len(currentHistories) >= maxHistoryCount {
-		pageHistories := currentHistories[:maxHistoryCount]
+	for len(currentHistories) >= defaultMaxHistoryCount {
+		pageHistories := currentHistories[:defaultMaxHistoryCount]
 		for _, version := range pageHistories {
 			expectedFiles = append(expectedFiles, filepath.Join(".history", key+".h", pagePrefix+pageHistories[0], version))
 		}
-		currentHistories = currentHistories[maxHistoryCount:]
+		currentHistories = currentHistories[defaultMaxHistoryCount:]
 	}
 	for _, version := range currentHistories {
 		expectedFiles = append(expectedFiles, filepath.Join(".history", key+".h", version))
@@ -294,3 +473,669 @@ func TestFileKVStore_Fsck_OrganizeHistories(t *testing.T) {
 
 	t.Log("Fsck successfully organized histories into subdirectories")
 }
+
+// 测试 Fsck 功能：按 WithMaxHistoryCount 设置的个数分页
+func TestFileKVStore_Fsck_OrganizeHistoriesMaxCount(t *testing.T) {
+	tempDir := t.TempDir()
+
+	key := "key1"
+	testData := map[string][]byte{
+		key: []byte("value1"),
+	}
+
+	now := time.Now()
+	count := 25
+	versions := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		version := strconv.FormatInt(now.Add(time.Duration(i+1)*time.Second).UnixNano(), 10)
+		testData[".history/"+key+".h/"+version] = []byte(version)
+		versions = append(versions, version)
+	}
+	writeTestDataToFS(t, tempDir, testData)
+
+	store := NewFileKVStore(tempDir, WithMaxHistoryCount(10))
+	ctx := context.Background()
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+
+	// 每 10 个一页，共两页，剩下的 5 个留在默认目录中
+	expectedFiles := []string{key}
+	for i, version := range versions {
+		if i < 20 {
+			expectedFiles = append(expectedFiles, filepath.Join(".history", key+".h", pagePrefix+versions[i/10*10], version))
+		} else {
+			expectedFiles = append(expectedFiles, filepath.Join(".history", key+".h", version))
+		}
+	}
+	checkFiles(t, tempDir, expectedFiles)
+
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, versions)
+
+	value, err := store.GetByVersion(ctx, key, versions[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != versions[3] {
+		t.Errorf("expected %q, got %q", versions[3], value)
+	}
+
+	// 小于 1 时使用默认值，25 个历史记录不需要分页
+	otherDir := t.TempDir()
+	writeTestDataToFS(t, otherDir, testData)
+	if err := NewFileKVStore(otherDir, WithMaxHistoryCount(0)).Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles = []string{key}
+	for _, version := range versions {
+		expectedFiles = append(expectedFiles, filepath.Join(".history", key+".h", version))
+	}
+	checkFiles(t, otherDir, expectedFiles)
+}
+
+// 测试 FindEmptyVersions 和 Fsck 功能：报告内容为空的历史记录，Fsck 不会因为它们失败
+func TestFileKVStore_Fsck_EmptyVersions(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-empty-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"key1":                                []byte("value1"),
+		".history/key1.h/1672531200000000000": []byte("value0"),
+		".history/key1.h/1672531201000000000": []byte(""),
+		".history/key1.h/1672531202000000000": []byte("value1"),
+		// 当前值为空时，空的历史记录是正常的
+		"key2":                                []byte(""),
+		".history/key2.h/1672531200000000000": []byte(""),
+		"multi/level/key":                     []byte("value"),
+		".history/multi/level/key.h/p_1672531200000000000/1672531200000000000": []byte(""),
+		".history/multi/level/key.h/1672531201000000000":                       []byte("value"),
+	})
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	emptyVersions, err := store.FindEmptyVersions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emptyVersions) != 2 {
+		t.Fatalf("expected 2 keys with empty versions, got %v", emptyVersions)
+	}
+	if versions := emptyVersions["key1"]; len(versions) != 1 || versions[0] != "1672531201000000000" {
+		t.Fatalf("unexpected empty versions for key1: %v", versions)
+	}
+	if versions := emptyVersions["multi/level/key"]; len(versions) != 1 || versions[0] != "1672531200000000000" {
+		t.Fatalf("unexpected empty versions for multi/level/key: %v", versions)
+	}
+
+	// Fsck 只通过 WithFsckWarningFunc 报告，不删除，也不返回错误
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []error
+	store = NewFileKVStore(tempDir, WithFsckWarningFunc(func(warning error) {
+		warnings = append(warnings, warning)
+	}))
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for cursor, done := "", false; !done; {
+		var err error
+		cursor, done, err = store.FsckIncremental(ctx, time.Hour, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("expected Fsck and FsckIncremental to report empty versions, got %v", warnings)
+	}
+	for _, warning := range warnings {
+		if !errors.Is(warning, ErrEmptyVersions) || !strings.Contains(warning.Error(), "key1@1672531201000000000") ||
+			!strings.Contains(warning.Error(), "multi/level/key@1672531200000000000") {
+			t.Fatalf("unexpected warning: %v", warning)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, ".history/key1.h/1672531201000000000")); err != nil {
+		t.Fatalf("expected empty version to be kept, got %v", err)
+	}
+
+	// 归档中的空历史记录也能找到
+	if err := store.ArchiveKey(ctx, "key1"); err != nil {
+		t.Fatal(err)
+	}
+	archived, err := store.FindEmptyVersions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(archived, emptyVersions) {
+		t.Fatalf("expected %v after archiving, got %v", emptyVersions, archived)
+	}
+}
+
+// 测试 Fsck 功能：整理历史记录时被中断，下次整理时可以恢复
+func TestFileKVStore_Fsck_OrganizeInterrupted(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-interrupted-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	key := "key1"
+	testData := map[string][]byte{
+		key: []byte("value1"),
+	}
+	count := 250
+	baseTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		version := strconv.FormatInt(baseTime.Add(time.Duration(i)*time.Second).UnixNano(), 10)
+		testData[".history/"+key+".h/"+version] = []byte(version)
+		versions = append(versions, version)
+	}
+	writeTestDataToFS(t, tempDir, testData)
+
+	errCrash := errors.New("simulated crash")
+	crashAfter := func(n int) func(string) error {
+		calls := 0
+		return func(string) error {
+			calls++
+			if calls == n {
+				return errCrash
+			}
+			return nil
+		}
+	}
+	for _, crashAt := range []string{"copy", "rename", "remove"} {
+		// 分别在复制第 50 个记录、把临时目录改名为分页目录、删除第 50 个原文件时模拟崩溃
+		fsys := &faultFS{FS: osFS{}}
+		switch crashAt {
+		case "copy":
+			fsys.writeFileErr = crashAfter(50)
+		case "rename":
+			crash := crashAfter(1)
+			fsys.renameErr = func(oldpath, newpath string) error { return crash(newpath) }
+		case "remove":
+			fsys.removeErr = crashAfter(50)
+		}
+		store := NewFileKVStore(tempDir, WithFS(fsys))
+		ctx := context.Background()
+
+		if err := store.Fsck(ctx); !errors.Is(err, errCrash) {
+			t.Fatalf("crash at %s: expected simulated crash, got %v", crashAt, err)
+		}
+
+		// 中断后不会留下不完整的分页目录，所有的历史记录仍然可以读到
+		pageDir := filepath.Join(tempDir, ".history", key+".h", pagePrefix+versions[0])
+		if _, err := os.Stat(pageDir); (err == nil) != (crashAt == "remove") {
+			t.Fatalf("crash at %s: unexpected page directory state: %v", crashAt, err)
+		}
+		histories, err := store.GetHistories(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkHistories(t, histories, versions)
+		for _, version := range []string{versions[0], versions[49], versions[count-1]} {
+			value, err := store.GetByVersion(ctx, key, version)
+			if err != nil || string(value) != version {
+				t.Fatalf("crash at %s: expected %q, got %q, %v", crashAt, version, value, err)
+			}
+		}
+
+		// 恢复正常后再次整理，所有的历史记录都完整地保留下来
+		fsys.writeFileErr = nil
+		fsys.renameErr = nil
+		fsys.removeErr = nil
+		if err := store.Fsck(ctx); err != nil {
+			t.Fatalf("crash at %s: Fsck failed: %v", crashAt, err)
+		}
+		histories, err = store.GetHistories(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkHistories(t, histories, versions)
+
+		var expectedFiles []string
+		expectedFiles = append(expectedFiles, key)
+		for i, version := range versions {
+			if i < defaultMaxHistoryCount {
+				expectedFiles = append(expectedFiles, filepath.Join(".history", key+".h", pagePrefix+versions[0], version))
+			} else {
+				expectedFiles = append(expectedFiles, filepath.Join(".history", key+".h", version))
+			}
+		}
+		checkFiles(t, tempDir, expectedFiles)
+
+		// 还原成未整理的状态，测试下一个崩溃点
+		for _, version := range versions[:defaultMaxHistoryCount] {
+			if err := os.Rename(filepath.Join(pageDir, version), filepath.Join(tempDir, ".history", key+".h", version)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Remove(pageDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 测试 Fsck 功能：把放错分页的历史记录移到正确的分页
+func TestFileKVStore_Fsck_MisfiledRecords(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-misfiled-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	key := "misfiled"
+	versions := writePagedHistories(t, tempDir, key, 3*defaultMaxHistoryCount+1)
+	historyDir := filepath.Join(tempDir, ".history", key+".h")
+	page := func(i int) string {
+		return filepath.Join(historyDir, pagePrefix+versions[i*defaultMaxHistoryCount])
+	}
+	move := func(name, from, to string) {
+		t.Helper()
+		if err := os.Rename(filepath.Join(from, name), filepath.Join(to, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 较新的记录放到了第一个分页，较旧的记录（带元数据）放到了最后一个分页
+	move(versions[450], page(2), page(0))
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		".history/" + key + ".h/" + pagePrefix + versions[0] + "/" + versions[10] + ".meta": []byte("author=test\n"),
+	})
+	move(versions[10], page(0), page(2))
+	move(versions[10]+".meta", page(0), page(2))
+	// 比所有分页都早的记录
+	older := "1600000000000000000"
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		".history/" + key + ".h/" + pagePrefix + versions[defaultMaxHistoryCount] + "/" + older: []byte(older),
+	})
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{
+		filepath.Join(page(2), versions[450]),
+		filepath.Join(page(0), versions[10]),
+		filepath.Join(page(0), versions[10]+".meta"),
+		filepath.Join(historyDir, older),
+	} {
+		if _, err := os.Stat(file); err != nil {
+			t.Fatalf("expected record to be relocated: %v", err)
+		}
+	}
+
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != len(versions)+1 {
+		t.Fatalf("expected %d histories, got %d", len(versions)+1, len(histories))
+	}
+	value, err := store.GetByVersion(ctx, key, versions[450])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != versions[450] {
+		t.Fatalf("expected %q, got %q", versions[450], value)
+	}
+}
+
+// writeFsckTestData 生成 keyCount 个键：有的历史记录需要分页，有的没有历史记录，还有一个孤立的历史记录
+func writeFsckTestData(tb testing.TB, tempDir string, keyCount int) {
+	tb.Helper()
+
+	baseTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(name, value string) {
+		fullPath := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, []byte(value), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for i := 0; i < keyCount; i++ {
+		key := "dir" + strconv.Itoa(i%4) + "/key" + strconv.Itoa(i)
+		records := 0
+		switch i % 3 {
+		case 0:
+			records = defaultMaxHistoryCount + 50
+		case 2:
+			records = 3
+		}
+		value := "value"
+		for j := 0; j < records; j++ {
+			version := strconv.FormatInt(baseTime.Add(time.Duration(j)*time.Second).UnixNano(), 10)
+			value = key + " " + version
+			write(filepath.Join(historyDirConst, key+historyDirSuffix, version), value)
+		}
+		write(key, value)
+	}
+	write(filepath.Join(historyDirConst, "orphan"+historyDirSuffix, "1672531200000000000"), "orphan")
+}
+
+// checkSameFiles 检查 actualDir 和 expectedDir 中的文件和内容完全相同，返回 actualDir 中的所有文件
+func checkSameFiles(t *testing.T, expectedDir, actualDir string) []string {
+	t.Helper()
+
+	expectedFiles, err := getAllFiles(expectedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualFiles, err := getAllFiles(actualDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expectedFiles) != len(actualFiles) {
+		t.Fatalf("expected %d files, got %d", len(expectedFiles), len(actualFiles))
+	}
+	for i := range expectedFiles {
+		if expectedFiles[i] != actualFiles[i] {
+			t.Fatalf("expected file %q, got %q", expectedFiles[i], actualFiles[i])
+		}
+		expectedData, err := os.ReadFile(filepath.Join(expectedDir, expectedFiles[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actualData, err := os.ReadFile(filepath.Join(actualDir, actualFiles[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(expectedData) != string(actualData) {
+			t.Fatalf("file %q: expected %q, got %q", expectedFiles[i], expectedData, actualData)
+		}
+	}
+	return actualFiles
+}
+
+func TestFileKVStore_FsckIncremental(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-incremental-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mockedtimex := timextest.Mock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer mockedtimex.TearDown()
+
+	fullDir := filepath.Join(tempDir, "full")
+	incrementalDir := filepath.Join(tempDir, "incremental")
+	writeFsckTestData(t, fullDir, 30)
+	writeFsckTestData(t, incrementalDir, 30)
+
+	ctx := context.Background()
+	lateKey := filepath.Join("dir0", "late")
+	if err := os.WriteFile(filepath.Join(fullDir, lateKey), []byte("late"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFileKVStore(fullDir, WithRecentIndexSize(5)).Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每次只处理一个键，中途新增的键也会被处理
+	store := NewFileKVStore(incrementalDir, WithRecentIndexSize(5))
+	cursor := ""
+	increments := 0
+	for done := false; !done; {
+		cursor, done, err = store.FsckIncremental(ctx, 0, cursor)
+		if err != nil {
+			t.Fatalf("increment %d: %v", increments, err)
+		}
+		increments++
+		if increments == 40 {
+			if !strings.HasPrefix(cursor, fsckPhaseOrganize+":") {
+				t.Fatalf("expected to be organizing after 40 increments, got cursor %q", cursor)
+			}
+			if err := os.WriteFile(filepath.Join(incrementalDir, lateKey), []byte("late"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if increments > 1000 {
+			t.Fatal("expected FsckIncremental to finish")
+		}
+	}
+	if cursor != "" {
+		t.Fatalf("expected an empty cursor when done, got %q", cursor)
+	}
+	// 20 个键的历史目录加上 1 个孤立的历史目录，整理阶段已经越过 dir0/late 时才新增它，所以整理阶段只有 30 个键，
+	// 之后的 2 个阶段各 31 个键
+	if expected := 21 + 30 + 2*31; increments != expected {
+		t.Fatalf("expected %d increments, got %d", expected, increments)
+	}
+
+	// 所有增量执行完后的结果和执行一次 Fsck 的结果相同
+	checkSameFiles(t, fullDir, incrementalDir)
+
+	// 预算足够时一次完成
+	cursor, done, err := store.FsckIncremental(ctx, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done || cursor != "" {
+		t.Fatalf("expected to finish in one increment, got cursor %q", cursor)
+	}
+
+	if _, _, err := store.FsckIncremental(ctx, time.Hour, "bad cursor"); err == nil {
+		t.Fatal("expected an error for an invalid cursor")
+	}
+}
+
+func TestFileKVStore_FsckConcurrency(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-concurrency-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mockedtimex := timextest.Mock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer mockedtimex.TearDown()
+
+	serialDir := filepath.Join(tempDir, "serial")
+	concurrentDir := filepath.Join(tempDir, "concurrent")
+	writeFsckTestData(t, serialDir, 30)
+	writeFsckTestData(t, concurrentDir, 30)
+
+	ctx := context.Background()
+	if err := NewFileKVStore(serialDir).Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFileKVStore(concurrentDir, WithFsckConcurrency(8)).Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 并发执行的结果和逐个执行的结果相同
+	concurrentFiles := checkSameFiles(t, serialDir, concurrentDir)
+
+	// 分页、补全历史记录和删除孤立的历史记录都已完成
+	paged := 0
+	for _, name := range concurrentFiles {
+		if strings.Contains(name, "/"+pagePrefix) {
+			paged++
+		}
+		if strings.Contains(name, "orphan") {
+			t.Fatalf("expected orphaned history to be removed, got %q", name)
+		}
+	}
+	if paged == 0 {
+		t.Fatal("expected paged histories")
+	}
+	store := NewFileKVStore(concurrentDir)
+	keys, err := store.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, err := store.GetLastVersion(ctx, key); err != nil {
+			t.Fatalf("key %q: %v", key, err)
+		}
+	}
+}
+
+// openCountFS 统计同时在读取的历史目录的最大个数，每次读取都稍作停留，让并发的读取重叠
+type openCountFS struct {
+	FS
+	open    atomic.Int32
+	maxOpen atomic.Int32
+}
+
+func (c *openCountFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !strings.Contains(name, historyDirSuffix) {
+		return c.FS.ReadDir(name)
+	}
+	n := c.open.Add(1)
+	defer c.open.Add(-1)
+	for {
+		m := c.maxOpen.Load()
+		if n <= m || c.maxOpen.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	return c.FS.ReadDir(name)
+}
+
+func TestFileKVStore_FsckMaxOpenDirs(t *testing.T) {
+	tempDir := t.TempDir()
+
+	mockedtimex := timextest.Mock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer mockedtimex.TearDown()
+
+	ctx := context.Background()
+	for _, test := range []struct {
+		name     string
+		maxOpen  int
+		expected func(maxOpen int32) bool
+	}{
+		// 没有限制时 8 个 goroutine 会同时读取多个历史目录
+		{name: "unlimited", maxOpen: 0, expected: func(maxOpen int32) bool { return maxOpen > 2 }},
+		{name: "limited", maxOpen: 2, expected: func(maxOpen int32) bool { return maxOpen >= 1 && maxOpen <= 2 }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(tempDir, test.name)
+			writeFsckTestData(t, dir, 12)
+
+			fsys := &openCountFS{FS: osFS{}}
+			store := NewFileKVStore(dir, WithFS(fsys), WithFsckConcurrency(8), WithFsckMaxOpenDirs(test.maxOpen))
+			if err := store.Fsck(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if maxOpen := fsys.maxOpen.Load(); !test.expected(maxOpen) {
+				t.Errorf("unexpected number of concurrently open history directories: %d", maxOpen)
+			}
+		})
+	}
+	// 限制不改变 Fsck 的结果
+	checkSameFiles(t, filepath.Join(tempDir, "unlimited"), filepath.Join(tempDir, "limited"))
+}
+
+func BenchmarkFsck_Serial(b *testing.B) {
+	benchmarkFsck(b, 1)
+}
+
+func BenchmarkFsck_Concurrent(b *testing.B) {
+	benchmarkFsck(b, 8)
+}
+
+func benchmarkFsck(b *testing.B, concurrency int) {
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir := filepath.Join(tempDir, strconv.Itoa(i))
+		writeFsckTestData(b, dir, 60)
+		store := NewFileKVStore(dir, WithFsckConcurrency(concurrency))
+		b.StartTimer()
+
+		if err := store.Fsck(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFileKVStore_FsckSerialized(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-fsck-serialized-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mockedtimex := timextest.Mock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer mockedtimex.TearDown()
+
+	expectedDir := filepath.Join(tempDir, "expected")
+	concurrentDir := filepath.Join(tempDir, "concurrent")
+	writeFsckTestData(t, expectedDir, 30)
+	writeFsckTestData(t, concurrentDir, 30)
+
+	ctx := context.Background()
+	if err := NewFileKVStore(expectedDir).Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同时执行的两个 Fsck 被串行化，结果和执行一次相同
+	store := NewFileKVStore(concurrentDir, WithFsckConcurrency(4))
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- store.Fsck(ctx)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSameFiles(t, expectedDir, concurrentDir)
+
+	// 默认等待正在执行的 Fsck 完成
+	store.fsckMu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Fsck(ctx)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected Fsck to wait for the running one, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	store.fsckMu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// 设置了 WithFsckNoWait 时立即返回 ErrFsckInProgress
+	noWait := NewFileKVStore(concurrentDir, WithFsckNoWait(true))
+	noWait.fsckMu.Lock()
+	if err := noWait.Fsck(ctx); !errors.Is(err, ErrFsckInProgress) {
+		t.Fatalf("expected ErrFsckInProgress, got %v", err)
+	}
+	if _, _, err := noWait.FsckIncremental(ctx, time.Hour, ""); !errors.Is(err, ErrFsckInProgress) {
+		t.Fatalf("expected ErrFsckInProgress, got %v", err)
+	}
+	noWait.fsckMu.Unlock()
+	if err := noWait.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -15,22 +15,58 @@ type ImportedFile struct {
 // Git import functionality
 type GitImportResult struct {
 	ImportedFiles map[string][]ImportedFile
-	Errors        []error
+	// SkippedBinaryFiles lists the paths skipped because their content is binary, see GitImportOptions.SkipBinary
+	SkippedBinaryFiles []string
+	Errors             []error
 }
 
 // ImportProgressCallback is a callback function for import progress updates
 type ImportProgressCallback func(ctx context.Context, phase string, current int, total int, message string)
 
+// defaultBinaryDetectSize is the number of leading bytes checked for NUL bytes, the same as git
+const defaultBinaryDetectSize = 8000
+
+// GitImportOptions controls ImportGitRepoWithOptions
+type GitImportOptions struct {
+	// Filter skips the files for which it returns false, nil imports all files
+	Filter func(ctx context.Context, file string, timestamp time.Time) bool
+	// SkipBinary skips files whose content is binary, that is it has a NUL byte
+	// in the first BinaryDetectSize bytes. It complements the name-based Filter.
+	SkipBinary bool
+	// BinaryDetectSize is the number of leading bytes checked by SkipBinary, 0 means 8000
+	BinaryDetectSize int
+	// Progress receives progress updates, may be nil
+	Progress ImportProgressCallback
+}
+
+// isBinaryContent reports whether the first size bytes of content contain a NUL byte
+func isBinaryContent(content []byte, size int) bool {
+	if size <= 0 {
+		size = defaultBinaryDetectSize
+	}
+	if len(content) > size {
+		content = content[:size]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
 // ImportGitRepo imports a git repository into the KV system, including file history
 func ImportGitRepo(ctx context.Context, store KeyValueStore, gitdir string, filter func(ctx context.Context, file string, timestamp time.Time) bool, progressCallback ...ImportProgressCallback) (*GitImportResult, error) {
-	// Get progressCallback if provided
-	var callback ImportProgressCallback
+	opts := GitImportOptions{Filter: filter}
 	if len(progressCallback) > 0 {
-		callback = progressCallback[0]
+		opts.Progress = progressCallback[0]
 	}
+	return ImportGitRepoWithOptions(ctx, store, gitdir, opts)
+}
+
+// ImportGitRepoWithOptions is ImportGitRepo with the options in a struct
+func ImportGitRepoWithOptions(ctx context.Context, store KeyValueStore, gitdir string, opts GitImportOptions) (*GitImportResult, error) {
+	callback := opts.Progress
+	filter := opts.Filter
 	result := &GitImportResult{
 		ImportedFiles: make(map[string][]ImportedFile),
 	}
+	skippedBinary := make(map[string]bool)
 
 	// Open the git repository
 	r, err := GitPlainOpen(gitdir)
@@ -99,8 +135,8 @@ func ImportGitRepo(ctx context.Context, store KeyValueStore, gitdir string, filt
 		callback(ctx, "sorting", 0, 0, "Finished sorting commits")
 	}
 
-	// Map to track the last content of each file
-	lastContent := make(map[string][]byte)
+	// Track the last content of each file
+	dedup := NewDeduplicator()
 
 	// Iterate through all commits from oldest to newest
 	if callback != nil {
@@ -140,11 +176,20 @@ func ImportGitRepo(ctx context.Context, store KeyValueStore, gitdir string, filt
 
 			contentBytes := []byte(content)
 
+			if opts.SkipBinary && isBinaryContent(contentBytes, opts.BinaryDetectSize) {
+				if !skippedBinary[filePath] {
+					skippedBinary[filePath] = true
+					result.SkippedBinaryFiles = append(result.SkippedBinaryFiles, filePath)
+				}
+				return nil
+			}
+
 			// Check if content has changed
-			if lastBytes, ok := lastContent[filePath]; !ok || !bytes.Equal(lastBytes, contentBytes) {
+			if dedup.Add(filePath, contentBytes) {
 				// Content has changed, create history record
 				kvVersion, err := store.SetWithTimestamp(ctx, filePath, contentBytes, c.Committer.When)
 				if err != nil {
+					dedup.Forget(filePath)
 					result.Errors = append(result.Errors, errorWrap(err, filePath))
 					return nil
 				}
@@ -157,9 +202,6 @@ func ImportGitRepo(ctx context.Context, store KeyValueStore, gitdir string, filt
 
 				// Add to the result map
 				result.ImportedFiles[filePath] = append(result.ImportedFiles[filePath], importedFile)
-
-				// Update last content
-				lastContent[filePath] = contentBytes
 			}
 
 			return nil
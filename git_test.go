@@ -2,10 +2,12 @@ package filekv
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
@@ -392,3 +394,196 @@ func assertFileExistsWithContent(t *testing.T, ctx context.Context, store KeyVal
 		t.Fatalf("Expected content '%s' for file %s, got '%s'", expectedContent, path, string(content))
 	}
 }
+
+// TestImportGitRepoConcurrentRead 测试导入过程中并发读取时，读到的值一定有对应的历史记录
+func TestImportGitRepoConcurrentRead(t *testing.T) {
+	// 创建临时目录用于测试
+	tempDir, err := os.MkdirTemp("", "git-import-test-concurrent")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	repoDir := filepath.Join(tempDir, "test-repo")
+	r, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatalf("Failed to init git repo: %v", err)
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatalf("Failed to get worktree: %v", err)
+	}
+
+	commitTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		if err := os.WriteFile(filepath.Join(repoDir, "config.txt"), []byte("content "+strconv.Itoa(i)), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if _, err := wt.Add("config.txt"); err != nil {
+			t.Fatalf("Failed to add file to git: %v", err)
+		}
+		_, err = wt.Commit("commit "+strconv.Itoa(i), &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Test Author",
+				Email: "test@example.com",
+				When:  commitTime.Add(time.Duration(i) * time.Second),
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+	}
+
+	store := NewFileKVStore(filepath.Join(tempDir, "kv-store"))
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			value, err := store.Get(ctx, "config.txt")
+			if err != nil {
+				if errors.Is(err, ErrKeyNotFound) {
+					continue
+				}
+				readErr <- err
+				return
+			}
+			// 读到的值一定能在历史记录中找到
+			histories, err := store.GetHistories(ctx, "config.txt")
+			if err != nil {
+				readErr <- err
+				return
+			}
+			found := false
+			for _, h := range histories {
+				content, err := store.GetByVersion(ctx, "config.txt", h.Version)
+				if err != nil {
+					readErr <- err
+					return
+				}
+				if string(content) == string(value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				readErr <- errors.New("head '" + string(value) + "' has no history record")
+				return
+			}
+		}
+	}()
+
+	result, err := ImportGitRepo(ctx, store, repoDir, nil)
+	close(done)
+	if err != nil {
+		t.Fatalf("Failed to import git repo: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		t.Fatalf("Expected no errors, got %v", result.Errors)
+	}
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+
+	histories, err := store.GetHistories(ctx, "config.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 50 {
+		t.Fatalf("Expected 50 histories, got %d", len(histories))
+	}
+}
+
+// TestImportGitRepoSkipBinary 测试导入时跳过二进制文件
+func TestImportGitRepoSkipBinary(t *testing.T) {
+	// 创建临时目录用于测试
+	tempDir, err := ioutil.TempDir("", "git-import-test-binary")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 创建测试用的 git 仓库
+	repoDir := filepath.Join(tempDir, "test-repo")
+	r, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatalf("Failed to init git repo: %v", err)
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatalf("Failed to get worktree: %v", err)
+	}
+
+	// 小的二进制文件和文本文件，二进制文件无法用大小过滤
+	testFiles := map[string][]byte{
+		"text.txt":      []byte("plain text"),
+		"assets/ab.bin": {0x89, 'P', 'N', 'G', 0x00, 0x01},
+	}
+	for path, content := range testFiles {
+		fullPath := filepath.Join(repoDir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatalf("Failed to create file dir: %v", err)
+		}
+		if err := ioutil.WriteFile(fullPath, content, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if _, err := wt.Add(path); err != nil {
+			t.Fatalf("Failed to add file to git: %v", err)
+		}
+	}
+	_, err = wt.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Test Author",
+			Email: "test@example.com",
+			When:  nowTime(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	ctx := context.Background()
+
+	// 默认导入所有文件
+	store := NewFileKVStore(filepath.Join(tempDir, "kv-all"))
+	result, err := ImportGitRepo(ctx, store, repoDir, nil)
+	if err != nil {
+		t.Fatalf("Failed to import git repo: %v", err)
+	}
+	if len(result.ImportedFiles) != 2 || len(result.SkippedBinaryFiles) != 0 {
+		t.Fatalf("Expected 2 imported files and no skipped files, got %v, %v", result.ImportedFiles, result.SkippedBinaryFiles)
+	}
+
+	// 跳过二进制文件
+	store = NewFileKVStore(filepath.Join(tempDir, "kv-text"))
+	result, err = ImportGitRepoWithOptions(ctx, store, repoDir, GitImportOptions{SkipBinary: true})
+	if err != nil {
+		t.Fatalf("Failed to import git repo: %v", err)
+	}
+	if len(result.ImportedFiles) != 1 || len(result.ImportedFiles["text.txt"]) != 1 {
+		t.Fatalf("Expected only text.txt to be imported, got %v", result.ImportedFiles)
+	}
+	if len(result.SkippedBinaryFiles) != 1 || result.SkippedBinaryFiles[0] != "assets/ab.bin" {
+		t.Fatalf("Expected assets/ab.bin to be skipped, got %v", result.SkippedBinaryFiles)
+	}
+	assertFileExistsWithContent(t, ctx, store, "text.txt", "plain text")
+	if _, err := store.Get(ctx, "assets/ab.bin"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected assets/ab.bin not to be imported, got %v", err)
+	}
+
+	// NUL 字节在检查范围之外时不算二进制文件
+	if isBinaryContent([]byte("abc\x00"), 3) {
+		t.Fatal("Expected NUL byte beyond the detect size to be ignored")
+	}
+	if !isBinaryContent([]byte("abc\x00"), 0) {
+		t.Fatal("Expected content with NUL byte to be binary")
+	}
+}
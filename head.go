@@ -0,0 +1,116 @@
+package filekv
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+)
+
+// headMarkerName 是历史目录中记录主数据文件对应哪个版本的文件名，以 . 开头，所以遍历历史记录文件时会跳过它
+// 只有写入过比已有的版本更早的版本（如 SetWithTimestamp 使用了更早的时间戳，或者时钟回拨）之后才有这个文件，
+// 这时主数据文件不是最新的版本，而是最后写入的版本。
+// 文件中每行一个版本，第一行是最后写入的版本，第二行是写入它之前主数据文件对应的版本，
+// 第一行的版本不存在时（写入中途失败）以第二行为准。
+const headMarkerName = ".head"
+
+// newestLooseVersion 返回历史目录的默认目录中最新的版本，最新的版本总是留在默认目录中（见分页和 ArchiveKey）
+func (f *FileKVStore) newestLooseVersion(historyDir string) (string, error) {
+	entries, err := f.fsys.ReadDir(historyDir)
+	if err != nil {
+		if isNotExist(err) {
+			return "", nil
+		}
+		return "", errorWrap(err, "reading history directory")
+	}
+	newest := ""
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, metaSuffix) {
+			continue
+		}
+		if newest == "" || compareVersions(name, newest) > 0 {
+			newest = name
+		}
+	}
+	return newest, nil
+}
+
+// readHeadMarker 读取历史目录中的 .head 文件，没有时返回 nil
+func (f *FileKVStore) readHeadMarker(historyDir string) ([]string, error) {
+	data, err := f.fsys.ReadFile(filepath.Join(historyDir, headMarkerName))
+	if err != nil {
+		if isNotExist(err) {
+			return nil, nil
+		}
+		return nil, errorWrap(err, "reading head marker")
+	}
+	return parseRecentIndex(data), nil
+}
+
+// markHead 在写入新的版本 version 之前调用，必要时更新 .head 文件，返回写入成功后是否要删除它
+// 在写入历史记录之前更新，所以写入中途失败时第一行的版本不存在，读者以第二行为准
+func (f *FileKVStore) markHead(historyDir, version string) (bool, error) {
+	marker, err := f.readHeadMarker(historyDir)
+	if err != nil {
+		return false, err
+	}
+	newest, err := f.newestLooseVersion(historyDir)
+	if err != nil {
+		return false, err
+	}
+	inOrder := newest == "" || compareVersions(version, newest) >= 0
+	if inOrder && len(marker) == 0 {
+		return false, nil
+	}
+
+	prev := newest
+	if len(marker) > 0 {
+		prev = marker[0]
+	}
+	if err := f.writeFileAtomic(filepath.Join(historyDir, headMarkerName), formatRecentIndex([]string{version, prev})); err != nil {
+		return false, errorWrap(err, "writing head marker")
+	}
+	return inOrder, nil
+}
+
+// unmarkHead 在按顺序写入的最新版本成为主数据文件之后删除 .head 文件
+func (f *FileKVStore) unmarkHead(historyDir string) {
+	_ = f.fsys.Remove(filepath.Join(historyDir, headMarkerName))
+}
+
+// headVersion 返回主数据文件对应的版本，即最后写入的版本，通常就是最新的版本，
+// 写入过比已有的版本更早的版本之后以 .head 文件为准。没有历史记录时返回的错误和 GetLastVersion 相同
+func (f *FileKVStore) headVersion(ctx context.Context, key string) (*Version, error) {
+	historyDir := f.keyToHistoryPath(key)
+	histories, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(histories) == 0 {
+		return nil, f.noHistoryErr(key)
+	}
+
+	marker, err := f.readHeadMarker(historyDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range marker {
+		if i := indexOfVersion(histories, version); i >= 0 {
+			return &histories[i], nil
+		}
+	}
+	return &histories[len(histories)-1], nil
+}
+
+// readHeadVersion 返回主数据文件对应的版本和它的原始内容（变换之前的）
+func (f *FileKVStore) readHeadVersion(ctx context.Context, key string) (*Version, []byte, error) {
+	version, err := f.headVersion(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := f.newHistoryContents(f.keyToHistoryPath(key)).read(*version)
+	if err != nil {
+		return nil, nil, errorWrap(err, "reading history file of '"+key+"@"+version.Version+"'")
+	}
+	return version, content, nil
+}
@@ -0,0 +1,66 @@
+//go:build go1.23
+// +build go1.23
+
+package filekv
+
+import (
+	"context"
+	"errors"
+	"iter"
+)
+
+// errStopIteration 用于在迭代器的使用者 break 时停止遍历
+var errStopIteration = errors.New("stop iteration")
+
+// Keys 返回一个遍历所有以 prefix 开头的键的迭代器，键是在遍历目录的过程中逐个产生的，可以随时 break
+// 遍历出错时产生一个空的键和错误，然后结束
+func (f *FileKVStore) Keys(ctx context.Context, prefix string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		err := f.walkKeys(ctx, prefix, func(key string) error {
+			if !yield(key, nil) {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopIteration) {
+			yield("", err)
+		}
+	}
+}
+
+// Versions 返回一个按版本升序遍历键的所有历史记录的迭代器，元数据在遍历到对应的版本时才读取，可以随时 break
+// 出错时产生一个空的 Version 和错误，然后结束
+func (f *FileKVStore) Versions(ctx context.Context, key string) iter.Seq2[Version, error] {
+	return func(yield func(Version, error) bool) {
+		if err := f.validateKey(key); err != nil {
+			yield(Version{}, err)
+			return
+		}
+
+		historyDir := f.keyToHistoryPath(key)
+		versions, err := f.readHistories(ctx, historyDir)
+		if err != nil {
+			yield(Version{}, err)
+			return
+		}
+
+		for _, version := range versions {
+			if err := ctx.Err(); err != nil {
+				yield(Version{}, err)
+				return
+			}
+			if version.hasMeta {
+				meta, err := f.readHistoryMeta(historyDir, version)
+				if err != nil {
+					yield(Version{}, err)
+					return
+				}
+				version.Meta = meta
+				version.Pinned = isPinnedMeta(meta)
+			}
+			if !yield(version, nil) {
+				return
+			}
+		}
+	}
+}
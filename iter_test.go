@@ -0,0 +1,119 @@
+//go:build go1.23
+// +build go1.23
+
+package filekv
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileKVStore_Keys(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-keys-iter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	expected := []string{"a/1", "a/2", "a/3/x", "b/1"}
+	for _, key := range expected {
+		if _, err := store.Set(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	for key, err := range store.Keys(ctx, "a/") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) != 3 || keys[0] != "a/1" || keys[1] != "a/2" || keys[2] != "a/3/x" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	// 中途 break
+	count := 0
+	for _, err := range store.Keys(ctx, "") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Fatalf("expected to stop after 2 keys, got %d", count)
+	}
+}
+
+func TestFileKVStore_Versions(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-versions-iter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/versions"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	for i := 0; i < 5; i++ {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := store.SetMeta(ctx, key, versions[1], map[string]string{"author": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []Version
+	for version, err := range store.Versions(ctx, key) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, version)
+	}
+	if len(got) != len(versions) {
+		t.Fatalf("expected %d versions, got %d", len(versions), len(got))
+	}
+	for i := range versions {
+		if got[i].Version != versions[i] {
+			t.Fatalf("expected version %q at %d, got %q", versions[i], i, got[i].Version)
+		}
+	}
+	if got[1].Meta["author"] != "test" {
+		t.Fatalf("expected meta author=test, got %v", got[1].Meta)
+	}
+
+	// 中途 break
+	got = got[:0]
+	for version, err := range store.Versions(ctx, key) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, version)
+		if len(got) == 3 {
+			break
+		}
+	}
+	if len(got) != 3 || got[2].Version != versions[2] {
+		t.Fatalf("unexpected versions after break: %v", got)
+	}
+}
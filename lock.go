@@ -0,0 +1,85 @@
+package filekv
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyLocks 为每个键提供一个互斥锁，用于串行化同一个键上的写操作
+// 不再使用的锁会被回收，所以 map 不会无限增长
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock 锁住指定的键，返回的函数用于解锁
+func (k *keyLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyLock{}
+	}
+	l := k.locks[key]
+	if l == nil {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// lockName 返回键使用的锁的名字，设置了 WithCaseInsensitive 时只有大小写不同的键使用同一个锁，
+// 因为它们在不区分大小写的文件系统上是同一个文件
+func (f *FileKVStore) lockName(key string) string {
+	if f.caseInsensitive {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// lockKey 锁住一个键，Set、SetMeta、UpdateMeta、Delete 等修改键的方法都在它的保护下执行，返回的函数用于解锁
+func (f *FileKVStore) lockKey(key string) func() {
+	return f.locks.lock(f.lockName(key))
+}
+
+// lockKeys 按锁名的顺序锁住多个键，重复的键只锁一次，以免两个调用以相反的顺序加锁时死锁
+func (f *FileKVStore) lockKeys(keys ...string) func() {
+	names := make([]string, 0, len(keys))
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		name := f.lockName(key)
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	unlocks := make([]func(), 0, len(names))
+	for _, name := range names {
+		unlocks = append(unlocks, f.locks.lock(name))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package filekv
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileKVStore_KeyLockStress(t *testing.T) {
+	store := NewFileKVStore(t.TempDir())
+	ctx := context.Background()
+	key := "test/stress"
+
+	if _, err := store.Set(ctx, key, []byte("initial")); err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines = 8
+	const rounds = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	versions := map[string]struct{}{}
+	errCh := make(chan error, goroutines*rounds*2)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				name := strconv.Itoa(g) + "_" + strconv.Itoa(i)
+				version, err := store.Set(ctx, key, []byte("value "+name))
+				if err != nil {
+					errCh <- err
+					continue
+				}
+				mu.Lock()
+				if _, ok := versions[version]; ok {
+					t.Errorf("version %s was returned twice", version)
+				}
+				versions[version] = struct{}{}
+				mu.Unlock()
+
+				if err := store.UpdateMeta(ctx, key, "head", map[string]string{"m" + name: "1"}); err != nil {
+					errCh <- err
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	// 每次写入都产生了自己的历史记录，当前值和最新的历史记录一致
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != goroutines*rounds+1 {
+		t.Fatalf("expected %d histories, got %d", goroutines*rounds+1, len(histories))
+	}
+	if _, err := store.GetConsistent(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有丢失元数据
+	metaCount := 0
+	for _, h := range histories {
+		metaCount += len(h.Meta)
+	}
+	if metaCount != goroutines*rounds {
+		t.Errorf("expected %d meta entries, got %d", goroutines*rounds, metaCount)
+	}
+}
+
+func TestFileKVStore_LockCaseInsensitive(t *testing.T) {
+	store := NewFileKVStore(t.TempDir(), WithCaseInsensitive(true))
+
+	// 只有大小写不同的键只锁一次，不会死锁
+	unlock := store.lockKeys("Config", "config")
+
+	locked := make(chan struct{})
+	go func() {
+		unlock := store.lockKey("CONFIG")
+		close(locked)
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected keys differing only by case to share a lock")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
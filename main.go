@@ -5,12 +5,17 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cabify/timex"
@@ -20,7 +25,13 @@ type Version struct {
 	Name    string
 	Version string
 	Meta    map[string]string
+	// Pinned 表示该版本已被固定，清理历史记录时不会删除它
+	Pinned bool
+	// Size 是该版本内容的字节数，只有 GetHistoriesWithSizes 会填写它，其它方法返回的总是 0
+	Size    int64
 	hasMeta bool
+	// archived 表示该版本在 ArchiveKey 生成的归档文件中，Name 不是一个文件
+	archived bool
 }
 
 // KeyValueStore 是键值存储接口
@@ -36,6 +47,7 @@ type KeyValueStore interface {
 	// ctx: 上下文，用于取消或超时控制
 	// key: 键名
 	// version: 版本号，当为 "head" 时表示获取最新版本
+	// 键（包括它的历史记录）不存在时返回 ErrKeyNotFound，键存在但版本不存在时返回 ErrVersionNotFound
 	GetByVersion(ctx context.Context, key string, version string) ([]byte, error)
 
 	// Set 设置键的值，同时创建历史记录
@@ -128,7 +140,7 @@ type KeyValueStore interface {
 	// Fsck 文件系统检查，修复不一致状态
 	// ctx: 上下文，用于取消或超时控制
 	// 实现以下功能：
-	// 1: 当历史记录超过 200 个时，组织成子目录结构，按时间分页存储
+	// 1: 当历史记录超过 WithMaxHistoryCount 设置的个数（默认 200）时，组织成子目录结构，按时间分页存储
 	// 2: 删除不存在键对应的历史记录
 	// 3: 确保每个存在的键都有对应的历史记录，如果没有则从当前值创建
 	Fsck(ctx context.Context) error
@@ -136,10 +148,18 @@ type KeyValueStore interface {
 
 const (
 	metaSuffix       = ".meta"
+	keyMetaSuffix    = ".keymeta"
 	historyDirSuffix = ".h"
 	historyDirConst  = ".history"
 	pagePrefix       = "p_"
-	maxHistoryCount  = 200
+	tempPagePrefix   = ".tmp_"
+	tempFileSuffix   = ".tmp"
+	// defaultMaxHistoryCount 是每一页历史记录的默认个数，见 WithMaxHistoryCount
+	defaultMaxHistoryCount = 200
+	// defaultDirPerm 和 defaultFilePerm 是创建目录和文件时默认的权限，见 WithDirPerm 和 WithFilePerm
+	defaultDirPerm  = 0755
+	defaultFilePerm = 0644
+	counterWidth    = 4
 )
 
 type wrapErr struct {
@@ -162,27 +182,363 @@ func errorWrap(err error, msg string) error {
 	return &wrapErr{err: err, msg: msg}
 }
 
+// notFoundError 是 “不存在” 类的错误，它同时匹配 fs.ErrNotExist，
+// 所以 errors.Is(err, os.ErrNotExist) 的判断依然有效
+type notFoundError struct {
+	msg string
+}
+
+func (e *notFoundError) Error() string {
+	return e.msg
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return target == fs.ErrNotExist
+}
+
+var (
+	// ErrKeyNotFound 键不存在
+	ErrKeyNotFound error = &notFoundError{msg: "key not found"}
+	// ErrVersionNotFound 版本（历史记录）不存在
+	ErrVersionNotFound error = &notFoundError{msg: "version not found"}
+	// ErrInvalidKey 键名不合法
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrKeyIsNamespace 键是一个目录（有子键），不是一个值
+	ErrKeyIsNamespace = errors.New("key is a namespace")
+	// ErrKeyHasChildren 是 ErrKeyIsNamespace 的别名，如删除有子键的键时返回
+	ErrKeyHasChildren = ErrKeyIsNamespace
+	// ErrReadOnly 存储是只读的
+	ErrReadOnly = errors.New("store is read-only")
+	// ErrBusy 键正在被使用，操作等待超时
+	ErrBusy = errors.New("key is busy")
+	// ErrEmptyVersions Fsck 发现了内容为空的历史记录，通过 WithFsckWarningFunc 报告，详见 FindEmptyVersions
+	ErrEmptyVersions = errors.New("found empty versions")
+	// ErrCaseCollision 键名只有大小写不同，无法确定历史记录属于哪个键
+	ErrCaseCollision = errors.New("keys differ only by case")
+	// ErrVersionExists 设置了 WithNoCollisionSuffix 时，时间戳对应的历史记录已经存在
+	ErrVersionExists = errors.New("version already exists")
+	// ErrInconsistentHead 键的当前值和最新的历史记录不一致，见 GetConsistent
+	ErrInconsistentHead = errors.New("head is inconsistent with the latest history")
+	// ErrRateLimited 键的写入次数超过了 WithRateLimit 设置的限制
+	ErrRateLimited = errors.New("key write rate limited")
+	// ErrClockRegression 系统时钟回拨，当前时间早于键的上一个版本，见 WithClockRegression
+	ErrClockRegression = errors.New("clock regression")
+	// ErrFsckInProgress 设置了 WithFsckNoWait 时，已经有 Fsck 在执行
+	ErrFsckInProgress = errors.New("fsck is already in progress")
+	// ErrKeyConflict 写入的键和已有的键冲突：一个路径不能既是值又是命名空间，
+	// 如 "a" 是一个值时不能写入 "a/b"，"a/b" 存在时不能写入 "a"（这时错误同时匹配 ErrKeyIsNamespace）
+	ErrKeyConflict = errors.New("key conflicts with an existing key")
+	// ErrKeyExists 目标键已经存在，见 Rename
+	ErrKeyExists = errors.New("key already exists")
+	// ErrRenameLoop 改名标记形成了环，见 GetRenameChain
+	ErrRenameLoop = errors.New("rename markers form a loop")
+	// ErrVersionMismatch 键的最新版本和 CompareAndSwap 期望的版本不同
+	ErrVersionMismatch = errors.New("version mismatch")
+	// ErrQuotaExceeded 写入会使存储占用的空间超过 WithMaxStoreBytes 设置的限额
+	ErrQuotaExceeded = errors.New("store quota exceeded")
+)
+
+// keyConflictError 是键和命名空间冲突的错误，它同时匹配 ErrKeyConflict 和它包装的错误
+type keyConflictError struct {
+	msg string
+	err error
+}
+
+func (e *keyConflictError) Error() string {
+	return e.msg
+}
+
+func (e *keyConflictError) Is(target error) bool {
+	return target == ErrKeyConflict
+}
+
+func (e *keyConflictError) Unwrap() error {
+	return e.err
+}
+
+// missingKeyError 是键和它的历史记录都不存在时，GetLastVersion 等版本相关的方法返回的错误
+// 它包装了 ErrKeyNotFound，同时为了兼容之前的调用者也匹配 ErrVersionNotFound
+type missingKeyError struct {
+	msg string
+}
+
+func (e *missingKeyError) Error() string {
+	return e.msg + ": " + ErrKeyNotFound.Error()
+}
+
+func (e *missingKeyError) Is(target error) bool {
+	return target == ErrVersionNotFound
+}
+
+func (e *missingKeyError) Unwrap() error {
+	return ErrKeyNotFound
+}
+
+// noHistoryErr 返回键没有任何历史记录时的错误，键本身也不存在时返回 missingKeyError
+func (f *FileKVStore) noHistoryErr(key string) error {
+	msg := "no history found for key '" + key + "'"
+	if _, err := f.fsys.Stat(f.keyToPath(key)); err != nil && isNotExist(err) {
+		return &missingKeyError{msg: msg}
+	}
+	return errorWrap(ErrVersionNotFound, msg)
+}
+
+// isNotExist 判断错误是否表示文件不存在，父路径是文件时（ENOTDIR）也视为不存在
+func isNotExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
 type FileKVStore struct {
 	rootDir       string
+	fsys          FS
+	readOnly      bool
 	ignoreWarning bool
 	compareFunc   func(a, b []byte) bool
+
+	touchOnUnchanged         bool
+	normalizeTrailingNewline bool
+	recentIndexSize          int
+	caseInsensitive          bool
+	noCollisionSuffix        bool
+	restoreHeadOnFsck        bool
+	linkHistory              bool
+	skipInvalidKeys          bool
+	treatEmptyAsAbsent       bool
+	fsckConcurrency          int
+	fsckMaxOpenDirs          int
+	fsckNoWait               bool
+	fsckWarningFunc          func(warning error)
+	followRenames            bool
+	maxHistoryCount          int
+	dirPerm                  fs.FileMode
+	filePerm                 fs.FileMode
+	keyCodec                 KeyCodec
+	transform                Transformer
+
+	rateLimiter               keyRateLimiter
+	clock                     keyClock
+	rateLimitExemptTimestamps bool
+	quota                     storeQuota
+
+	tempDir         string
+	tempSeq         atomic.Uint64
+	tempDirCrossDev atomic.Bool
+
+	defaultMeta     map[string]string
+	defaultMetaFunc func(ctx context.Context) map[string]string
+
+	locks         keyLocks
+	refs          keyRefs
+	pages         pageCache
+	deleteTimeout time.Duration
+
+	fsckMu sync.Mutex
+
+	bgMu sync.Mutex
+	bg   *backgroundLoop
 }
 
-func WithIgnoreWarning(value bool) func(*FileKVStore) {
+var _ KeyValueStore = (*FileKVStore)(nil)
+
+// Option 是 NewFileKVStore 的选项，用于修改 FileKVStore 的默认行为
+type Option = func(*FileKVStore)
+
+// WithIgnoreWarning 设置把非致命的错误当作警告，默认返回这些错误
+// 如 Fsck 处理某个键出错时继续处理其它的键，写入时无法创建历史记录目录时只写入值
+func WithIgnoreWarning(value bool) Option {
 	return func(s *FileKVStore) {
 		s.ignoreWarning = value
 	}
 }
 
-func WithCompareFunc(fn func(a, b []byte) bool) func(*FileKVStore) {
+func WithCompareFunc(fn func(a, b []byte) bool) Option {
 	return func(s *FileKVStore) {
 		s.compareFunc = fn
 	}
 }
 
-func NewFileKVStore(rootDir string, opts ...func(*FileKVStore)) *FileKVStore {
+// WithTouchOnUnchanged 设置 Set 的值没有变化时是否更新主数据文件的修改时间（不产生历史记录），
+// 用于让监视文件修改时间的程序知道值被重新发布了，默认不更新
+func WithTouchOnUnchanged(value bool) Option {
+	return func(s *FileKVStore) {
+		s.touchOnUnchanged = value
+	}
+}
+
+// WithNormalizeTrailingNewline 设置 Set 是否把文本值的结尾规范化为正好一个换行符，默认不规范化
+// 打开后，比较和保存之前会去掉值末尾所有的换行符再加上一个，原来以 "\r\n" 结尾的值加上 "\r\n"，
+// 用于避免不同的工具对末尾换行的处理不同而产生无意义的历史记录。
+// 包含 NUL 字节的值被认为是二进制数据，空值也不是文本，它们都保持不变。
+func WithNormalizeTrailingNewline(value bool) Option {
+	return func(s *FileKVStore) {
+		s.normalizeTrailingNewline = value
+	}
+}
+
+// WithCaseInsensitive 设置键名是否不区分大小写，默认区分
+// 打开后，Fsck 在判断历史记录是否孤立时会忽略大小写去匹配主数据文件，
+// 用于数据目录在不区分大小写的文件系统之间复制或迁移的情况。
+func WithCaseInsensitive(value bool) Option {
+	return func(s *FileKVStore) {
+		s.caseInsensitive = value
+	}
+}
+
+// WithNoCollisionSuffix 设置时间戳对应的历史记录已经存在时，不再加 _N 后缀生成新的版本号，
+// 而是直接返回 ErrVersionExists，由调用者决定如何处理，默认加后缀
+// 适合自己保证时间戳不重复的导入程序，可以省掉查找可用后缀的开销
+func WithNoCollisionSuffix(value bool) Option {
+	return func(s *FileKVStore) {
+		s.noCollisionSuffix = value
+	}
+}
+
+// WithRestoreHeadOnFsck 设置 Fsck 遇到有历史记录但主数据文件不存在的键时，
+// 是否用 RestoreHead 从最新的历史记录恢复主数据文件，而不是把历史记录当作孤立的记录删除，默认删除
+// 注意打开后，用 Delete(key, false) 删除但保留了历史记录的键也会被恢复
+func WithRestoreHeadOnFsck(value bool) Option {
+	return func(s *FileKVStore) {
+		s.restoreHeadOnFsck = value
+	}
+}
+
+// WithLinkHistory 设置 Set 是否只写一次值，再用硬链接生成历史记录，默认分别写入主数据文件和历史记录
+// 打开后值先写入临时文件，硬链接为历史记录后再改名为主数据文件，避免在网络文件系统上重复写入相同的内容。
+// FS 没有实现 LinkFS 或者创建硬链接失败（如文件系统不支持）时退回到分别写入。
+// 注意主数据文件和最新的历史记录是同一个文件，修改主数据文件的修改时间（见 WithTouchOnUnchanged）也会修改历史记录的。
+func WithLinkHistory(value bool) Option {
+	return func(s *FileKVStore) {
+		s.linkHistory = value
+	}
+}
+
+// WithSkipInvalidKeys 设置 ListKeys 等列出键的方法是否跳过不能通过键名检查的文件，默认列出它们
+// 不论是否设置，都可以用 ListInvalidKeys 找出这些文件
+func WithSkipInvalidKeys(value bool) Option {
+	return func(s *FileKVStore) {
+		s.skipInvalidKeys = value
+	}
+}
+
+// WithTreatEmptyAsAbsent 设置是否把内容为空的值当作已删除（墓碑），这时 Get 返回 ErrKeyNotFound，Exists 返回 false
+// 默认空值是一个合法的值。它只影响这两个方法，历史记录依然保留空值的版本。
+func WithTreatEmptyAsAbsent(value bool) Option {
+	return func(s *FileKVStore) {
+		s.treatEmptyAsAbsent = value
+	}
+}
+
+// WithFsckConcurrency 设置 Fsck 整理历史记录和补全历史记录时最多同时处理的键的个数，默认为 1，即逐个处理
+// 每个键的整理是相互独立的，键很多时并发处理可以加快 Fsck。删除孤立历史记录的阶段总是逐个处理。
+func WithFsckConcurrency(n int) Option {
+	return func(s *FileKVStore) {
+		s.fsckConcurrency = n
+	}
+}
+
+// WithFsckMaxOpenDirs 设置 Fsck 整理和补全历史记录时最多同时处理（打开）的历史目录的个数，默认为 0，即不限制
+// 和 WithFsckConcurrency 一起使用，键很多的存储在内存或打开文件数受限的系统上并发执行时，可以用它避免 EMFILE
+func WithFsckMaxOpenDirs(n int) Option {
+	return func(s *FileKVStore) {
+		s.fsckMaxOpenDirs = n
+	}
+}
+
+// WithFsckNoWait 设置已经有 Fsck 在执行时，新的 Fsck 立即返回 ErrFsckInProgress，默认等待前一个 Fsck 完成
+// 这只对同一个 FileKVStore 实例有效，多个实例（或多个进程）操作同一个目录时不会互相等待
+func WithFsckNoWait(value bool) Option {
+	return func(s *FileKVStore) {
+		s.fsckNoWait = value
+	}
+}
+
+// WithFsckWarningFunc 设置 Fsck 和 FsckIncremental 报告只能报告、不能自动修复的问题的函数，如内容为空的历史记录（ErrEmptyVersions）
+// 这些问题不会让 Fsck 返回错误，所以不会让定期执行的 Fsck 一直失败。默认不检查这些问题。
+func WithFsckWarningFunc(fn func(warning error)) Option {
+	return func(s *FileKVStore) {
+		s.fsckWarningFunc = fn
+	}
+}
+
+// WithMaxHistoryCount 设置默认目录中的历史记录达到多少个时分页，同时也是每一页的历史记录个数，默认为 200
+// 历史记录很多时较小的分页可以加快读取目录。n 小于 1 时使用默认值。
+// 修改后已有的分页不会自动调整，Compact 会按新的个数合并多余的分页。
+func WithMaxHistoryCount(n int) Option {
+	return func(s *FileKVStore) {
+		if n < 1 {
+			n = defaultMaxHistoryCount
+		}
+		s.maxHistoryCount = n
+	}
+}
+
+// WithDirPerm 设置创建目录（包括历史记录目录和分页目录）时的权限，默认为 0755，实际的权限还受 umask 影响
+func WithDirPerm(perm os.FileMode) Option {
+	return func(s *FileKVStore) {
+		s.dirPerm = perm
+	}
+}
+
+// WithFilePerm 设置创建文件（包括数据文件、历史记录和元数据文件）时的权限，默认为 0644，实际的权限还受 umask 影响
+// 已经存在的文件被原子地替换时也会使用这个权限
+func WithFilePerm(perm os.FileMode) Option {
+	return func(s *FileKVStore) {
+		s.filePerm = perm
+	}
+}
+
+// WithTempDir 设置原子写入时临时文件所在的目录，默认临时文件和目标文件放在同一个目录中
+// 原子写入是先写临时文件再 rename 到目标文件，rename 只有在同一个文件系统中才是原子的，
+// 所以 dir 必须和数据目录在同一个文件系统中：rename 因为跨文件系统而失败时，之后的写入退回到同目录的临时文件。
+// dir 不能是数据目录下的普通目录，否则其中的临时文件会被当作键列出。
+func WithTempDir(dir string) Option {
+	return func(s *FileKVStore) {
+		s.tempDir = dir
+	}
+}
+
+// normalizeValue 根据 WithNormalizeTrailingNewline 规范化值，不修改 value 本身
+func (f *FileKVStore) normalizeValue(value []byte) []byte {
+	if !f.normalizeTrailingNewline || len(value) == 0 || bytes.IndexByte(value, 0) >= 0 {
+		return value
+	}
+	newline := "\n"
+	if bytes.HasSuffix(value, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	trimmed := bytes.TrimRight(value, "\r\n")
+	if len(trimmed)+len(newline) == len(value) && bytes.HasSuffix(value, []byte(newline)) {
+		return value
+	}
+	result := make([]byte, 0, len(trimmed)+len(newline))
+	result = append(result, trimmed...)
+	return append(result, newline...)
+}
+
+// WithDefaultMeta 设置每个新的历史记录都会自动带上的元数据
+func WithDefaultMeta(meta map[string]string) Option {
+	return func(s *FileKVStore) {
+		s.defaultMeta = meta
+	}
+}
+
+// WithDefaultMetaFunc 设置一个动态生成默认元数据的函数，它的结果会覆盖 WithDefaultMeta 中的同名项
+// 它在每次产生新的历史记录时以调用者的 ctx 调用，例如从 ctx 中取出当前用户记录为 author，
+// 这样不用在每次调用时显式地传入元数据
+func WithDefaultMetaFunc(fn func(ctx context.Context) map[string]string) Option {
+	return func(s *FileKVStore) {
+		s.defaultMetaFunc = fn
+	}
+}
+
+func NewFileKVStore(rootDir string, opts ...Option) *FileKVStore {
 	s := &FileKVStore{
-		rootDir: rootDir,
+		rootDir:         rootDir,
+		fsys:            osFS{},
+		deleteTimeout:   defaultDeleteTimeout,
+		maxHistoryCount: defaultMaxHistoryCount,
+		dirPerm:         defaultDirPerm,
+		filePerm:        defaultFilePerm,
 	}
 	for _, opt := range opts {
 		opt(s)
@@ -192,10 +548,13 @@ func NewFileKVStore(rootDir string, opts ...func(*FileKVStore)) *FileKVStore {
 
 func (f *FileKVStore) validateKey(key string) error {
 	if key == "" {
-		return errors.New("invalid key: must not empty")
+		return errorWrap(ErrInvalidKey, "key must not be empty")
 	}
 	if strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
-		return errors.New("invalid key: must not start with '/' or contain '\\'")
+		return errorWrap(ErrInvalidKey, "key '"+key+"' must not start with '/' or contain '\\'")
+	}
+	if strings.HasSuffix(key, keyMetaSuffix) || strings.HasSuffix(key, recentSuffix) || strings.HasSuffix(key, movedSuffix) {
+		return errorWrap(ErrInvalidKey, "key '"+key+"' must not end with '"+keyMetaSuffix+"', '"+recentSuffix+"' or '"+movedSuffix+"'")
 	}
 
 	parts := strings.Split(key, "/")
@@ -206,13 +565,16 @@ func (f *FileKVStore) validateKey(key string) error {
 		if strings.HasPrefix(part, ".") ||
 			strings.HasPrefix(part, pagePrefix) ||
 			strings.HasSuffix(part, historyDirSuffix) {
-			return errors.New("invalid key part: '" + part + "' cannot start with '.' or 'p_' or end with '.h'")
+			return errorWrap(ErrInvalidKey, "key part '"+part+"' cannot start with '.' or 'p_' or end with '.h'")
 		}
 	}
 	return nil
 }
 
 func (f *FileKVStore) keyToPath(key string) string {
+	if f.keyCodec != nil {
+		key = f.keyCodec.EncodeKey(key)
+	}
 	return filepath.Join(f.rootDir, key)
 }
 
@@ -221,7 +583,7 @@ func (f *FileKVStore) keyToHistoryPath(key string) string {
 }
 
 func (f *FileKVStore) readProperties(filePath string) (map[string]string, error) {
-	data, err := os.ReadFile(filePath)
+	data, err := f.fsys.ReadFile(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -259,7 +621,7 @@ func (f *FileKVStore) writeProperties(filePath string, props map[string]string)
 	}
 
 	// Try to write the file directly
-	err := os.WriteFile(filePath, buf.Bytes(), 0644)
+	err := f.fsys.WriteFile(filePath, buf.Bytes(), f.filePerm)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return errorWrap(err, "writing meta file")
@@ -267,11 +629,11 @@ func (f *FileKVStore) writeProperties(filePath string, props map[string]string)
 
 		// Directory doesn't exist, create it and retry
 		dir := filepath.Dir(filePath)
-		if mkdirErr := os.MkdirAll(dir, 0755); mkdirErr != nil {
+		if mkdirErr := f.fsys.MkdirAll(dir, f.dirPerm); mkdirErr != nil {
 			return errorWrap(mkdirErr, "creating directory")
 		}
 		// Retry writing the file after creating the directory
-		err = os.WriteFile(filePath, buf.Bytes(), 0644)
+		err = f.fsys.WriteFile(filePath, buf.Bytes(), f.filePerm)
 		if err != nil {
 			return errorWrap(err, "writing meta file")
 		}
@@ -279,239 +641,983 @@ func (f *FileKVStore) writeProperties(filePath string, props map[string]string)
 	return nil
 }
 
-func (f *FileKVStore) Get(ctx context.Context, key string) ([]byte, error) {
-	if err := f.validateKey(key); err != nil {
-		return nil, err
+// writeFileAtomic 先写入同目录下的临时文件再改名，这样读者不会读到只写了一部分的文件
+// 临时文件以 '.' 开头，不会被当作键或历史记录；返回的错误和 WriteFile 一样不做包装
+func (f *FileKVStore) writeFileAtomic(filePath string, data []byte) error {
+	if f.tempDir != "" && !f.tempDirCrossDev.Load() {
+		if done, err := f.writeFileAtomicInTempDir(filePath, data); done {
+			return err
+		}
 	}
 
-	dataFile := f.keyToPath(key)
-	data, err := os.ReadFile(dataFile)
-	if err != nil {
-		return nil, errorWrap(err, "reading file")
+	tempFile := siblingTempFile(filePath)
+	if err := f.fsys.WriteFile(tempFile, data, f.filePerm); err != nil {
+		// 写了一半的临时文件没有用了，目标文件还是原来的内容
+		_ = f.fsys.Remove(tempFile)
+		return err
 	}
-	return data, nil
+	if err := f.fsys.Rename(tempFile, filePath); err != nil {
+		_ = f.fsys.Remove(tempFile)
+		return err
+	}
+	return nil
 }
 
-func (f *FileKVStore) searchVersionInSubDirs(ctx context.Context, historyDir string, version string, isExist func(versionFile string) error) (string, error) {
-	entries, err := os.ReadDir(historyDir)
-	if err != nil {
-		return "", errorWrap(err, "reading history directory")
+// siblingTempFile 返回和 filePath 在同一个目录中的临时文件名 .<name>.<pid>.tmp
+// 同一个进程内写同一个文件时有键的锁保护，带上进程号以免多个进程同时写同一个键时使用同一个临时文件
+func siblingTempFile(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+"."+strconv.Itoa(os.Getpid())+tempFileSuffix)
+}
+
+// writeFileAtomicInTempDir 在 WithTempDir 设置的目录中写临时文件再 rename 到 filePath
+// 临时目录不可用或者和 filePath 不在同一个文件系统中时返回 false，由调用者退回到同目录的临时文件
+func (f *FileKVStore) writeFileAtomicInTempDir(filePath string, data []byte) (bool, error) {
+	tempFile := filepath.Join(f.tempDir, "."+strconv.Itoa(os.Getpid())+"_"+strconv.FormatUint(f.tempSeq.Add(1), 10)+tempFileSuffix)
+	if err := f.fsys.WriteFile(tempFile, data, f.filePerm); err != nil {
+		_ = f.fsys.Remove(tempFile)
+		return false, nil
+	}
+	err := f.fsys.Rename(tempFile, filePath)
+	if err == nil {
+		return true, nil
+	}
+	_ = f.fsys.Remove(tempFile)
+	if errors.Is(err, syscall.EXDEV) {
+		f.tempDirCrossDev.Store(true)
+		return false, nil
 	}
+	return true, err
+}
 
-	var errList []error
-	for _, entry := range entries {
-		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), pagePrefix) {
-			continue
+// writeFileAtomicWithDir 和 writeFileAtomic 相同，当目录不存在时先创建目录再重试
+// 主数据文件可能是历史记录的硬链接（见 WithLinkHistory），所以不能原地重写，必须用它替换
+func (f *FileKVStore) writeFileAtomicWithDir(filePath string, data []byte) error {
+	return f.retryWithDir(filepath.Dir(filePath), func() error {
+		return f.writeFileAtomic(filePath, data)
+	})
+}
+
+// writeFileWithDir 写文件，当目录不存在时先创建目录再重试
+func (f *FileKVStore) writeFileWithDir(filePath string, data []byte) error {
+	return f.retryWithDir(filepath.Dir(filePath), func() error {
+		return f.fsys.WriteFile(filePath, data, f.filePerm)
+	})
+}
+
+// maxDirRetries 是写文件时因为目录不存在而创建目录并重试的最多次数
+// 目录可能在创建之后、写入之前又被并发地删除（如删除同一目录下的最后一个键），所以不止重试一次
+const maxDirRetries = 2
+
+// retryWithDir 执行 write，当它因为目录不存在而失败时，创建 dir 并重试
+func (f *FileKVStore) retryWithDir(dir string, write func() error) error {
+	err := write()
+	for retries := 0; err != nil && os.IsNotExist(err) && retries < maxDirRetries; retries++ {
+		if mkdirErr := f.fsys.MkdirAll(dir, f.dirPerm); mkdirErr != nil {
+			return errorWrap(mkdirErr, "creating directory")
 		}
+		err = write()
+	}
+	return err
+}
 
-		subdirPath := filepath.Join(historyDir, entry.Name())
-		versionFile := filepath.Join(subdirPath, version)
+// sampleSize 是 isValueChanged 比较大文件时抽样的头部和尾部的长度
+const sampleSize = 4096
 
-		err := isExist(versionFile)
-		if err == nil {
-			return versionFile, nil
+// isValueChanged 检查文件中的值和 value 是否不同
+// 没有设置 compareFunc 时，先比较长度，再比较头部和尾部的抽样，都相同时才读取整个文件比较，
+// 以免值很大时为了比较而读取整个文件
+func (f *FileKVStore) isValueChanged(key, dataFile string, value []byte) (bool, error) {
+	if f.compareFunc == nil && f.transform == nil {
+		st, err := f.fsys.Stat(dataFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return true, nil
+			}
+			return false, err
 		}
-		if !os.IsNotExist(err) {
-			errList = append(errList, err)
+		if !st.IsDir() {
+			if st.Size() != int64(len(value)) {
+				return true, nil
+			}
+			if len(value) > 2*sampleSize {
+				same, err := f.isSampleSame(dataFile, value)
+				if err != nil {
+					return false, err
+				}
+				if !same {
+					return true, nil
+				}
+			}
 		}
 	}
-	if len(errList) == 0 {
-		return "", os.ErrNotExist
+
+	existingValue, err := f.fsys.ReadFile(dataFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
 	}
-	if len(errList) == 1 {
-		return "", errList[0]
+	existingValue, err = f.decodeValue(key, existingValue)
+	if err != nil {
+		return false, err
 	}
-	return "", errors.Join(errList...)
+	return !f.isSameValue(existingValue, value), nil
 }
 
-func isHeadRevision(revision string) bool {
-	return revision == "" || revision == "head" || revision == "HEAD" || revision == "Head"
+// isSampleSame 比较文件和 value 的头部和尾部，文件不支持随机读取时返回 true
+func (f *FileKVStore) isSampleSame(dataFile string, value []byte) (bool, error) {
+	file, err := f.fsys.Open(dataFile)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	r, ok := file.(io.ReaderAt)
+	if !ok {
+		return true, nil
+	}
+
+	buf := make([]byte, sampleSize)
+	for _, off := range []int{0, len(value) - sampleSize} {
+		if _, err := r.ReadAt(buf, int64(off)); err != nil {
+			if err == io.EOF {
+				// 文件在 Stat 之后被修改了
+				return false, nil
+			}
+			return false, err
+		}
+		if !bytes.Equal(buf, value[off:off+sampleSize]) {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
-func (f *FileKVStore) GetByVersion(ctx context.Context, key string, version string) ([]byte, error) {
-	if isHeadRevision(version) {
-		return f.Get(ctx, key)
+// isSameValue 比较两个值是否相等，优先使用 compareFunc
+func (f *FileKVStore) isSameValue(a, b []byte) bool {
+	if f.compareFunc != nil {
+		return f.compareFunc(a, b)
 	}
+	return bytes.Equal(a, b)
+}
 
+func (f *FileKVStore) Get(ctx context.Context, key string) ([]byte, error) {
 	if err := f.validateKey(key); err != nil {
 		return nil, err
 	}
-	historyDir := f.keyToHistoryPath(key)
-
-	// First check default directory
-	defaultPath := filepath.Join(historyDir, version)
-	data, err := os.ReadFile(defaultPath)
-	if err == nil {
-		return data, nil
-	}
-	if !os.IsNotExist(err) {
-		return nil, errorWrap(err, "reading history")
+	key, err := f.followRename(ctx, key)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = f.searchVersionInSubDirs(ctx, historyDir, version, func(versionFile string) error {
-		data, err = os.ReadFile(versionFile)
-		return err
-	})
+	release := f.refs.acquire(key)
+	defer release()
+
+	dataFile := f.keyToPath(key)
+	data, err := f.fsys.ReadFile(dataFile)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, errors.New("version '" + version + "' not found for key '" + key + "'")
-		}
-		return nil, errorWrap(err, "reading history")
+		return nil, f.wrapKeyErr(err, key, "reading key")
+	}
+	data, err = f.decodeValue(key, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 && f.treatEmptyAsAbsent {
+		return nil, errorWrap(ErrKeyNotFound, "reading key '"+key+"': value is empty")
 	}
 	return data, nil
 }
 
-func (f *FileKVStore) Set(ctx context.Context, key string, value []byte) (string, error) {
-	return f.SetWithTimestamp(ctx, key, value, timex.Now())
-}
-
-func (f *FileKVStore) SetWithTimestamp(ctx context.Context, key string, value []byte, timestamp time.Time) (string, error) {
+// GetConsistent 和 Get 相同，但是会检查当前值和最后写入的历史记录是否一致，不一致时返回 ErrInconsistentHead
+// Set 先写历史记录再写主数据文件，中途失败或主数据文件被外部修改时两者会不一致，
+// 这时可以用 RestoreHead 修复。没有历史记录时不检查。
+// 最后写入的历史记录通常就是最新的，用 SetWithTimestamp 写入了更早的时间戳之后则是那个更早的版本。
+func (f *FileKVStore) GetConsistent(ctx context.Context, key string) ([]byte, error) {
 	if err := f.validateKey(key); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	dataFile := f.keyToPath(key)
+	// 和写入互斥，以免读到写了一半的结果
+	unlock := f.lockKey(key)
+	defer unlock()
 
-	// Read existing value to compare
-	existingValue, err := os.ReadFile(dataFile)
-	if err != nil && !os.IsNotExist(err) {
-		return "", errorWrap(err, "reading file for comparison")
+	data, err := f.Get(ctx, key)
+	if err != nil {
+		return nil, err
 	}
 
-	// If value is the same, don't create new history
-	if f.compareFunc != nil {
-		if f.compareFunc(existingValue, value) {
-			return "", nil
+	// 和最后写入的版本比较，它通常就是最新的版本，但是写入过更早的时间戳之后不是
+	lastVersion, historyData, err := f.readHeadVersion(ctx, key)
+	if err != nil {
+		if errors.Is(err, ErrVersionNotFound) {
+			return data, nil
 		}
-	} else if bytes.Equal(existingValue, value) {
-		return "", nil
+		return nil, err
 	}
-
-	// Create history record
-	timestampStr := strconv.FormatInt(timestamp.UnixNano(), 10)
-	historyDir := f.keyToHistoryPath(key)
-	historyFile := filepath.Join(historyDir, timestampStr)
-
-	// Write new value
-	err = os.WriteFile(dataFile, value, 0644)
+	historyData, err = f.decodeValue(key, historyData)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return "", errorWrap(err, "writing file")
-		}
+		return nil, err
+	}
+	if !bytes.Equal(data, historyData) {
+		return nil, errorWrap(ErrInconsistentHead, "value of '"+key+"' differs from version '"+lastVersion.Version+"'")
+	}
+	return data, nil
+}
 
-		// Directory doesn't exist, create it and retry
-		if mkdirErr := os.MkdirAll(filepath.Dir(dataFile), 0755); mkdirErr != nil {
-			return "", errorWrap(mkdirErr, "creating directory")
-		}
+// Equal 比较两个键的当前值是否相同，任何一个键不存在时返回 ErrKeyNotFound
+// 没有设置 WithCompareFunc 和 WithTransform 时先比较长度，长度相同时再按块逐段比较两个文件，不会把整个值读入内存；
+// 设置了时读取两个值，变换为逻辑内容后再比较（设置了 WithCompareFunc 时用它比较）。
+func (f *FileKVStore) Equal(ctx context.Context, keyA, keyB string) (bool, error) {
+	if err := f.validateKey(keyA); err != nil {
+		return false, err
+	}
+	if err := f.validateKey(keyB); err != nil {
+		return false, err
+	}
+
+	releaseA := f.refs.acquire(keyA)
+	defer releaseA()
+	if keyB != keyA {
+		// 同一个键只能加一次读锁，否则有 Delete 在等待时第二次会一直等下去
+		releaseB := f.refs.acquire(keyB)
+		defer releaseB()
+	}
+
+	if f.compareFunc != nil || f.transform != nil {
+		a, err := f.readValue(keyA)
+		if err != nil {
+			return false, err
+		}
+		b, err := f.readValue(keyB)
+		if err != nil {
+			return false, err
+		}
+		return f.isSameValue(a, b), nil
+	}
+
+	var sizes [2]int64
+	for i, key := range []string{keyA, keyB} {
+		st, err := f.fsys.Stat(f.keyToPath(key))
+		if err != nil {
+			return false, f.wrapKeyErr(err, key, "checking key")
+		}
+		if st.IsDir() {
+			return false, errorWrap(ErrKeyIsNamespace, "checking key '"+key+"'")
+		}
+		sizes[i] = st.Size()
+	}
+	if sizes[0] != sizes[1] {
+		return false, nil
+	}
+
+	fileA, err := f.fsys.Open(f.keyToPath(keyA))
+	if err != nil {
+		return false, f.wrapKeyErr(err, keyA, "opening key")
+	}
+	defer fileA.Close()
+	fileB, err := f.fsys.Open(f.keyToPath(keyB))
+	if err != nil {
+		return false, f.wrapKeyErr(err, keyB, "opening key")
+	}
+	defer fileB.Close()
+
+	bufA := make([]byte, sampleSize)
+	bufB := make([]byte, sampleSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		nA, errA := io.ReadFull(fileA, bufA)
+		nB, errB := io.ReadFull(fileB, bufB)
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			// 文件在 Stat 之后可能被修改了，两个文件要同时结束
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errorWrap(errA, "reading key '"+keyA+"'")
+		}
+		if errB != nil {
+			if errB == io.EOF || errB == io.ErrUnexpectedEOF {
+				return false, nil
+			}
+			return false, errorWrap(errB, "reading key '"+keyB+"'")
+		}
+	}
+}
+
+// EncodingIdentity 是 GetRaw 返回的编码，表示保存的是没有经过压缩等变换的原始值
+const EncodingIdentity = "identity"
+
+// EncodingTransformed 是 GetRaw 返回的编码，表示保存的值经过了 WithTransform 设置的变换，
+// 但是 Transformer 没有实现 EncodingTransformer，不知道变换的名字，需要用 Get 读取逻辑内容
+const EncodingTransformed = "transformed"
+
+// GetRaw 返回键的最新值在存储中保存的字节（变换之后的）和它的编码，编码可以直接用作 HTTP 的 Content-Encoding
+// 没有设置 WithTransform 时编码是 EncodingIdentity，返回的字节和 Get 相同；设置了时编码由 EncodingTransformer 给出，
+// 没有实现它时是 EncodingTransformed。WithTreatEmptyAsAbsent 的判断和 Get 相同，按变换之后的逻辑内容判断
+func (f *FileKVStore) GetRaw(ctx context.Context, key string) ([]byte, string, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, "", err
+	}
+	key, err := f.followRename(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	release := f.refs.acquire(key)
+	defer release()
+
+	data, err := f.readKeyFile(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if f.treatEmptyAsAbsent {
+		value, err := f.decodeValue(key, data)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(value) == 0 {
+			return nil, "", errorWrap(ErrKeyNotFound, "reading key '"+key+"': value is empty")
+		}
+	}
+	return data, f.encodingOf(key), nil
+}
+
+// wrapKeyErr 把读取主数据文件时的错误转换为 ErrKeyNotFound 或 ErrKeyIsNamespace
+func (f *FileKVStore) wrapKeyErr(err error, key, msg string) error {
+	if isNotExist(err) {
+		return errorWrap(ErrKeyNotFound, msg+" '"+key+"'")
+	}
+	if st, statErr := f.fsys.Stat(f.keyToPath(key)); statErr == nil && st.IsDir() {
+		return errorWrap(ErrKeyIsNamespace, msg+" '"+key+"'")
+	}
+	return errorWrap(err, msg+" '"+key+"'")
+}
+
+// wrapSetKeyErr 和 wrapKeyErr 相同，但是用于写入时，键和已有的值或命名空间冲突时返回 ErrKeyConflict
+func (f *FileKVStore) wrapSetKeyErr(err error, key, msg string) error {
+	if isNotExist(err) {
+		// 某一级父路径是一个值，所以不能作为命名空间
+		for parent := path.Dir(key); parent != "." && parent != "/"; parent = path.Dir(parent) {
+			st, statErr := f.fsys.Stat(f.keyToPath(parent))
+			if statErr == nil && !st.IsDir() {
+				return &keyConflictError{msg: msg + " '" + key + "': key '" + parent + "' is a value and cannot also be a namespace"}
+			}
+		}
+		return f.wrapKeyErr(err, key, msg)
+	}
+	if st, statErr := f.fsys.Stat(f.keyToPath(key)); statErr == nil && st.IsDir() {
+		return &keyConflictError{
+			msg: msg + " '" + key + "': key is a namespace and cannot also be a value",
+			err: ErrKeyIsNamespace,
+		}
+	}
+	return f.wrapKeyErr(err, key, msg)
+}
+
+func (f *FileKVStore) searchVersionInSubDirs(ctx context.Context, historyDir string, version string, isExist func(versionFile string) error) (string, error) {
+	// 先用缓存的分页目录列表找到版本所在的分页
+	if pageDir, ok := f.pages.find(historyDir, version); ok {
+		versionFile := filepath.Join(historyDir, pageDir, version)
+		err := isExist(versionFile)
+		if err == nil {
+			return versionFile, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	entries, err := f.fsys.ReadDir(historyDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			f.pages.invalidate(historyDir)
+			return "", os.ErrNotExist
+		}
+		return "", errorWrap(err, "reading history directory")
+	}
+
+	var pages []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), pagePrefix) {
+			pages = append(pages, entry.Name())
+		}
+	}
+	f.pages.put(historyDir, pages)
+
+	var errList []error
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), pagePrefix) {
+			continue
+		}
+
+		subdirPath := filepath.Join(historyDir, entry.Name())
+		versionFile := filepath.Join(subdirPath, version)
+
+		err := isExist(versionFile)
+		if err == nil {
+			return versionFile, nil
+		}
+		if !os.IsNotExist(err) {
+			errList = append(errList, err)
+		}
+	}
+	if len(errList) == 0 {
+		return "", os.ErrNotExist
+	}
+	if len(errList) == 1 {
+		return "", errList[0]
+	}
+	return "", errors.Join(errList...)
+}
+
+// uniqueHistoryFile 为时间戳生成一个不冲突的历史记录文件名
+// 当同一时间戳的历史记录已存在时，在后面加上补零的 "_NNNN" 计数后缀，如 1672531200000000000_0001，
+// 补零是为了让按字符串排序的结果和写入的先后顺序一致
+// 设置了 WithNoCollisionSuffix 时不加后缀，直接返回 ErrVersionExists
+// 注意这里只检查默认目录，分页子目录中保存的都是较早的历史记录
+// 只有元数据文件的版本也视为已经存在：写入时先写元数据再写历史记录，中途崩溃会留下这样的元数据文件，
+// 不能让它变成之后用同一个版本号写入的历史记录的元数据
+func (f *FileKVStore) uniqueHistoryFile(historyDir string, timestamp int64) (string, string, error) {
+	timestampStr := strconv.FormatInt(timestamp, 10)
+	version := timestampStr
+	for counter := 1; ; counter++ {
+		historyFile := filepath.Join(historyDir, version)
+		exists, err := f.historyFileOccupied(historyFile)
+		if err != nil {
+			return "", "", err
+		}
+		if !exists {
+			return version, historyFile, nil
+		}
+		if f.noCollisionSuffix {
+			return "", "", errorWrap(ErrVersionExists, "version '"+version+"'")
+		}
+		version = timestampStr + "_" + formatCounter(counter)
+	}
+}
+
+// historyFileOccupied 检查历史记录文件或者它的元数据文件是否已经存在
+func (f *FileKVStore) historyFileOccupied(historyFile string) (bool, error) {
+	for _, name := range []string{historyFile, historyFile + metaSuffix} {
+		if _, err := f.fsys.Stat(name); err == nil {
+			return true, nil
+		} else if !isNotExist(err) {
+			return false, errorWrap(err, "checking history file")
+		}
+	}
+	return false, nil
+}
+
+// compareVersions 比较两个版本的先后，a 较早时返回负数，较晚时返回正数
+// 两个版本都能解析为时间戳时按时间戳和冲突计数比较，否则（如外部写入的 ULID 等非数字的版本）按字符串比较
+func compareVersions(a, b string) int {
+	aTime, aCounter, aErr := parseVersion(a)
+	bTime, bCounter, bErr := parseVersion(b)
+	if aErr != nil || bErr != nil {
+		return strings.Compare(a, b)
+	}
+	if aTime != bTime {
+		if aTime < bTime {
+			return -1
+		}
+		return 1
+	}
+	return aCounter - bCounter
+}
+
+// formatCounter 把冲突计数格式化为至少 4 位的补零字符串
+func formatCounter(counter int) string {
+	s := strconv.Itoa(counter)
+	if len(s) < counterWidth {
+		s = strings.Repeat("0", counterWidth-len(s)) + s
+	}
+	return s
+}
+
+// parseVersion 解析版本号，返回时间戳和冲突计数（没有计数后缀时为 0）
+func parseVersion(version string) (int64, int, error) {
+	timestampStr, counterStr, hasCounter := strings.Cut(version, "_")
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !hasCounter {
+		return timestamp, 0, nil
+	}
+	counter, err := strconv.Atoi(counterStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return timestamp, counter, nil
+}
+
+func isHeadRevision(revision string) bool {
+	return revision == "" || revision == "head" || revision == "HEAD" || revision == "Head"
+}
+
+func (f *FileKVStore) GetByVersion(ctx context.Context, key string, version string) ([]byte, error) {
+	if isHeadRevision(version) {
+		return f.Get(ctx, key)
+	}
+
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+	release := f.refs.acquire(key)
+	defer release()
+
+	historyDir := f.keyToHistoryPath(key)
+
+	// First check default directory
+	defaultPath := filepath.Join(historyDir, version)
+	data, err := f.fsys.ReadFile(defaultPath)
+	if err == nil {
+		return f.decodeValue(key, data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, errorWrap(err, "reading history")
+	}
+
+	_, err = f.searchVersionInSubDirs(ctx, historyDir, version, func(versionFile string) error {
+		data, err = f.fsys.ReadFile(versionFile)
+		return err
+	})
+	if err == nil {
+		return f.decodeValue(key, data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, errorWrap(err, "reading history")
+	}
+
+	// version 可能是不带计数后缀的时间戳，而磁盘上的历史记录带有 "_N" 后缀
+	if historyFile, ok := f.resolveCollidedVersion(historyDir, version); ok {
+		data, err = f.fsys.ReadFile(historyFile)
+		if err != nil {
+			return nil, errorWrap(err, "reading history")
+		}
+		return f.decodeValue(key, data)
+	}
+
+	// 最后查找 ArchiveKey 生成的归档
+	data, ok, err := f.findArchivedVersion(historyDir, version)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return f.decodeValue(key, data)
+	}
+	return nil, f.versionNotFoundErr(key, historyDir, version)
+}
+
+// versionNotFoundErr 返回找不到版本时的错误
+// 历史目录和主数据文件都不存在时表示键本身不存在，返回 ErrKeyNotFound，否则返回 ErrVersionNotFound
+func (f *FileKVStore) versionNotFoundErr(key, historyDir, version string) error {
+	if _, err := f.fsys.Stat(historyDir); err != nil && isNotExist(err) {
+		if _, err := f.fsys.Stat(f.keyToPath(key)); err != nil && isNotExist(err) {
+			return errorWrap(ErrKeyNotFound, "key '"+key+"' not found")
+		}
+	}
+	return errorWrap(ErrVersionNotFound, "version '"+version+"' not found for key '"+key+"'")
+}
+
+// resolveCollidedVersion 当 version 是一个不带计数后缀的时间戳时，
+// 查找以它为时间戳且计数最小的历史记录，返回该历史记录的文件路径
+func (f *FileKVStore) resolveCollidedVersion(historyDir, version string) (string, bool) {
+	if strings.Contains(version, "_") {
+		return "", false
+	}
+	timestamp, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return "", false
+	}
+
+	var found string
+	minCounter := -1
+	f.foreachHistories(historyDir, func(historyFile, name, version string, hasMeta bool, info fs.DirEntry) (bool, error) {
+		ts, counter, err := parseVersion(version)
+		if err != nil || ts != timestamp {
+			return true, nil
+		}
+		if minCounter < 0 || counter < minCounter {
+			minCounter = counter
+			found = historyFile
+		}
+		return true, nil
+	})
+	return found, minCounter >= 0
+}
+
+func (f *FileKVStore) Set(ctx context.Context, key string, value []byte) (string, error) {
+	return f.setWithClock(ctx, key, value, nil)
+}
+
+func (f *FileKVStore) SetWithTimestamp(ctx context.Context, key string, value []byte, timestamp time.Time) (string, error) {
+	if f.readOnly {
+		return "", ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return "", err
+	}
+	if !f.rateLimitExemptTimestamps && !f.rateLimiter.allow(key) {
+		return "", errorWrap(ErrRateLimited, "setting key '"+key+"'")
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	return f.set(ctx, key, value, timestamp, nil)
+}
+
+// SetWithMeta 设置键的值，并同时为新的版本写入元数据
+// 元数据在历史记录之前写入，所以读者看到新版本时它的元数据一定已经存在，写入元数据失败时不会产生新的版本
+// 当值和当前值相同时不产生新的版本，也不写入元数据，version 返回空串
+func (f *FileKVStore) SetWithMeta(ctx context.Context, key string, value []byte, meta map[string]string) (string, error) {
+	return f.setWithClock(ctx, key, value, meta)
+}
+
+// setWithClock 用当前时间作为时间戳写入新的值，时钟回拨时按 WithClockRegression 处理
+func (f *FileKVStore) setWithClock(ctx context.Context, key string, value []byte, meta map[string]string) (string, error) {
+	if f.readOnly {
+		return "", ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return "", err
+	}
+	if !f.rateLimiter.allow(key) {
+		return "", errorWrap(ErrRateLimited, "setting key '"+key+"'")
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	return f.setNow(ctx, key, value, meta)
+}
+
+// setNow 是 setWithClock 中持有键的锁之后的部分
+func (f *FileKVStore) setNow(ctx context.Context, key string, value []byte, meta map[string]string) (string, error) {
+	timestamp, err := f.clock.now(f.lockName(key), key)
+	if err != nil {
+		return "", err
+	}
+	version, err := f.set(ctx, key, value, timestamp, meta)
+	if err == nil && version != "" {
+		f.clock.issued(f.lockName(key), timestamp)
+	}
+	return version, err
+}
+
+// CompareAndSwap 只在键的最新版本等于 expectedVersion 时写入新的值，否则返回 ErrVersionMismatch，用于避免并发的读-改-写丢失更新
+// expectedVersion 为空串时要求键不存在。检查和写入在键的锁中进行，所以两个基于同一个版本的 CompareAndSwap 只有一个会成功。
+// 和 Set 相同，值没有变化时不产生新的版本，返回空串。
+func (f *FileKVStore) CompareAndSwap(ctx context.Context, key string, expectedVersion string, value []byte) (string, error) {
+	if f.readOnly {
+		return "", ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return "", err
+	}
+	if !f.rateLimiter.allow(key) {
+		return "", errorWrap(ErrRateLimited, "setting key '"+key+"'")
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	if expectedVersion == "" {
+		if _, err := f.fsys.Stat(f.keyToPath(key)); err == nil {
+			return "", errorWrap(ErrVersionMismatch, "key '"+key+"' already exists")
+		} else if !isNotExist(err) {
+			return "", errorWrap(err, "checking existence of key '"+key+"'")
+		}
+	} else {
+		actual := ""
+		last, err := f.GetLastVersion(ctx, key)
+		if err == nil {
+			actual = last.Version
+		} else if !errors.Is(err, ErrVersionNotFound) {
+			return "", err
+		}
+		if actual != expectedVersion {
+			return "", errorWrap(ErrVersionMismatch, "key '"+key+"' is at version '"+actual+"', expected '"+expectedVersion+"'")
+		}
+	}
+	return f.setNow(ctx, key, value, nil)
+}
+
+// set 写入新的值和历史记录，调用者必须持有键的锁
+func (f *FileKVStore) set(ctx context.Context, key string, value []byte, timestamp time.Time, meta map[string]string) (string, error) {
+	dataFile := f.keyToPath(key)
+	value = f.normalizeValue(value)
+
+	// If value is the same, don't create new history
+	changed, err := f.isValueChanged(key, dataFile, value)
+	if err != nil {
+		return "", f.wrapSetKeyErr(err, key, "reading file for comparison")
+	}
+	if !changed {
+		if f.touchOnUnchanged {
+			if err := f.touch(dataFile); err != nil {
+				return "", errorWrap(err, "touching file")
+			}
+		}
+		return "", nil
+	}
+
+	value, err = f.encodeValue(key, value)
+	if err != nil {
+		return "", err
+	}
+
+	reserved, err := f.reserveQuota(ctx, key, dataFile, int64(len(value)))
+	if err != nil {
+		return "", err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			f.releaseQuota(reserved)
+		}
+	}()
+
+	// Create history record
+	historyDir := f.keyToHistoryPath(key)
+	timestampStr, historyFile, err := f.uniqueHistoryFile(historyDir, timestamp.UnixNano())
+	if err != nil {
+		return "", err
+	}
+	unmark, err := f.markHead(historyDir, timestampStr)
+	if err != nil {
+		return "", err
+	}
 
-		// Retry writing the file after creating the directory
-		err = os.WriteFile(dataFile, value, 0644)
-		if err != nil {
-			return "", errorWrap(err, "writing file")
+	// 先写入新的历史记录的元数据（包括默认的元数据），历史记录文件不存在时元数据文件不会被当作一个版本，
+	// 这样读者看到新版本时它的元数据一定已经存在，元数据写入失败时也不会留下没有元数据的版本
+	var metaFile string
+	if meta := f.newVersionMeta(ctx, meta); len(meta) > 0 {
+		metaFile = historyFile + metaSuffix
+		if err := f.writeProperties(metaFile, meta); err != nil {
+			return "", err
 		}
+	}
 
-		// Directory doesn't exist, create it and retry
-		mkdirErr := os.MkdirAll(historyDir, 0755)
-		if mkdirErr != nil {
-			if !f.ignoreWarning {
-				return "", errorWrap(mkdirErr, "creating history directory")
-			}
+	defer f.pages.invalidate(historyDir)
+
+	if err := f.writeValueAndHistory(dataFile, historyDir, historyFile, value); err != nil {
+		if metaFile != "" {
+			_ = f.fsys.Remove(metaFile)
 		}
+		return "", err
+	}
+	committed = true
+	if unmark {
+		f.unmarkHead(historyDir)
 	}
+	f.appendRecentIndex(ctx, key, timestampStr)
+	return timestampStr, nil
+}
 
-	err = os.WriteFile(historyFile, value, 0644)
+// touch 把文件的修改时间更新为当前时间，FS 不支持 Chtimes 时重写文件内容
+func (f *FileKVStore) touch(filePath string) error {
+	if chtimes, ok := f.fsys.(ChtimesFS); ok {
+		now := timex.Now()
+		return chtimes.Chtimes(filePath, now, now)
+	}
+	data, err := f.fsys.ReadFile(filePath)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return "", errorWrap(err, "writing history file")
+		return err
+	}
+	return f.fsys.WriteFile(filePath, data, f.filePerm)
+}
+
+// writeValueAndHistory 写入历史记录文件和主数据文件
+// 先写历史记录再更新主数据文件，这样读者看到新的值时，它对应的历史记录一定已经存在
+func (f *FileKVStore) writeValueAndHistory(dataFile, historyDir, historyFile string, value []byte) error {
+	if linker, ok := f.fsys.(LinkFS); ok && f.linkHistory {
+		linked, err := f.writeValueAndLinkHistory(linker, dataFile, historyDir, historyFile, value)
+		if linked || err != nil {
+			return err
 		}
-		// Directory doesn't exist, create it and retry
-		mkdirErr := os.MkdirAll(historyDir, 0755)
-		if mkdirErr != nil {
+		// 不支持硬链接，退回到分别写入
+	}
+
+	historyWritten := true
+	err := f.writeFileAtomic(historyFile, value)
+	for retries := 0; err != nil && os.IsNotExist(err) && retries < maxDirRetries; retries++ {
+		// Directory doesn't exist (or was removed concurrently), create it and retry
+		if mkdirErr := f.fsys.MkdirAll(historyDir, f.dirPerm); mkdirErr != nil {
 			if !f.ignoreWarning {
-				return "", errorWrap(mkdirErr, "creating history directory")
-			}
-		} else {
-			// Retry writing the file after creating the directory
-			err = os.WriteFile(historyFile, value, 0644)
-			if err != nil {
-				return "", errorWrap(err, "writing history file")
+				return errorWrap(mkdirErr, "creating history directory")
 			}
+			historyWritten = false
+			err = nil
+			break
 		}
+		err = f.writeFileAtomic(historyFile, value)
+	}
+	if err != nil {
+		return errorWrap(err, "writing history file")
 	}
 
-	return timestampStr, nil
+	// Write new value
+	err = f.writeFileAtomicWithDir(dataFile, value)
+	if err != nil {
+		// 值没有更新，删除已经写入的历史记录
+		if historyWritten {
+			_ = f.fsys.Remove(historyFile)
+		}
+		return errorWrap(err, "writing file")
+	}
+	return nil
+}
+
+// writeValueAndLinkHistory 把值写入临时文件，硬链接为历史记录后再改名为主数据文件，值只写入一次
+// 创建硬链接失败时返回 false 和 nil，由调用者退回到分别写入
+func (f *FileKVStore) writeValueAndLinkHistory(linker LinkFS, dataFile, historyDir, historyFile string, value []byte) (bool, error) {
+	tempFile := siblingTempFile(dataFile)
+	if err := f.writeFileWithDir(tempFile, value); err != nil {
+		_ = f.fsys.Remove(tempFile)
+		return false, errorWrap(err, "writing file")
+	}
+
+	err := linker.Link(tempFile, historyFile)
+	if err != nil && os.IsNotExist(err) {
+		if mkdirErr := f.fsys.MkdirAll(historyDir, f.dirPerm); mkdirErr != nil {
+			_ = f.fsys.Remove(tempFile)
+			return false, errorWrap(mkdirErr, "creating history directory")
+		}
+		err = linker.Link(tempFile, historyFile)
+	}
+	if err != nil {
+		_ = f.fsys.Remove(tempFile)
+		return false, nil
+	}
+
+	if err := f.fsys.Rename(tempFile, dataFile); err != nil {
+		// 值没有更新，删除已经创建的历史记录
+		_ = f.fsys.Remove(historyFile)
+		_ = f.fsys.Remove(tempFile)
+		return false, errorWrap(err, "writing file")
+	}
+	return true, nil
+}
+
+// newVersionMeta 生成新的历史记录的元数据，优先级从低到高为：
+// WithDefaultMeta, WithDefaultMetaFunc, 调用时显式指定的 meta
+func (f *FileKVStore) newVersionMeta(ctx context.Context, meta map[string]string) map[string]string {
+	if len(f.defaultMeta) == 0 && f.defaultMetaFunc == nil {
+		return meta
+	}
+
+	result := make(map[string]string, len(f.defaultMeta)+len(meta))
+	for k, v := range f.defaultMeta {
+		result[k] = v
+	}
+	if f.defaultMetaFunc != nil {
+		for k, v := range f.defaultMetaFunc(ctx) {
+			result[k] = v
+		}
+	}
+	for k, v := range meta {
+		result[k] = v
+	}
+	return result
 }
 
-func (f *FileKVStore) ensureHistoryRecordExists(key, historyDir string, timestamp int64) (string, error) {
+// ensureHistoryRecordExists 从当前值创建一个历史记录，它的元数据和 Set 一样由 newVersionMeta 生成
+func (f *FileKVStore) ensureHistoryRecordExists(ctx context.Context, key, historyDir string, timestamp int64, meta map[string]string) (string, error) {
 	timestampStr := strconv.FormatInt(timestamp, 10)
 	historyFile := filepath.Join(historyDir, timestampStr)
 
 	// Create history record from current value
-	currentValue, err := f.Get(context.Background(), key)
+	// 直接读取主数据文件：历史记录保存的是变换后的内容，值为空时（WithTreatEmptyAsAbsent）也要为它创建历史记录
+	currentValue, err := f.readKeyFile(key)
 	if err != nil {
 		return "", err
 	}
 
-	err = os.WriteFile(historyFile, currentValue, 0644)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return "", errorWrap(err, "writing history file")
+	// 和 set 一样先写元数据再写历史记录
+	var metaFile string
+	if meta := f.newVersionMeta(ctx, meta); len(meta) > 0 {
+		metaFile = historyFile + metaSuffix
+		if err := f.writeProperties(metaFile, meta); err != nil {
+			return "", err
 		}
+	}
+
+	err = f.fsys.WriteFile(historyFile, currentValue, f.filePerm)
+	if err != nil && os.IsNotExist(err) {
 		// Directory doesn't exist, create it and retry
-		if mkdirErr := os.MkdirAll(historyDir, 0755); mkdirErr != nil {
-			return "", errorWrap(mkdirErr, "creating history directory")
+		if mkdirErr := f.fsys.MkdirAll(historyDir, f.dirPerm); mkdirErr != nil {
+			err = mkdirErr
+		} else {
+			// Retry writing the file after creating the directory
+			err = f.fsys.WriteFile(historyFile, currentValue, f.filePerm)
 		}
-		// Retry writing the file after creating the directory
-		err = os.WriteFile(historyFile, currentValue, 0644)
-		if err != nil {
-			return "", errorWrap(err, "writing history file")
+	}
+	if err != nil {
+		if metaFile != "" {
+			_ = f.fsys.Remove(metaFile)
 		}
+		return "", errorWrap(err, "writing history file")
 	}
 	return timestampStr, nil
 }
 
 func (f *FileKVStore) SetMeta(ctx context.Context, key, version string, meta map[string]string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
 	if err := f.validateKey(key); err != nil {
 		return err
 	}
 
+	unlock := f.lockKey(key)
+	defer unlock()
+
 	historyDir := f.keyToHistoryPath(key)
 
 	if isHeadRevision(version) {
 		lastVersion, err := f.GetLastVersion(ctx, key)
 		if err != nil {
-			if !os.IsNotExist(err) {
+			if !errors.Is(err, ErrVersionNotFound) {
 				return err
 			}
 			// If no history exists, create one based on current value
+			// 新创建的历史记录和 Set 一样带上默认的元数据，显式指定的 meta 优先
 			timestamp := timex.Now().UnixNano()
-			versionName, err := f.ensureHistoryRecordExists(key, historyDir, timestamp)
-			if err != nil {
-				return err
-			}
-			version = versionName
-		} else {
-			version = lastVersion.Name
+			_, err = f.ensureHistoryRecordExists(ctx, key, historyDir, timestamp, meta)
+			return err
 		}
+		version = lastVersion.Name
 
 		// First try default directory
 		metaFile := filepath.Join(historyDir, version+metaSuffix)
 		return f.writeProperties(metaFile, meta)
 	}
 
+	// 归档中的版本的元数据不能单独修改，先还原整个归档
+	if err := f.unarchiveIf(ctx, historyDir, func(entry archiveEntry) bool { return entry.Version == version }); err != nil {
+		return err
+	}
+
 	versionFile := filepath.Join(historyDir, version)
-	_, err := os.Stat(versionFile)
+	_, err := f.fsys.Stat(versionFile)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return errorWrap(err, "check history")
 		}
 		versionFile, err = f.searchVersionInSubDirs(ctx, historyDir, version, func(versionFile string) error {
-			_, err := os.Stat(versionFile)
+			_, err := f.fsys.Stat(versionFile)
 			return err
 		})
 		if err != nil {
 			if os.IsNotExist(err) {
-				return errorWrap(os.ErrNotExist, "no history found for key '"+key+"'")
+				return errorWrap(ErrVersionNotFound, "version '"+version+"' not found for key '"+key+"'")
 			}
 			return errorWrap(err, "search history")
 		}
@@ -520,21 +1626,50 @@ func (f *FileKVStore) SetMeta(ctx context.Context, key, version string, meta map
 }
 
 func (f *FileKVStore) UpdateMeta(ctx context.Context, key, version string, meta map[string]string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
 	if err := f.validateKey(key); err != nil {
 		return err
 	}
 
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	metaFile, err := f.resolveMetaFile(ctx, key, version)
+	if err != nil {
+		return err
+	}
+
+	// Read existing metadata
+	existingMeta, err := f.readProperties(metaFile)
+	if err != nil && !os.IsNotExist(err) {
+		return errorWrap(err, "reading meta file")
+	}
+	// Merge with new metadata
+	if len(existingMeta) == 0 {
+		existingMeta = meta
+	} else {
+		for k, v := range meta {
+			existingMeta[k] = v
+		}
+	}
+	return f.writeProperties(metaFile, existingMeta)
+}
+
+// resolveMetaFile 查找指定版本对应的元数据文件路径
+// 当 version 为 head 时使用最后一次历史记录，没有历史记录时以当前值创建一个
+func (f *FileKVStore) resolveMetaFile(ctx context.Context, key, version string) (string, error) {
 	historyDir := f.keyToHistoryPath(key)
 
-	var metaFile string
 	if isHeadRevision(version) {
 		lastVersion, err := f.GetLastVersion(ctx, key)
 		if err != nil {
 			// If no history exists, create one based on current value
 			timestamp := timex.Now().UnixNano()
-			versionName, err := f.ensureHistoryRecordExists(key, historyDir, timestamp)
+			versionName, err := f.ensureHistoryRecordExists(ctx, key, historyDir, timestamp, nil)
 			if err != nil {
-				return err
+				return "", err
 			}
 			version = versionName
 		} else {
@@ -542,74 +1677,97 @@ func (f *FileKVStore) UpdateMeta(ctx context.Context, key, version string, meta
 		}
 
 		// First try default directory
-		metaFile = filepath.Join(historyDir, version+metaSuffix)
-	} else {
-		versionFile := filepath.Join(historyDir, version)
-		_, err := os.Stat(versionFile)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return errorWrap(err, "check default history")
-			}
-			versionFile, err = f.searchVersionInSubDirs(ctx, historyDir, version, func(versionFile string) error {
-				_, err := os.Stat(versionFile)
-				return err
-			})
-			if err != nil {
-				if os.IsNotExist(err) {
-					return errorWrap(os.ErrNotExist, "no history found for key '"+key+"'")
-				}
-				return errorWrap(err, "search history")
-			}
-		}
-
-		metaFile = versionFile + metaSuffix
+		return filepath.Join(historyDir, version+metaSuffix), nil
 	}
 
-	// Read existing metadata
-	existingMeta, err := f.readProperties(metaFile)
-	if err != nil && !os.IsNotExist(err) {
-		return errorWrap(err, "reading meta file")
+	// 归档中的版本的元数据不能单独修改，先还原整个归档
+	if err := f.unarchiveIf(ctx, historyDir, func(entry archiveEntry) bool { return entry.Version == version }); err != nil {
+		return "", err
 	}
-	// Merge with new metadata
-	if len(existingMeta) == 0 {
-		existingMeta = meta
-	} else {
-		for k, v := range meta {
-			existingMeta[k] = v
+
+	versionFile := filepath.Join(historyDir, version)
+	_, err := f.fsys.Stat(versionFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", errorWrap(err, "check default history")
+		}
+		versionFile, err = f.searchVersionInSubDirs(ctx, historyDir, version, func(versionFile string) error {
+			_, err := f.fsys.Stat(versionFile)
+			return err
+		})
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", errorWrap(ErrVersionNotFound, "version '"+version+"' not found for key '"+key+"'")
+			}
+			return "", errorWrap(err, "search history")
 		}
 	}
-	return f.writeProperties(metaFile, existingMeta)
+	return versionFile + metaSuffix, nil
 }
 
 func (f *FileKVStore) Delete(ctx context.Context, key string, removeHistories bool) error {
+	_, err := f.DeleteExisting(ctx, key, removeHistories)
+	return err
+}
+
+// DeleteExisting 和 Delete 相同，同时返回键是否存在并被删除了
+// 键不存在时 Delete 什么也不做并返回 nil，调用者需要区分这种情况时使用 DeleteExisting，它此时返回 false 和 nil
+func (f *FileKVStore) DeleteExisting(ctx context.Context, key string, removeHistories bool) (bool, error) {
+	if f.readOnly {
+		return false, ErrReadOnly
+	}
 	if err := f.validateKey(key); err != nil {
-		return err
+		return false, err
 	}
 
+	unlock := f.lockKey(key)
+	defer unlock()
+
 	keyPath := f.keyToPath(key)
 
 	// Check if there are child keys
-	st, err := os.Stat(keyPath)
+	st, err := f.fsys.Stat(keyPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+		if isNotExist(err) {
+			return false, nil
 		}
-		return errorWrap(err, "checking existence of key '"+key+"'")
+		return false, errorWrap(err, "checking existence of key '"+key+"'")
 	}
 	if st.IsDir() {
-		return errors.New("cannot delete key " + key + ": it has child keys")
+		return false, errorWrap(ErrKeyIsNamespace, "cannot delete key '"+key+"': it has child keys")
+	}
+
+	// 等待正在进行的读操作完成，删除期间新的读操作等待删除完成
+	unlockRefs, err := f.refs.lock(ctx, key, f.deleteTimeout)
+	if err != nil {
+		return false, err
 	}
+	defer unlockRefs()
+	defer f.quota.invalidate()
+
 	if removeHistories {
 		historyDir := f.keyToHistoryPath(key)
-		if err := os.RemoveAll(historyDir); err != nil && !os.IsNotExist(err) {
-			return errorWrap(err, "removing history directory")
+		defer f.pages.invalidate(historyDir)
+		if err := f.fsys.RemoveAll(historyDir); err != nil && !os.IsNotExist(err) {
+			return false, errorWrap(err, "removing history directory")
 		}
 	}
 
-	if err := os.Remove(keyPath); err != nil {
-		return errorWrap(err, "removing file")
+	if err := f.fsys.Remove(keyPath); err != nil {
+		return false, errorWrap(err, "removing file")
 	}
-	return nil
+	f.clock.forget(f.lockName(key))
+	if err := f.fsys.Remove(keyPath + keyMetaSuffix); err != nil && !os.IsNotExist(err) {
+		return true, errorWrap(err, "removing key meta file")
+	}
+	if err := f.fsys.Remove(keyPath + recentSuffix); err != nil && !os.IsNotExist(err) {
+		return true, errorWrap(err, "removing recent index file")
+	}
+	// 键是改名后用同一个名字重新创建的，删除之前的改名标记，以免之后又指向改名后的键
+	if err := f.fsys.Remove(keyPath + movedSuffix); err != nil && !os.IsNotExist(err) {
+		return true, errorWrap(err, "removing rename marker")
+	}
+	return true, nil
 }
 
 func (f *FileKVStore) Exists(ctx context.Context, key string) (bool, error) {
@@ -618,9 +1776,9 @@ func (f *FileKVStore) Exists(ctx context.Context, key string) (bool, error) {
 	}
 
 	path := f.keyToPath(key)
-	st, err := os.Stat(path)
+	st, err := f.fsys.Stat(path)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if isNotExist(err) {
 			return false, nil
 		}
 		return false, errorWrap(err, "checking existence of key '"+key+"'")
@@ -628,29 +1786,214 @@ func (f *FileKVStore) Exists(ctx context.Context, key string) (bool, error) {
 	if st.IsDir() {
 		return false, nil
 	}
+	if f.treatEmptyAsAbsent {
+		empty, err := f.isEmptyValue(key, st.Size())
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		return !empty, nil
+	}
 	return true, nil
 }
 
+// isEmptyValue 检查键的值是否为空，size 是主数据文件的大小，和 Get 中 WithTreatEmptyAsAbsent 的判断相同，
+// 按变换之后的逻辑内容判断，所以设置了 WithTransform 时要读出并变换整个值
+func (f *FileKVStore) isEmptyValue(key string, size int64) (bool, error) {
+	if f.transform == nil {
+		return size == 0, nil
+	}
+	value, err := f.readValue(key)
+	if err != nil {
+		return false, err
+	}
+	return len(value) == 0, nil
+}
+
+// keyFileExists 检查键的主数据文件是否存在，和 Exists 不同，它不把空的值当作不存在，用于 Fsck 等内部的检查
+func (f *FileKVStore) keyFileExists(key string) (bool, error) {
+	st, err := f.fsys.Stat(f.keyToPath(key))
+	if err != nil {
+		if isNotExist(err) {
+			return false, nil
+		}
+		return false, errorWrap(err, "checking existence of key '"+key+"'")
+	}
+	return !st.IsDir(), nil
+}
+
+// readKeyFile 读取键的主数据文件的原始内容（变换之前的），不把空的值当作不存在
+func (f *FileKVStore) readKeyFile(key string) ([]byte, error) {
+	data, err := f.fsys.ReadFile(f.keyToPath(key))
+	if err != nil {
+		return nil, f.wrapKeyErr(err, key, "reading key")
+	}
+	return data, nil
+}
+
+// readValue 读取键的主数据文件并变换为逻辑内容，不把空的值当作不存在
+func (f *FileKVStore) readValue(key string) ([]byte, error) {
+	data, err := f.readKeyFile(key)
+	if err != nil {
+		return nil, err
+	}
+	return f.decodeValue(key, data)
+}
+
+// ModTime 返回键的当前值（主数据文件）的修改时间，比 GetLastVersion 开销更小，适合用于检查缓存是否过期
+func (f *FileKVStore) ModTime(ctx context.Context, key string) (time.Time, error) {
+	if err := f.validateKey(key); err != nil {
+		return time.Time{}, err
+	}
+
+	st, err := f.fsys.Stat(f.keyToPath(key))
+	if err != nil {
+		return time.Time{}, f.wrapKeyErr(err, key, "getting modification time of key")
+	}
+	if st.IsDir() {
+		return time.Time{}, errorWrap(ErrKeyIsNamespace, "getting modification time of key '"+key+"'")
+	}
+	return st.ModTime(), nil
+}
+
+// KeyInfo 是 Stat 返回的键的信息
+type KeyInfo struct {
+	// Size 是主数据文件的字节数，设置了 WithTransform 时是变换之后保存在文件中的大小
+	Size    int64
+	ModTime time.Time
+	// Exists 在 Stat 成功时总是 true，键不存在时 Stat 返回 ErrKeyNotFound
+	Exists bool
+	// Version 是最新的版本号，没有历史记录（如在外部创建的文件）时为空串
+	Version string
+}
+
+// Stat 返回键的大小、修改时间和最新版本，它只 Stat 主数据文件并读取最新的历史记录，不会读取整个值
+// 键不存在时返回 ErrKeyNotFound，键是一个命名空间时返回 ErrKeyIsNamespace
+func (f *FileKVStore) Stat(ctx context.Context, key string) (*KeyInfo, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+
+	st, err := f.fsys.Stat(f.keyToPath(key))
+	if err != nil {
+		return nil, f.wrapKeyErr(err, key, "getting info of key")
+	}
+	if st.IsDir() {
+		return nil, errorWrap(ErrKeyIsNamespace, "getting info of key '"+key+"'")
+	}
+	if f.treatEmptyAsAbsent {
+		empty, err := f.isEmptyValue(key, st.Size())
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			return nil, errorWrap(ErrKeyNotFound, "getting info of key '"+key+"': value is empty")
+		}
+	}
+
+	version, err := lastVersionOf(ctx, f, key)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyInfo{
+		Size:    st.Size(),
+		ModTime: st.ModTime(),
+		Exists:  true,
+		Version: version,
+	}, nil
+}
+
 func (f *FileKVStore) ListKeys(ctx context.Context, prefix string) ([]string, error) {
 	var keys []string
+	err := f.walkKeys(ctx, prefix, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+// ListKeysWithSeparator 和 ListKeys 相同，但是返回的键中用 sep 作为层级的分隔符，sep 只能是 '/' 或 '\'
+// 键在内部始终以 '/' 分隔，prefix 中可以使用 sep 或 '/'，只有输出会被转换，
+// 如在 Windows 上需要本地路径风格的键时使用 ListKeysWithSeparator(ctx, prefix, filepath.Separator)
+func (f *FileKVStore) ListKeysWithSeparator(ctx context.Context, prefix string, sep rune) ([]string, error) {
+	if sep != '/' && sep != '\\' {
+		return nil, errors.New("separator must be '/' or '\\', got '" + string(sep) + "'")
+	}
+	if sep != '/' {
+		prefix = strings.ReplaceAll(prefix, string(sep), "/")
+	}
+
+	var keys []string
+	err := f.walkKeys(ctx, prefix, func(key string) error {
+		if sep != '/' {
+			key = strings.ReplaceAll(key, "/", string(sep))
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+// walkKeys 遍历所有以 prefix 开头的键，对每个键执行 fn，fn 返回错误时停止遍历并返回该错误
+// 设置了 WithSkipInvalidKeys 时跳过不合法的键
+func (f *FileKVStore) walkKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return f.walkKeysSkipping(ctx, prefix, nil, fn)
+}
+
+// walkKeysSkipping 和 walkKeys 相同，但是 skipDir 返回 true 的目录（参数为 / 分隔的相对路径）会被整个跳过
+func (f *FileKVStore) walkKeysSkipping(ctx context.Context, prefix string, skipDir func(dir string) bool, fn func(key string) error) error {
+	if !f.skipInvalidKeys {
+		return f.walkAllKeys(ctx, prefix, skipDir, fn)
+	}
+	return f.walkAllKeys(ctx, prefix, skipDir, func(key string) error {
+		if f.validateKey(key) != nil {
+			return nil
+		}
+		return fn(key)
+	})
+}
+
+// ListInvalidKeys 列出数据目录中所有不能通过键名检查的文件（如在外部创建的 p_x、x.h），以便清理
+// 它们不能通过 Get、Delete 等方法操作，不论是否设置了 WithSkipInvalidKeys
+func (f *FileKVStore) ListInvalidKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := f.walkAllKeys(ctx, "", nil, func(key string) error {
+		if f.validateKey(key) != nil {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
 
-	err := filepath.WalkDir(f.rootDir, func(pa string, d fs.DirEntry, err error) error {
+// walkAllKeys 遍历所有以 prefix 开头的键，包括不合法的键，skipDir 不为 nil 时跳过它返回 true 的目录
+func (f *FileKVStore) walkAllKeys(ctx context.Context, prefix string, skipDir func(dir string) bool, fn func(key string) error) error {
+	return fs.WalkDir(f.fsys, f.rootDir, func(pa string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return errorWrap(err, "walking directory '"+pa+"'")
 		}
+		if pa == f.rootDir {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if d.Name() == "." {
 			return filepath.SkipDir
 		}
 		if d.Name() == historyDirConst {
 			return filepath.SkipDir
 		}
-		if strings.HasPrefix(d.Name(), pagePrefix) {
-			return filepath.SkipDir
-		}
 		if strings.HasPrefix(d.Name(), ".") {
+			if !d.IsDir() {
+				return nil // 如写入时的临时文件
+			}
 			return filepath.SkipDir
 		}
-		if strings.HasSuffix(d.Name(), historyDirSuffix) {
+		// 这样的文件不是合法的键，但是仍然列出，由 walkKeys 根据 WithSkipInvalidKeys 决定是否跳过
+		if d.IsDir() && (strings.HasPrefix(d.Name(), pagePrefix) || strings.HasSuffix(d.Name(), historyDirSuffix)) {
 			return filepath.SkipDir
 		}
 
@@ -664,31 +2007,42 @@ func (f *FileKVStore) ListKeys(ctx context.Context, prefix string) ([]string, er
 
 		if d.IsDir() {
 			// 对于目录，我们不应该根据前缀跳过，因为它可能包含匹配前缀的文件
-			if len(relPath) > len(prefix) {
+			// 设置了 KeyCodec 时目录名不一定和键的前缀一致，不跳过
+			if f.keyCodec == nil && len(relPath) > len(prefix) {
 				if !strings.HasPrefix(relPath, prefix) {
 					return filepath.SkipDir
 				}
 			}
+			if skipDir != nil && skipDir(relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(relPath, keyMetaSuffix) || strings.HasSuffix(relPath, recentSuffix) || strings.HasSuffix(relPath, movedSuffix) {
 			return nil
 		}
 
-		if prefix == "" {
-			keys = append(keys, relPath)
-		} else {
-			// Only include files (not directories)
-			if strings.HasPrefix(relPath, prefix) {
-				keys = append(keys, relPath)
+		key := relPath
+		if f.keyCodec != nil {
+			var ok bool
+			if key, ok = f.keyCodec.DecodeKey(relPath); !ok {
+				return nil
 			}
 		}
+		if prefix == "" {
+			return fn(key)
+		}
+		// Only include files (not directories)
+		if strings.HasPrefix(key, prefix) {
+			return fn(key)
+		}
 		return nil
 	})
-
-	return keys, err
 }
 
-func traverseDir(historyDir, prefix string, traverseSubDir bool, errList *[]error,
+func (f *FileKVStore) traverseDir(historyDir, prefix string, traverseSubDir bool, errList *[]error,
 	callback func(historyFile, name, version string, hasMeta bool, info fs.DirEntry) (bool, error)) bool {
-	entries, err := os.ReadDir(historyDir)
+	entries, err := f.fsys.ReadDir(historyDir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return true
@@ -708,7 +2062,7 @@ func traverseDir(historyDir, prefix string, traverseSubDir bool, errList *[]erro
 					fullName = prefix + "/" + entryName
 				}
 
-				continueTraverse := traverseDir(filepath.Join(historyDir, entryName), fullName, false, errList, callback)
+				continueTraverse := f.traverseDir(filepath.Join(historyDir, entryName), fullName, false, errList, callback)
 				if !continueTraverse {
 					return false
 				}
@@ -756,12 +2110,22 @@ func traverseDir(historyDir, prefix string, traverseSubDir bool, errList *[]erro
 // callback: 回调函数，接收历史记录的文件路径、版本号和文件状态，返回是否继续遍历和错误
 func (f *FileKVStore) foreachHistories(historyDir string, callback func(historyFile, name, version string, hasMeta bool, info fs.DirEntry) (bool, error)) []error {
 	var errList []error
-	traverseDir(historyDir, "", true, &errList, callback)
+	f.traverseDir(historyDir, "", true, &errList, callback)
 	return errList
 }
 
-// readHistories 枚举指定键的所有版本，返回不包含元数据的 Version 切片
+// readHistories 枚举指定键的所有版本，包括归档中的版本，返回的 Version 中只有归档中的版本包含元数据
+// 归档中的版本要用 historyContents 和 readHistoryMeta 读取
 func (f *FileKVStore) readHistories(ctx context.Context, historyDir string) ([]Version, error) {
+	versions, err := f.readLooseHistories(ctx, historyDir)
+	if err != nil {
+		return nil, err
+	}
+	return f.mergeArchivedHistories(historyDir, versions)
+}
+
+// readLooseHistories 枚举指定键的所有单独保存的版本（不包括归档中的），返回不包含元数据的 Version 切片
+func (f *FileKVStore) readLooseHistories(ctx context.Context, historyDir string) ([]Version, error) {
 	var versions []Version
 
 	// 使用 foreachHistories 遍历所有版本文件，同时获取 hasMeta 信息
@@ -783,16 +2147,31 @@ func (f *FileKVStore) readHistories(ctx context.Context, historyDir string) ([]V
 
 	// 按版本号排序（升序）
 	sort.Slice(versions, func(i, j int) bool {
-		return versions[i].Version < versions[j].Version
+		return compareVersions(versions[i].Version, versions[j].Version) < 0
 	})
 
-	return versions, nil
+	// 整理分页期间同一个版本可能同时在默认目录和分页中，只保留分页中的，默认目录中的马上会被删除
+	deduped := versions[:0]
+	for _, version := range versions {
+		if n := len(deduped); n > 0 && deduped[n-1].Version == version.Version {
+			if strings.Contains(version.Name, "/") {
+				deduped[n-1] = version
+			}
+			continue
+		}
+		deduped = append(deduped, version)
+	}
+	return deduped, nil
 }
 
 func (f *FileKVStore) GetHistories(ctx context.Context, key string) ([]Version, error) {
 	if err := f.validateKey(key); err != nil {
 		return nil, err
 	}
+	key, err := f.followRename(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 
 	historyDir := f.keyToHistoryPath(key)
 
@@ -805,39 +2184,305 @@ func (f *FileKVStore) GetHistories(ctx context.Context, key string) ([]Version,
 	// 第二步：为有元数据的版本读取元数据
 	for i := range versions {
 		if versions[i].hasMeta {
-			metaFile := filepath.Join(historyDir, versions[i].Name+metaSuffix)
-			meta, err := f.readProperties(metaFile)
-			if err != nil && !os.IsNotExist(err) {
-				return nil, errorWrap(err, "reading meta file")
+			meta, err := f.readHistoryMeta(historyDir, versions[i])
+			if err != nil {
+				return nil, err
 			}
 			versions[i].Meta = meta
+			versions[i].Pinned = isPinnedMeta(meta)
 		}
 	}
 
 	return versions, nil
 }
 
+// GetHistoriesLimited 按从新到旧的顺序返回键的最多 maxRecords 个历史记录，还有更早的记录没有返回时 truncated 为 true
+// 它从默认目录开始，按从新到旧的顺序逐个读取分页，达到上限后就停止，不会遍历全部的历史记录，
+// 用于历史记录非常多的键。maxRecords 不大于 0 时不限制个数。
+func (f *FileKVStore) GetHistoriesLimited(ctx context.Context, key string, maxRecords int) ([]Version, bool, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, false, err
+	}
+
+	var versions []Version
+	truncated := false
+	err := f.foreachHistoriesNewestFirst(ctx, f.keyToHistoryPath(key), func(version Version) (bool, error) {
+		if maxRecords > 0 && len(versions) >= maxRecords {
+			truncated = true
+			return false, nil
+		}
+		versions = append(versions, version)
+		return true, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return versions, truncated, nil
+}
+
+// GetLatestByMeta 返回元数据中 metaKey 的值等于 metaValue 的最新版本的内容和版本信息，没有这样的版本时返回 ErrVersionNotFound
+// 它按从新到旧的顺序逐个读取元数据，找到第一个匹配的版本后就停止，如用 channel=stable 标记的最新发布版本
+func (f *FileKVStore) GetLatestByMeta(ctx context.Context, key, metaKey, metaValue string) ([]byte, *Version, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, nil, err
+	}
+
+	historyDir := f.keyToHistoryPath(key)
+	var found *Version
+	err := f.foreachHistoriesNewestFirst(ctx, historyDir, func(version Version) (bool, error) {
+		if value, ok := version.Meta[metaKey]; ok && value == metaValue {
+			found = &version
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if found == nil {
+		return nil, nil, f.versionNotFoundErr(key, historyDir, metaKey+"="+metaValue)
+	}
+
+	value, err := f.newHistoryContents(historyDir).read(*found)
+	if os.IsNotExist(err) && !found.archived {
+		// 找到之后它被整理到了分页中，按版本号重新查找
+		value, err = f.GetByVersion(ctx, key, found.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+		return value, found, nil
+	}
+	if err != nil {
+		return nil, nil, errorWrap(err, "reading history file '"+found.Name+"' of '"+key+"'")
+	}
+	value, err = f.decodeValue(key, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, found, nil
+}
+
+// foreachHistoriesNewestFirst 从默认目录开始，按从新到旧的顺序逐个读取分页，对每个历史记录（带上元数据）执行 fn
+// fn 返回 false 时停止遍历，之后的分页都不会再读取。归档中的版本按版本号插入到相应的位置，两处都有的版本只保留没有归档的
+func (f *FileKVStore) foreachHistoriesNewestFirst(ctx context.Context, historyDir string, fn func(version Version) (bool, error)) error {
+	stopped := false
+
+	// 归档只是一个文件，一次读出它的索引
+	archived, _, err := f.readArchiveIndex(historyDir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(archived, func(i, j int) bool {
+		return compareVersions(archived[i].Version, archived[j].Version) > 0
+	})
+	// emit 先把比 version 新的归档中的版本交给 fn，再把 version 交给 fn
+	emit := func(version Version) (bool, error) {
+		for len(archived) > 0 {
+			c := compareVersions(archived[0].Version, version.Version)
+			if c < 0 {
+				break
+			}
+			entry := archived[0]
+			archived = archived[1:]
+			if c == 0 {
+				continue
+			}
+			if ok, err := fn(entry.version()); err != nil || !ok {
+				return ok, err
+			}
+		}
+		return fn(version)
+	}
+
+	looseNames := map[string]struct{}{}
+	// collect 把 dir 中的历史记录按从新到旧的顺序交给 fn，返回 dir 中的分页目录
+	collect := func(dir, prefix string) ([]string, error) {
+		entries, err := f.fsys.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, errorWrap(err, "reading history directory")
+		}
+
+		var pages, names []string
+		metas := map[string]struct{}{}
+		for _, entry := range entries {
+			name := entry.Name()
+			switch {
+			case entry.IsDir():
+				if strings.HasPrefix(name, pagePrefix) {
+					pages = append(pages, name)
+				}
+			case strings.HasPrefix(name, "."):
+			case strings.HasSuffix(name, metaSuffix):
+				metas[strings.TrimSuffix(name, metaSuffix)] = struct{}{}
+			default:
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return compareVersions(names[i], names[j]) > 0
+		})
+
+		for _, name := range names {
+			version := Version{Name: name, Version: name}
+			if prefix != "" {
+				// 整理分页期间同一个版本可能同时在默认目录和分页中
+				if _, ok := looseNames[name]; ok {
+					continue
+				}
+				version.Name = prefix + "/" + name
+			} else {
+				looseNames[name] = struct{}{}
+			}
+			if _, ok := metas[name]; ok {
+				meta, err := f.readProperties(filepath.Join(dir, name+metaSuffix))
+				if err != nil && !os.IsNotExist(err) {
+					return nil, errorWrap(err, "reading meta file")
+				}
+				version.Meta = meta
+				version.Pinned = isPinnedMeta(meta)
+			}
+			ok, err := emit(version)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				stopped = true
+				return nil, nil
+			}
+		}
+		return pages, nil
+	}
+
+	pages, err := collect(historyDir, "")
+	if err != nil {
+		return err
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return compareVersions(strings.TrimPrefix(pages[i], pagePrefix), strings.TrimPrefix(pages[j], pagePrefix)) > 0
+	})
+	for _, page := range pages {
+		if stopped {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := collect(filepath.Join(historyDir, page), page); err != nil {
+			return err
+		}
+	}
+	// 剩下的归档中的版本比所有没有归档的版本都旧
+	for _, entry := range archived {
+		if stopped {
+			break
+		}
+		ok, err := fn(entry.version())
+		if err != nil {
+			return err
+		}
+		stopped = !ok
+	}
+	return nil
+}
+
+// GetHistoriesWithSizes 和 GetHistories 相同，同时填写每个版本的 Size
+// 它需要对每个历史记录执行一次 Stat，不需要大小时应该使用 GetHistories
+func (f *FileKVStore) GetHistoriesWithSizes(ctx context.Context, key string) ([]Version, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+	// 和 GetHistories 一样沿着改名标记查找，之后都使用改名后的键
+	key, err := f.followRename(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	histories, err := f.GetHistories(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.fillHistorySizes(ctx, f.keyToHistoryPath(key), histories); err != nil {
+		return nil, err
+	}
+	return histories, nil
+}
+
+// fillHistorySizes 填写 readHistories 返回的每个版本的 Size，归档中的版本的大小从归档的索引中读取
+func (f *FileKVStore) fillHistorySizes(ctx context.Context, historyDir string, histories []Version) error {
+	var archivedSizes map[string]int64
+	for i := range histories {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if histories[i].archived {
+			if archivedSizes == nil {
+				archived, _, err := f.readArchiveIndex(historyDir)
+				if err != nil {
+					return err
+				}
+				archivedSizes = make(map[string]int64, len(archived))
+				for _, entry := range archived {
+					archivedSizes[entry.Version] = entry.Size
+				}
+			}
+			histories[i].Size = archivedSizes[histories[i].Version]
+			continue
+		}
+		// Name 包含分页目录，如 "p_1672531200000000000/1672531201000000000"
+		historyFile := filepath.Join(historyDir, histories[i].Name)
+		st, err := f.fsys.Stat(historyFile)
+		if err != nil {
+			return errorWrap(err, "checking history file '"+historyFile+"'")
+		}
+		histories[i].Size = st.Size()
+	}
+	return nil
+}
+
+// GetHistoriesWithHead 返回键的所有历史记录，以及当前值（即主数据文件的内容，通常是最新的历史记录，见 GetConsistent）
+// 相当于 GetHistories 加上 Get，用于在时间线上直接显示当前值。两次读取都在键的锁的保护下执行，
+// 所以不会在中间插入一次写入，返回的历史记录和当前值是一致的
+func (f *FileKVStore) GetHistoriesWithHead(ctx context.Context, key string) ([]Version, []byte, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, nil, err
+	}
+	key, err := f.followRename(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	histories, err := f.GetHistories(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	head, err := f.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return histories, head, nil
+}
+
 func (f *FileKVStore) GetLastVersion(ctx context.Context, key string) (*Version, error) {
 	if err := f.validateKey(key); err != nil {
 		return nil, err
 	}
 
 	historyDir := f.keyToHistoryPath(key)
-	var maxTime int64 = 0
 	var latestVersionName string
+	var latestVersion string
 	var latestHistoryFile string
 	var hasMeta bool
 
 	// 使用 foreachHistories 遍历所有版本文件，找到最新版本
 	errList := f.foreachHistories(historyDir, func(historyFile, name, version string, metaExists bool, info fs.DirEntry) (bool, error) {
-		timestamp, err := strconv.ParseInt(version, 10, 64)
-		if err != nil {
-			return true, nil
-		}
-
-		if timestamp > maxTime {
-			maxTime = timestamp
+		if latestVersion == "" || compareVersions(version, latestVersion) > 0 {
 			latestVersionName = name
+			latestVersion = version
 			latestHistoryFile = historyFile
 			hasMeta = metaExists
 		}
@@ -848,8 +2493,8 @@ func (f *FileKVStore) GetLastVersion(ctx context.Context, key string) (*Version,
 		return nil, errors.Join(errList...)
 	}
 
-	if maxTime == 0 {
-		return nil, errorWrap(os.ErrNotExist, "no history found for key '"+key+"'")
+	if latestVersion == "" {
+		return nil, f.noHistoryErr(key)
 	}
 
 	// 读取元数据
@@ -864,8 +2509,108 @@ func (f *FileKVStore) GetLastVersion(ctx context.Context, key string) (*Version,
 
 	return &Version{
 		Name:    latestVersionName,
-		Version: strconv.FormatInt(maxTime, 10),
+		Version: latestVersion,
+		Meta:    meta,
+		Pinned:  isPinnedMeta(meta),
+	}, nil
+}
+
+// GetFirstVersion 返回键最早的历史记录，用于显示键的创建时间，没有历史记录时返回 ErrKeyNotFound
+// 分页目录按其中第一个版本命名，所以最早的记录只可能在编号最小的分页、默认目录或者归档中，
+// 只需要读取这两个目录和归档的索引，不需要遍历所有的历史记录
+func (f *FileKVStore) GetFirstVersion(ctx context.Context, key string) (*Version, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+
+	historyDir := f.keyToHistoryPath(key)
+
+	// earliest 返回 dir 中最早的历史记录和它是否有元数据，以及 dir 下编号最小的分页目录
+	earliest := func(dir string) (string, bool, string, error) {
+		entries, err := f.fsys.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", false, "", nil
+			}
+			return "", false, "", errorWrap(err, "reading history directory")
+		}
+
+		var first, firstPage string
+		metas := map[string]struct{}{}
+		for _, entry := range entries {
+			name := entry.Name()
+			switch {
+			case entry.IsDir():
+				if strings.HasPrefix(name, pagePrefix) && (firstPage == "" ||
+					compareVersions(strings.TrimPrefix(name, pagePrefix), strings.TrimPrefix(firstPage, pagePrefix)) < 0) {
+					firstPage = name
+				}
+			case strings.HasPrefix(name, "."):
+			case strings.HasSuffix(name, metaSuffix):
+				metas[strings.TrimSuffix(name, metaSuffix)] = struct{}{}
+			default:
+				if first == "" || compareVersions(name, first) < 0 {
+					first = name
+				}
+			}
+		}
+		_, hasMeta := metas[first]
+		return first, hasMeta, firstPage, nil
+	}
+
+	first, hasMeta, firstPage, err := earliest(historyDir)
+	if err != nil {
+		return nil, err
+	}
+	name := first
+	if firstPage != "" {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pageFirst, pageHasMeta, _, err := earliest(filepath.Join(historyDir, firstPage))
+		if err != nil {
+			return nil, err
+		}
+		if pageFirst != "" && (first == "" || compareVersions(pageFirst, first) < 0) {
+			first = pageFirst
+			hasMeta = pageHasMeta
+			name = firstPage + "/" + pageFirst
+		}
+	}
+
+	// 归档中的版本可能更早
+	archived, _, err := f.readArchiveIndex(historyDir)
+	if err != nil {
+		return nil, err
+	}
+	var earliestArchived *archiveEntry
+	for i := range archived {
+		if earliestArchived == nil || compareVersions(archived[i].Version, earliestArchived.Version) < 0 {
+			earliestArchived = &archived[i]
+		}
+	}
+	if earliestArchived != nil && (first == "" || compareVersions(earliestArchived.Version, first) < 0) {
+		version := earliestArchived.version()
+		return &version, nil
+	}
+
+	if first == "" {
+		return nil, errorWrap(ErrKeyNotFound, "no history found for key '"+key+"'")
+	}
+
+	var meta map[string]string
+	if hasMeta {
+		meta, err = f.readProperties(filepath.Join(historyDir, name+metaSuffix))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errorWrap(err, "reading meta file")
+		}
+	}
+	return &Version{
+		Name:    name,
+		Version: first,
 		Meta:    meta,
+		Pinned:  isPinnedMeta(meta),
+		hasMeta: hasMeta,
 	}, nil
 }
 
@@ -882,7 +2627,7 @@ func (f *FileKVStore) GetPrevVersion(ctx context.Context, key, revision string)
 		return nil, err
 	}
 	if len(histories) == 0 {
-		return nil, errorWrap(os.ErrNotExist, "no history found for key '"+key+"'")
+		return nil, f.noHistoryErr(key)
 	}
 
 	// Find the target version index
@@ -891,102 +2636,277 @@ func (f *FileKVStore) GetPrevVersion(ctx context.Context, key, revision string)
 		// For HEAD, we want the previous of the last version
 		if len(histories) < 2 {
 			// No previous version
-			return nil, errorWrap(os.ErrNotExist, "no previous version found")
+			return nil, errorWrap(ErrVersionNotFound, "no previous version found")
 		}
 		targetIndex = len(histories) - 1
 	} else {
 		// Find the index of the specified revision
-		for i, v := range histories {
-			if v.Version == revision {
-				targetIndex = i
-				break
-			}
-		}
-
+		targetIndex = indexOfVersion(histories, revision)
 		if targetIndex == -1 {
-			return nil, errorWrap(os.ErrNotExist, "version '"+revision+"' not found for key '"+key+"'")
+			return nil, errorWrap(ErrVersionNotFound, "version '"+revision+"' not found for key '"+key+"'")
 		}
 	}
 
 	// Get the previous version
 	if targetIndex == 0 {
-		// No previous version
-		return nil, errorWrap(os.ErrNotExist, "no previous version found")
+		// No previous version
+		return nil, errorWrap(ErrVersionNotFound, "no previous version found")
+	}
+
+	return &histories[targetIndex-1], nil
+}
+
+// indexOfVersion 返回 version 在 histories 中的位置，不存在时返回 -1
+func indexOfVersion(histories []Version, version string) int {
+	for i, v := range histories {
+		if v.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *FileKVStore) GetNextVersion(ctx context.Context, key, revision string) (*Version, error) {
+	if isHeadRevision(revision) {
+		return nil, errorWrap(ErrVersionNotFound, "no next version found")
+	}
+
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+
+	historyDir := f.keyToHistoryPath(key)
+
+	// Get all histories (using readHistories instead of GetHistories for better performance)
+	histories, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(histories) == 0 {
+		return nil, f.noHistoryErr(key)
+	}
+
+	// Find the index of the specified revision
+	targetIndex := indexOfVersion(histories, revision)
+	if targetIndex == -1 {
+		return nil, errorWrap(ErrVersionNotFound, "version '"+revision+"' not found for key '"+key+"'")
+	}
+
+	// Get the next version
+	if targetIndex == len(histories)-1 {
+		// No next version
+		return nil, errorWrap(ErrVersionNotFound, "no next version found")
+	}
+
+	return &histories[targetIndex+1], nil
+}
+
+// GetVersionPair 返回指定版本和它的前一个版本的内容和元数据，用于显示这个版本修改了什么
+// version 为 head 时表示最后一次历史记录，和 GetByVersion 相同，也可以是不带计数后缀的时间戳，
+// 没有前一个版本时 prev 和 prevVer 为 nil
+func (f *FileKVStore) GetVersionPair(ctx context.Context, key, version string) (prev, cur []byte, prevVer, curVer *Version, err error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	release := f.refs.acquire(key)
+	defer release()
+
+	historyDir := f.keyToHistoryPath(key)
+	histories, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	var targetIndex int
+	if isHeadRevision(version) {
+		targetIndex = len(histories) - 1
+	} else {
+		targetIndex = indexOfVersion(histories, version)
+		if targetIndex < 0 {
+			// version 可能是不带计数后缀的时间戳，而磁盘上的历史记录带有 "_N" 后缀
+			if historyFile, ok := f.resolveCollidedVersion(historyDir, version); ok {
+				targetIndex = indexOfVersion(histories, filepath.Base(historyFile))
+			}
+		}
+	}
+	if targetIndex < 0 {
+		return nil, nil, nil, nil, errorWrap(ErrVersionNotFound, "version '"+version+"' not found for key '"+key+"'")
+	}
+
+	contents := f.newHistoryContents(historyDir)
+	curVer = &histories[targetIndex]
+	cur, err = f.readVersionWithMeta(key, historyDir, contents, curVer)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if targetIndex == 0 {
+		return nil, cur, nil, curVer, nil
 	}
 
-	return &histories[targetIndex-1], nil
+	prevVer = &histories[targetIndex-1]
+	prev, err = f.readVersionWithMeta(key, historyDir, contents, prevVer)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return prev, cur, prevVer, curVer, nil
 }
 
-func (f *FileKVStore) GetNextVersion(ctx context.Context, key, revision string) (*Version, error) {
-	if isHeadRevision(revision) {
-		return nil, errorWrap(os.ErrNotExist, "no next version found")
+// readVersionWithMeta 读取版本的内容并变换为逻辑内容，同时为 version 填充元数据
+func (f *FileKVStore) readVersionWithMeta(key, historyDir string, contents *historyContents, version *Version) ([]byte, error) {
+	data, err := contents.read(*version)
+	if err != nil {
+		return nil, errorWrap(err, "reading history")
 	}
-
-	if err := f.validateKey(key); err != nil {
+	meta, err := f.readHistoryMeta(historyDir, *version)
+	if err != nil {
 		return nil, err
 	}
+	version.Meta = meta
+	version.Pinned = isPinnedMeta(meta)
+	return f.decodeValue(key, data)
+}
 
-	historyDir := f.keyToHistoryPath(key)
-
-	// Get all histories (using readHistories instead of GetHistories for better performance)
-	histories, err := f.readHistories(ctx, historyDir)
-	if err != nil {
-		return nil, err
+// ResolveVersion 把 version 解析为具体的版本号
+// version 为 "head"/"HEAD" 时返回最后一次历史记录的版本号，为 "head~N" 时返回倒数第 N+1 个历史记录的版本号，
+// 否则检查该版本存在后原样返回（不带计数后缀的时间戳会被解析为实际的版本号）
+func (f *FileKVStore) ResolveVersion(ctx context.Context, key, version string) (string, error) {
+	if err := f.validateKey(key); err != nil {
+		return "", err
 	}
-	if len(histories) == 0 {
-		return nil, errorWrap(os.ErrNotExist, "no history found for key '"+key+"'")
+
+	if isHeadRevision(version) {
+		last, err := f.GetLastVersion(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		return last.Version, nil
 	}
 
-	// Find the target version index
-	targetIndex := -1
-	// Find the index of the specified revision
-	for i, v := range histories {
-		if v.Version == revision {
-			targetIndex = i
-			break
+	if n, ok, err := parseHeadOffset(version); ok {
+		if err != nil {
+			return "", err
+		}
+		histories, err := f.readHistories(ctx, f.keyToHistoryPath(key))
+		if err != nil {
+			return "", err
+		}
+		if n >= len(histories) {
+			return "", errorWrap(ErrVersionNotFound, "version '"+version+"' not found for key '"+key+"'")
 		}
+		return histories[len(histories)-1-n].Version, nil
 	}
 
-	if targetIndex == -1 {
-		return nil, errorWrap(os.ErrNotExist, "version '"+revision+"' not found for key '"+key+"'")
+	historyFile, err := f.resolveHistoryFile(ctx, key, version)
+	if err != nil {
+		if !errors.Is(err, ErrVersionNotFound) {
+			return "", err
+		}
+		_, ok, archiveErr := f.findArchivedVersion(f.keyToHistoryPath(key), version)
+		if archiveErr != nil {
+			return "", archiveErr
+		}
+		if !ok {
+			return "", err
+		}
+		return version, nil
 	}
+	return filepath.Base(historyFile), nil
+}
 
-	// Get the next version
-	if targetIndex == len(histories)-1 {
-		// No next version
-		return nil, errorWrap(os.ErrNotExist, "no next version found")
+// resolveHistoryFile 查找具体的版本（不能是 head）对应的历史记录文件路径
+// 依次查找默认目录、分页子目录，以及不带计数后缀的时间戳对应的冲突版本
+func (f *FileKVStore) resolveHistoryFile(ctx context.Context, key, version string) (string, error) {
+	historyDir := f.keyToHistoryPath(key)
+	historyFile := filepath.Join(historyDir, version)
+	_, err := f.fsys.Stat(historyFile)
+	if err == nil {
+		return historyFile, nil
+	}
+	if !isNotExist(err) {
+		return "", errorWrap(err, "checking version '"+version+"'")
+	}
+	historyFile, err = f.searchVersionInSubDirs(ctx, historyDir, version, func(versionFile string) error {
+		_, err := f.fsys.Stat(versionFile)
+		return err
+	})
+	if err == nil {
+		return historyFile, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errorWrap(err, "checking version '"+version+"'")
 	}
+	if historyFile, ok := f.resolveCollidedVersion(historyDir, version); ok {
+		return historyFile, nil
+	}
+	return "", errorWrap(ErrVersionNotFound, "version '"+version+"' not found for key '"+key+"'")
+}
 
-	return &histories[targetIndex+1], nil
+// parseHeadOffset 解析 "head~N" 形式的版本，ok 表示 version 是否是这种形式
+func parseHeadOffset(version string) (int, bool, error) {
+	idx := strings.IndexByte(version, '~')
+	if idx <= 0 || !isHeadRevision(version[:idx]) {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(version[idx+1:])
+	if err != nil || n < 0 {
+		return 0, true, errorWrap(ErrVersionNotFound, "invalid version '"+version+"'")
+	}
+	return n, true, nil
 }
 
 func (f *FileKVStore) CleanupHistoriesByTime(ctx context.Context, key string, maxAge time.Duration) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
 	if err := f.validateKey(key); err != nil {
 		return err
 	}
 
+	// 还原归档和删除历史记录时不能有并发的 ArchiveKey、SetMeta 等修改历史目录的操作
+	unlock := f.lockKey(key)
+	defer unlock()
+
 	historyDir := f.keyToHistoryPath(key)
-	cutoffTime := timex.Now().Add(-maxAge).Unix()
+	cutoffTime := timex.Now().Add(-maxAge).UnixNano()
+	defer f.quota.invalidate()
+
+	// 归档中有需要清理的历史记录时先还原整个归档
+	err := f.unarchiveIf(ctx, historyDir, func(entry archiveEntry) bool {
+		timestamp, _, err := parseVersion(entry.Version)
+		return err == nil && timestamp < cutoffTime
+	})
+	if err != nil {
+		return err
+	}
 
 	errList := f.foreachHistories(historyDir, func(historyFile, name, version string, hasMeta bool, info fs.DirEntry) (bool, error) {
-		timestamp, err := strconv.ParseInt(version, 10, 64)
+		timestamp, _, err := parseVersion(version)
 		if err != nil {
 			return true, nil
 		}
 
 		if timestamp < cutoffTime {
+			if hasMeta {
+				pinned, err := f.isPinned(historyFile)
+				if err != nil || pinned {
+					return true, err
+				}
+			}
 			// Remove the history file and its meta file
-			if err := os.Remove(historyFile); err != nil && !os.IsNotExist(err) {
+			if err := f.fsys.Remove(historyFile); err != nil && !os.IsNotExist(err) {
 				return true, errorWrap(err, "removing history file")
 			}
 			if hasMeta {
-				if err := os.Remove(historyFile + metaSuffix); err != nil && !os.IsNotExist(err) {
+				if err := f.fsys.Remove(historyFile + metaSuffix); err != nil && !os.IsNotExist(err) {
 					return true, errorWrap(err, "removing history meta file")
 				}
 			}
 		}
 		return true, nil
 	})
+	if err := f.rebuildRecentIndex(ctx, key); err != nil {
+		errList = append(errList, err)
+	}
 
 	if len(errList) > 0 {
 		if len(errList) == 1 {
@@ -999,51 +2919,76 @@ func (f *FileKVStore) CleanupHistoriesByTime(ctx context.Context, key string, ma
 }
 
 func (f *FileKVStore) CleanupHistoriesByCount(ctx context.Context, key string, maxCount int) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
 	if err := f.validateKey(key); err != nil {
 		return err
 	}
 
-	historyDir := f.keyToHistoryPath(key)
+	unlock := f.lockKey(key)
+	defer unlock()
 
-	// Collect all history files
-	var allHistories []Version
+	historyDir := f.keyToHistoryPath(key)
 
-	errList := f.foreachHistories(historyDir, func(historyFile, name, version string, hasMeta bool, info fs.DirEntry) (bool, error) {
-		allHistories = append(allHistories, Version{
-			Name:    name,
-			Version: version,
-			hasMeta: hasMeta,
-		})
-		return true, nil
-	})
+	// Collect all history files, sorted by timestamp (oldest first)
+	allHistories, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return err
+	}
 
-	if len(errList) > 0 {
-		if len(errList) == 1 {
-			return errList[0]
+	removed, err := f.trimHistories(ctx, historyDir, allHistories, maxCount)
+	if removed > 0 {
+		if rebuildErr := f.rebuildRecentIndex(ctx, key); rebuildErr != nil && err == nil {
+			err = rebuildErr
 		}
-		return errors.Join(errList...)
 	}
+	return err
+}
 
-	// Sort by timestamp (oldest first)
-	sort.Slice(allHistories, func(i, j int) bool {
-		return allHistories[i].Version < allHistories[j].Version
-	})
-
+// trimHistories 删除最旧的历史记录，只保留最新的 maxCount 个（被固定的版本不删除）
+// histories 必须已按时间升序排列，返回删除的历史记录数。调用者必须持有键的锁（见 lockKey），
+// 因为它可能需要还原归档，并且 histories 要在持有锁之后读取
+func (f *FileKVStore) trimHistories(ctx context.Context, historyDir string, histories []Version, maxCount int) (int, error) {
 	// Determine which histories to keep
-	if len(allHistories) <= maxCount {
-		return nil
+	if len(histories) <= maxCount {
+		return 0, nil
+	}
+	toRemove := histories[:len(histories)-maxCount]
+	defer f.quota.invalidate()
+
+	// 归档中的历史记录不能单独删除，先还原整个归档，还原后的文件名就是版本号
+	for _, history := range toRemove {
+		if history.archived {
+			if err := f.unarchiveIf(ctx, historyDir, nil); err != nil {
+				return 0, err
+			}
+			break
+		}
 	}
-	toRemove := allHistories[:len(allHistories)-maxCount]
 
 	// Delete histories that should be removed
+	removed := 0
 	var deleteErrList []error
 	for _, history := range toRemove {
 		historyFile := filepath.Join(historyDir, history.Name)
-		if err := os.Remove(historyFile); err != nil && !os.IsNotExist(err) {
+		if history.hasMeta {
+			pinned, err := f.isPinned(historyFile)
+			if err != nil {
+				deleteErrList = append(deleteErrList, err)
+				continue
+			}
+			if pinned {
+				continue
+			}
+		}
+		if err := f.fsys.Remove(historyFile); err != nil && !os.IsNotExist(err) {
 			deleteErrList = append(deleteErrList, errorWrap(err, "removing history file '"+historyFile+"'"))
+			continue
 		}
+		removed++
 		if history.hasMeta {
-			if err := os.Remove(historyFile + metaSuffix); err != nil && !os.IsNotExist(err) {
+			if err := f.fsys.Remove(historyFile + metaSuffix); err != nil && !os.IsNotExist(err) {
 				deleteErrList = append(deleteErrList, errorWrap(err, "removing meta file for '"+historyFile+"'"))
 			}
 		}
@@ -1051,87 +2996,346 @@ func (f *FileKVStore) CleanupHistoriesByCount(ctx context.Context, key string, m
 
 	if len(deleteErrList) > 0 {
 		if len(deleteErrList) == 1 {
-			return deleteErrList[0]
+			return removed, deleteErrList[0]
 		}
-		return errors.Join(deleteErrList...)
+		return removed, errors.Join(deleteErrList...)
 	}
 
-	return nil
+	return removed, nil
+}
+
+// CapHistoriesPerKey 遍历一次整个历史记录目录，把每个键的历史记录裁剪到最新的 maxCount 个
+// 被固定的版本不会被删除，返回每个键删除的历史记录数（没有删除的键不在结果中）
+func (f *FileKVStore) CapHistoriesPerKey(ctx context.Context, maxCount int) (map[string]int, error) {
+	if f.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	historyRoot := filepath.Join(f.rootDir, historyDirConst)
+	results := map[string]int{}
+	var errList []error
+
+	err := fs.WalkDir(f.fsys, historyRoot, func(pa string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errorWrap(err, "accessing path "+pa)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.IsDir() || !strings.HasSuffix(d.Name(), historyDirSuffix) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(historyRoot, pa)
+		if err != nil {
+			return errorWrap(err, "getting relative path for "+pa)
+		}
+		key := strings.ReplaceAll(strings.TrimSuffix(relPath, historyDirSuffix), "\\", "/")
+
+		unlock := f.lockKey(key)
+		defer unlock()
+
+		histories, err := f.readHistories(ctx, pa)
+		if err != nil {
+			errList = append(errList, errorWrap(err, "reading histories of '"+key+"'"))
+			return filepath.SkipDir
+		}
+		removed, err := f.trimHistories(ctx, pa, histories, maxCount)
+		if removed > 0 {
+			results[key] = removed
+			if err := f.rebuildRecentIndex(ctx, key); err != nil {
+				errList = append(errList, err)
+			}
+		}
+		if err != nil {
+			errList = append(errList, err)
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		errList = append(errList, err)
+	}
+
+	if len(errList) > 0 {
+		if len(errList) == 1 {
+			return results, errList[0]
+		}
+		return results, errors.Join(errList...)
+	}
+	return results, nil
 }
 
 // organizeHistoriesIfNeeded 组织历史记录到子目录中（如果需要）
-// 如果某个键的历史记录数量超过 maxHistoryCount，则将较早的历史记录移动到按时间命名的子目录中
+// 如果某个键的历史记录数量超过 f.maxHistoryCount，则将较早的历史记录移动到按时间命名的子目录中
 // 最新的历史记录仍保留在默认目录下。
+// 每一页先在临时目录中用硬链接（或复制）建好，再整体改名为最终的 p_<first> 目录，最后删除默认目录中的原文件，
+// 所以任何时候每个历史记录都能在默认目录或者分页中读到。中途被中断时，下次整理会删除临时目录，
+// 以及默认目录中已经在分页中的重复记录。
 func (f *FileKVStore) organizeHistoriesIfNeeded(key, historyDir string) error {
+	defer f.pages.invalidate(historyDir)
+
 	var allHistories []string
 
-	// Add histories from default directory
-	entries, err := os.ReadDir(historyDir)
+	// Add histories from default directory
+	entries, err := f.fsys.ReadDir(historyDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // 如果历史目录不存在，无需处理
+		}
+		return errorWrap(err, "reading history path")
+	}
+	recovered, err := f.recoverTempPages(historyDir, entries)
+	if err != nil {
+		return err
+	}
+	// 上次整理在改名分页目录之后、删除原文件之前中断时，默认目录中还有已经在分页中的版本
+	removed, err := f.removePagedDuplicates(historyDir, entries)
+	if err != nil {
+		return err
+	}
+	if recovered || removed {
+		entries, err = f.fsys.ReadDir(historyDir)
+		if err != nil {
+			return errorWrap(err, "reading history path")
+		}
+	}
+	metas := map[string]struct{}{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			// Skip subdirectories for now, we'll process them separately
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue // Skip . files
+		}
+		if strings.HasSuffix(entry.Name(), metaSuffix) {
+			metas[strings.TrimSuffix(entry.Name(), metaSuffix)] = struct{}{}
+			continue // Skip meta files
+		}
+		allHistories = append(allHistories, entry.Name())
+	}
+	// Sort by timestamp (oldest first)
+	sort.Slice(allHistories, func(i, j int) bool {
+		return compareVersions(allHistories[i], allHistories[j]) < 0
+	})
+
+	// 保留最新的一个在默认目录（如果有历史记录）
+	allHistoriesForOrganizing := allHistories
+	if len(allHistoriesForOrganizing) > 1 {
+		allHistoriesForOrganizing = allHistoriesForOrganizing[:len(allHistoriesForOrganizing)-1]
+	}
+
+	// 按 f.maxHistoryCount 分组
+	for len(allHistoriesForOrganizing) >= f.maxHistoryCount {
+		pageHistories := allHistoriesForOrganizing[:f.maxHistoryCount]
+		pageDirName := pagePrefix + pageHistories[0]
+		pageDirPath := filepath.Join(historyDir, pageDirName)
+		tempDirPath := filepath.Join(historyDir, tempPagePrefix+pageDirName)
+
+		// 创建临时子目录
+		err = f.fsys.MkdirAll(tempDirPath, f.dirPerm)
+		if err != nil {
+			return errorWrap(err, "creating page directory")
+		}
+
+		// 把该页的历史记录链接（不支持时复制）到临时子目录，原来的文件留在默认目录中，
+		// 所以整理期间或者中途崩溃时读者仍然能在默认目录中找到它们
+		for _, historyName := range pageHistories {
+			oldPath := filepath.Join(historyDir, historyName)
+			newPath := filepath.Join(tempDirPath, historyName)
+			if err := f.linkOrCopyFile(oldPath, newPath); err != nil {
+				return errorWrap(err, "copying history file from "+oldPath+" to "+newPath)
+			}
+			if _, exists := metas[historyName]; exists {
+				if err := f.linkOrCopyFile(oldPath+metaSuffix, newPath+metaSuffix); err != nil && !os.IsNotExist(err) {
+					return errorWrap(err, "copying history meta file from "+oldPath+metaSuffix+" to "+newPath+metaSuffix)
+				}
+			}
+		}
+
+		// 临时子目录整体改名为最终的分页目录，之后再删除默认目录中的原文件，
+		// 这期间同一个版本同时出现在两个目录中，读者会去掉重复的版本
+		if err := f.fsys.Rename(tempDirPath, pageDirPath); err != nil {
+			return errorWrap(err, "renaming page directory from "+tempDirPath+" to "+pageDirPath)
+		}
+		f.pages.invalidate(historyDir)
+		if err := f.removeDuplicateRecords(historyDir, pageHistories); err != nil {
+			return err
+		}
+		allHistoriesForOrganizing = allHistoriesForOrganizing[f.maxHistoryCount:]
+	}
+	return nil
+}
+
+// linkOrCopyFile 把 oldPath 硬链接为 newPath，FS 不支持硬链接时复制它的内容
+func (f *FileKVStore) linkOrCopyFile(oldPath, newPath string) error {
+	if linker, ok := f.fsys.(LinkFS); ok {
+		if err := linker.Link(oldPath, newPath); err == nil || os.IsNotExist(err) {
+			return err
+		}
+	}
+	data, err := f.fsys.ReadFile(oldPath)
+	if err != nil {
+		return err
+	}
+	return f.fsys.WriteFile(newPath, data, f.filePerm)
+}
+
+// removeDuplicateRecords 删除默认目录中已经复制到分页中的历史记录和它们的元数据
+func (f *FileKVStore) removeDuplicateRecords(historyDir string, names []string) error {
+	for _, name := range names {
+		historyFile := filepath.Join(historyDir, name)
+		if err := f.fsys.Remove(historyFile + metaSuffix); err != nil && !os.IsNotExist(err) {
+			return errorWrap(err, "removing history meta file "+historyFile+metaSuffix)
+		}
+		if err := f.fsys.Remove(historyFile); err != nil && !os.IsNotExist(err) {
+			return errorWrap(err, "removing history file "+historyFile)
+		}
+	}
+	return nil
+}
+
+// removePagedDuplicates 删除默认目录中同时也在某个分页中的历史记录，返回是否删除了
+func (f *FileKVStore) removePagedDuplicates(historyDir string, entries []fs.DirEntry) (bool, error) {
+	loose := map[string]struct{}{}
+	var pages []string
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+			if strings.HasPrefix(name, pagePrefix) {
+				pages = append(pages, name)
+			}
+		case strings.HasPrefix(name, "."), strings.HasSuffix(name, metaSuffix):
+		default:
+			loose[name] = struct{}{}
+		}
+	}
+	if len(pages) == 0 || len(loose) == 0 {
+		return false, nil
+	}
+
+	var duplicates []string
+	for _, page := range pages {
+		pageEntries, err := f.fsys.ReadDir(filepath.Join(historyDir, page))
+		if err != nil {
+			return false, errorWrap(err, "reading page directory")
+		}
+		for _, entry := range pageEntries {
+			if _, ok := loose[entry.Name()]; ok && !entry.IsDir() {
+				duplicates = append(duplicates, entry.Name())
+			}
+		}
+	}
+	if len(duplicates) == 0 {
+		return false, nil
+	}
+	return true, f.removeDuplicateRecords(historyDir, duplicates)
+}
+
+// recoverTempPages 删除上次整理被中断时留下的临时分页目录，其中的历史记录在默认目录中都还有原文件；
+// 旧版本的整理是把历史记录移动到临时分页目录中的，这样的记录要移回默认目录。返回是否有临时目录被处理
+func (f *FileKVStore) recoverTempPages(historyDir string, entries []fs.DirEntry) (bool, error) {
+	recovered := false
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), tempPagePrefix) {
+			continue
+		}
+		recovered = true
+
+		tempDirPath := filepath.Join(historyDir, entry.Name())
+		tempEntries, err := f.fsys.ReadDir(tempDirPath)
+		if err != nil {
+			return recovered, errorWrap(err, "reading temporary page directory")
+		}
+		for _, tempEntry := range tempEntries {
+			oldPath := filepath.Join(tempDirPath, tempEntry.Name())
+			newPath := filepath.Join(historyDir, tempEntry.Name())
+			if _, err := f.fsys.Stat(newPath); err == nil {
+				if err := f.fsys.Remove(oldPath); err != nil {
+					return recovered, errorWrap(err, "removing temporary history file "+oldPath)
+				}
+				continue
+			}
+			if err := f.fsys.Rename(oldPath, newPath); err != nil {
+				return recovered, errorWrap(err, "moving history file from "+oldPath+" to "+newPath)
+			}
+		}
+		if err := f.fsys.Remove(tempDirPath); err != nil {
+			return recovered, errorWrap(err, "removing temporary page directory")
+		}
+	}
+	return recovered, nil
+}
+
+// relocateMisfiledRecords 检查分页目录中的每个历史记录是否在分页的范围内，即不早于本分页的第一个版本，
+// 并且早于下一个分页的第一个版本，把不在范围内的记录（和它的元数据）移到正确的分页，
+// 比第一个分页还早的记录移到默认目录中
+func (f *FileKVStore) relocateMisfiledRecords(historyDir string) error {
+	entries, err := f.fsys.ReadDir(historyDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // 如果历史目录不存在，无需处理
+			return nil
 		}
 		return errorWrap(err, "reading history path")
 	}
-	metas := map[string]struct{}{}
+	var pages []string
 	for _, entry := range entries {
-		if entry.IsDir() {
-			// Skip subdirectories for now, we'll process them separately
-			continue
-		}
-		if strings.HasPrefix(entry.Name(), ".") {
-			continue // Skip . files
-		}
-		if strings.HasSuffix(entry.Name(), metaSuffix) {
-			metas[strings.TrimSuffix(entry.Name(), metaSuffix)] = struct{}{}
-			continue // Skip meta files
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), pagePrefix) {
+			pages = append(pages, entry.Name())
 		}
-		allHistories = append(allHistories, entry.Name())
 	}
-	// Sort by timestamp (oldest first)
-	sort.Slice(allHistories, func(i, j int) bool {
-		return allHistories[i] < allHistories[j]
+	if len(pages) == 0 {
+		return nil
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return compareVersions(strings.TrimPrefix(pages[i], pagePrefix), strings.TrimPrefix(pages[j], pagePrefix)) < 0
 	})
 
-	// 保留最新的一个在默认目录（如果有历史记录）
-	allHistoriesForOrganizing := allHistories
-	if len(allHistoriesForOrganizing) > 1 {
-		allHistoriesForOrganizing = allHistoriesForOrganizing[:len(allHistoriesForOrganizing)-1]
+	// targetDir 返回 version 应该所在的目录
+	targetDir := func(version string) string {
+		i := sort.Search(len(pages), func(i int) bool {
+			return compareVersions(strings.TrimPrefix(pages[i], pagePrefix), version) > 0
+		})
+		if i == 0 {
+			return historyDir
+		}
+		return filepath.Join(historyDir, pages[i-1])
 	}
 
-	// 按 maxHistoryCount 分组
-	for len(allHistoriesForOrganizing) >= maxHistoryCount {
-		pageHistories := allHistoriesForOrganizing[:maxHistoryCount]
-		pageDirName := pagePrefix + pageHistories[0]
-		pageDirPath := filepath.Join(historyDir, pageDirName)
-
-		// 创建子目录
-		err = os.MkdirAll(pageDirPath, 0755)
+	relocated := false
+	for _, page := range pages {
+		pageDir := filepath.Join(historyDir, page)
+		pageEntries, err := f.fsys.ReadDir(pageDir)
 		if err != nil {
-			return errorWrap(err, "creating page directory")
+			return errorWrap(err, "reading page directory")
 		}
+		for _, entry := range pageEntries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, metaSuffix) {
+				continue
+			}
+			target := targetDir(name)
+			if target == pageDir {
+				continue
+			}
 
-		// 将该页的历史记录移动到子目录
-		for _, historyName := range pageHistories {
-			oldPath := filepath.Join(historyDir, historyName)
-			newPath := filepath.Join(pageDirPath, historyName)
-
-			if err := os.Rename(oldPath, newPath); err != nil {
+			oldPath := filepath.Join(pageDir, name)
+			newPath := filepath.Join(target, name)
+			if err := f.fsys.Rename(oldPath, newPath); err != nil {
 				return errorWrap(err, "moving history file from "+oldPath+" to "+newPath)
 			}
-
-			_, exists := metas[historyName]
-			if exists {
-				oldMetaPath := oldPath + metaSuffix
-				newMetaPath := newPath + metaSuffix
-				if _, statErr := os.Stat(oldMetaPath); statErr == nil {
-					if err := os.Rename(oldMetaPath, newMetaPath); err != nil {
-						return errorWrap(err, "moving history meta file from "+oldMetaPath+" to "+newMetaPath)
-					}
-				}
+			if err := f.fsys.Rename(oldPath+metaSuffix, newPath+metaSuffix); err != nil && !os.IsNotExist(err) {
+				return errorWrap(err, "moving history meta file from "+oldPath+metaSuffix+" to "+newPath+metaSuffix)
 			}
+			relocated = true
 		}
-		allHistoriesForOrganizing = allHistoriesForOrganizing[200:]
+	}
+	if relocated {
+		f.pages.invalidate(historyDir)
 	}
 	return nil
 }
@@ -1143,27 +3347,9 @@ func (f *FileKVStore) walkAndOrganizeHistories(ctx context.Context) error {
 		return errorWrap(err, "listing all keys from main directory")
 	}
 
-	var errList []error
-	for _, key := range allMainKeys {
-		if validateErr := f.validateKey(key); validateErr != nil {
-			if f.ignoreWarning {
-				errList = append(errList, errorWrap(validateErr, "invalid key found during organization: "+key))
-				continue
-			} else {
-				return errorWrap(validateErr, "invalid key found during organization: "+key)
-			}
-		}
-
-		historyDir := f.keyToHistoryPath(key)
-		err := f.organizeHistoriesIfNeeded(key, historyDir)
-		if err != nil {
-			if f.ignoreWarning {
-				errList = append(errList, err)
-				continue
-			} else {
-				return err
-			}
-		}
+	errList, err := f.forEachKey(ctx, allMainKeys, f.organizeKeyHistories)
+	if err != nil {
+		return err
 	}
 
 	if len(errList) > 0 {
@@ -1176,16 +3362,200 @@ func (f *FileKVStore) walkAndOrganizeHistories(ctx context.Context) error {
 	return nil
 }
 
+// organizeKeyHistories 把一个键放错分页的历史记录移到正确的分页，并在需要时组织成分页，返回警告和致命错误
+func (f *FileKVStore) organizeKeyHistories(key string) ([]error, error) {
+	if validateErr := f.validateKey(key); validateErr != nil {
+		if f.ignoreWarning {
+			return []error{errorWrap(validateErr, "invalid key found during organization: "+key)}, nil
+		} else {
+			return nil, errorWrap(validateErr, "invalid key found during organization: "+key)
+		}
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	historyDir := f.keyToHistoryPath(key)
+	err := f.relocateMisfiledRecords(historyDir)
+	if err == nil {
+		err = f.organizeHistoriesIfNeeded(key, historyDir)
+	}
+	if err != nil {
+		if f.ignoreWarning {
+			return []error{err}, nil
+		} else {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// forEachKey 对每个键执行 fn，收集 fn 返回的警告
+// fn 返回的致命错误会停止处理剩下的键并返回该错误。设置了 WithFsckConcurrency 时用有限个 goroutine 并发执行，
+// 这时 fn 必须是并发安全的，已经开始处理的键会执行完，警告的顺序也不固定。
+// 设置了 WithFsckMaxOpenDirs 时，同时执行的 fn（每个处理一个键的历史目录）不超过它的个数
+func (f *FileKVStore) forEachKey(ctx context.Context, keys []string, fn func(key string) ([]error, error)) ([]error, error) {
+	if f.fsckMaxOpenDirs > 0 && f.fsckConcurrency > f.fsckMaxOpenDirs {
+		sem := make(chan struct{}, f.fsckMaxOpenDirs)
+		next := fn
+		fn = func(key string) ([]error, error) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			return next(key)
+		}
+	}
+
+	var warnings []error
+	if f.fsckConcurrency <= 1 {
+		for _, key := range keys {
+			errs, err := fn(key)
+			warnings = append(warnings, errs...)
+			if err != nil {
+				return warnings, err
+			}
+		}
+		return warnings, nil
+	}
+
+	var (
+		mu       sync.Mutex
+		fatalErr error
+		wg       sync.WaitGroup
+	)
+	keyCh := make(chan string)
+	for i := 0; i < f.fsckConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyCh {
+				errs, err := fn(key)
+
+				mu.Lock()
+				warnings = append(warnings, errs...)
+				if err != nil && fatalErr == nil {
+					fatalErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		mu.Lock()
+		stop := fatalErr != nil
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			break
+		}
+		keyCh <- key
+	}
+	close(keyCh)
+	wg.Wait()
+
+	if fatalErr != nil {
+		return warnings, fatalErr
+	}
+	return warnings, ctx.Err()
+}
+
 // removeOrphanedHistories 删除孤立的历史记录（即对应键已不存在的历史记录）
-func (f *FileKVStore) removeOrphanedHistories(ctx context.Context, historyRoot string) error {
+// 设置了 WithCaseInsensitive 时，忽略大小写能匹配到主数据文件的历史记录不会被删除，
+// 匹配有歧义时（多个键或多个历史目录只有大小写不同）跳过它，把 ErrCaseCollision 作为警告返回，不论是否设置了 WithIgnoreWarning
+// 返回警告和致命错误，有警告时也会处理完所有的历史目录
+func (f *FileKVStore) removeOrphanedHistories(ctx context.Context, historyRoot string) ([]error, error) {
+	type historyEntry struct {
+		key  string
+		path string
+	}
+	var entries []historyEntry
+	err := f.walkHistoryDirs(ctx, historyRoot, func(key, historyDir string) error {
+		entries = append(entries, historyEntry{key: key, path: historyDir})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 只有大小写不同的历史目录的个数
+	foldCounts := map[string]int{}
+	if f.caseInsensitive {
+		for _, entry := range entries {
+			foldCounts[strings.ToLower(entry.key)]++
+		}
+	}
+
+	var warnings []error
+	for _, entry := range entries {
+		errs, err := f.removeOrphanedHistory(ctx, entry.key, entry.path, foldCounts)
+		warnings = append(warnings, errs...)
+		if err != nil {
+			return warnings, err
+		}
+	}
+	return warnings, nil
+}
+
+// removeOrphanedHistory 在 key 不存在时删除（或恢复）它的历史目录 historyDir，返回警告和致命错误
+// foldCounts 是只有大小写不同的历史目录的个数，只在设置了 WithCaseInsensitive 时使用
+func (f *FileKVStore) removeOrphanedHistory(ctx context.Context, key, historyDir string, foldCounts map[string]int) ([]error, error) {
+	// Check if the corresponding key still exists in the main data directory
+	// 不能用 Exists：设置了 WithTreatEmptyAsAbsent 时值为空的键也有主数据文件，它的历史记录不是孤立的
+	exists, err := f.keyFileExists(key)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, nil
+	}
+
+	if f.caseInsensitive {
+		matches, err := f.findKeysIgnoreCase(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 1 && foldCounts[strings.ToLower(key)] == 1 {
+			return nil, nil
+		}
+		if len(matches) > 0 {
+			// 有歧义时不能确定是否孤立，只报告，不中止 Fsck
+			return []error{errorWrap(ErrCaseCollision, "history of '"+key+"' matches keys '"+strings.Join(matches, "', '")+"'")}, nil
+		}
+	}
+
+	if f.restoreHeadOnFsck {
+		_, err := f.RestoreHead(ctx, key)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, ErrVersionNotFound) {
+			if f.ignoreWarning {
+				return []error{err}, nil
+			}
+			return nil, err
+		}
+	}
+
+	// Key does not exist, remove its history directory
+	if err := f.fsys.RemoveAll(historyDir); err != nil {
+		return nil, errorWrap(err, "removing orphaned history directory")
+	}
+	return nil, nil
+}
+
+// walkHistoryDirs 遍历 historyRoot 下所有键的历史目录，对每个目录执行 fn，fn 返回错误时停止遍历并返回该错误
+// 传给 fn 的键是从目录名还原的，对应的键不一定存在
+func (f *FileKVStore) walkHistoryDirs(ctx context.Context, historyRoot string, fn func(key, historyDir string) error) error {
 	// Walk through the entire history directory tree
-	err := filepath.WalkDir(historyRoot, func(pa string, d fs.DirEntry, err error) error {
+	return fs.WalkDir(f.fsys, historyRoot, func(pa string, d fs.DirEntry, err error) error {
 		if err != nil {
 			if os.IsNotExist(err) {
 				return nil
 			}
 			return errorWrap(err, "accessing path "+pa)
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if !d.IsDir() {
 			return nil // Skip files
 		}
@@ -1208,22 +3578,61 @@ func (f *FileKVStore) removeOrphanedHistories(ctx context.Context, historyRoot s
 		key := strings.TrimSuffix(relPath, historyDirSuffix)
 		// Normalize the key path separator to forward slash
 		key = strings.ReplaceAll(key, "\\", "/")
-
-		// Check if the corresponding key still exists in the main data directory
-		exists, err := f.Exists(ctx, key)
-		if err != nil {
+		if err := fn(key, pa); err != nil {
 			return err
 		}
-		if !exists {
-			// Key does not exist, remove its history directory
-			if err := os.RemoveAll(pa); err != nil {
-				return errorWrap(err, "removing orphaned history directory")
-			}
-		}
 		return filepath.SkipDir
 	})
+}
 
-	return err
+// findKeysIgnoreCase 忽略大小写查找和 key 匹配的所有键（主数据文件）
+func (f *FileKVStore) findKeysIgnoreCase(key string) ([]string, error) {
+	if f.keyCodec != nil {
+		key = f.keyCodec.EncodeKey(key)
+	}
+	candidates := []string{""}
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		var next []string
+		for _, candidate := range candidates {
+			dirEntries, err := f.fsys.ReadDir(filepath.Join(f.rootDir, filepath.FromSlash(candidate)))
+			if err != nil {
+				if isNotExist(err) {
+					continue
+				}
+				return nil, errorWrap(err, "reading directory of '"+candidate+"'")
+			}
+			for _, entry := range dirEntries {
+				if !strings.EqualFold(entry.Name(), part) {
+					continue
+				}
+				// 最后一段必须是文件，前面的必须是目录
+				if entry.IsDir() != (i < len(parts)-1) {
+					continue
+				}
+				if candidate == "" {
+					next = append(next, entry.Name())
+				} else {
+					next = append(next, candidate+"/"+entry.Name())
+				}
+			}
+		}
+		if len(next) == 0 {
+			return nil, nil
+		}
+		candidates = next
+	}
+	if f.keyCodec != nil {
+		keys := candidates[:0]
+		for _, candidate := range candidates {
+			if decoded, ok := f.keyCodec.DecodeKey(candidate); ok {
+				keys = append(keys, decoded)
+			}
+		}
+		candidates = keys
+	}
+	sort.Strings(candidates)
+	return candidates, nil
 }
 
 // hasHistories 检查指定键是否有历史记录，并根据 ignoreWarning 设置处理错误
@@ -1262,59 +3671,186 @@ func (f *FileKVStore) ensureHistoryForExistingKeys(ctx context.Context, historyR
 		return errorWrap(err, "listing all keys from main directory")
 	}
 
-	var errList []error // 用于收集过程中的错误
+	// 用于收集过程中的错误
+	errList, err := f.forEachKey(ctx, allMainKeys, func(key string) ([]error, error) {
+		return f.ensureKeyHistory(ctx, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(errList) > 0 {
+		if len(errList) == 1 {
+			return errList[0]
+		}
+		return errors.Join(errList...)
+	}
+
+	return nil
+}
+
+// ensureKeyHistory 在存在的键没有历史记录时基于其当前值创建一个，返回警告和致命错误
+func (f *FileKVStore) ensureKeyHistory(ctx context.Context, key string) ([]error, error) {
+	var errList []error
+	if validateErr := f.validateKey(key); validateErr != nil {
+		if f.ignoreWarning {
+			return []error{errorWrap(validateErr, "invalid key found during fsck: "+key)}, nil
+		} else {
+			return nil, errorWrap(validateErr, "invalid key found during fsck: "+key)
+		}
+	}
+
+	historyDir := f.keyToHistoryPath(key)
 
-	for _, key := range allMainKeys {
-		if validateErr := f.validateKey(key); validateErr != nil {
+	hasHistory, fatalErr := f.hasHistories(historyDir, key, &errList)
+	if fatalErr != nil {
+		return errList, fatalErr
+	}
+	if !hasHistory {
+		timestamp := timex.Now().UnixNano()
+		_, createErr := f.ensureHistoryRecordExists(ctx, key, historyDir, timestamp, nil)
+		if createErr != nil {
 			if f.ignoreWarning {
-				errList = append(errList, errorWrap(validateErr, "invalid key found during fsck: "+key))
-				continue
+				// 如果忽略警告，则记录错误并跳过此键
+				errList = append(errList, errorWrap(createErr, "failed to create initial history for key '"+key+"'"))
 			} else {
-				return errorWrap(validateErr, "invalid key found during fsck: "+key)
+				// 如果不忽略警告，则视为致命错误
+				return errList, errorWrap(createErr, "failed to create initial history for key '"+key+"'")
 			}
 		}
+	}
+	return errList, nil
+}
 
-		historyDir := f.keyToHistoryPath(key)
+// FindEmptyVersions 查找内容为空（0 字节）但当前值不为空的历史记录，返回键到版本列表的映射
+// 这种历史记录一般是在创建历史记录时崩溃留下的，它并不是一个真正的版本，由调用者决定删除或修复
+func (f *FileKVStore) FindEmptyVersions(ctx context.Context) (map[string][]string, error) {
+	keys, err := f.ListKeys(ctx, "")
+	if err != nil {
+		return nil, errorWrap(err, "listing all keys from main directory")
+	}
 
-		hasHistory, fatalErr := f.hasHistories(historyDir, key, &errList)
-		if fatalErr != nil {
-			return fatalErr
+	results := map[string][]string{}
+	var errList []error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-		if !hasHistory {
-			timestamp := timex.Now().UnixNano()
-			_, createErr := f.ensureHistoryRecordExists(key, historyDir, timestamp)
-			if createErr != nil {
-				if f.ignoreWarning {
-					// 如果忽略警告，则记录错误并跳过此键
-					errList = append(errList, errorWrap(createErr, "failed to create initial history for key '"+key+"'"))
-				} else {
-					// 如果不忽略警告，则视为致命错误
-					return errorWrap(createErr, "failed to create initial history for key '"+key+"'")
-				}
-			}
+
+		versions, errs := f.findKeyEmptyVersions(ctx, key)
+		errList = append(errList, errs...)
+		if len(versions) > 0 {
+			results[key] = versions
 		}
 	}
 
 	if len(errList) > 0 {
 		if len(errList) == 1 {
-			return errList[0]
+			return results, errList[0]
 		}
-		return errors.Join(errList...)
+		return results, errors.Join(errList...)
 	}
+	return results, nil
+}
 
-	return nil
+// findKeyEmptyVersions 返回一个键内容为空但当前值不为空的历史记录（包括归档中的），按版本排序，见 FindEmptyVersions
+func (f *FileKVStore) findKeyEmptyVersions(ctx context.Context, key string) ([]string, []error) {
+	st, err := f.fsys.Stat(f.keyToPath(key))
+	if err != nil {
+		if !isNotExist(err) {
+			return nil, []error{errorWrap(err, "checking key '"+key+"'")}
+		}
+		return nil, nil
+	}
+	if st.Size() == 0 {
+		return nil, nil
+	}
+
+	historyDir := f.keyToHistoryPath(key)
+	histories, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return nil, []error{err}
+	}
+	if err := f.fillHistorySizes(ctx, historyDir, histories); err != nil {
+		return nil, []error{err}
+	}
+
+	// readHistories 返回的版本已经排好序了
+	var versions []string
+	for _, version := range histories {
+		if version.Size == 0 {
+			versions = append(versions, version.Version)
+		}
+	}
+	return versions, nil
+}
+
+// Restore 把键恢复为指定版本的内容，用于一次调用完成回滚，返回新的版本
+// 旧的内容以当前时间作为时间戳重新写入，所以回滚本身也是一个新的历史记录，中间的版本不会被删除。
+// 和 Set 相同，指定版本的内容和当前值相同时不产生新的版本，返回空串；版本不存在时返回 ErrVersionNotFound。
+func (f *FileKVStore) Restore(ctx context.Context, key, version string) (string, error) {
+	if f.readOnly {
+		return "", ErrReadOnly
+	}
+	value, err := f.GetByVersion(ctx, key, version)
+	if err != nil {
+		return "", err
+	}
+	return f.SetWithTimestamp(ctx, key, value, timex.Now())
+}
+
+// RestoreHead 用最后写入的历史记录（见 GetConsistent）重写键的主数据文件，返回恢复的版本
+// 用于主数据文件被意外删除但历史记录还在的情况，不会产生新的历史记录；没有历史记录时返回 ErrVersionNotFound
+func (f *FileKVStore) RestoreHead(ctx context.Context, key string) (string, error) {
+	if f.readOnly {
+		return "", ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return "", err
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	lastVersion, value, err := f.readHeadVersion(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := f.writeFileAtomicWithDir(f.keyToPath(key), value); err != nil {
+		return "", errorWrap(err, "writing file of '"+key+"'")
+	}
+	return lastVersion.Version, nil
 }
 
 // Fsck 执行文件系统检查和修复操作
 // 实现以下功能：
-// 8.1: 当历史记录超过 200 个时，组织成子目录结构，按时间分页存储
-// 8.2: 删除不存在键对应的历史记录
+// 8.1: 当历史记录超过 WithMaxHistoryCount 设置的个数（默认 200）时，组织成子目录结构，按时间分页存储
+// 8.2: 删除不存在键对应的历史记录，设置了 WithRestoreHeadOnFsck 时改为恢复键的主数据文件，
+// 设置了 WithCaseInsensitive 时有歧义的历史记录被跳过，ErrCaseCollision 在其它步骤完成后返回
 // 8.3: 确保每个存在的键都有对应的历史记录，如果没有则从当前值创建
+// 8.4: 设置了 WithFsckWarningFunc 时，检查内容为空的历史记录，只报告不修复，用 ErrEmptyVersions 交给该函数，不会让 Fsck 失败
+// 8.5: 设置了 WithRecentIndexSize 时，重建每个键的最近版本索引，见 RebuildHeadIndex
+// 8.6: 把放错分页的历史记录移到正确的分页中（和 8.1 一起执行）
+// 8.7: 设置了 WithMaxStoreBytes 时，重新统计存储已经占用的字节数
+// 设置了 WithFsckConcurrency 时 8.1 和 8.3 并发处理多个键
+// 一次执行不完时可以用 FsckIncremental 分多次执行
+// 同一时间只有一个 Fsck 在执行，后来的调用等待它完成，设置了 WithFsckNoWait 时返回 ErrFsckInProgress
 func (f *FileKVStore) Fsck(ctx context.Context) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	unlock, err := f.lockFsck()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	historyRoot := filepath.Join(f.rootDir, historyDirConst)
 
-	// 8.2: 删除孤立的历史记录
-	if err := f.removeOrphanedHistories(ctx, historyRoot); err != nil {
+	// 8.2: 删除孤立的历史记录，警告（如有歧义的历史记录）不中止 Fsck，在其它步骤完成后返回
+	warnings, err := f.removeOrphanedHistories(ctx, historyRoot)
+	if err != nil {
 		return err
 	}
 
@@ -1328,5 +3864,67 @@ func (f *FileKVStore) Fsck(ctx context.Context) error {
 		return err
 	}
 
+	// 8.5: Rebuild recent version indexes
+	if _, err := f.RebuildHeadIndex(ctx, ""); err != nil {
+		return err
+	}
+
+	// 8.7: 纠正 WithMaxStoreBytes 的已占用字节数
+	if err := f.reconcileQuota(ctx); err != nil {
+		return err
+	}
+
+	// 8.4: Report empty history records
+	if f.fsckWarningFunc != nil {
+		emptyVersions, err := f.FindEmptyVersions(ctx)
+		if err != nil {
+			return err
+		}
+		if len(emptyVersions) > 0 {
+			f.fsckWarningFunc(emptyVersionsError(emptyVersions))
+		}
+	}
+
+	if len(warnings) > 0 {
+		if len(warnings) == 1 {
+			return warnings[0]
+		}
+		return errors.Join(warnings...)
+	}
 	return nil
 }
+
+// lockFsck 保证同一时间只有一个 Fsck（或 FsckIncremental 的一次增量）在执行，返回的函数用于解锁
+// 交错执行的两个 Fsck 可能把对方正在移动的分页或正在检查的孤立历史记录删除
+func (f *FileKVStore) lockFsck() (func(), error) {
+	if f.fsckNoWait {
+		if !f.fsckMu.TryLock() {
+			return nil, ErrFsckInProgress
+		}
+	} else {
+		f.fsckMu.Lock()
+	}
+	return f.fsckMu.Unlock, nil
+}
+
+// emptyVersionsError 把 FindEmptyVersions 的结果包装成 ErrEmptyVersions，按键排序列出所有的 key@version
+func emptyVersionsError(emptyVersions map[string][]string) error {
+	keys := make([]string, 0, len(emptyVersions))
+	for key := range emptyVersions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, key := range keys {
+		for _, version := range emptyVersions[key] {
+			if sb.Len() > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(key)
+			sb.WriteString("@")
+			sb.WriteString(version)
+		}
+	}
+	return errorWrap(ErrEmptyVersions, sb.String())
+}
@@ -0,0 +1,240 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// metaPinned 是标记版本被固定的元数据名
+const metaPinned = "pinned"
+
+func isPinnedMeta(meta map[string]string) bool {
+	return meta[metaPinned] == "true"
+}
+
+// isPinned 检查历史记录是否被固定
+func (f *FileKVStore) isPinned(historyFile string) (bool, error) {
+	meta, err := f.readProperties(historyFile + metaSuffix)
+	if err != nil {
+		return false, err
+	}
+	return isPinnedMeta(meta), nil
+}
+
+// PinVersion 固定指定的版本，被固定的版本不会被 CleanupHistoriesByTime 和 CleanupHistoriesByCount 删除
+// version 为 head 时表示最后一次历史记录
+func (f *FileKVStore) PinVersion(ctx context.Context, key, version string) error {
+	return f.UpdateMeta(ctx, key, version, map[string]string{metaPinned: "true"})
+}
+
+// UnpinVersion 取消固定指定的版本
+func (f *FileKVStore) UnpinVersion(ctx context.Context, key, version string) error {
+	return f.RemoveMetaKeys(ctx, key, version, []string{metaPinned})
+}
+
+// DeleteMeta 删除键的指定版本的所有元数据，version 为 head 时表示最后一次历史记录，和 SetMeta 相同，
+// 没有历史记录时以当前值创建一个。版本没有元数据时什么也不做。
+func (f *FileKVStore) DeleteMeta(ctx context.Context, key, version string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return err
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	metaFile, err := f.resolveMetaFile(ctx, key, version)
+	if err != nil {
+		return err
+	}
+	if err := f.fsys.Remove(metaFile); err != nil && !os.IsNotExist(err) {
+		return errorWrap(err, "removing meta file")
+	}
+	return nil
+}
+
+// RemoveMetaKeys 从键的指定版本的元数据中删除 keys 中的名字，删除后元数据为空时删除元数据文件
+// version 的处理和 DeleteMeta 相同，元数据中没有这些名字时什么也不做
+func (f *FileKVStore) RemoveMetaKeys(ctx context.Context, key, version string, keys []string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return err
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	metaFile, err := f.resolveMetaFile(ctx, key, version)
+	if err != nil {
+		return err
+	}
+
+	meta, err := f.readProperties(metaFile)
+	if err != nil {
+		return err
+	}
+	removed := false
+	for _, name := range keys {
+		if _, ok := meta[name]; ok {
+			delete(meta, name)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	if len(meta) == 0 {
+		if err := f.fsys.Remove(metaFile); err != nil && !os.IsNotExist(err) {
+			return errorWrap(err, "removing meta file")
+		}
+		return nil
+	}
+	return f.writeProperties(metaFile, meta)
+}
+
+// GetMeta 获取键的指定版本的元数据，version 为 head 时表示最后一次历史记录
+// 版本在分页目录或归档中时也能找到，版本存在但没有元数据时返回空的 map，版本不存在时返回 ErrVersionNotFound
+func (f *FileKVStore) GetMeta(ctx context.Context, key, version string) (map[string]string, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+
+	historyDir := f.keyToHistoryPath(key)
+	var meta map[string]string
+	if isHeadRevision(version) {
+		lastVersion, err := f.GetLastVersion(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		meta = lastVersion.Meta
+	} else {
+		historyFile, err := f.resolveHistoryFile(ctx, key, version)
+		if err == nil {
+			meta, err = f.readProperties(historyFile + metaSuffix)
+		} else if errors.Is(err, ErrVersionNotFound) {
+			meta, err = f.findArchivedMeta(historyDir, version, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	return meta, nil
+}
+
+// findArchivedMeta 在归档中查找版本的元数据，版本不在归档中时返回 notFound
+func (f *FileKVStore) findArchivedMeta(historyDir, version string, notFound error) (map[string]string, error) {
+	archived, _, err := f.readArchiveIndex(historyDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range archived {
+		if entry.Version == version {
+			return entry.Meta, nil
+		}
+	}
+	return nil, notFound
+}
+
+// SetKeyMeta 设置键本身的元数据（如 owner, description），它和具体的版本无关
+// 元数据保存在 <key>.keymeta 文件中，删除键时一起删除
+func (f *FileKVStore) SetKeyMeta(ctx context.Context, key string, meta map[string]string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return err
+	}
+	exists, err := f.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errorWrap(ErrKeyNotFound, "setting key meta of '"+key+"'")
+	}
+	return f.writeProperties(f.keyToPath(key)+keyMetaSuffix, meta)
+}
+
+// GetKeyMeta 获取键本身的元数据，没有元数据时返回空的 map
+func (f *FileKVStore) GetKeyMeta(ctx context.Context, key string) (map[string]string, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+	exists, err := f.Exists(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errorWrap(ErrKeyNotFound, "getting key meta of '"+key+"'")
+	}
+	meta, err := f.readProperties(f.keyToPath(key) + keyMetaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	return meta, nil
+}
+
+// DistinctMetaKeys 返回键的所有版本的元数据中出现过的名字（已排序），用于构建按元数据过滤的界面
+// 它只遍历一次历史目录，遍历的同时读取元数据文件
+func (f *FileKVStore) DistinctMetaKeys(ctx context.Context, key string) ([]string, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+
+	names := map[string]struct{}{}
+	if err := f.collectMetaKeys(ctx, f.keyToHistoryPath(key), names); err != nil {
+		return nil, err
+	}
+	return sortedNames(names), nil
+}
+
+// DistinctMetaKeysAll 和 DistinctMetaKeys 相同，但是返回整个存储中所有版本的元数据中出现过的名字
+func (f *FileKVStore) DistinctMetaKeysAll(ctx context.Context) ([]string, error) {
+	names := map[string]struct{}{}
+	err := f.walkHistoryDirs(ctx, filepath.Join(f.rootDir, historyDirConst), func(key, historyDir string) error {
+		return f.collectMetaKeys(ctx, historyDir, names)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedNames(names), nil
+}
+
+// collectMetaKeys 把 historyDir 中所有元数据（包括归档中的版本的）的名字加入 names
+func (f *FileKVStore) collectMetaKeys(ctx context.Context, historyDir string, names map[string]struct{}) error {
+	histories, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return err
+	}
+	for _, version := range histories {
+		meta, err := f.readHistoryMeta(historyDir, version)
+		if err != nil {
+			return err
+		}
+		for name := range meta {
+			names[name] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func sortedNames(names map[string]struct{}) []string {
+	results := make([]string, 0, len(names))
+	for name := range names {
+		results = append(results, name)
+	}
+	sort.Strings(results)
+	return results
+}
@@ -0,0 +1,636 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cabify/timex/timextest"
+)
+
+func TestFileKVStore_PinVersion(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-pin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/pin"
+
+	initialTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	timextest.Mocked(initialTime, func(mockedtimex *timextest.TestImplementation) {
+		var versions []string
+		for i := 0; i < 5; i++ {
+			version, err := store.Set(ctx, key, []byte("version "+string(rune('0'+i))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			versions = append(versions, version)
+			mockedtimex.SetNow(mockedtimex.Now().Add(time.Second))
+		}
+
+		if err := store.PinVersion(ctx, key, versions[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.PinVersion(ctx, key, versions[2]); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("CleanupHistoriesByCount", func(t *testing.T) {
+			if err := store.CleanupHistoriesByCount(ctx, key, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			histories, err := store.GetHistories(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkHistories(t, histories, []string{versions[0], versions[2], versions[4]})
+			for _, h := range histories {
+				expected := h.Version == versions[0] || h.Version == versions[2]
+				if h.Pinned != expected {
+					t.Fatalf("expected pinned of %s to be %v", h.Version, expected)
+				}
+			}
+		})
+
+		t.Run("CleanupHistoriesByTime", func(t *testing.T) {
+			mockedtimex.SetNow(mockedtimex.Now().Add(24 * time.Hour))
+			if err := store.CleanupHistoriesByTime(ctx, key, time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			histories, err := store.GetHistories(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, version := range []string{versions[0], versions[2]} {
+				found := false
+				for _, h := range histories {
+					if h.Version == version {
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("expected pinned version %s to survive cleanup", version)
+				}
+			}
+		})
+
+		t.Run("UnpinVersion", func(t *testing.T) {
+			if err := store.UnpinVersion(ctx, key, versions[0]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(store.keyToHistoryPath(key), versions[0]+metaSuffix)); !os.IsNotExist(err) {
+				t.Fatalf("expected meta file to be removed after unpin, got %v", err)
+			}
+
+			if err := store.CleanupHistoriesByCount(ctx, key, 1); err != nil {
+				t.Fatal(err)
+			}
+			histories, err := store.GetHistories(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, h := range histories {
+				if h.Version == versions[0] {
+					t.Fatalf("expected unpinned version %s to be removed", versions[0])
+				}
+			}
+		})
+	})
+}
+
+func TestFileKVStore_KeyMeta(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-keymeta-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/keymeta"
+
+	if err := store.SetKeyMeta(ctx, key, map[string]string{"owner": "alice"}); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if _, err := store.Set(ctx, key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.GetKeyMeta(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta == nil || len(meta) != 0 {
+		t.Fatalf("expected empty key meta, got %v", meta)
+	}
+
+	if err := store.SetKeyMeta(ctx, key, map[string]string{"owner": "alice", "description": "test key"}); err != nil {
+		t.Fatal(err)
+	}
+	// 键的元数据和版本无关，设置新的值后依然存在
+	if _, err := store.Set(ctx, key, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	meta, err = store.GetKeyMeta(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["owner"] != "alice" || meta["description"] != "test key" {
+		t.Fatalf("unexpected key meta: %v", meta)
+	}
+
+	keys, err := store.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("expected key meta to be excluded from listing, got %v", keys)
+	}
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, key, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, key+keyMetaSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("expected key meta file to be removed, got %v", err)
+	}
+}
+
+type testMetaContextKey struct{}
+
+func TestFileKVStore_DefaultMeta(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-defaultmeta-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir,
+		WithDefaultMeta(map[string]string{"host": "host1", "app": "default"}),
+		WithDefaultMetaFunc(func(ctx context.Context) map[string]string {
+			app, _ := ctx.Value(testMetaContextKey{}).(string)
+			if app == "" {
+				return nil
+			}
+			return map[string]string{"app": app}
+		}))
+	key := "test/defaultmeta"
+
+	initialTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	timextest.Mocked(initialTime, func(mockedtimex *timextest.TestImplementation) {
+		version1, err := store.Set(context.Background(), key, []byte("v1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mockedtimex.SetNow(mockedtimex.Now().Add(time.Second))
+
+		ctx := context.WithValue(context.Background(), testMetaContextKey{}, "fromctx")
+		version2, err := store.Set(ctx, key, []byte("v2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 显式设置的元数据优先，且 UpdateMeta 不会被默认值覆盖
+		if err := store.UpdateMeta(ctx, key, version2, map[string]string{"host": "explicit"}); err != nil {
+			t.Fatal(err)
+		}
+
+		histories, err := store.GetHistories(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkHistories(t, histories, []string{version1, version2})
+		if histories[0].Meta["host"] != "host1" || histories[0].Meta["app"] != "default" {
+			t.Fatalf("unexpected meta of first version: %v", histories[0].Meta)
+		}
+		if histories[1].Meta["host"] != "explicit" || histories[1].Meta["app"] != "fromctx" {
+			t.Fatalf("unexpected meta of second version: %v", histories[1].Meta)
+		}
+	})
+}
+
+func TestFileKVStore_DefaultMetaOtherPaths(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithDefaultMeta(map[string]string{"host": "host1"}))
+	ctx := context.Background()
+
+	// 导入的版本
+	session, err := store.BeginImport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.AddVersion("import", []byte("value"), time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Finish(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fsck 和 SetMeta 为没有历史记录的键创建的版本
+	for _, key := range []string{"fsck", "setmeta"} {
+		if err := os.WriteFile(filepath.Join(tempDir, key), []byte("value"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetMeta(ctx, "setmeta", "head", map[string]string{"author": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"import", "fsck", "setmeta"} {
+		lastVersion, err := store.GetLastVersion(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastVersion.Meta["host"] != "host1" {
+			t.Fatalf("%s: expected the default meta, got %v", key, lastVersion.Meta)
+		}
+	}
+	lastVersion, err := store.GetLastVersion(ctx, "setmeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastVersion.Meta["author"] != "bob" {
+		t.Fatalf("expected the explicit meta to be kept, got %v", lastVersion.Meta)
+	}
+}
+
+func TestFileKVStore_MetaFromContext(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-metactx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir, WithDefaultMetaFunc(func(ctx context.Context) map[string]string {
+		author, _ := ctx.Value(testMetaContextKey{}).(string)
+		if author == "" {
+			return nil
+		}
+		return map[string]string{"author": author}
+	}))
+	ctx := context.WithValue(context.Background(), testMetaContextKey{}, "alice")
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 所有产生新版本的方法都从 ctx 中记录 author
+	if _, err := store.Set(ctx, "set", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetWithTimestamp(ctx, "timestamp", []byte("value"), timestamp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PutAll(ctx, map[string][]byte{"putall": []byte("value")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"set", "timestamp", "putall"} {
+		lastVersion, err := store.GetLastVersion(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastVersion.Meta["author"] != "alice" {
+			t.Fatalf("%s: expected author alice, got %v", key, lastVersion.Meta)
+		}
+	}
+
+	// ctx 中没有用户时不产生元数据
+	if _, err := store.Set(context.Background(), "anonymous", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	lastVersion, err := store.GetLastVersion(ctx, "anonymous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lastVersion.Meta) != 0 {
+		t.Fatalf("expected no meta, got %v", lastVersion.Meta)
+	}
+}
+
+func TestFileKVStore_SetWithMeta(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-setwithmeta-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	errMetaWrite := errors.New("meta write failed")
+	fsys := &faultFS{FS: osFS{}}
+	store := NewFileKVStore(tempDir, WithFS(fsys), WithDefaultMeta(map[string]string{"source": "default"}))
+	ctx := context.Background()
+	key := "test/setwithmeta"
+
+	version, err := store.SetWithMeta(ctx, key, []byte("value1"), map[string]string{"author": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 1 || histories[0].Version != version {
+		t.Fatalf("unexpected histories: %v", histories)
+	}
+	if histories[0].Meta["author"] != "alice" || histories[0].Meta["source"] != "default" {
+		t.Fatalf("unexpected meta: %v", histories[0].Meta)
+	}
+
+	// 值没有变化时不产生新的版本
+	version2, err := store.SetWithMeta(ctx, key, []byte("value1"), map[string]string{"author": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version2 != "" {
+		t.Fatalf("expected empty version, got %q", version2)
+	}
+
+	// 元数据在历史记录之前写入，元数据写入失败时不会产生新的版本，也不修改当前值
+	fsys.writeFileErr = func(name string) error {
+		if filepath.Ext(name) == metaSuffix {
+			return errMetaWrite
+		}
+		return nil
+	}
+	if _, err := store.SetWithMeta(ctx, key, []byte("value2"), map[string]string{"author": "bob"}); !errors.Is(err, errMetaWrite) {
+		t.Fatalf("expected meta write error, got %v", err)
+	}
+	if _, err := store.SetWithMeta(ctx, "test/newkey", []byte("value"), map[string]string{"author": "bob"}); !errors.Is(err, errMetaWrite) {
+		t.Fatalf("expected meta write error, got %v", err)
+	}
+	fsys.writeFileErr = nil
+
+	histories, err = store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{version})
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value1" {
+		t.Fatalf("expected value to stay %q, got %q", "value1", value)
+	}
+	exists, err := store.Exists(ctx, "test/newkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("expected new key not to be created")
+	}
+	histories, err = store.GetHistories(ctx, "test/newkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 0 {
+		t.Fatalf("expected no orphan versions, got %v", histories)
+	}
+
+	// 写入值失败时删除已经写入的元数据，不留下没有历史记录的元数据文件
+	dataFile := filepath.Join(tempDir, "test", "setwithmeta")
+	fsys.renameErr = func(oldpath, newpath string) error {
+		if newpath == dataFile {
+			return errMetaWrite
+		}
+		return nil
+	}
+	if _, err := store.SetWithMeta(ctx, key, []byte("value3"), map[string]string{"author": "carol"}); !errors.Is(err, errMetaWrite) {
+		t.Fatalf("expected value write error, got %v", err)
+	}
+	fsys.renameErr = nil
+	metaFiles, err := filepath.Glob(filepath.Join(tempDir, ".history", "test", "setwithmeta.h", "*"+metaSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metaFiles) != 1 || metaFiles[0] != filepath.Join(tempDir, ".history", "test", "setwithmeta.h", version+metaSuffix) {
+		t.Fatalf("expected only the meta of %s, got %v", version, metaFiles)
+	}
+	histories, err = store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{version})
+}
+
+func TestFileKVStore_DistinctMetaKeys(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-distinct-meta-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(key string, i int, meta map[string]string) {
+		t.Helper()
+		version, err := store.SetWithTimestamp(ctx, key, []byte(key+" "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta != nil {
+			if err := store.SetMeta(ctx, key, version, meta); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 不同版本的元数据名有重叠也有不同，也有没有元数据的版本
+	write("test/a", 0, map[string]string{"author": "alice", "channel": "beta"})
+	write("test/a", 1, nil)
+	write("test/a", 2, map[string]string{"author": "bob", "ticket": "T-1"})
+	write("test/b", 0, map[string]string{"author": "carol", "reviewer": "dave"})
+	write("test/c", 0, nil)
+
+	for key, expected := range map[string][]string{
+		"test/a": {"author", "channel", "ticket"},
+		"test/b": {"author", "reviewer"},
+		"test/c": {},
+	} {
+		names, err := store.DistinctMetaKeys(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Fatalf("%s: expected %v, got %v", key, expected, names)
+		}
+	}
+
+	names, err := store.DistinctMetaKeysAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "author,channel,reviewer,ticket"; strings.Join(names, ",") != expected {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	// 归档中的版本的元数据也被统计
+	if err := store.ArchiveKey(ctx, "test/a"); err != nil {
+		t.Fatal(err)
+	}
+	names, err = store.DistinctMetaKeys(ctx, "test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "author,channel,ticket"; strings.Join(names, ",") != expected {
+		t.Fatalf("expected %v after archiving, got %v", expected, names)
+	}
+	names, err = store.DistinctMetaKeysAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "author,channel,reviewer,ticket"; strings.Join(names, ",") != expected {
+		t.Fatalf("expected %v after archiving, got %v", expected, names)
+	}
+}
+
+func TestFileKVStore_GetMeta(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithMaxHistoryCount(2))
+	ctx := context.Background()
+	key := "test/getmeta"
+
+	var versions []string
+	for i := 0; i < 5; i++ {
+		version, err := store.Set(ctx, key, []byte("value "+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := store.SetMeta(ctx, key, versions[0], map[string]string{"author": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMeta(ctx, key, "head", map[string]string{"author": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	// 分页之后也能找到
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		version  string
+		expected map[string]string
+	}{
+		{versions[0], map[string]string{"author": "alice"}},
+		{"head", map[string]string{"author": "bob"}},
+		{"HEAD", map[string]string{"author": "bob"}},
+		{versions[2], map[string]string{}},
+	} {
+		meta, err := store.GetMeta(ctx, key, test.version)
+		if err != nil {
+			t.Fatalf("%s: %v", test.version, err)
+		}
+		if meta == nil || !reflect.DeepEqual(meta, test.expected) {
+			t.Errorf("%s: expected %v, got %#v", test.version, test.expected, meta)
+		}
+	}
+
+	// 归档中的版本
+	if err := store.ArchiveKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.GetMeta(ctx, key, versions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["author"] != "alice" {
+		t.Errorf("expected archived meta, got %v", meta)
+	}
+
+	if _, err := store.GetMeta(ctx, key, "1"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected ErrVersionNotFound, got %v", err)
+	}
+	if _, err := store.GetMeta(ctx, "test/missing", "head"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected ErrVersionNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_RemoveMeta(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/removemeta"
+
+	v1, err := store.SetWithMeta(ctx, key, []byte("v1"), map[string]string{"a": "1", "b": "2", "c": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaFile := filepath.Join(tempDir, ".history", "test", "removemeta.h", v1+".meta")
+
+	// 删除一部分名字，不存在的名字被忽略
+	if err := store.RemoveMetaKeys(ctx, key, v1, []string{"a", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.GetMeta(ctx, key, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta, map[string]string{"b": "2", "c": "3"}) {
+		t.Errorf("unexpected meta %v", meta)
+	}
+
+	// 删除最后的名字时删除元数据文件
+	if err := store.RemoveMetaKeys(ctx, key, "head", []string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(metaFile); !os.IsNotExist(err) {
+		t.Errorf("expected the meta file to be removed, got %v", err)
+	}
+	if meta, err := store.GetMeta(ctx, key, v1); err != nil || len(meta) != 0 {
+		t.Errorf("expected empty meta, got %v, %v", meta, err)
+	}
+
+	// DeleteMeta 删除整个元数据文件
+	if err := store.SetMeta(ctx, key, v1, map[string]string{"x": "1", "y": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteMeta(ctx, key, v1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(metaFile); !os.IsNotExist(err) {
+		t.Errorf("expected the meta file to be removed, got %v", err)
+	}
+	if err := store.DeleteMeta(ctx, key, v1); err != nil {
+		t.Errorf("expected deleting absent meta to succeed, got %v", err)
+	}
+	if err := store.DeleteMeta(ctx, key, "1"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected ErrVersionNotFound, got %v", err)
+	}
+
+	// 没有历史记录时和 SetMeta 一样以当前值创建一个
+	if err := os.WriteFile(filepath.Join(tempDir, "external"), []byte("external"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveMetaKeys(ctx, "external", "head", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	histories, err := store.GetHistories(ctx, "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 1 {
+		t.Errorf("expected a history record to be created, got %d", len(histories))
+	}
+}
@@ -0,0 +1,197 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+)
+
+// MirrorPolicy decides what MirrorStore does when a write to the secondary store fails.
+type MirrorPolicy int
+
+const (
+	// MirrorIgnoreSecondaryErrors logs the failure and reports the primary's result.
+	MirrorIgnoreSecondaryErrors MirrorPolicy = iota
+	// MirrorFailOnSecondaryError returns the secondary's error. The write to the
+	// primary has already been applied at that point and is not rolled back.
+	MirrorFailOnSecondaryError
+)
+
+// MirrorStore implements the KeyValueStore interface by reading from a primary
+// store and applying every mutation to both the primary and a secondary store,
+// which is useful for migrating to a new store while it is live.
+//
+// Mutations go to the primary first and are only forwarded to the secondary
+// when the primary succeeds. New versions are written to the secondary with
+// the primary's timestamp, so both stores end up with the same version names.
+type MirrorStore struct {
+	primary   KeyValueStore
+	secondary KeyValueStore
+	policy    MirrorPolicy
+	logf      func(format string, args ...any)
+}
+
+var _ KeyValueStore = (*MirrorStore)(nil)
+
+func NewMirrorStore(primary, secondary KeyValueStore, policy MirrorPolicy) *MirrorStore {
+	return &MirrorStore{
+		primary:   primary,
+		secondary: secondary,
+		policy:    policy,
+		logf:      log.Printf,
+	}
+}
+
+// SetLogger sets the function used to log secondary failures under
+// MirrorIgnoreSecondaryErrors. It defaults to log.Printf.
+func (m *MirrorStore) SetLogger(logf func(format string, args ...any)) {
+	m.logf = logf
+}
+
+// mirrorErr handles an error from the secondary store according to the policy.
+func (m *MirrorStore) mirrorErr(err error, op, key string) error {
+	if err == nil {
+		return nil
+	}
+	if key != "" {
+		op += " of '" + key + "'"
+	}
+	if m.policy == MirrorFailOnSecondaryError {
+		return errorWrap(err, "mirroring "+op+" to the secondary store")
+	}
+	if m.logf != nil {
+		m.logf("filekv: mirroring %s to the secondary store failed: %v", op, err)
+	}
+	return nil
+}
+
+// mirrorSet writes value to the secondary store as the given primary version.
+// When the primary reports no change the secondary may still be behind, so
+// the value is written with a fresh timestamp instead.
+func (m *MirrorStore) mirrorSet(ctx context.Context, key string, value []byte, version string) error {
+	if version == "" {
+		_, err := m.secondary.Set(ctx, key, value)
+		return err
+	}
+	ts, _, err := parseVersion(version)
+	if err != nil {
+		_, err = m.secondary.Set(ctx, key, value)
+		return err
+	}
+	_, err = m.secondary.SetWithTimestamp(ctx, key, value, time.Unix(0, ts))
+	return err
+}
+
+func (m *MirrorStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return m.primary.Get(ctx, key)
+}
+
+func (m *MirrorStore) GetByVersion(ctx context.Context, key string, version string) ([]byte, error) {
+	return m.primary.GetByVersion(ctx, key, version)
+}
+
+func (m *MirrorStore) Set(ctx context.Context, key string, value []byte) (string, error) {
+	version, err := m.primary.Set(ctx, key, value)
+	if err != nil {
+		return "", err
+	}
+	if err := m.mirrorErr(m.mirrorSet(ctx, key, value, version), "set", key); err != nil {
+		return version, err
+	}
+	return version, nil
+}
+
+func (m *MirrorStore) SetWithTimestamp(ctx context.Context, key string, value []byte, timestamp time.Time) (string, error) {
+	version, err := m.primary.SetWithTimestamp(ctx, key, value, timestamp)
+	if err != nil {
+		return "", err
+	}
+	if err := m.mirrorErr(m.mirrorSet(ctx, key, value, version), "set", key); err != nil {
+		return version, err
+	}
+	return version, nil
+}
+
+func (m *MirrorStore) SetMeta(ctx context.Context, key, version string, meta map[string]string) error {
+	if err := m.primary.SetMeta(ctx, key, version, meta); err != nil {
+		return err
+	}
+	return m.mirrorErr(m.secondary.SetMeta(ctx, key, version, meta), "set meta", key)
+}
+
+func (m *MirrorStore) UpdateMeta(ctx context.Context, key, version string, meta map[string]string) error {
+	if err := m.primary.UpdateMeta(ctx, key, version, meta); err != nil {
+		return err
+	}
+	return m.mirrorErr(m.secondary.UpdateMeta(ctx, key, version, meta), "update meta", key)
+}
+
+func (m *MirrorStore) Delete(ctx context.Context, key string, removeHistories bool) error {
+	if err := m.primary.Delete(ctx, key, removeHistories); err != nil {
+		return err
+	}
+	err := m.secondary.Delete(ctx, key, removeHistories)
+	// The key may not have been copied to the secondary yet
+	if errors.Is(err, ErrKeyNotFound) {
+		err = nil
+	}
+	return m.mirrorErr(err, "delete", key)
+}
+
+func (m *MirrorStore) Exists(ctx context.Context, key string) (bool, error) {
+	return m.primary.Exists(ctx, key)
+}
+
+func (m *MirrorStore) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	return m.primary.ListKeys(ctx, prefix)
+}
+
+func (m *MirrorStore) GetHistories(ctx context.Context, key string) ([]Version, error) {
+	return m.primary.GetHistories(ctx, key)
+}
+
+func (m *MirrorStore) GetLastVersion(ctx context.Context, key string) (*Version, error) {
+	return m.primary.GetLastVersion(ctx, key)
+}
+
+func (m *MirrorStore) GetPrevVersion(ctx context.Context, key, revision string) (*Version, error) {
+	return m.primary.GetPrevVersion(ctx, key, revision)
+}
+
+func (m *MirrorStore) GetNextVersion(ctx context.Context, key, revision string) (*Version, error) {
+	return m.primary.GetNextVersion(ctx, key, revision)
+}
+
+func (m *MirrorStore) CleanupHistoriesByTime(ctx context.Context, key string, maxAge time.Duration) error {
+	if err := m.primary.CleanupHistoriesByTime(ctx, key, maxAge); err != nil {
+		return err
+	}
+	return m.mirrorErr(m.secondary.CleanupHistoriesByTime(ctx, key, maxAge), "cleanup", key)
+}
+
+func (m *MirrorStore) CleanupHistoriesByCount(ctx context.Context, key string, maxCount int) error {
+	if err := m.primary.CleanupHistoriesByCount(ctx, key, maxCount); err != nil {
+		return err
+	}
+	return m.mirrorErr(m.secondary.CleanupHistoriesByCount(ctx, key, maxCount), "cleanup", key)
+}
+
+func (m *MirrorStore) Fsck(ctx context.Context) error {
+	if err := m.primary.Fsck(ctx); err != nil {
+		return err
+	}
+	return m.mirrorErr(m.secondary.Fsck(ctx), "fsck", "")
+}
+
+// Close closes both stores if they are io.Closers, even if closing the primary fails.
+func (m *MirrorStore) Close() error {
+	var errList []error
+	for _, store := range []KeyValueStore{m.primary, m.secondary} {
+		if closer, ok := store.(io.Closer); ok {
+			errList = append(errList, closer.Close())
+		}
+	}
+	return errors.Join(errList...)
+}
@@ -0,0 +1,156 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorStore(t *testing.T) {
+	ctx := context.Background()
+	primary := NewFileKVStore(t.TempDir())
+	secondary := NewFileKVStore(t.TempDir())
+	store := NewMirrorStore(primary, secondary, MirrorFailOnSecondaryError)
+
+	version, err := store.Set(ctx, "config/a", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := store.SetWithTimestamp(ctx, "config/b", []byte("b1"), timestamp); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMeta(ctx, "config/a", version, map[string]string{"author": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateMeta(ctx, "config/a", "head", map[string]string{"reason": "init"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个存储收到了同样的写入，版本号也相同
+	for name, s := range map[string]*FileKVStore{"primary": primary, "secondary": secondary} {
+		value, err := s.Get(ctx, "config/a")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(value) != "v1" {
+			t.Errorf("%s: expected v1, got %q", name, value)
+		}
+		last, err := s.GetLastVersion(ctx, "config/a")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if last.Version != version {
+			t.Errorf("%s: expected version %s, got %s", name, version, last.Version)
+		}
+		if last.Meta["author"] != "alice" || last.Meta["reason"] != "init" {
+			t.Errorf("%s: unexpected meta %v", name, last.Meta)
+		}
+
+		histories, err := s.GetHistories(ctx, "config/b")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(histories) != 1 || histories[0].Version != fmt.Sprint(timestamp.UnixNano()) {
+			t.Errorf("%s: unexpected histories %v", name, histories)
+		}
+	}
+
+	// 读取只访问主存储
+	if _, err := secondary.Set(ctx, "only/secondary", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := store.Exists(ctx, "only/secondary"); err != nil || exists {
+		t.Errorf("expected reads to use the primary only, got %v, %v", exists, err)
+	}
+
+	// 值没有变化时也写入副存储，让落后的副存储追上来
+	if err := secondary.Delete(ctx, "config/a", true); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := store.Set(ctx, "config/a", []byte("v1")); err != nil || version != "" {
+		t.Fatalf("expected an unchanged set, got %q, %v", version, err)
+	}
+	if value, err := secondary.Get(ctx, "config/a"); err != nil || string(value) != "v1" {
+		t.Errorf("expected the secondary to catch up, got %q, %v", value, err)
+	}
+
+	// 副存储中还没有的键也可以删除
+	if _, err := primary.Set(ctx, "only/primary", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "only/primary", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "config/b", true); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]*FileKVStore{"primary": primary, "secondary": secondary} {
+		if exists, err := s.Exists(ctx, "config/b"); err != nil || exists {
+			t.Errorf("%s: expected config/b to be deleted, got %v, %v", name, exists, err)
+		}
+	}
+}
+
+func TestMirrorStore_SecondaryFailure(t *testing.T) {
+	ctx := context.Background()
+	errInjected := errors.New("injected")
+
+	t.Run("fail", func(t *testing.T) {
+		primary, fsys := NewFileKVStore(t.TempDir()), &faultFS{FS: osFS{}}
+		store := NewMirrorStore(primary, NewFileKVStore(t.TempDir(), WithFS(fsys)), MirrorFailOnSecondaryError)
+		fsys.writeFileErr = func(string) error { return errInjected }
+
+		version, err := store.Set(ctx, "a", []byte("1"))
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("expected the secondary error, got %v", err)
+		}
+		// 主存储中的写入不会回滚
+		if version == "" {
+			t.Error("expected the primary version to be returned")
+		}
+		if value, err := primary.Get(ctx, "a"); err != nil || string(value) != "1" {
+			t.Errorf("expected the primary to keep the write, got %q, %v", value, err)
+		}
+	})
+
+	t.Run("ignore", func(t *testing.T) {
+		primary, fsys := NewFileKVStore(t.TempDir()), &faultFS{FS: osFS{}}
+		store := NewMirrorStore(primary, NewFileKVStore(t.TempDir(), WithFS(fsys)), MirrorIgnoreSecondaryErrors)
+		var logs []string
+		store.SetLogger(func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		})
+		fsys.writeFileErr = func(string) error { return errInjected }
+
+		version, err := store.Set(ctx, "a", []byte("1"))
+		if err != nil {
+			t.Fatalf("expected the secondary error to be ignored, got %v", err)
+		}
+		if version == "" {
+			t.Error("expected the primary version to be returned")
+		}
+		if len(logs) != 1 || !strings.Contains(logs[0], "'a'") || !strings.Contains(logs[0], errInjected.Error()) {
+			t.Errorf("expected the failure to be logged, got %v", logs)
+		}
+	})
+
+	t.Run("primary failure", func(t *testing.T) {
+		secondary := NewFileKVStore(t.TempDir())
+		store := NewMirrorStore(NewFileKVStore(t.TempDir(), WithFS(&faultFS{
+			FS:           osFS{},
+			writeFileErr: func(string) error { return errInjected },
+		})), secondary, MirrorIgnoreSecondaryErrors)
+
+		if _, err := store.Set(ctx, "a", []byte("1")); !errors.Is(err, errInjected) {
+			t.Fatalf("expected the primary error, got %v", err)
+		}
+		// 主存储失败时不写入副存储
+		if _, err := secondary.Get(ctx, "a"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("expected the secondary to be untouched, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package filekv
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pageCache 缓存每个历史目录下的分页子目录列表（按分页的第一个版本排序），
+// 以便按版本号二分查找历史记录所在的分页，而不用每次都 ReadDir 再逐个探测。
+// 缓存只是一个提示，查找失败时会退回到逐个探测并刷新缓存。
+type pageCache struct {
+	mu    sync.Mutex
+	pages map[string][]string
+}
+
+func (c *pageCache) put(historyDir string, pages []string) {
+	sort.Slice(pages, func(i, j int) bool {
+		return compareVersions(strings.TrimPrefix(pages[i], pagePrefix), strings.TrimPrefix(pages[j], pagePrefix)) < 0
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pages == nil {
+		c.pages = map[string][]string{}
+	}
+	c.pages[historyDir] = pages
+}
+
+func (c *pageCache) invalidate(historyDir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pages, historyDir)
+}
+
+// find 返回 version 应该所在的分页子目录名，即第一个版本号不大于 version 的最后一个分页
+func (c *pageCache) find(historyDir, version string) (string, bool) {
+	c.mu.Lock()
+	pages, ok := c.pages[historyDir]
+	c.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	i := sort.Search(len(pages), func(i int) bool {
+		return compareVersions(strings.TrimPrefix(pages[i], pagePrefix), version) > 0
+	})
+	if i == 0 {
+		return "", false
+	}
+	return pages[i-1], true
+}
@@ -0,0 +1,133 @@
+package filekv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writePagedHistories 直接写入 count 个历史记录并用 Fsck 整理成分页
+func writePagedHistories(tb testing.TB, tempDir, key string, count int) []string {
+	tb.Helper()
+
+	historyDir := filepath.Join(tempDir, ".history", key+".h")
+	baseTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		version := strconv.FormatInt(baseTime.Add(time.Duration(i)*time.Second).UnixNano(), 10)
+		if i == 0 {
+			if err := os.MkdirAll(historyDir, 0755); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(historyDir, version), []byte(version), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, key), []byte(versions[len(versions)-1]), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	if err := NewFileKVStore(tempDir).Fsck(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	return versions
+}
+
+func TestFileKVStore_GetByVersionPaged(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-pagecache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	key := "paged"
+	versions := writePagedHistories(t, tempDir, key, 10*defaultMaxHistoryCount+50)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	// 第一次查找后缓存分页列表，之后的查找都通过二分查找找到分页
+	for round := 0; round < 2; round++ {
+		for _, version := range versions {
+			value, err := store.GetByVersion(ctx, key, version)
+			if err != nil {
+				t.Fatalf("round %d: %s: %v", round, version, err)
+			}
+			if string(value) != version {
+				t.Fatalf("round %d: expected %q, got %q", round, version, value)
+			}
+		}
+	}
+
+	// 整理后缓存失效，仍然可以读到所有的版本
+	store2 := NewFileKVStore(tempDir)
+	timestamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < defaultMaxHistoryCount; i++ {
+		version, err := store2.SetWithTimestamp(ctx, key, []byte("more "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range versions {
+		if _, err := store.GetByVersion(ctx, key, version); err != nil {
+			t.Fatalf("after organize: %s: %v", version, err)
+		}
+	}
+
+	// 缓存过期（由其它实例修改了分页）时退回到逐个探测
+	if _, err := store.GetByVersion(ctx, key, versions[0]); err != nil {
+		t.Fatal(err)
+	}
+	historyDir := filepath.Join(tempDir, ".history", key+".h")
+	if err := os.Rename(filepath.Join(historyDir, pagePrefix+versions[0]), filepath.Join(historyDir, pagePrefix+"0")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := store.GetByVersion(ctx, key, versions[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != versions[1] {
+		t.Fatalf("expected %q, got %q", versions[1], value)
+	}
+}
+
+func benchmarkGetByVersionPaged(b *testing.B, cached bool) {
+	tempDir, err := os.MkdirTemp("", "filekv-pagecache-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	key := "paged"
+	versions := writePagedHistories(b, tempDir, key, 50*defaultMaxHistoryCount+1)
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	historyDir := store.keyToHistoryPath(key)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !cached {
+			store.pages.invalidate(historyDir)
+		}
+		if _, err := store.GetByVersion(ctx, key, versions[(i*7919)%(len(versions)-1)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetByVersionPaged_Cached(b *testing.B) {
+	benchmarkGetByVersionPaged(b, true)
+}
+
+func BenchmarkGetByVersionPaged_Uncached(b *testing.B) {
+	benchmarkGetByVersionPaged(b, false)
+}
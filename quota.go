@@ -0,0 +1,138 @@
+package filekv
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// WithMaxStoreBytes 限制整个存储（包括历史记录和附属文件）最多占用 maxBytes 字节，
+// 写入新的值会超过限制时 Set 等写入方法返回 ErrQuotaExceeded，值没有改变的写入不受限制。
+// 已经占用的字节数在第一次写入时遍历整个存储得到，之后在内存中随写入累加（新的值和它的历史记录），
+// 删除键或者清理历史记录之后重新遍历，Fsck 结束时也会重新遍历以纠正偏差（如其它进程的写入）。
+// 硬链接（见 WithLinkHistory）按每个链接分别计算，所以结果可能偏大。maxBytes <= 0 时不限制（默认）。
+func WithMaxStoreBytes(maxBytes int64) Option {
+	return func(s *FileKVStore) {
+		s.quota.maxBytes = maxBytes
+	}
+}
+
+// storeQuota 维护存储已经占用的字节数，known 为 false 时需要重新遍历存储
+type storeQuota struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	used  int64
+	known bool
+}
+
+// invalidate 在删除了文件之后调用，下次写入时重新遍历存储
+func (q *storeQuota) invalidate() {
+	if q.maxBytes <= 0 {
+		return
+	}
+	q.mu.Lock()
+	q.known = false
+	q.mu.Unlock()
+}
+
+// reserveQuota 在写入键的新值之前检查存储的限额，size 是新的值写入磁盘的字节数
+// 没有超过限额时把这次写入增加的字节数计入已经占用的字节数并返回它，写入失败时调用者用 releaseQuota 退还
+func (f *FileKVStore) reserveQuota(ctx context.Context, key, dataFile string, size int64) (int64, error) {
+	if f.quota.maxBytes <= 0 {
+		return 0, nil
+	}
+
+	// 新的值和它的历史记录各占一份；不使用硬链接时旧的值在历史记录中有一份副本，主数据文件中的那份会被释放
+	delta := size
+	if !f.linkHistory {
+		delta += size
+		if st, err := f.fsys.Stat(dataFile); err == nil && st.Mode().IsRegular() {
+			delta -= st.Size()
+		}
+	}
+	return f.reserveQuotaBytes(ctx, "setting key '"+key+"'", delta)
+}
+
+// reserveQuotaBytes 把一次写入增加的 delta 个字节计入已经占用的字节数并返回它，超过限额时返回 ErrQuotaExceeded，
+// msg 用于错误信息。写入失败时调用者用 releaseQuota 退还
+func (f *FileKVStore) reserveQuotaBytes(ctx context.Context, msg string, delta int64) (int64, error) {
+	if f.quota.maxBytes <= 0 {
+		return 0, nil
+	}
+
+	f.quota.mu.Lock()
+	defer f.quota.mu.Unlock()
+
+	if !f.quota.known {
+		used, err := f.storeBytes(ctx)
+		if err != nil {
+			return 0, err
+		}
+		f.quota.used, f.quota.known = used, true
+	}
+	if delta > 0 && f.quota.used+delta > f.quota.maxBytes {
+		return 0, errorWrap(ErrQuotaExceeded, msg)
+	}
+	f.quota.used += delta
+	return delta, nil
+}
+
+// releaseQuota 退还 reserveQuota 计入的字节数
+func (f *FileKVStore) releaseQuota(delta int64) {
+	if delta == 0 {
+		return
+	}
+	f.quota.mu.Lock()
+	f.quota.used -= delta
+	f.quota.mu.Unlock()
+}
+
+// reconcileQuota 重新遍历存储得到已经占用的字节数，由 Fsck 调用
+func (f *FileKVStore) reconcileQuota(ctx context.Context) error {
+	if f.quota.maxBytes <= 0 {
+		return nil
+	}
+	f.quota.mu.Lock()
+	defer f.quota.mu.Unlock()
+
+	used, err := f.storeBytes(ctx)
+	if err != nil {
+		return err
+	}
+	f.quota.used, f.quota.known = used, true
+	return nil
+}
+
+// storeBytes 遍历整个存储，返回所有普通文件的字节数之和
+func (f *FileKVStore) storeBytes(ctx context.Context) (int64, error) {
+	var total int64
+	err := fs.WalkDir(f.fsys, f.rootDir, func(pa string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errorWrap(err, "accessing path "+pa)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errorWrap(err, "checking size of "+pa)
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, errorWrap(err, "computing store size")
+	}
+	return total, nil
+}
@@ -0,0 +1,121 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileKVStore_MaxStoreBytes(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithMaxStoreBytes(4500))
+	ctx := context.Background()
+
+	value := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, 1000)
+	}
+
+	// 每个值和它的历史记录各占 1000 字节
+	if _, err := store.Set(ctx, "a", value('a')); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, "b", value('b')); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, "c", value('c')); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := store.SetFromReader(ctx, "c", bytes.NewReader(value('c'))); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "c")); !os.IsNotExist(err) {
+		t.Fatalf("expected the rejected key not to be written, got %v", err)
+	}
+
+	// 值没有改变的写入不受限制
+	if version, err := store.Set(ctx, "a", value('a')); err != nil || version != "" {
+		t.Fatalf("expected an unchanged write to succeed, got %q, %v", version, err)
+	}
+
+	// 删除之后释放了空间
+	if err := store.Delete(ctx, "a", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, "c", value('c')); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fsck 纠正其它途径写入的文件
+	if err := os.WriteFile(filepath.Join(tempDir, "external"), value('x'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := store.storeBytes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.quota.used != expected {
+		t.Errorf("expected %d used bytes after fsck, got %d", expected, store.quota.used)
+	}
+	if _, err := store.Set(ctx, "d", []byte("small")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+
+	// FsckIncremental 全部完成之后也会纠正
+	if err := os.Remove(filepath.Join(tempDir, "external")); err != nil {
+		t.Fatal(err)
+	}
+	cursor := ""
+	for {
+		next, done, err := store.FsckIncremental(ctx, 0, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done {
+			break
+		}
+		cursor = next
+	}
+	expected, err = store.storeBytes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.quota.used != expected {
+		t.Errorf("expected %d used bytes after incremental fsck, got %d", expected, store.quota.used)
+	}
+	if _, err := store.Set(ctx, "d", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileKVStore_MaxStoreBytesImport(t *testing.T) {
+	store := NewFileKVStore(t.TempDir(), WithMaxStoreBytes(1500))
+	ctx := context.Background()
+
+	session, err := store.BeginImport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := session.AddVersion("a", bytes.Repeat([]byte{'a'}, 1000), timestamp); err != nil {
+		t.Fatal(err)
+	}
+	// 导入的历史记录也计入限额
+	if _, err := session.AddVersion("a", bytes.Repeat([]byte{'b'}, 1000), timestamp.Add(time.Second)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := session.Finish(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Finish 之后重新统计，主数据文件也计入
+	if _, err := store.Set(ctx, "b", []byte("small")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package filekv
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/cabify/timex"
+)
+
+// maxRateLimitedKeys 是写入限速最多跟踪的键的个数，超过时淘汰最久没有写入的键
+// 被淘汰的键再次写入时按一个新的键计算，所以它只会让限速变得宽松，不会误拒绝写入
+const maxRateLimitedKeys = 10000
+
+// WithRateLimit 限制每个键在 per 时间内最多写入 maxWrites 次，超过时 Set 等写入方法返回 ErrRateLimited
+// 用令牌桶实现，令牌按 per/maxWrites 的间隔匀速恢复，所以允许最多 maxWrites 次的突发写入。
+// maxWrites <= 0 时不限速（默认）。限速状态只保存在内存中，不在多个进程间共享。
+func WithRateLimit(maxWrites int, per time.Duration) Option {
+	return func(s *FileKVStore) {
+		s.rateLimiter.maxWrites = maxWrites
+		s.rateLimiter.per = per
+	}
+}
+
+// WithRateLimitExemptTimestamps 设置 SetWithTimestamp 是否不受 WithRateLimit 的限制，
+// 用于导入历史数据时按原来的时间戳大量写入
+func WithRateLimitExemptTimestamps(value bool) Option {
+	return func(s *FileKVStore) {
+		s.rateLimitExemptTimestamps = value
+	}
+}
+
+// keyRateLimiter 为每个键维护一个令牌桶，最近写入的键在 lru 的前面
+type keyRateLimiter struct {
+	maxWrites int
+	per       time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// allow 判断键是否还可以写入，可以时消耗一个令牌
+func (r *keyRateLimiter) allow(key string) bool {
+	if r.maxWrites <= 0 {
+		return true
+	}
+	now := timex.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.buckets == nil {
+		r.buckets = map[string]*list.Element{}
+	}
+
+	var bucket *tokenBucket
+	if elem, ok := r.buckets[key]; ok {
+		bucket = elem.Value.(*tokenBucket)
+		if elapsed := now.Sub(bucket.last); elapsed > 0 {
+			if r.per > 0 {
+				bucket.tokens += float64(elapsed) / float64(r.per) * float64(r.maxWrites)
+			}
+			if bucket.tokens > float64(r.maxWrites) {
+				bucket.tokens = float64(r.maxWrites)
+			}
+			bucket.last = now
+		}
+		r.lru.MoveToFront(elem)
+	} else {
+		bucket = &tokenBucket{key: key, tokens: float64(r.maxWrites), last: now}
+		r.buckets[key] = r.lru.PushFront(bucket)
+		for r.lru.Len() > maxRateLimitedKeys {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.buckets, oldest.Value.(*tokenBucket).key)
+		}
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -0,0 +1,119 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cabify/timex/timextest"
+)
+
+func TestFileKVStore_RateLimit(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-ratelimit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mockedtimex := timextest.Mock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer mockedtimex.TearDown()
+
+	store := NewFileKVStore(tempDir, WithRateLimit(3, time.Minute))
+	ctx := context.Background()
+	key := "test/ratelimit"
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.Set(ctx, key, []byte("value "+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Set(ctx, key, []byte("value 3")); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if _, err := store.SetWithTimestamp(ctx, key, []byte("value 3"), mockedtimex.Now()); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if _, err := store.SetWithMeta(ctx, key, []byte("value 3"), nil); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+
+	// 被拒绝的写入不会修改值
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value 2" {
+		t.Fatalf("expected %q, got %q", "value 2", value)
+	}
+
+	// 每个键单独限速
+	if _, err := store.Set(ctx, "test/other", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 令牌匀速恢复：过了 1/3 个周期可以再写一次
+	mockedtimex.SetNow(mockedtimex.Now().Add(20 * time.Second))
+	if _, err := store.Set(ctx, key, []byte("value 3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, key, []byte("value 4")); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+
+	// 过了整个周期后恢复到最多 3 次
+	mockedtimex.SetNow(mockedtimex.Now().Add(time.Hour))
+	for i := 4; i < 7; i++ {
+		if _, err := store.Set(ctx, key, []byte("value "+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Set(ctx, key, []byte("value 7")); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+
+	// 导入时按时间戳写入可以不受限制
+	store = NewFileKVStore(tempDir, WithRateLimit(1, time.Minute), WithRateLimitExemptTimestamps(true))
+	timestamp := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if _, err := store.SetWithTimestamp(ctx, "test/import", []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Set(ctx, "test/import", []byte("value 5")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, "test/import", []byte("value 6")); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestKeyRateLimiter_Eviction(t *testing.T) {
+	mockedtimex := timextest.Mock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer mockedtimex.TearDown()
+
+	limiter := &keyRateLimiter{maxWrites: 1, per: time.Hour}
+	if !limiter.allow("first") {
+		t.Fatal("expected first write to be allowed")
+	}
+	if limiter.allow("first") {
+		t.Fatal("expected second write to be limited")
+	}
+
+	// 跟踪的键数量有上限，最久没有写入的键被淘汰
+	for i := 0; i < maxRateLimitedKeys; i++ {
+		limiter.allow("key" + strconv.Itoa(i))
+	}
+	if len(limiter.buckets) != maxRateLimitedKeys || limiter.lru.Len() != maxRateLimitedKeys {
+		t.Fatalf("expected %d tracked keys, got %d", maxRateLimitedKeys, len(limiter.buckets))
+	}
+	if _, ok := limiter.buckets["first"]; ok {
+		t.Fatal("expected idle key to be evicted")
+	}
+	if !limiter.allow("first") {
+		t.Fatal("expected evicted key to start with a full bucket")
+	}
+}
@@ -0,0 +1,187 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"strings"
+)
+
+// recentSuffix 是最近版本索引文件的后缀，索引文件和主数据文件放在一起
+const recentSuffix = ".recent"
+
+// WithRecentIndexSize 设置为每个键维护一个 <key>.recent 索引文件，记录最新的 size 个版本号，
+// 用 GetRecentVersions 读取最近的版本时不需要遍历历史记录，为 0 时不维护索引（默认）
+// 索引在 Set、清理历史记录和 Fsck 时更新
+func WithRecentIndexSize(size int) Option {
+	return func(s *FileKVStore) {
+		s.recentIndexSize = size
+	}
+}
+
+// GetRecentVersions 返回键最新的几个版本号，按时间升序排列
+// 优先直接读取索引文件，索引不存在时遍历历史记录，返回最新的 WithRecentIndexSize 个版本（没有设置时返回所有版本）
+func (f *FileKVStore) GetRecentVersions(ctx context.Context, key string) ([]string, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+
+	data, err := f.fsys.ReadFile(f.keyToPath(key) + recentSuffix)
+	if err == nil {
+		return parseRecentIndex(data), nil
+	}
+	if !isNotExist(err) {
+		return nil, errorWrap(err, "reading recent index of '"+key+"'")
+	}
+	return f.recentVersionsFromHistories(ctx, key)
+}
+
+func parseRecentIndex(data []byte) []string {
+	var versions []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			versions = append(versions, line)
+		}
+	}
+	return versions
+}
+
+func formatRecentIndex(versions []string) []byte {
+	var buf bytes.Buffer
+	for _, version := range versions {
+		buf.WriteString(version)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func (f *FileKVStore) recentVersionsFromHistories(ctx context.Context, key string) ([]string, error) {
+	histories, err := f.readHistories(ctx, f.keyToHistoryPath(key))
+	if err != nil {
+		return nil, err
+	}
+	if f.recentIndexSize > 0 && len(histories) > f.recentIndexSize {
+		histories = histories[len(histories)-f.recentIndexSize:]
+	}
+	versions := make([]string, 0, len(histories))
+	for _, h := range histories {
+		versions = append(versions, h.Version)
+	}
+	return versions, nil
+}
+
+// appendRecentIndex 在 Set 产生新的版本后把它加到索引中
+// 新的版本不一定最新（如 SetWithTimestamp 用了更早的时间戳），所以按版本的顺序插入，比索引中所有的版本都旧并且索引已满时不加入。
+// 索引文件不存在时（如第一次写入、之前更新失败或在设置 WithRecentIndexSize 之前已经有历史记录）根据历史记录重建，
+// 这时新的版本已经写入，不能只用它创建索引，否则会丢掉更早的版本。
+// 索引只是一个缓存，更新失败时删除索引文件，之后读取时退回到遍历历史记录
+func (f *FileKVStore) appendRecentIndex(ctx context.Context, key, version string) {
+	if f.recentIndexSize <= 0 {
+		return
+	}
+
+	indexFile := f.keyToPath(key) + recentSuffix
+	data, err := f.fsys.ReadFile(indexFile)
+	if err != nil {
+		if !os.IsNotExist(err) || f.rebuildRecentIndex(ctx, key) != nil {
+			_ = f.fsys.Remove(indexFile)
+		}
+		return
+	}
+	versions := parseRecentIndex(data)
+
+	i := sort.Search(len(versions), func(i int) bool {
+		return compareVersions(versions[i], version) >= 0
+	})
+	if i < len(versions) && versions[i] == version {
+		return
+	}
+	versions = append(versions, "")
+	copy(versions[i+1:], versions[i:])
+	versions[i] = version
+	if len(versions) > f.recentIndexSize {
+		versions = versions[len(versions)-f.recentIndexSize:]
+	}
+	if err := f.writeFileAtomic(indexFile, formatRecentIndex(versions)); err != nil {
+		_ = f.fsys.Remove(indexFile)
+	}
+}
+
+// rebuildRecentIndex 根据实际的历史记录重建索引，用于删除了历史记录之后
+func (f *FileKVStore) rebuildRecentIndex(ctx context.Context, key string) error {
+	if f.recentIndexSize <= 0 {
+		return nil
+	}
+
+	indexFile := f.keyToPath(key) + recentSuffix
+	versions, err := f.recentVersionsFromHistories(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		if err := f.fsys.Remove(indexFile); err != nil && !os.IsNotExist(err) {
+			return errorWrap(err, "removing recent index of '"+key+"'")
+		}
+		return nil
+	}
+	if err := f.writeFileAtomic(indexFile, formatRecentIndex(versions)); err != nil {
+		return errorWrap(err, "writing recent index of '"+key+"'")
+	}
+	return nil
+}
+
+// RebuildHeadIndex 根据实际的历史记录重建 prefix 下每个键的最近版本索引，返回被修正的索引个数
+// 索引的最后一行就是键的最新版本，写入过程中崩溃可能使索引过期，重建后 GetRecentVersions 的结果又可以信任了。
+// 没有设置 WithRecentIndexSize 时不维护索引，直接返回 0。Fsck 会对所有的键执行它。
+func (f *FileKVStore) RebuildHeadIndex(ctx context.Context, prefix string) (int, error) {
+	if f.readOnly {
+		return 0, ErrReadOnly
+	}
+	if f.recentIndexSize <= 0 {
+		return 0, nil
+	}
+
+	keys, err := f.ListKeys(ctx, prefix)
+	if err != nil {
+		return 0, errorWrap(err, "listing keys from main directory")
+	}
+
+	fixed := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return fixed, err
+		}
+
+		changed, err := f.rebuildHeadIndexOfKey(ctx, key)
+		if err != nil {
+			return fixed, err
+		}
+		if changed {
+			fixed++
+		}
+	}
+	return fixed, nil
+}
+
+// rebuildHeadIndexOfKey 重建一个键的最近版本索引，返回索引是否被修改
+// 重建期间锁住键，以免和 Set 同时更新索引时丢掉新的版本
+func (f *FileKVStore) rebuildHeadIndexOfKey(ctx context.Context, key string) (bool, error) {
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	indexFile := f.keyToPath(key) + recentSuffix
+	before, err := f.fsys.ReadFile(indexFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errorWrap(err, "reading recent index of '"+key+"'")
+	}
+	if err := f.rebuildRecentIndex(ctx, key); err != nil {
+		return false, err
+	}
+	after, err := f.fsys.ReadFile(indexFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errorWrap(err, "reading recent index of '"+key+"'")
+	}
+	return !bytes.Equal(before, after), nil
+}
@@ -0,0 +1,231 @@
+package filekv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// checkRecentIndex 检查索引文件存在，并且和实际最新的 size 个版本一致
+func checkRecentIndex(t *testing.T, store *FileKVStore, tempDir, key string, size int) {
+	t.Helper()
+
+	ctx := context.Background()
+	if _, err := os.Stat(filepath.Join(tempDir, key+recentSuffix)); err != nil {
+		t.Fatalf("expected recent index for %q: %v", key, err)
+	}
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) > size {
+		histories = histories[len(histories)-size:]
+	}
+	recent, err := store.GetRecentVersions(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != len(histories) {
+		t.Fatalf("expected %d recent versions, got %v", len(histories), recent)
+	}
+	for i := range histories {
+		if recent[i] != histories[i].Version {
+			t.Fatalf("expected recent version %q at %d, got %q", histories[i].Version, i, recent[i])
+		}
+	}
+}
+
+func TestFileKVStore_RecentIndex(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-recent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir, WithRecentIndexSize(3))
+	ctx := context.Background()
+	key := "test/recent"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if _, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		checkRecentIndex(t, store, tempDir, key, 3)
+	}
+
+	// 更早的时间戳按版本的顺序插入，比索引中所有的版本都旧时不加入
+	for i, offset := range []time.Duration{3500 * time.Millisecond, -time.Second} {
+		if _, err := store.SetWithTimestamp(ctx, key, []byte("earlier "+strconv.Itoa(i)), timestamp.Add(offset)); err != nil {
+			t.Fatal(err)
+		}
+		checkRecentIndex(t, store, tempDir, key, 3)
+	}
+
+	// 清理后索引和实际的历史记录一致
+	if err := store.CleanupHistoriesByCount(ctx, key, 2); err != nil {
+		t.Fatal(err)
+	}
+	checkRecentIndex(t, store, tempDir, key, 3)
+
+	for i := 5; i < 8; i++ {
+		if _, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRecentIndex(t, store, tempDir, key, 3)
+
+	if _, err := store.CapHistoriesPerKey(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkRecentIndex(t, store, tempDir, key, 3)
+
+	// 索引文件不是键
+	keys, err := store.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	// Fsck 修复错误的索引
+	if err := os.WriteFile(filepath.Join(tempDir, key+recentSuffix), []byte("bogus\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkRecentIndex(t, store, tempDir, key, 3)
+
+	// 删除键时一起删除索引
+	if err := store.Delete(ctx, key, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, key+recentSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("expected recent index to be removed, got %v", err)
+	}
+
+	// 没有索引时遍历历史记录
+	plain := NewFileKVStore(tempDir)
+	for i := 0; i < 4; i++ {
+		if _, err := plain.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recent, err := plain.GetRecentVersions(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 4 {
+		t.Fatalf("expected all 4 versions without index, got %v", recent)
+	}
+
+	// 没有索引的键再写入时根据历史记录创建索引，不会只记录新的版本
+	if _, err := store.SetWithTimestamp(ctx, key, []byte("value 4"), timestamp.Add(4*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	checkRecentIndex(t, store, tempDir, key, 3)
+}
+
+func TestFileKVStore_RebuildHeadIndex(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-rebuild-head-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir, WithRecentIndexSize(3))
+	ctx := context.Background()
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := []string{"a/k1", "a/k2", "a/k3", "b/k4"}
+	for _, key := range keys {
+		for i := 0; i < 4; i++ {
+			if _, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 索引完好时不需要修正
+	fixed, err := store.RebuildHeadIndex(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed != 0 {
+		t.Fatalf("expected 0 fixed indexes, got %d", fixed)
+	}
+
+	// 模拟崩溃：一个索引过期，一个索引丢失，一个索引损坏
+	if err := os.WriteFile(filepath.Join(tempDir, "a/k1"+recentSuffix), []byte("1672531200000000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tempDir, "a/k2"+recentSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "b/k4"+recentSuffix), []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只重建 prefix 下的索引
+	fixed, err = store.RebuildHeadIndex(ctx, "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed != 2 {
+		t.Fatalf("expected 2 fixed indexes, got %d", fixed)
+	}
+	for _, key := range keys[:3] {
+		checkRecentIndex(t, store, tempDir, key, 3)
+	}
+
+	// Fsck 重建所有的索引
+	if err := store.Fsck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		checkRecentIndex(t, store, tempDir, key, 3)
+	}
+
+	// 没有设置 WithRecentIndexSize 时不维护索引
+	fixed, err = NewFileKVStore(tempDir).RebuildHeadIndex(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed != 0 {
+		t.Fatalf("expected 0 fixed indexes, got %d", fixed)
+	}
+}
+
+func TestFileKVStore_RebuildHeadIndexLocksKey(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithRecentIndexSize(3))
+	if _, err := store.Set(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 键正在写入时等待写入完成再重建它的索引
+	unlock := store.lockKey("a")
+	done := make(chan error, 1)
+	go func() {
+		_, err := store.RebuildHeadIndex(ctx, "")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected RebuildHeadIndex to wait for the key lock, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkRecentIndex(t, store, tempDir, "a", 3)
+}
@@ -0,0 +1,137 @@
+package filekv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cabify/timex"
+)
+
+// defaultDeleteTimeout 是 Delete 等待正在进行的读操作完成的默认超时时间
+const defaultDeleteTimeout = 5 * time.Second
+
+// WithDeleteTimeout 设置 Delete 等待正在进行的读操作完成的超时时间，超时后 Delete 返回 ErrBusy
+func WithDeleteTimeout(timeout time.Duration) Option {
+	return func(s *FileKVStore) {
+		s.deleteTimeout = timeout
+	}
+}
+
+// keyRefs 是每个键的读写锁：读操作共享，Delete 和 Rename 独占，以免在某些文件系统（如 Windows）上
+// 删除或移动正在被读取的文件导致读取失败。独占的一方在等待时，新的读操作也要等待它完成，所以读操作不断时它也不会一直等下去；
+// 独占的一方只等待 WithDeleteTimeout 设置的时间，读操作一直没有完成时返回 ErrBusy。不再使用的键会被回收，所以 map 不会无限增长
+type keyRefs struct {
+	mu   sync.Mutex
+	refs map[string]*keyRef
+}
+
+type keyRef struct {
+	readers int
+	// writer 为 true 时有 Delete 或 Rename 独占着这个键
+	writer bool
+	// waiting 是等待独占这个键的操作数，大于 0 时新的读操作要等待
+	waiting int
+	// changed 在状态改变时关闭并换成新的
+	changed chan struct{}
+}
+
+// get 返回键的状态，不存在时创建，调用者必须持有 k.mu
+func (k *keyRefs) get(key string) *keyRef {
+	if k.refs == nil {
+		k.refs = map[string]*keyRef{}
+	}
+	ref := k.refs[key]
+	if ref == nil {
+		ref = &keyRef{changed: make(chan struct{})}
+		k.refs[key] = ref
+	}
+	return ref
+}
+
+// notify 唤醒所有等待这个键的操作，不再使用时回收它，调用者必须持有 k.mu
+func (k *keyRefs) notify(key string, ref *keyRef) {
+	close(ref.changed)
+	ref.changed = make(chan struct{})
+	if ref.readers == 0 && !ref.writer && ref.waiting == 0 {
+		delete(k.refs, key)
+	}
+}
+
+// acquire 开始一个读操作，有 Delete 或 Rename 正在进行或者等待时先等它完成，返回的函数用于结束读操作
+func (k *keyRefs) acquire(key string) func() {
+	k.mu.Lock()
+	for {
+		ref := k.get(key)
+		if !ref.writer && ref.waiting == 0 {
+			ref.readers++
+			break
+		}
+		changed := ref.changed
+		k.mu.Unlock()
+		<-changed
+		k.mu.Lock()
+	}
+	k.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			k.mu.Lock()
+			ref := k.refs[key]
+			ref.readers--
+			if ref.readers == 0 {
+				k.notify(key, ref)
+			}
+			k.mu.Unlock()
+		})
+	}
+}
+
+// lock 等待键上所有的读操作完成后独占这个键，超时返回 ErrBusy，返回的函数用于解除独占
+// 持有它期间新的读操作都会等待，所以删除或移动文件时不会有读操作进来
+func (k *keyRefs) lock(ctx context.Context, key string, timeout time.Duration) (func(), error) {
+	k.mu.Lock()
+	ref := k.get(key)
+	ref.waiting++
+
+	var timer timex.Timer
+	for ref.readers > 0 || ref.writer {
+		if timer == nil {
+			timer = timex.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		changed := ref.changed
+		k.mu.Unlock()
+
+		var err error
+		select {
+		case <-changed:
+		case <-timer.C():
+			err = errorWrap(ErrBusy, "waiting for reads of '"+key+"'")
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		k.mu.Lock()
+		if err != nil {
+			ref.waiting--
+			k.notify(key, ref)
+			k.mu.Unlock()
+			return nil, err
+		}
+	}
+	ref.waiting--
+	ref.writer = true
+	k.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			k.mu.Lock()
+			ref.writer = false
+			k.notify(key, ref)
+			k.mu.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,183 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileKVStore_DeleteWaitsForReads(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-refcount-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/refcount"
+
+	if _, err := store.Set(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 读操作和删除操作交错执行，读到的要么是完整的值，要么是 ErrKeyNotFound
+	var wg, started sync.WaitGroup
+	errCh := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if j == 1 {
+					started.Done()
+				}
+				value, err := store.Get(ctx, key)
+				if err != nil {
+					if j == 0 {
+						started.Done()
+					}
+					if errors.Is(err, ErrKeyNotFound) {
+						return
+					}
+					errCh <- err
+					return
+				}
+				if string(value) != "value" {
+					errCh <- errors.New("unexpected value: " + string(value))
+					return
+				}
+			}
+		}()
+	}
+
+	// 等所有的读操作都开始之后再删除
+	started.Wait()
+	if err := store.Delete(ctx, key, true); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	exists, err := store.Exists(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("expected key to be deleted")
+	}
+}
+
+func TestFileKVStore_DeleteBusy(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-busy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir, WithDeleteTimeout(10*time.Millisecond))
+	ctx := context.Background()
+	key := "test/busy"
+
+	if _, err := store.Set(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟一个一直没有完成的读操作
+	release := store.refs.acquire(key)
+	if err := store.Delete(ctx, key, true); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy, got %v", err)
+	}
+	if _, err := store.Get(ctx, key); err != nil {
+		t.Fatalf("expected key to still exist, got %v", err)
+	}
+
+	// 读操作完成后删除可以继续
+	done := make(chan error, 1)
+	store.deleteTimeout = time.Minute
+	go func() {
+		done <- store.Delete(ctx, key, true)
+	}()
+	waitForRefsLocker(store, key)
+
+	// Delete 等待期间新的读操作要等它完成，所以不断的读操作不会让 Delete 一直等下去，也不会读到删除了一半的键
+	got := make(chan error, 1)
+	go func() {
+		_, err := store.Get(ctx, key)
+		got <- err
+	}()
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-got; !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected the read queued behind Delete to get ErrKeyNotFound, got %v", err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_RenameWaitsForReads(t *testing.T) {
+	store := NewFileKVStore(t.TempDir())
+	ctx := context.Background()
+
+	if _, err := store.Set(ctx, "old", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	release := store.refs.acquire("old")
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Rename(ctx, "old", "new")
+	}()
+	waitForRefsLocker(store, "old")
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := store.Get(ctx, "old")
+		got <- err
+	}()
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-got; !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected the read queued behind Rename to get ErrKeyNotFound, got %v", err)
+	}
+
+	// 超时返回 ErrBusy 之后键不再被独占，读操作照常进行
+	store.deleteTimeout = 0
+	release = store.refs.acquire("new")
+	if err := store.Rename(ctx, "new", "old"); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy, got %v", err)
+	}
+	release()
+	if value, err := store.Get(ctx, "new"); err != nil || string(value) != "value" {
+		t.Fatalf("expected %q, got %q, %v", "value", value, err)
+	}
+}
+
+// waitForRefsLocker 等待有 Delete 或 Rename 开始等待独占键
+func waitForRefsLocker(store *FileKVStore, key string) {
+	for {
+		store.refs.mu.Lock()
+		ref := store.refs.refs[key]
+		waiting := ref != nil && ref.waiting > 0
+		store.refs.mu.Unlock()
+		if waiting {
+			return
+		}
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,173 @@
+package filekv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// movedSuffix 是改名标记文件的后缀，键改名后在原来的位置留下 <oldkey>.moved，内容为新的键名
+const movedSuffix = ".moved"
+
+// WithFollowRenames 设置 Get 和 GetHistories 在键不存在时沿着 Rename 留下的标记查找改名后的键，默认不查找
+// 这样仍然使用旧键名的调用者可以读到改名后的值和历史记录，查找的过程见 GetRenameChain
+func WithFollowRenames(value bool) Option {
+	return func(s *FileKVStore) {
+		s.followRenames = value
+	}
+}
+
+// Rename 把键（包括它的历史记录、键的元数据和最近版本索引）改名为 newKey，并在旧键的位置留下指向 newKey 的标记
+// oldKey 不存在时返回 ErrKeyNotFound，newKey 已经存在时返回 ErrKeyExists，newKey 和已有的命名空间冲突时返回 ErrKeyConflict。
+// 之后用同一个名字重新创建并删除旧键时标记也会被删除，旧键名和改名后的键之间不再有联系。
+func (f *FileKVStore) Rename(ctx context.Context, oldKey, newKey string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if err := f.validateKey(oldKey); err != nil {
+		return err
+	}
+	if err := f.validateKey(newKey); err != nil {
+		return err
+	}
+	if oldKey == newKey {
+		return errorWrap(ErrKeyExists, "renaming key '"+oldKey+"' to itself")
+	}
+
+	// 按键名的顺序加锁，以免两个方向相反的 Rename 死锁
+	unlock := f.lockKeys(oldKey, newKey)
+	defer unlock()
+
+	oldPath := f.keyToPath(oldKey)
+	newPath := f.keyToPath(newKey)
+
+	st, err := f.fsys.Stat(oldPath)
+	if err != nil {
+		return f.wrapKeyErr(err, oldKey, "renaming key")
+	}
+	if st.IsDir() {
+		return errorWrap(ErrKeyIsNamespace, "cannot rename key '"+oldKey+"': it has child keys")
+	}
+	if st, err := f.fsys.Stat(newPath); err == nil {
+		if st.IsDir() {
+			return &keyConflictError{
+				msg: "renaming key '" + oldKey + "' to '" + newKey + "': key is a namespace and cannot also be a value",
+				err: ErrKeyIsNamespace,
+			}
+		}
+		return errorWrap(ErrKeyExists, "renaming key '"+oldKey+"' to '"+newKey+"'")
+	} else if !isNotExist(err) {
+		return errorWrap(err, "checking existence of key '"+newKey+"'")
+	}
+
+	// 等待正在进行的读操作完成，移动期间新的读操作等待移动完成
+	unlockRefs, err := f.refs.lock(ctx, oldKey, f.deleteTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlockRefs()
+
+	// 先移动历史记录再移动主数据文件，和写入的顺序一致，移动主数据文件失败时把历史记录移回去
+	oldHistoryDir := f.keyToHistoryPath(oldKey)
+	newHistoryDir := f.keyToHistoryPath(newKey)
+	defer f.pages.invalidate(oldHistoryDir)
+	defer f.pages.invalidate(newHistoryDir)
+
+	historyMoved := false
+	if _, err := f.fsys.Stat(oldHistoryDir); err == nil {
+		// 新键可能有被删除时留下的历史记录，和改名过来的历史记录无法合并，先删除它
+		if err := f.fsys.RemoveAll(newHistoryDir); err != nil && !os.IsNotExist(err) {
+			return errorWrap(err, "removing history directory of '"+newKey+"'")
+		}
+		err := f.retryWithDir(filepath.Dir(newHistoryDir), func() error {
+			return f.fsys.Rename(oldHistoryDir, newHistoryDir)
+		})
+		if err != nil {
+			return errorWrap(err, "moving history directory of '"+oldKey+"' to '"+newKey+"'")
+		}
+		historyMoved = true
+	} else if !os.IsNotExist(err) {
+		return errorWrap(err, "checking history directory of '"+oldKey+"'")
+	}
+
+	err = f.retryWithDir(filepath.Dir(newPath), func() error {
+		return f.fsys.Rename(oldPath, newPath)
+	})
+	if err != nil {
+		if historyMoved {
+			_ = f.fsys.Rename(newHistoryDir, oldHistoryDir)
+		}
+		return f.wrapSetKeyErr(err, newKey, "renaming key '"+oldKey+"' to")
+	}
+	f.clock.move(f.lockName(oldKey), f.lockName(newKey))
+
+	for _, suffix := range []string{keyMetaSuffix, recentSuffix} {
+		if err := f.fsys.Rename(oldPath+suffix, newPath+suffix); err != nil && !os.IsNotExist(err) {
+			return errorWrap(err, "moving '"+suffix+"' file of '"+oldKey+"' to '"+newKey+"'")
+		}
+	}
+	// newKey 可能也是之前改名留下的，它现在存在了，之前的标记已经没有用了
+	if err := f.fsys.Remove(newPath + movedSuffix); err != nil && !isNotExist(err) {
+		return errorWrap(err, "removing rename marker of '"+newKey+"'")
+	}
+	if err := f.writeFileAtomicWithDir(oldPath+movedSuffix, []byte(newKey)); err != nil {
+		return errorWrap(err, "writing rename marker of '"+oldKey+"'")
+	}
+	return nil
+}
+
+// GetRenameChain 沿着 Rename 留下的标记查找键改名后的位置，返回从 key 开始依次改名经过的所有键名，最后一个为当前的键名
+// key 没有被改名过时只返回 key 本身。标记指向的键又被改名时继续查找，遇到已经存在的键时停止，
+// 标记形成环时返回 ErrRenameLoop。
+func (f *FileKVStore) GetRenameChain(ctx context.Context, key string) ([]string, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+
+	chain := []string{key}
+	seen := map[string]struct{}{key: {}}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		keyPath := f.keyToPath(key)
+		data, err := f.fsys.ReadFile(keyPath + movedSuffix)
+		if err != nil {
+			if isNotExist(err) {
+				return chain, nil
+			}
+			return nil, errorWrap(err, "reading rename marker of '"+key+"'")
+		}
+		if _, err := f.fsys.Stat(keyPath); err == nil {
+			// 键已经被重新创建了，标记已经过时
+			return chain, nil
+		} else if !isNotExist(err) {
+			return nil, errorWrap(err, "checking existence of key '"+key+"'")
+		}
+
+		next := strings.TrimSpace(string(data))
+		if err := f.validateKey(next); err != nil {
+			return nil, errorWrap(err, "invalid rename marker of '"+key+"'")
+		}
+		if _, ok := seen[next]; ok {
+			return nil, errorWrap(ErrRenameLoop, "following renames of '"+chain[0]+"': '"+strings.Join(chain, "' -> '")+"' -> '"+next+"'")
+		}
+		seen[next] = struct{}{}
+		chain = append(chain, next)
+		key = next
+	}
+}
+
+// followRename 设置了 WithFollowRenames 时返回 key 改名后当前的键名，否则返回 key 本身
+func (f *FileKVStore) followRename(ctx context.Context, key string) (string, error) {
+	if !f.followRenames {
+		return key, nil
+	}
+	chain, err := f.GetRenameChain(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return chain[len(chain)-1], nil
+}
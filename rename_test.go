@@ -0,0 +1,197 @@
+package filekv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileKVStore_Rename(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithRecentIndexSize(3))
+
+	v1, err := store.Set(ctx, "old/a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := store.Set(ctx, "old/a", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetKeyMeta(ctx, "old/a", map[string]string{"owner": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 连续改名两次：old/a -> mid/b -> new/c
+	if err := store.Rename(ctx, "old/a", "mid/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Rename(ctx, "mid/b", "new/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := store.Get(ctx, "new/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "2" {
+		t.Errorf("expected 2, got %q", value)
+	}
+	histories, err := store.GetHistories(ctx, "new/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{v1, v2})
+	meta, err := store.GetKeyMeta(ctx, "new/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["owner"] != "ops" {
+		t.Errorf("expected the key meta to be moved, got %v", meta)
+	}
+	recent, err := os.ReadFile(filepath.Join(tempDir, "new", "c"+recentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parseRecentIndex(recent), []string{v1, v2}) {
+		t.Errorf("expected the recent index to be moved, got %q", recent)
+	}
+
+	for key, expected := range map[string][]string{
+		"old/a": {"old/a", "mid/b", "new/c"},
+		"mid/b": {"mid/b", "new/c"},
+		"new/c": {"new/c"},
+	} {
+		chain, err := store.GetRenameChain(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(chain, expected) {
+			t.Errorf("%s: expected chain %v, got %v", key, expected, chain)
+		}
+	}
+
+	// 默认不沿着标记查找
+	if _, err := store.Get(ctx, "old/a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	following := NewFileKVStore(tempDir, WithFollowRenames(true))
+	value, err = following.Get(ctx, "old/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "2" {
+		t.Errorf("expected 2, got %q", value)
+	}
+	histories, err = following.GetHistories(ctx, "old/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{v1, v2})
+	histories, err = following.GetHistoriesWithSizes(ctx, "old/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{v1, v2})
+	if histories[0].Size != 1 || histories[1].Size != 1 {
+		t.Errorf("unexpected sizes: %+v", histories)
+	}
+	replayed := &memReplayStore{}
+	if err := following.ReplayHistory(ctx, "old/a", replayed, "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed.values, []string{"1", "2"}) {
+		t.Errorf("expected to replay the renamed key, got %v", replayed.values)
+	}
+
+	// 标记不是键
+	keys, err := store.ListKeys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"new/c"}) {
+		t.Errorf("expected only new/c, got %v", keys)
+	}
+
+	// 重新创建旧键后不再沿着标记查找，删除它时标记也被删除
+	if _, err := following.Set(ctx, "old/a", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := following.Get(ctx, "old/a"); err != nil || string(value) != "again" {
+		t.Errorf("expected again, got %q, %v", value, err)
+	}
+	if err := following.Delete(ctx, "old/a", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := following.Get(ctx, "old/a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound after the marker was removed, got %v", err)
+	}
+	chain, err := store.GetRenameChain(ctx, "old/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(chain, []string{"old/a"}) {
+		t.Errorf("expected the chain to end at old/a, got %v", chain)
+	}
+}
+
+func TestFileKVStore_RenameErrors(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir)
+
+	if _, err := store.Set(ctx, "a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, "b", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, "ns/child", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Rename(ctx, "missing", "x"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := store.Rename(ctx, "a", "b"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("expected ErrKeyExists, got %v", err)
+	}
+	if err := store.Rename(ctx, "a", "ns"); !errors.Is(err, ErrKeyConflict) {
+		t.Errorf("expected ErrKeyConflict, got %v", err)
+	}
+	if err := store.Rename(ctx, "a", "b/x"); !errors.Is(err, ErrKeyConflict) {
+		t.Errorf("expected ErrKeyConflict, got %v", err)
+	}
+	if err := store.Rename(ctx, "ns", "x"); !errors.Is(err, ErrKeyIsNamespace) {
+		t.Errorf("expected ErrKeyIsNamespace, got %v", err)
+	}
+	if err := store.Rename(ctx, "a", "x"+movedSuffix); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey, got %v", err)
+	}
+	// 失败的改名不修改原来的键
+	if value, err := store.Get(ctx, "a"); err != nil || string(value) != "a" {
+		t.Errorf("expected a to be untouched, got %q, %v", value, err)
+	}
+	if histories, err := store.GetHistories(ctx, "a"); err != nil || len(histories) != 1 {
+		t.Errorf("expected the history of a to be untouched, got %v, %v", histories, err)
+	}
+
+	// 标记形成环
+	if err := os.WriteFile(filepath.Join(tempDir, "x"+movedSuffix), []byte("y"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "y"+movedSuffix), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetRenameChain(ctx, "x"); !errors.Is(err, ErrRenameLoop) {
+		t.Errorf("expected ErrRenameLoop, got %v", err)
+	}
+	if _, err := NewFileKVStore(tempDir, WithFollowRenames(true)).Get(ctx, "x"); !errors.Is(err, ErrRenameLoop) {
+		t.Errorf("expected ErrRenameLoop, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package filekv
+
+import (
+	"context"
+	"time"
+)
+
+// ReplayHistory 按版本升序把 srcKey 的每个历史版本以原来的时间戳写入 dst 的 dstKey 中，同时复制版本的元数据
+// dst 可以是任意的 KeyValueStore，用于把一个键连同它的历史记录迁移到另一个存储中。
+// 版本号由 dst 重新生成，时间戳冲突时可能带上不同的后缀；和上一个版本相同的值不会在 dst 中产生历史记录，
+// 它的元数据也不会被复制。设置了 WithFollowRenames 时 srcKey 可以是改名之前的键名。
+func (f *FileKVStore) ReplayHistory(ctx context.Context, srcKey string, dst KeyValueStore, dstKey string) error {
+	if err := f.validateKey(srcKey); err != nil {
+		return err
+	}
+	// 和 GetHistories 一样沿着改名标记查找，之后都使用改名后的键
+	srcKey, err := f.followRename(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	histories, err := f.GetHistories(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+
+	for _, history := range histories {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ts, _, err := parseVersion(history.Version)
+		if err != nil {
+			return errorWrap(err, "parsing version '"+history.Version+"' of '"+srcKey+"'")
+		}
+		value, err := f.GetByVersion(ctx, srcKey, history.Version)
+		if err != nil {
+			return err
+		}
+
+		version, err := dst.SetWithTimestamp(ctx, dstKey, value, time.Unix(0, ts))
+		if err != nil {
+			return errorWrap(err, "replaying version '"+history.Version+"' of '"+srcKey+"'")
+		}
+		if version == "" || len(history.Meta) == 0 {
+			continue
+		}
+		if err := dst.SetMeta(ctx, dstKey, version, history.Meta); err != nil {
+			return errorWrap(err, "replaying meta of version '"+history.Version+"' of '"+srcKey+"'")
+		}
+	}
+	return nil
+}
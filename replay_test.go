@@ -0,0 +1,128 @@
+package filekv
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// memReplayStore 是一个只实现了 SetWithTimestamp 和 SetMeta 的内存存储，用于测试 ReplayHistory
+type memReplayStore struct {
+	KeyValueStore
+
+	keys       []string
+	values     []string
+	timestamps []time.Time
+	metas      map[string]map[string]string
+}
+
+func (m *memReplayStore) SetWithTimestamp(ctx context.Context, key string, value []byte, timestamp time.Time) (string, error) {
+	if len(m.values) > 0 && m.values[len(m.values)-1] == string(value) {
+		return "", nil
+	}
+	m.keys = append(m.keys, key)
+	m.values = append(m.values, string(value))
+	m.timestamps = append(m.timestamps, timestamp)
+	return "v" + strconv.Itoa(len(m.values)), nil
+}
+
+func (m *memReplayStore) SetMeta(ctx context.Context, key, version string, meta map[string]string) error {
+	if m.metas == nil {
+		m.metas = map[string]map[string]string{}
+	}
+	m.metas[version] = meta
+	return nil
+}
+
+func TestFileKVStore_ReplayHistory(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/replay"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	for i := 0; i < 4; i++ {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("value "+strconv.Itoa(i)), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := store.SetMeta(ctx, key, versions[2], map[string]string{"author": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 回放到内存存储中
+	mem := &memReplayStore{}
+	if err := store.ReplayHistory(ctx, key, mem, "dst/replay"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mem.values) != len(versions) {
+		t.Fatalf("expected %d versions, got %d", len(versions), len(mem.values))
+	}
+	for i := range versions {
+		if mem.keys[i] != "dst/replay" {
+			t.Fatalf("expected key %q, got %q", "dst/replay", mem.keys[i])
+		}
+		if expected := "value " + strconv.Itoa(i); mem.values[i] != expected {
+			t.Fatalf("expected %q at %d, got %q", expected, i, mem.values[i])
+		}
+		if expected := timestamp.Add(time.Duration(i) * time.Second); !mem.timestamps[i].Equal(expected) {
+			t.Fatalf("expected timestamp %v at %d, got %v", expected, i, mem.timestamps[i])
+		}
+	}
+	if len(mem.metas) != 1 || mem.metas["v3"]["author"] != "test" {
+		t.Fatalf("unexpected metas: %v", mem.metas)
+	}
+
+	// 回放到另一个 FileKVStore 中，版本号和元数据都保持一致
+	dstDir, err := os.MkdirTemp("", "filekv-replay-dst-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	dst := NewFileKVStore(dstDir)
+	if err := store.ReplayHistory(ctx, key, dst, "other"); err != nil {
+		t.Fatal(err)
+	}
+	srcHistories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstHistories, err := dst.GetHistories(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, dstHistories, versions)
+	for i := range srcHistories {
+		if dstHistories[i].Meta["author"] != srcHistories[i].Meta["author"] {
+			t.Fatalf("expected meta %v at %d, got %v", srcHistories[i].Meta, i, dstHistories[i].Meta)
+		}
+	}
+	value, err := dst.Get(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value 3" {
+		t.Fatalf("expected %q, got %q", "value 3", value)
+	}
+
+	// 没有历史记录的键不写入任何内容
+	mem = &memReplayStore{}
+	if err := store.ReplayHistory(ctx, "test/missing", mem, "dst/missing"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mem.values) != 0 {
+		t.Fatalf("expected no versions, got %v", mem.values)
+	}
+}
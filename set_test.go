@@ -1,10 +1,16 @@
 package filekv
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -227,3 +233,682 @@ func TestFileKVStore_SetHistoryStructure(t *testing.T) {
 		checkFiles(t, tempDir, expectedFiles)
 	})
 }
+
+func TestFileKVStore_SetLargeValueChanged(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-large-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/large"
+
+	value := make([]byte, 10*sampleSize)
+	rand.New(rand.NewSource(1)).Read(value)
+	if _, err := store.Set(ctx, key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	// 相同的值不产生新的版本
+	version, err := store.Set(ctx, key, append([]byte(nil), value...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		t.Fatalf("expected no new version for unchanged value, got %q", version)
+	}
+
+	// 长度相同，只有中间（抽样范围之外）、头部或尾部不同的值都必须产生新的版本
+	for _, offset := range []int{len(value) / 2, 0, len(value) - 1} {
+		changed := append([]byte(nil), value...)
+		changed[offset] ^= 0xff
+		version, err := store.Set(ctx, key, changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version == "" {
+			t.Fatalf("expected new version when byte %d changed", offset)
+		}
+		got, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(changed) {
+			t.Fatalf("unexpected value after changing byte %d", offset)
+		}
+		value = changed
+	}
+
+	// 长度不同
+	version, err = store.Set(ctx, key, value[:len(value)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == "" {
+		t.Fatal("expected new version when length changed")
+	}
+}
+
+func benchmarkSetLargeValue(b *testing.B, opts ...Option) {
+	tempDir, err := os.MkdirTemp("", "filekv-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir, opts...)
+	ctx := context.Background()
+	key := "bench/large"
+
+	// 两个长度不同的大值交替写入
+	values := [][]byte{make([]byte, 16<<20), make([]byte, 16<<20+1)}
+	if _, err := store.Set(ctx, key, values[0]); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 每次只比较，不产生新的版本，以免测到写文件的开销
+		if _, err := store.isValueChanged(key, store.keyToPath(key), values[1]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetLargeValue_FastPath(b *testing.B) {
+	benchmarkSetLargeValue(b)
+}
+
+func BenchmarkSetLargeValue_FullCompare(b *testing.B) {
+	benchmarkSetLargeValue(b, WithCompareFunc(bytes.Equal))
+}
+
+func TestFileKVStore_TouchOnUnchanged(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-touch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	key := "test/touch"
+	past := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, touch := range []bool{false, true} {
+		store := NewFileKVStore(tempDir, WithTouchOnUnchanged(touch))
+		if _, err := store.Set(ctx, key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(tempDir, key), past, past); err != nil {
+			t.Fatal(err)
+		}
+		historiesBefore, err := store.GetHistories(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		version, err := store.Set(ctx, key, []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != "" {
+			t.Fatalf("touch=%v: expected no new version, got %q", touch, version)
+		}
+		historiesAfter, err := store.GetHistories(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(historiesAfter) != len(historiesBefore) {
+			t.Fatalf("touch=%v: expected %d histories, got %d", touch, len(historiesBefore), len(historiesAfter))
+		}
+
+		mtime, err := store.ModTime(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if touch != mtime.After(past) {
+			t.Fatalf("touch=%v: unexpected mtime %v", touch, mtime)
+		}
+	}
+}
+
+func TestFileKVStore_NormalizeTrailingNewline(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-newline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir, WithNormalizeTrailingNewline(true))
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"a=1", "a=1\n"},
+		{"a=1\n", "a=1\n"},
+		{"a=1\n\n\n", "a=1\n"},
+		{"a=1\r\n", "a=1\r\n"},
+		{"a=1\r\n\r\n", "a=1\r\n"},
+		{"a=1\r", "a=1\n"},
+		{"", ""},
+		{"bin\x00ary", "bin\x00ary"},
+		{"bin\x00ary\n\n", "bin\x00ary\n\n"},
+	} {
+		key := "test/newline"
+		if err := store.Delete(ctx, key, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Set(ctx, key, []byte(test.input)); err != nil {
+			t.Fatal(err)
+		}
+		value, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != test.expected {
+			t.Fatalf("Set(%q): expected %q, got %q", test.input, test.expected, value)
+		}
+	}
+
+	// 只有末尾换行不同的值不产生新的历史记录
+	key := "test/churn"
+	if _, err := store.Set(ctx, key, []byte("config")); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"config\n", "config", "config\n\n"} {
+		version, err := store.Set(ctx, key, []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != "" {
+			t.Fatalf("Set(%q): expected no new version, got %q", value, version)
+		}
+	}
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 1 {
+		t.Fatalf("expected 1 history, got %d", len(histories))
+	}
+
+	// 默认不规范化
+	plain := NewFileKVStore(tempDir)
+	if _, err := plain.Set(ctx, key, []byte("config")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := plain.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "config" {
+		t.Fatalf("expected value to be stored as is, got %q", value)
+	}
+}
+
+// linkFaultFS 在 faultFS 的基础上支持硬链接
+type linkFaultFS struct {
+	*faultFS
+}
+
+func (l linkFaultFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func TestFileKVStore_LinkHistory(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-link-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	writes := 0
+	fsys := &faultFS{
+		FS: osFS{},
+		writeFileErr: func(name string) error {
+			writes++
+			return nil
+		},
+	}
+
+	for _, test := range []struct {
+		key    string
+		fsys   FS
+		writes int
+	}{
+		// 支持硬链接时只写入一次
+		{key: "link/key", fsys: linkFaultFS{fsys}, writes: 1},
+		// 不支持硬链接时退回到分别写入
+		{key: "copy/key", fsys: fsys, writes: 2},
+	} {
+		// 预先创建目录，以免目录不存在时的重试被计入写入次数
+		for _, dir := range []string{filepath.Dir(test.key), ".history/" + test.key + ".h"} {
+			if err := os.MkdirAll(filepath.Join(tempDir, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		store := NewFileKVStore(tempDir, WithFS(test.fsys), WithLinkHistory(true))
+		for _, value := range []string{"value1", "value2"} {
+			writes = 0
+			version, err := store.Set(ctx, test.key, []byte(value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if writes != test.writes {
+				t.Fatalf("%s: expected %d writes, got %d", test.key, test.writes, writes)
+			}
+
+			dataFile := filepath.Join(tempDir, test.key)
+			historyFile := filepath.Join(tempDir, ".history", test.key+".h", version)
+			for _, file := range []string{dataFile, historyFile} {
+				content, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(content) != value {
+					t.Fatalf("%s: expected %q, got %q", file, value, content)
+				}
+			}
+			dataInfo, err := os.Stat(dataFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			historyInfo, err := os.Stat(historyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if os.SameFile(dataInfo, historyInfo) != (test.writes == 1) {
+				t.Fatalf("%s: unexpected hard link state", test.key)
+			}
+		}
+
+		// 更新值之后旧的历史记录保持不变
+		histories, err := store.GetHistories(ctx, test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(histories) != 2 {
+			t.Fatalf("%s: expected 2 histories, got %d", test.key, len(histories))
+		}
+		value, err := store.GetByVersion(ctx, test.key, histories[0].Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "value1" {
+			t.Fatalf("%s: expected %q, got %q", test.key, "value1", value)
+		}
+	}
+}
+
+func TestFileKVStore_SetDirRemovedConcurrently(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-dir-removed-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	key := "dir/key"
+	dataDir := filepath.Join(tempDir, "dir")
+	historyDir := filepath.Join(tempDir, ".history", "dir", "key.h")
+
+	// 模拟另一个 goroutine 在 MkdirAll 之后、写入之前删除了目录
+	attempts := map[string]int{}
+	fsys := &faultFS{FS: osFS{}}
+	fsys.writeFileErr = func(name string) error {
+		dir := filepath.Dir(name)
+		if dir != dataDir && dir != historyDir {
+			return nil
+		}
+		attempts[dir]++
+		if attempts[dir] == 2 {
+			if err := os.RemoveAll(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}
+	store := NewFileKVStore(tempDir, WithFS(fsys))
+
+	version, err := store.Set(ctx, key, []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts[dataDir] != 3 || attempts[historyDir] != 3 {
+		t.Fatalf("expected 3 write attempts in each directory, got %v", attempts)
+	}
+
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value" {
+		t.Fatalf("expected %q, got %q", "value", value)
+	}
+	value, err = store.GetByVersion(ctx, key, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value" {
+		t.Fatalf("expected %q, got %q", "value", value)
+	}
+}
+
+func TestFileKVStore_SetPartialWrite(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-partial-write-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	key := "dir/key"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, target := range []string{"history", "data"} {
+		t.Run(target, func(t *testing.T) {
+			fsys := &faultFS{FS: osFS{}}
+			store := NewFileKVStore(tempDir, WithFS(fsys))
+			if _, err := store.SetWithTimestamp(ctx, key, []byte("old value"), timestamp); err != nil {
+				t.Fatal(err)
+			}
+
+			// 写入临时文件时只写了 3 个字节就失败，模拟写到一半时崩溃
+			fsys.writeLimit = func(name string) int {
+				if !strings.HasSuffix(name, tempFileSuffix) {
+					return -1
+				}
+				if target == "history" && strings.Contains(filepath.ToSlash(name), "/.history/") ||
+					target == "data" && !strings.Contains(filepath.ToSlash(name), "/.history/") {
+					return 3
+				}
+				return -1
+			}
+			if _, err := store.SetWithTimestamp(ctx, key, []byte("new value "+target), timestamp.Add(time.Hour)); !errors.Is(err, errShortWrite) {
+				t.Fatalf("expected short write error, got %v", err)
+			}
+			fsys.writeLimit = nil
+
+			// 原来的值和历史记录都没有被破坏，也没有留下临时文件
+			value, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != "old value" {
+				t.Fatalf("expected %q, got %q", "old value", value)
+			}
+			histories, err := store.GetHistories(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := histories[len(histories)-1]
+			value, err = store.GetByVersion(ctx, key, last.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != "old value" {
+				t.Fatalf("expected last version to be %q, got %q", "old value", value)
+			}
+			files, err := getAllFiles(tempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range files {
+				if strings.HasSuffix(name, tempFileSuffix) {
+					t.Fatalf("expected no temp files left, got %q", name)
+				}
+			}
+		})
+	}
+}
+
+func TestFileKVStore_SetStaleMeta(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "stale"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 模拟 SetWithMeta 写入元数据之后、写入历史记录之前崩溃，留下了没有历史记录的元数据文件
+	stale := strconv.FormatInt(timestamp.UnixNano(), 10)
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		".history/stale.h/" + stale + metaSuffix: []byte("author=crashed\n"),
+	})
+
+	// 之后用同一个时间戳写入时不使用这个版本号，也不继承它的元数据
+	version, err := store.SetWithTimestamp(ctx, key, []byte("value"), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == stale {
+		t.Fatalf("expected a version other than %s", stale)
+	}
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{version})
+	if len(histories[0].Meta) != 0 {
+		t.Errorf("expected no meta, got %v", histories[0].Meta)
+	}
+}
+
+func TestFileKVStore_SetTempDir(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-tempdir-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dataDir := filepath.Join(tempDir, "data")
+	scratchDir := filepath.Join(tempDir, "scratch")
+	if err := os.MkdirAll(scratchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var written []string
+	fsys := &faultFS{FS: osFS{}}
+	fsys.writeFileErr = func(name string) error {
+		written = append(written, name)
+		return nil
+	}
+	store := NewFileKVStore(dataDir, WithFS(fsys), WithTempDir(scratchDir))
+	ctx := context.Background()
+	key := "test/tempdir"
+
+	if _, err := store.Set(ctx, key, []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 历史记录和主数据文件的临时文件都在临时目录中（目录不存在时会重试）
+	if len(written) < 2 {
+		t.Fatalf("expected at least 2 writes, got %v", written)
+	}
+	for _, name := range written {
+		if filepath.Dir(name) != scratchDir {
+			t.Fatalf("expected temp file in %q, got %q", scratchDir, name)
+		}
+	}
+	entries, err := os.ReadDir(scratchDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no temp files left, got %v", entries)
+	}
+	value, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value1" {
+		t.Fatalf("expected %q, got %q", "value1", value)
+	}
+
+	// 跨文件系统时 rename 失败，退回到同目录的临时文件
+	fsys.renameErr = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) == scratchDir {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return nil
+	}
+	written = nil
+	if _, err := store.Set(ctx, key, []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	value, err = store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value2" {
+		t.Fatalf("expected %q, got %q", "value2", value)
+	}
+	files, err := getAllFiles(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		if strings.HasSuffix(name, tempFileSuffix) {
+			t.Fatalf("expected no temp files left, got %q", name)
+		}
+	}
+
+	// 之后的写入不再尝试临时目录
+	written = nil
+	if _, err := store.Set(ctx, key, []byte("value3")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range written {
+		if filepath.Dir(name) == scratchDir {
+			t.Fatalf("expected no temp file in %q after cross-device rename, got %q", scratchDir, name)
+		}
+	}
+}
+
+// 测试 WithDirPerm 和 WithFilePerm：新建的目录和文件使用设置的权限
+func TestFileKVStore_SetPerm(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		dirPerm  os.FileMode
+		filePerm os.FileMode
+	}{
+		{name: "default", dirPerm: 0755, filePerm: 0644},
+		{name: "custom", opts: []Option{WithDirPerm(0700), WithFilePerm(0600)}, dirPerm: 0700, filePerm: 0600},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			store := NewFileKVStore(tempDir, test.opts...)
+
+			version, err := store.Set(ctx, "a/b", []byte("value"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SetMeta(ctx, "a/b", version, map[string]string{"k": "v"}); err != nil {
+				t.Fatal(err)
+			}
+			// 替换已有的文件时也使用设置的权限
+			if _, err := store.Set(ctx, "a/b", []byte("value2")); err != nil {
+				t.Fatal(err)
+			}
+
+			historyDir := filepath.Join(tempDir, ".history", "a", "b.h")
+			for _, dir := range []string{filepath.Join(tempDir, "a"), historyDir} {
+				info, err := os.Stat(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if perm := info.Mode().Perm(); perm != test.dirPerm {
+					t.Errorf("%s: expected perm %o, got %o", dir, test.dirPerm, perm)
+				}
+			}
+			for _, file := range []string{
+				filepath.Join(tempDir, "a", "b"),
+				filepath.Join(historyDir, version),
+				filepath.Join(historyDir, version+metaSuffix),
+			} {
+				info, err := os.Stat(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if perm := info.Mode().Perm(); perm != test.filePerm {
+					t.Errorf("%s: expected perm %o, got %o", file, test.filePerm, perm)
+				}
+			}
+		})
+	}
+}
+
+func TestFileKVStore_CompareAndSwap(t *testing.T) {
+	store := NewFileKVStore(t.TempDir())
+	ctx := context.Background()
+	key := "test/cas"
+
+	// 期望的版本为空串时要求键不存在
+	v1, err := store.CompareAndSwap(ctx, key, "", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CompareAndSwap(ctx, key, "", []byte("again")); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected ErrVersionMismatch, got %v", err)
+	}
+	if _, err := store.CompareAndSwap(ctx, key, "1", []byte("stale")); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected ErrVersionMismatch, got %v", err)
+	}
+	if _, err := store.CompareAndSwap(ctx, "test/missing", v1, []byte("x")); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected ErrVersionMismatch for a missing key, got %v", err)
+	}
+
+	// 两个基于同一个版本的写入并发执行时只有一个成功
+	expected := v1
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		results := make([]string, 2)
+		errs := make([]error, 2)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], errs[i] = store.CompareAndSwap(ctx, key, expected, []byte("round "+strconv.Itoa(round)+" writer "+strconv.Itoa(i)))
+			}(i)
+		}
+		wg.Wait()
+
+		winner := -1
+		for i, err := range errs {
+			if err == nil {
+				if winner >= 0 {
+					t.Fatalf("round %d: both swaps succeeded", round)
+				}
+				winner = i
+			} else if !errors.Is(err, ErrVersionMismatch) {
+				t.Fatalf("round %d: unexpected error %v", round, err)
+			}
+		}
+		if winner < 0 {
+			t.Fatalf("round %d: no swap succeeded: %v", round, errs)
+		}
+		value, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "round " + strconv.Itoa(round) + " writer " + strconv.Itoa(winner); string(value) != want {
+			t.Fatalf("round %d: expected %q, got %q", round, want, value)
+		}
+		expected = results[winner]
+	}
+}
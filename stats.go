@@ -0,0 +1,409 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// DedupReport 是 AnalyzeDuplication 的结果
+type DedupReport struct {
+	// TotalRecords 历史记录总数
+	TotalRecords int
+	// UniqueContents 内容不同的历史记录数
+	UniqueContents int
+	// TotalBytes 所有历史记录的总字节数
+	TotalBytes int64
+	// ReclaimableBytes 按内容去重后可以节省的字节数
+	ReclaimableBytes int64
+}
+
+// AnalyzeDuplication 统计所有以 prefix 开头的键的历史记录（包括归档中的）中内容重复的情况，用于评估按内容去重能节省多少空间
+// 内容是以流的方式计算哈希的，只在内存中保存哈希值，归档中的版本要整个读出来
+func (f *FileKVStore) AnalyzeDuplication(ctx context.Context, prefix string) (*DedupReport, error) {
+	keys, err := f.ListKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DedupReport{}
+	seen := map[[sha256.Size]byte]struct{}{}
+	hasher := sha256.New()
+	var errList []error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		historyDir := f.keyToHistoryPath(key)
+		histories, err := f.readHistories(ctx, historyDir)
+		if err != nil {
+			errList = append(errList, err)
+			continue
+		}
+		contents := f.newHistoryContents(historyDir)
+		for _, version := range histories {
+			hasher.Reset()
+			n, err := f.hashHistory(hasher, contents, historyDir, version)
+			if err != nil {
+				if isNotExist(err) {
+					continue
+				}
+				errList = append(errList, err)
+				continue
+			}
+
+			var sum [sha256.Size]byte
+			hasher.Sum(sum[:0])
+			report.TotalRecords++
+			report.TotalBytes += n
+			if _, ok := seen[sum]; ok {
+				report.ReclaimableBytes += n
+			} else {
+				seen[sum] = struct{}{}
+				report.UniqueContents++
+			}
+		}
+	}
+
+	if len(errList) > 0 {
+		if len(errList) == 1 {
+			return nil, errList[0]
+		}
+		return nil, errors.Join(errList...)
+	}
+	return report, nil
+}
+
+// hashHistory 把 readHistories 返回的一个版本的原始内容写入 w，返回写入的字节数
+// 单独保存的版本以流的方式读取，归档中的版本通过 contents 整个读出来
+func (f *FileKVStore) hashHistory(w io.Writer, contents *historyContents, historyDir string, version Version) (int64, error) {
+	if version.archived {
+		content, err := contents.read(version)
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(content)
+		return int64(n), err
+	}
+
+	historyFile := filepath.Join(historyDir, version.Name)
+	file, err := f.fsys.Open(historyFile)
+	if err != nil {
+		if isNotExist(err) {
+			return 0, err
+		}
+		return 0, errorWrap(err, "opening history file '"+historyFile+"'")
+	}
+	defer file.Close()
+
+	n, err := io.Copy(w, file)
+	if err != nil {
+		return n, errorWrap(err, "reading history file '"+historyFile+"'")
+	}
+	return n, nil
+}
+
+// KeyStorage 是一个键占用的存储空间
+type KeyStorage struct {
+	Key string
+	// HeadBytes 主数据文件的字节数
+	HeadBytes int64
+	// HistoryBytes 所有历史记录（包括分页子目录中的历史记录和元数据文件，以及 ArchiveKey 生成的归档文件）的字节数
+	HistoryBytes int64
+	// RecordCount 历史记录数，包括归档中的
+	RecordCount int
+}
+
+// KeyStorageBreakdown 统计键的当前值和历史记录各占用了多少字节，历史记录包括分页子目录中的历史记录和它们的元数据文件，
+// 以及归档文件
+func (f *FileKVStore) KeyStorageBreakdown(ctx context.Context, key string) (headBytes int64, historyBytes int64, recordCount int, err error) {
+	if err := f.validateKey(key); err != nil {
+		return 0, 0, 0, err
+	}
+	usage, err := f.keyStorage(ctx, key)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return usage.HeadBytes, usage.HistoryBytes, usage.RecordCount, nil
+}
+
+func (f *FileKVStore) keyStorage(ctx context.Context, key string) (KeyStorage, error) {
+	usage := KeyStorage{Key: key}
+
+	st, err := f.fsys.Stat(f.keyToPath(key))
+	if err != nil {
+		return usage, f.wrapKeyErr(err, key, "checking key")
+	}
+	if st.IsDir() {
+		return usage, errorWrap(ErrKeyIsNamespace, "checking key '"+key+"'")
+	}
+	usage.HeadBytes = st.Size()
+
+	historyDir := f.keyToHistoryPath(key)
+	histories, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return usage, err
+	}
+	for _, version := range histories {
+		// 归档中的版本（包括元数据）的字节数算在归档文件中
+		if version.archived {
+			usage.RecordCount++
+			continue
+		}
+
+		historyFile := filepath.Join(historyDir, version.Name)
+		fi, err := f.fsys.Stat(historyFile)
+		if err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return usage, errorWrap(err, "checking history file '"+historyFile+"'")
+		}
+		usage.RecordCount++
+		usage.HistoryBytes += fi.Size()
+
+		if version.hasMeta {
+			metaInfo, err := f.fsys.Stat(historyFile + metaSuffix)
+			if err != nil {
+				if isNotExist(err) {
+					continue
+				}
+				return usage, errorWrap(err, "checking meta file of '"+historyFile+"'")
+			}
+			usage.HistoryBytes += metaInfo.Size()
+		}
+	}
+
+	archiveFile := filepath.Join(historyDir, archiveFileName)
+	archiveInfo, err := f.fsys.Stat(archiveFile)
+	if err != nil {
+		if isNotExist(err) {
+			return usage, nil
+		}
+		return usage, errorWrap(err, "checking archive file '"+archiveFile+"'")
+	}
+	usage.HistoryBytes += archiveInfo.Size()
+	return usage, nil
+}
+
+// TopKeysByHistoryBytes 返回历史记录占用空间最多的 n 个键，按 HistoryBytes 降序排列
+func (f *FileKVStore) TopKeysByHistoryBytes(ctx context.Context, n int) ([]KeyStorage, error) {
+	keys, err := f.ListKeys(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]KeyStorage, 0, len(keys))
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		usage, err := f.keyStorage(ctx, key)
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		results = append(results, usage)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].HistoryBytes != results[j].HistoryBytes {
+			return results[i].HistoryBytes > results[j].HistoryBytes
+		}
+		return results[i].Key < results[j].Key
+	})
+	if n >= 0 && len(results) > n {
+		results = results[:n]
+	}
+	return results, nil
+}
+
+// RootHash 计算所有以 prefix 开头的键的摘要，用于低成本地比较两个副本是否一致
+// 它按键名排序，把每个键的键名、最新版本和当前值（变换之后的逻辑内容）的 sha256 依次写入一个 sha256 摘要，
+// 数据相同的两个存储得到的结果一定相同。没有历史记录的键的版本按空串计算。
+func (f *FileKVStore) RootHash(ctx context.Context, prefix string) ([]byte, error) {
+	keys, err := f.ListKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	root := sha256.New()
+	content := sha256.New()
+	var lenBuf [binary.MaxVarintLen64]byte
+	writeField := func(s string) {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(s)))
+		root.Write(lenBuf[:n])
+		root.Write([]byte(s))
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		content.Reset()
+		version, exists, err := f.hashHead(ctx, key, content)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue // 键在遍历之后被删除了
+		}
+
+		writeField(key)
+		writeField(version)
+		root.Write(content.Sum(nil))
+	}
+	return root.Sum(nil), nil
+}
+
+// hashHead 返回键的最新版本，并把当前值写入 h，键不存在时返回 false
+// 和 GetConsistent 相同，读取期间锁住键，以免版本和内容来自两次不同的写入
+func (f *FileKVStore) hashHead(ctx context.Context, key string, h hash.Hash) (string, bool, error) {
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	version, err := lastVersionOf(ctx, f, key)
+	if err != nil {
+		return "", false, err
+	}
+	exists, err := f.hashValue(key, h)
+	return version, exists, err
+}
+
+// hashValue 把键的当前值（变换之后的逻辑内容）写入 h，键不存在时返回 false
+// 没有设置 WithTransform 时流式地读取文件，设置了时要先读出整个值再变换
+func (f *FileKVStore) hashValue(key string, h hash.Hash) (bool, error) {
+	if f.transform != nil {
+		value, err := f.readValue(key)
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		h.Write(value)
+		return true, nil
+	}
+
+	file, err := f.fsys.Open(f.keyToPath(key))
+	if err != nil {
+		if isNotExist(err) {
+			return false, nil
+		}
+		return false, errorWrap(err, "opening file of '"+key+"'")
+	}
+	defer file.Close()
+	if _, err := io.Copy(h, file); err != nil {
+		return false, errorWrap(err, "reading file of '"+key+"'")
+	}
+	return true, nil
+}
+
+// DiffAgainst 比较 prefix 下的键和另一个副本 other 中的键，返回只在这里存在的键、只在 other 中存在的键，
+// 以及两边都存在但是不同的键，结果都已排序。判断标准和 RootHash 相同：最新版本不同时认为键不同，这时不需要读取内容，
+// 版本相同时再比较当前值的 sha256，所以 RootHash 不同时可以用它找出具体是哪些键。
+// 每次只读取一个键的值，不会把所有的值加载到内存中，other 也是 *FileKVStore 时两边都流式地计算摘要。
+func (f *FileKVStore) DiffAgainst(ctx context.Context, other KeyValueStore, prefix string) (onlyHere []string, onlyThere []string, differing []string, err error) {
+	hereKeys, err := f.ListKeys(ctx, prefix)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	thereKeys, err := other.ListKeys(ctx, prefix)
+	if err != nil {
+		return nil, nil, nil, errorWrap(err, "listing keys of the other store")
+	}
+	sort.Strings(hereKeys)
+	sort.Strings(thereKeys)
+
+	i, j := 0, 0
+	for i < len(hereKeys) || j < len(thereKeys) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+
+		switch {
+		case j >= len(thereKeys) || (i < len(hereKeys) && hereKeys[i] < thereKeys[j]):
+			onlyHere = append(onlyHere, hereKeys[i])
+			i++
+			continue
+		case i >= len(hereKeys) || thereKeys[j] < hereKeys[i]:
+			onlyThere = append(onlyThere, thereKeys[j])
+			j++
+			continue
+		}
+
+		key := hereKeys[i]
+		i++
+		j++
+		same, err := f.sameHead(ctx, other, key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !same {
+			differing = append(differing, key)
+		}
+	}
+	return onlyHere, onlyThere, differing, nil
+}
+
+// sameHead 检查键在这里和 other 中的最新版本和当前值是否都相同
+func (f *FileKVStore) sameHead(ctx context.Context, other KeyValueStore, key string) (bool, error) {
+	hereVersion, err := lastVersionOf(ctx, f, key)
+	if err != nil {
+		return false, err
+	}
+	thereVersion, err := lastVersionOf(ctx, other, key)
+	if err != nil {
+		return false, errorWrap(err, "getting last version of '"+key+"' from the other store")
+	}
+	if hereVersion != thereVersion {
+		return false, nil
+	}
+
+	hereHash := sha256.New()
+	hereExists, err := f.hashValue(key, hereHash)
+	if err != nil {
+		return false, err
+	}
+	thereHash := sha256.New()
+	var thereExists bool
+	if otherStore, ok := other.(*FileKVStore); ok {
+		thereExists, err = otherStore.hashValue(key, thereHash)
+	} else {
+		var value []byte
+		value, err = other.Get(ctx, key)
+		if errors.Is(err, ErrKeyNotFound) {
+			err = nil
+		} else if err == nil {
+			thereExists = true
+			thereHash.Write(value)
+		}
+	}
+	if err != nil {
+		return false, errorWrap(err, "reading '"+key+"' from the other store")
+	}
+	return hereExists == thereExists && bytes.Equal(hereHash.Sum(nil), thereHash.Sum(nil)), nil
+}
+
+// lastVersionOf 返回键的最新版本，没有历史记录时返回空串
+func lastVersionOf(ctx context.Context, store KeyValueStore, key string) (string, error) {
+	lastVersion, err := store.GetLastVersion(ctx, key)
+	if err != nil {
+		if errors.Is(err, ErrVersionNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	return lastVersion.Version, nil
+}
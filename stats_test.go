@@ -0,0 +1,416 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileKVStore_AnalyzeDuplication(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	set := func(key, value string) {
+		t.Helper()
+		timestamp = timestamp.Add(time.Second)
+		if _, err := store.SetWithTimestamp(ctx, key, []byte(value), timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 在 app/ 下: "aaaa" 出现 3 次，"bb" 出现 2 次，"c" 出现 1 次
+	set("app/x", "aaaa")
+	set("app/x", "bb")
+	set("app/x", "aaaa")
+	set("app/y", "aaaa")
+	set("app/y", "c")
+	set("app/z/w", "bb")
+	// 不在前缀下的键不统计
+	set("other", "aaaa")
+
+	report, err := store.AnalyzeDuplication(ctx, "app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DedupReport{
+		TotalRecords:     6,
+		UniqueContents:   3,
+		TotalBytes:       4*3 + 2*2 + 1,
+		ReclaimableBytes: 4*2 + 2,
+	}
+	if *report != expected {
+		t.Fatalf("expected %+v, got %+v", expected, *report)
+	}
+
+	report, err = store.AnalyzeDuplication(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TotalRecords != 7 || report.UniqueContents != 3 || report.ReclaimableBytes != 4*3+2 {
+		t.Fatalf("unexpected report for all keys: %+v", *report)
+	}
+
+	// 归档之后结果不变
+	if err := store.ArchiveKey(ctx, "app/x"); err != nil {
+		t.Fatal(err)
+	}
+	report, err = store.AnalyzeDuplication(ctx, "app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != expected {
+		t.Fatalf("expected %+v after archiving, got %+v", expected, *report)
+	}
+}
+
+func TestFileKVStore_KeyStorageBreakdown(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 历史记录分布在默认目录和分页子目录中
+	writeTestDataToFS(t, tempDir, map[string][]byte{
+		"a": []byte("12345"),
+		".history/a.h/p_1672531200000000000/1672531200000000000": []byte("1"),
+		".history/a.h/p_1672531200000000000/1672531201000000000": []byte("12"),
+		".history/a.h/1672531202000000000":                       []byte("12345"),
+		".history/a.h/1672531202000000000.meta":                  []byte("k=v\n"),
+		"b/c":                                                    []byte("xy"),
+		".history/b/c.h/1672531200000000000":                     []byte("xy"),
+		"d":                                                      []byte("z"),
+	})
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	headBytes, historyBytes, recordCount, err := store.KeyStorageBreakdown(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headBytes != 5 || historyBytes != 1+2+5+4 || recordCount != 3 {
+		t.Fatalf("unexpected breakdown for a: %d, %d, %d", headBytes, historyBytes, recordCount)
+	}
+
+	if _, _, _, err := store.KeyStorageBreakdown(ctx, "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	top, err := store.TopKeysByHistoryBytes(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyStorage{
+		{Key: "a", HeadBytes: 5, HistoryBytes: 12, RecordCount: 3},
+		{Key: "b/c", HeadBytes: 2, HistoryBytes: 2, RecordCount: 1},
+	}
+	if len(top) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, top)
+	}
+	for i := range expected {
+		if top[i] != expected[i] {
+			t.Fatalf("expected %+v at %d, got %+v", expected[i], i, top[i])
+		}
+	}
+
+	// 归档之后归档中的版本仍然计数，归档文件的大小计入历史记录
+	if err := store.ArchiveKey(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	archiveInfo, err := os.Stat(filepath.Join(tempDir, ".history", "a.h", archiveFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headBytes, historyBytes, recordCount, err = store.KeyStorageBreakdown(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 5 + 4 + archiveInfo.Size(); headBytes != 5 || historyBytes != expected || recordCount != 3 {
+		t.Fatalf("unexpected breakdown for archived a: %d, %d, %d", headBytes, historyBytes, recordCount)
+	}
+	top, err = store.TopKeysByHistoryBytes(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0].Key != "a" || top[0].HistoryBytes != historyBytes || top[0].RecordCount != 3 {
+		t.Fatalf("unexpected top keys after archiving: %+v", top)
+	}
+}
+
+func TestFileKVStore_RootHash(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-roothash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	newReplica := func(name string) *FileKVStore {
+		store := NewFileKVStore(filepath.Join(tempDir, name))
+		// 写入的顺序不同，结果也相同
+		keys := []string{"a", "b/c", "b/d", "e"}
+		if name == "replica2" {
+			keys = []string{"e", "b/d", "a", "b/c"}
+		}
+		for _, key := range keys {
+			if _, err := store.SetWithTimestamp(ctx, key, []byte("value of "+key), timestamp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return store
+	}
+	replica1 := newReplica("replica1")
+	replica2 := newReplica("replica2")
+
+	hash1, err := replica1.RootHash(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := replica2.RootHash(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hash1, hash2) {
+		t.Fatalf("expected identical root hashes, got %x and %x", hash1, hash2)
+	}
+
+	// 一个键不同时结果不同，但是不影响其他前缀的结果
+	if _, err := replica2.SetWithTimestamp(ctx, "b/d", []byte("diverged"), timestamp.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	hash2, err = replica2.RootHash(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hash1, hash2) {
+		t.Fatal("expected root hashes to differ after divergence")
+	}
+	for _, test := range []struct {
+		prefix string
+		equal  bool
+	}{
+		{prefix: "b/", equal: false},
+		{prefix: "a", equal: true},
+		{prefix: "e", equal: true},
+	} {
+		hash1, err := replica1.RootHash(ctx, test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash2, err := replica2.RootHash(ctx, test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(hash1, hash2) != test.equal {
+			t.Fatalf("prefix %q: expected equal=%v", test.prefix, test.equal)
+		}
+	}
+}
+
+func TestFileKVStore_RootHashLocksKey(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileKVStore(t.TempDir())
+	if _, err := store.Set(ctx, "a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 键正在写入时等待写入完成，版本和内容来自同一次写入
+	unlock := store.lockKey("a")
+	done := make(chan error, 1)
+	go func() {
+		_, err := store.RootHash(ctx, "")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected RootHash to wait for the key lock, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// memHeadStore 是一个只保存每个键的当前值和最新版本的内存存储，用于测试 DiffAgainst
+type memHeadStore struct {
+	KeyValueStore
+
+	values   map[string]string
+	versions map[string]string
+}
+
+func (m *memHeadStore) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for key := range m.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memHeadStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, ok := m.values[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return []byte(value), nil
+}
+
+func (m *memHeadStore) GetLastVersion(ctx context.Context, key string) (*Version, error) {
+	version, ok := m.versions[key]
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+	return &Version{Name: version, Version: version}, nil
+}
+
+func TestFileKVStore_DiffAgainst(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-diff-against-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewFileKVStore(filepath.Join(tempDir, "here"))
+	other := &memHeadStore{values: map[string]string{}, versions: map[string]string{}}
+	put := func(key, value string, toStore, toOther bool, otherValue string) {
+		t.Helper()
+		version := ""
+		if toStore {
+			var err error
+			version, err = store.SetWithTimestamp(ctx, key, []byte(value), timestamp)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if toOther {
+			other.values[key] = otherValue
+			other.versions[key] = version
+			if version == "" {
+				other.versions[key] = strconv.FormatInt(timestamp.UnixNano(), 10)
+			}
+		}
+	}
+
+	put("same/a", "a", true, true, "a")
+	put("same/b", "b", true, true, "b")
+	put("here/only", "x", true, false, "")
+	put("there/only", "", false, true, "y")
+	// 版本相同但内容不同
+	put("diff/content", "mine", true, true, "theirs")
+	// 内容相同但版本不同
+	put("diff/version", "v", true, true, "v")
+	other.versions["diff/version"] = "1"
+
+	onlyHere, onlyThere, differing, err := store.DiffAgainst(ctx, other, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(onlyHere, ",") != "here/only" {
+		t.Fatalf("unexpected onlyHere %v", onlyHere)
+	}
+	if strings.Join(onlyThere, ",") != "there/only" {
+		t.Fatalf("unexpected onlyThere %v", onlyThere)
+	}
+	if strings.Join(differing, ",") != "diff/content,diff/version" {
+		t.Fatalf("unexpected differing %v", differing)
+	}
+
+	// 只比较 prefix 下的键
+	onlyHere, onlyThere, differing, err = store.DiffAgainst(ctx, other, "same/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onlyHere)+len(onlyThere)+len(differing) != 0 {
+		t.Fatalf("expected no differences, got %v %v %v", onlyHere, onlyThere, differing)
+	}
+
+	// 两边都是 FileKVStore 时流式地比较
+	replica := NewFileKVStore(filepath.Join(tempDir, "replica"))
+	for _, key := range []string{"same/a", "same/b", "diff/content"} {
+		value, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == "diff/content" {
+			value = []byte("other")
+		}
+		if _, err := replica.SetWithTimestamp(ctx, key, value, timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	onlyHere, onlyThere, differing, err = store.DiffAgainst(ctx, replica, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(onlyHere, ",") != "diff/version,here/only" || len(onlyThere) != 0 || strings.Join(differing, ",") != "diff/content" {
+		t.Fatalf("unexpected diff %v %v %v", onlyHere, onlyThere, differing)
+	}
+}
+
+func TestFileKVStore_DiffAgainstTransform(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 比较的是变换之后的逻辑内容，和文件中保存的格式无关
+	store := NewFileKVStore(filepath.Join(tempDir, "here"), WithTransform(envelopeTransformer{}))
+	plain := NewFileKVStore(filepath.Join(tempDir, "plain"))
+	other := &memHeadStore{values: map[string]string{}, versions: map[string]string{}}
+	for _, key := range []string{"env/a", "plain/b"} {
+		version, err := store.SetWithTimestamp(ctx, key, []byte("value of "+key), timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := plain.SetWithTimestamp(ctx, key, []byte("value of "+key), timestamp); err != nil {
+			t.Fatal(err)
+		}
+		other.values[key] = "value of " + key
+		other.versions[key] = version
+	}
+
+	for _, against := range []KeyValueStore{other, plain} {
+		onlyHere, onlyThere, differing, err := store.DiffAgainst(ctx, against, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(onlyHere)+len(onlyThere)+len(differing) != 0 {
+			t.Errorf("expected no differences, got %v %v %v", onlyHere, onlyThere, differing)
+		}
+	}
+
+	hash1, err := store.RootHash(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := plain.RootHash(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hash1, hash2) {
+		t.Errorf("expected identical root hashes, got %x and %x", hash1, hash2)
+	}
+}
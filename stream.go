@@ -0,0 +1,424 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HistoryRecord 是 StreamHistoryJSONL 输出的每一行记录
+type HistoryRecord struct {
+	Version   string            `json:"version"`
+	Timestamp time.Time         `json:"timestamp"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	// Content 在 JSON 中以 base64 编码
+	Content []byte `json:"content"`
+}
+
+// StreamHistoryJSONL 按版本升序把键的历史记录以 JSON Lines 格式写入 w，每行一个 HistoryRecord
+// 历史记录是逐个读取并写出的，不会把整个历史记录加载到内存中
+// sinceVersion 不为空时只输出比它新的版本，用于增量地获取新的变更
+func (f *FileKVStore) StreamHistoryJSONL(ctx context.Context, key string, w io.Writer, sinceVersion string) error {
+	if err := f.validateKey(key); err != nil {
+		return err
+	}
+
+	historyDir := f.keyToHistoryPath(key)
+	versions, err := f.readHistories(ctx, historyDir)
+	if err != nil {
+		return err
+	}
+
+	contents := f.newHistoryContents(historyDir)
+	encoder := json.NewEncoder(w)
+	for _, version := range versions {
+		if sinceVersion != "" && compareVersions(version.Version, sinceVersion) <= 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		content, err := contents.read(version)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// 可能在遍历期间被清理了
+				continue
+			}
+			return errorWrap(err, "reading history '"+version.Version+"' of '"+key+"'")
+		}
+		content, err = f.decodeValue(key, content)
+		if err != nil {
+			return err
+		}
+
+		record := HistoryRecord{
+			Version: version.Version,
+			Content: content,
+		}
+		if ts, _, err := parseVersion(version.Version); err == nil {
+			record.Timestamp = time.Unix(0, ts).UTC()
+		}
+		if version.hasMeta {
+			meta, err := f.readHistoryMeta(historyDir, version)
+			if err != nil {
+				return err
+			}
+			record.Meta = meta
+		}
+
+		if err := encoder.Encode(&record); err != nil {
+			return errorWrap(err, "writing history record '"+version.Version+"'")
+		}
+	}
+	return nil
+}
+
+// WriteVersionTo 把指定版本的内容写入 w，返回写入的字节数，version 为 head 时写入当前值
+// 和 GetByVersion 不同，它不会把整个内容读到内存中，适合导出很大的值
+func (f *FileKVStore) WriteVersionTo(ctx context.Context, key, version string, w io.Writer) (int64, error) {
+	r, err := f.OpenReaderByVersion(ctx, key, version)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, errorWrap(err, "writing version '"+version+"' of '"+key+"'")
+	}
+	return n, nil
+}
+
+// OpenReader 打开键的当前值用于流式读取，调用者负责关闭返回的 io.ReadCloser
+// 和 Get 不同，它不会把整个值读到内存中，适合很大的值。键不存在时返回 ErrKeyNotFound。
+// 关闭之前，删除该键的 Delete 会等待它被关闭，见 OpenReaderByVersion
+func (f *FileKVStore) OpenReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+	key, err := f.followRename(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return f.OpenReaderByVersion(ctx, key, "head")
+}
+
+// OpenReaderByVersion 打开键的指定版本用于流式读取，version 为 head 时打开当前值，调用者负责关闭返回的 io.ReadCloser
+// 版本在分页目录中时也能找到，版本不存在时返回 ErrVersionNotFound。
+// 关闭之前键处于被使用的状态，Delete 会等待它被关闭，超过 WithDeleteTimeout 设置的时间后返回 ErrBusy，所以用完之后要尽快关闭。
+// 设置了 WithTransform 时需要先读出整个内容再变换，这时不能节省内存。
+func (f *FileKVStore) OpenReaderByVersion(ctx context.Context, key, version string) (io.ReadCloser, error) {
+	if err := f.validateKey(key); err != nil {
+		return nil, err
+	}
+	release := f.refs.acquire(key)
+
+	file, err := f.openVersionFile(ctx, key, version)
+	if err != nil {
+		if !errors.Is(err, ErrVersionNotFound) {
+			release()
+			return nil, err
+		}
+		// 归档中的版本只能整个读出来
+		data, ok, archiveErr := f.findArchivedVersion(f.keyToHistoryPath(key), version)
+		if archiveErr == nil && ok {
+			data, archiveErr = f.decodeValue(key, data)
+		}
+		if archiveErr != nil || !ok {
+			release()
+			if archiveErr != nil {
+				return nil, archiveErr
+			}
+			return nil, err
+		}
+		return &versionReader{Reader: bytes.NewReader(data), release: release}, nil
+	}
+	r := &versionReader{Reader: file, file: file, release: release}
+	if f.transform != nil {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			r.Close()
+			return nil, errorWrap(err, "reading version '"+version+"' of '"+key+"'")
+		}
+		data, err = f.decodeValue(key, data)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		// 和 Get 一样按变换之后的内容判断是否为空
+		if len(data) == 0 && f.treatEmptyAsAbsent && isHeadRevision(version) {
+			r.Close()
+			return nil, errorWrap(ErrKeyNotFound, "opening key '"+key+"': value is empty")
+		}
+		r.Reader = bytes.NewReader(data)
+	}
+	return r, nil
+}
+
+// openVersionFile 打开键的指定版本的文件，version 为 head 时打开主数据文件
+func (f *FileKVStore) openVersionFile(ctx context.Context, key, version string) (fs.File, error) {
+	if !isHeadRevision(version) {
+		historyFile, err := f.resolveHistoryFile(ctx, key, version)
+		if err != nil {
+			return nil, err
+		}
+		file, err := f.fsys.Open(historyFile)
+		if err != nil {
+			if isNotExist(err) {
+				return nil, errorWrap(ErrVersionNotFound, "version '"+version+"' not found for key '"+key+"'")
+			}
+			return nil, errorWrap(err, "opening history file")
+		}
+		return file, nil
+	}
+
+	file, err := f.fsys.Open(f.keyToPath(key))
+	if err != nil {
+		return nil, f.wrapKeyErr(err, key, "opening key")
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errorWrap(err, "opening key '"+key+"'")
+	}
+	if st.IsDir() {
+		file.Close()
+		return nil, errorWrap(ErrKeyIsNamespace, "opening key '"+key+"'")
+	}
+	// 设置了 WithTransform 时要等变换之后再判断，见 OpenReaderByVersion
+	if st.Size() == 0 && f.treatEmptyAsAbsent && f.transform == nil {
+		file.Close()
+		return nil, errorWrap(ErrKeyNotFound, "opening key '"+key+"': value is empty")
+	}
+	return file, nil
+}
+
+// versionReader 是 OpenReaderByVersion 返回的 io.ReadCloser，关闭时关闭文件并释放键的引用，版本在归档中时 file 为 nil
+type versionReader struct {
+	io.Reader
+	file    fs.File
+	release func()
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (r *versionReader) Close() error {
+	r.closeOnce.Do(func() {
+		if r.file != nil {
+			r.closeErr = r.file.Close()
+		}
+		r.release()
+	})
+	return r.closeErr
+}
+
+// SetFromReader 把 r 中的全部内容作为键的新值写入，和 Set 相同，返回新的版本号，值没有改变时不产生新的版本并返回空串
+// 内容只被复制一次：一边写入临时文件一边计算 SHA-256，读完后和当前值比较，长度相同时才计算当前值的 SHA-256，
+// 值改变了就把临时文件作为新的值（历史记录是它的硬链接或者副本），所以上传很大的值时不需要把它放在内存中。
+// 代价是必须读完整个 r 才能判断值是否改变，值没有改变时读入的内容也会先写到磁盘上再丢弃。
+// 设置了 WithTransform、WithCompareFunc 或 WithNormalizeTrailingNewline，或者 FS 没有实现 CreateFS 时，
+// 需要完整的值才能比较，这时先把 r 的全部内容读到内存中再按 Set 处理。
+func (f *FileKVStore) SetFromReader(ctx context.Context, key string, r io.Reader) (string, error) {
+	if f.readOnly {
+		return "", ErrReadOnly
+	}
+	if err := f.validateKey(key); err != nil {
+		return "", err
+	}
+
+	creator, ok := f.fsys.(CreateFS)
+	if !ok || f.transform != nil || f.compareFunc != nil || f.normalizeTrailingNewline {
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return "", errorWrap(err, "reading value of '"+key+"'")
+		}
+		return f.Set(ctx, key, value)
+	}
+
+	if !f.rateLimiter.allow(key) {
+		return "", errorWrap(ErrRateLimited, "setting key '"+key+"'")
+	}
+
+	unlock := f.lockKey(key)
+	defer unlock()
+
+	timestamp, err := f.clock.now(f.lockName(key), key)
+	if err != nil {
+		return "", err
+	}
+
+	dataFile := f.keyToPath(key)
+	tempFile := siblingTempFile(dataFile)
+	committed := false
+	defer func() {
+		if !committed {
+			_ = f.fsys.Remove(tempFile)
+		}
+	}()
+
+	sum, size, err := f.copyToFile(creator, tempFile, r)
+	if err != nil {
+		return "", f.wrapSetKeyErr(err, key, "writing value of")
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	changed, err := f.isStreamChanged(dataFile, sum, size)
+	if err != nil {
+		return "", f.wrapSetKeyErr(err, key, "reading file for comparison")
+	}
+	if !changed {
+		if f.touchOnUnchanged {
+			if err := f.touch(dataFile); err != nil {
+				return "", errorWrap(err, "touching file")
+			}
+		}
+		return "", nil
+	}
+
+	reserved, err := f.reserveQuota(ctx, key, dataFile, size)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if !committed {
+			f.releaseQuota(reserved)
+		}
+	}()
+
+	historyDir := f.keyToHistoryPath(key)
+	timestampStr, historyFile, err := f.uniqueHistoryFile(historyDir, timestamp.UnixNano())
+	if err != nil {
+		return "", err
+	}
+	unmark, err := f.markHead(historyDir, timestampStr)
+	if err != nil {
+		return "", err
+	}
+	var metaFile string
+	if meta := f.newVersionMeta(ctx, nil); len(meta) > 0 {
+		metaFile = historyFile + metaSuffix
+		if err := f.writeProperties(metaFile, meta); err != nil {
+			return "", err
+		}
+	}
+
+	defer f.pages.invalidate(historyDir)
+
+	// 和 writeValueAndHistory 相同，先写历史记录再更新主数据文件
+	if err := f.linkOrCopyHistory(creator, tempFile, historyDir, historyFile); err != nil {
+		if metaFile != "" {
+			_ = f.fsys.Remove(metaFile)
+		}
+		return "", errorWrap(err, "writing history file")
+	}
+	if err := f.fsys.Rename(tempFile, dataFile); err != nil {
+		_ = f.fsys.Remove(historyFile)
+		if metaFile != "" {
+			_ = f.fsys.Remove(metaFile)
+		}
+		return "", f.wrapSetKeyErr(err, key, "writing file")
+	}
+	committed = true
+	if unmark {
+		f.unmarkHead(historyDir)
+	}
+
+	f.appendRecentIndex(ctx, key, timestampStr)
+	f.clock.issued(f.lockName(key), timestamp)
+	return timestampStr, nil
+}
+
+// copyToFile 把 r 的全部内容写入 filePath（目录不存在时先创建），返回内容的 SHA-256 和长度
+func (f *FileKVStore) copyToFile(creator CreateFS, filePath string, r io.Reader) ([]byte, int64, error) {
+	var w io.WriteCloser
+	err := f.retryWithDir(filepath.Dir(filePath), func() error {
+		var err error
+		w, err = creator.Create(filePath, f.filePerm)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, h), r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), size, nil
+}
+
+// isStreamChanged 判断内容的 SHA-256 为 sum、长度为 size 的值和主数据文件中的当前值是否不同
+func (f *FileKVStore) isStreamChanged(dataFile string, sum []byte, size int64) (bool, error) {
+	st, err := f.fsys.Stat(dataFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if st.IsDir() || st.Size() != size {
+		// 键是命名空间时由之后的 Rename 报告冲突
+		return true, nil
+	}
+
+	file, err := f.fsys.Open(dataFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return false, err
+	}
+	return !bytes.Equal(h.Sum(nil), sum), nil
+}
+
+// linkOrCopyHistory 把 tempFile 作为历史记录 historyFile，设置了 WithLinkHistory 时创建硬链接，否则复制一份
+func (f *FileKVStore) linkOrCopyHistory(creator CreateFS, tempFile, historyDir, historyFile string) error {
+	if linker, ok := f.fsys.(LinkFS); ok && f.linkHistory {
+		err := f.retryWithDir(historyDir, func() error {
+			return linker.Link(tempFile, historyFile)
+		})
+		if err == nil {
+			return nil
+		}
+		// 不支持硬链接，退回到复制
+	}
+
+	src, err := f.fsys.Open(tempFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	historyTemp := siblingTempFile(historyFile)
+	if _, _, err := f.copyToFile(creator, historyTemp, src); err != nil {
+		_ = f.fsys.Remove(historyTemp)
+		return err
+	}
+	if err := f.fsys.Rename(historyTemp, historyFile); err != nil {
+		_ = f.fsys.Remove(historyTemp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package filekv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeHistoryJSONL(t *testing.T, data []byte) []HistoryRecord {
+	t.Helper()
+
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid json line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestFileKVStore_StreamHistoryJSONL(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-stream-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/stream"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []string
+	var values []string
+	for i := 0; i < 5; i++ {
+		value := "value " + strconv.Itoa(i)
+		version, err := store.SetWithTimestamp(ctx, key, []byte(value), timestamp.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+		values = append(values, value)
+	}
+	if err := store.SetMeta(ctx, key, versions[1], map[string]string{"author": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := store.StreamHistoryJSONL(ctx, key, &buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	records := decodeHistoryJSONL(t, buf.Bytes())
+	if len(records) != len(versions) {
+		t.Fatalf("expected %d records, got %d", len(versions), len(records))
+	}
+	for i, record := range records {
+		if record.Version != versions[i] {
+			t.Fatalf("expected version %q at %d, got %q", versions[i], i, record.Version)
+		}
+		if string(record.Content) != values[i] {
+			t.Fatalf("expected content %q at %d, got %q", values[i], i, record.Content)
+		}
+		if !record.Timestamp.Equal(timestamp.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("unexpected timestamp %v at %d", record.Timestamp, i)
+		}
+	}
+	if records[1].Meta["author"] != "test" {
+		t.Fatalf("expected meta author=test, got %v", records[1].Meta)
+	}
+
+	// 只获取 sinceVersion 之后的版本
+	buf.Reset()
+	if err := store.StreamHistoryJSONL(ctx, key, &buf, versions[2]); err != nil {
+		t.Fatal(err)
+	}
+	records = decodeHistoryJSONL(t, buf.Bytes())
+	if len(records) != 2 || records[0].Version != versions[3] || records[1].Version != versions[4] {
+		t.Fatalf("unexpected records since %q: %v", versions[2], records)
+	}
+
+	buf.Reset()
+	if err := store.StreamHistoryJSONL(ctx, key, &buf, versions[4]); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected no output, got %q", buf.String())
+	}
+}
+
+func TestFileKVStore_WriteVersionTo(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-writeto-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/writeto"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	version1, err := store.SetWithTimestamp(ctx, key, bytes.Repeat([]byte("a"), 100000), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetWithTimestamp(ctx, key, []byte("latest"), timestamp.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	for version, expected := range map[string][]byte{
+		version1: bytes.Repeat([]byte("a"), 100000),
+		"head":   []byte("latest"),
+	} {
+		var buf bytes.Buffer
+		n, err := store.WriteVersionTo(ctx, key, version, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(expected)) {
+			t.Fatalf("%s: expected %d bytes written, got %d", version, len(expected), n)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("%s: unexpected content", version)
+		}
+		// 和 GetByVersion 的结果一致
+		value, err := store.GetByVersion(ctx, key, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), value) {
+			t.Fatalf("%s: content differs from GetByVersion", version)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := store.WriteVersionTo(ctx, key, "1234567890", &buf); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+	if _, err := store.WriteVersionTo(ctx, "test/missing", "head", &buf); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestFileKVStore_OpenReader(t *testing.T) {
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithDeleteTimeout(50*time.Millisecond))
+	ctx := context.Background()
+	key := "test/blob"
+
+	large := make([]byte, 5<<20+123)
+	rand.New(rand.NewSource(1)).Read(large)
+	version, err := store.Set(ctx, key, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, key, []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 分块读取，比较 SHA-256
+	readSum := func(r io.ReadCloser) [sha256.Size]byte {
+		t.Helper()
+		defer r.Close()
+		h := sha256.New()
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := r.Read(buf)
+			h.Write(buf[:n])
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		return sum
+	}
+
+	r, err := store.OpenReaderByVersion(ctx, key, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readSum(r) != sha256.Sum256(large) {
+		t.Fatal("content of the large version differs")
+	}
+	r, err = store.OpenReader(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readSum(r) != sha256.Sum256([]byte("small")) {
+		t.Fatal("content of head differs")
+	}
+
+	if _, err := store.OpenReader(ctx, "test/missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := store.OpenReader(ctx, "test"); !errors.Is(err, ErrKeyIsNamespace) {
+		t.Fatalf("expected ErrKeyIsNamespace, got %v", err)
+	}
+	if _, err := store.OpenReaderByVersion(ctx, key, "1234567890"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+
+	// 打开期间 Delete 等待它关闭
+	r, err = store.OpenReader(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, key, true); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy while the reader is open, got %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 重复关闭不会重复释放
+	r.Close()
+	if err := store.Delete(ctx, key, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileKVStore_OpenReaderByVersionPaged(t *testing.T) {
+	tempDir := t.TempDir()
+	key := "paged"
+	versions := writePagedHistories(t, tempDir, key, defaultMaxHistoryCount+10)
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+
+	// 最早的版本已经被移到分页目录中
+	r, err := store.OpenReaderByVersion(ctx, key, versions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != versions[0] {
+		t.Fatalf("expected %q, got %q", versions[0], data)
+	}
+}
+
+func TestFileKVStore_OpenReaderTransform(t *testing.T) {
+	store := NewFileKVStore(t.TempDir(), WithTransform(envelopeTransformer{}))
+	ctx := context.Background()
+
+	version, err := store.Set(ctx, "env/a", []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{version, "head"} {
+		r, err := store.OpenReaderByVersion(ctx, "env/a", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "payload" {
+			t.Errorf("%s: expected the decoded value, got %q", v, data)
+		}
+	}
+}
+
+func TestFileKVStore_OpenReaderTransformEmpty(t *testing.T) {
+	store := NewFileKVStore(t.TempDir(), WithTransform(envelopeTransformer{}), WithTreatEmptyAsAbsent(true))
+	ctx := context.Background()
+
+	// 文件中有头部，但变换之后的值为空，和 Get 一样当作不存在
+	if _, err := store.Set(ctx, "env/empty", []byte("")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "env/empty"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound from Get, got %v", err)
+	}
+	if _, err := store.OpenReader(ctx, "env/empty"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound from OpenReader, got %v", err)
+	}
+}
+
+func TestFileKVStore_SetFromReader(t *testing.T) {
+	for _, linkHistory := range []bool{false, true} {
+		t.Run("link="+strconv.FormatBool(linkHistory), func(t *testing.T) {
+			tempDir := t.TempDir()
+			store := NewFileKVStore(tempDir, WithLinkHistory(linkHistory))
+			ctx := context.Background()
+			key := "test/upload"
+
+			large := make([]byte, 3<<20+17)
+			rand.New(rand.NewSource(1)).Read(large)
+			v1, err := store.SetFromReader(ctx, key, bytes.NewReader(large))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v1 == "" {
+				t.Fatal("expected a new version")
+			}
+			dataInfo, err := os.Stat(filepath.Join(tempDir, "test", "upload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			historyInfo, err := os.Stat(filepath.Join(tempDir, ".history", "test", "upload.h", v1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if os.SameFile(dataInfo, historyInfo) != linkHistory {
+				t.Errorf("expected the history to be a hard link: %v", linkHistory)
+			}
+			for _, version := range []string{"head", v1} {
+				value, err := store.GetByVersion(ctx, key, version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(value, large) {
+					t.Fatalf("%s: value differs from the uploaded data", version)
+				}
+			}
+
+			// 内容相同时不产生新的版本
+			version, err := store.SetFromReader(ctx, key, bytes.NewReader(large))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != "" {
+				t.Fatalf("expected no new version for the same content, got %q", version)
+			}
+
+			// 长度相同但内容不同时产生新的版本
+			changed := append([]byte(nil), large...)
+			changed[len(changed)/2]++
+			v2, err := store.SetFromReader(ctx, key, bytes.NewReader(changed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v2 == "" {
+				t.Fatal("expected a new version for changed content")
+			}
+			histories, err := store.GetHistories(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkHistories(t, histories, []string{v1, v2})
+
+			// 读取失败时值不变，也不留下临时文件
+			errRead := errors.New("read failed")
+			if _, err := store.SetFromReader(ctx, key, io.MultiReader(bytes.NewReader([]byte("partial")), errReader{errRead})); !errors.Is(err, errRead) {
+				t.Fatalf("expected the read error, got %v", err)
+			}
+			value, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, changed) {
+				t.Fatal("expected the value to be unchanged after a failed upload")
+			}
+			files, err := getAllFiles(tempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range files {
+				if strings.HasSuffix(file, tempFileSuffix) {
+					t.Errorf("unexpected temp file %s", file)
+				}
+			}
+		})
+	}
+}
+
+func TestFileKVStore_SetFromReaderBuffered(t *testing.T) {
+	ctx := context.Background()
+
+	// 有变换时先读到内存中再按 Set 处理
+	store := NewFileKVStore(t.TempDir(), WithTransform(envelopeTransformer{}))
+	v1, err := store.SetFromReader(ctx, "env/a", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := store.Set(ctx, "env/a", []byte("hello")); err != nil || version != "" {
+		t.Fatalf("expected no new version, got %q, %v", version, err)
+	}
+	value, err := store.GetByVersion(ctx, "env/a", v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", value)
+	}
+
+	// FS 不支持流式写入时也一样
+	store = NewFileKVStore(t.TempDir(), WithFS(&faultFS{FS: osFS{}}))
+	if _, err := store.SetFromReader(ctx, "plain", strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := store.SetFromReader(ctx, "plain", strings.NewReader("world")); err != nil || version != "" {
+		t.Fatalf("expected no new version, got %q, %v", version, err)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
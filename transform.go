@@ -0,0 +1,67 @@
+package filekv
+
+// Transformer 在内容写入文件之前和从文件读出之后变换内容，如添加和去掉一个头部、转换换行符，
+// 用于对一部分键透明地使用另一种保存格式，不需要变换的键原样返回 value 即可。
+//
+// 变换发生在和文件交互的边界上：Set 先规范化（见 WithNormalizeTrailingNewline）并用变换前的逻辑内容
+// 判断值是否改变，再对它执行 OnWrite 写入主数据文件和历史记录；Get、GetByVersion 等读取方法读出文件后
+// 先执行 OnRead 再做其它处理（如 WithTreatEmptyAsAbsent 的判断）。存储本身不压缩也不加密，
+// 需要时应该在 OnWrite 中最后执行（OnRead 中最先执行），这样它们总是作用在最终写入文件的内容上。
+// OpenReader、OpenReaderByVersion、WriteVersionTo 和 Equal 也执行 OnRead，这时要先读出整个内容再变换；
+// RootHash 和 DiffAgainst 对当前值执行 OnRead 后再计算摘要，所以两个副本的变换不同时也可以比较；
+// 其它统计信息直接使用文件中的内容，不会执行 OnRead。GetRaw 返回文件中的内容，见 EncodingTransformer。
+type Transformer interface {
+	// OnWrite 返回 key 的逻辑内容 value 写入文件时的内容
+	OnWrite(key string, value []byte) ([]byte, error)
+	// OnRead 返回从 key 的文件中读出的内容 value 对应的逻辑内容
+	OnRead(key string, value []byte) ([]byte, error)
+}
+
+// EncodingTransformer 是 Transformer 可选实现的接口，Encoding 返回 key 的内容写入文件时使用的编码，
+// 如 "gzip"，GetRaw 把它作为编码返回，不变换的键应该返回 EncodingIdentity
+type EncodingTransformer interface {
+	Transformer
+	Encoding(key string) string
+}
+
+// WithTransform 设置读写内容时的变换，默认不变换
+func WithTransform(transform Transformer) Option {
+	return func(s *FileKVStore) {
+		s.transform = transform
+	}
+}
+
+// encodeValue 返回 key 的逻辑内容写入文件时的内容
+func (f *FileKVStore) encodeValue(key string, value []byte) ([]byte, error) {
+	if f.transform == nil {
+		return value, nil
+	}
+	data, err := f.transform.OnWrite(key, value)
+	if err != nil {
+		return nil, errorWrap(err, "transforming value of '"+key+"' for writing")
+	}
+	return data, nil
+}
+
+// decodeValue 返回从 key 的文件中读出的内容对应的逻辑内容
+func (f *FileKVStore) decodeValue(key string, data []byte) ([]byte, error) {
+	if f.transform == nil {
+		return data, nil
+	}
+	value, err := f.transform.OnRead(key, data)
+	if err != nil {
+		return nil, errorWrap(err, "transforming value of '"+key+"' for reading")
+	}
+	return value, nil
+}
+
+// encodingOf 返回 key 的内容在文件中的编码，见 GetRaw
+func (f *FileKVStore) encodingOf(key string) string {
+	if f.transform == nil {
+		return EncodingIdentity
+	}
+	if transform, ok := f.transform.(EncodingTransformer); ok {
+		return transform.Encoding(key)
+	}
+	return EncodingTransformed
+}
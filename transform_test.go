@@ -0,0 +1,189 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var envelopeHeader = []byte("ENVELOPE/1\n")
+
+// envelopeTransformer 为 env/ 下的键添加和去掉一个头部，其它键不变换
+type envelopeTransformer struct{}
+
+func (envelopeTransformer) OnWrite(key string, value []byte) ([]byte, error) {
+	if !strings.HasPrefix(key, "env/") {
+		return value, nil
+	}
+	return append(append([]byte{}, envelopeHeader...), value...), nil
+}
+
+func (envelopeTransformer) OnRead(key string, value []byte) ([]byte, error) {
+	if !strings.HasPrefix(key, "env/") {
+		return value, nil
+	}
+	if !bytes.HasPrefix(value, envelopeHeader) {
+		return nil, errors.New("missing envelope header")
+	}
+	return value[len(envelopeHeader):], nil
+}
+
+func TestFileKVStore_Transform(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-transform-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir, WithTransform(envelopeTransformer{}))
+	ctx := context.Background()
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	v1, err := store.SetWithTimestamp(ctx, "env/a", []byte("hello"), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := store.SetWithTimestamp(ctx, "env/a", []byte("world"), timestamp.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 文件中保存的是变换后的内容
+	data, err := os.ReadFile(filepath.Join(tempDir, "env", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(envelopeHeader)+"world" {
+		t.Fatalf("unexpected data file content %q", data)
+	}
+	data, err = os.ReadFile(filepath.Join(tempDir, ".history", "env", "a.h", v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(envelopeHeader)+"hello" {
+		t.Fatalf("unexpected history file content %q", data)
+	}
+
+	// 读取时得到变换前的内容
+	value, err := store.Get(ctx, "env/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "world" {
+		t.Fatalf("expected %q, got %q", "world", value)
+	}
+	for version, expected := range map[string]string{v1: "hello", v2: "world"} {
+		value, err := store.GetByVersion(ctx, "env/a", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expected {
+			t.Fatalf("%s: expected %q, got %q", version, expected, value)
+		}
+	}
+	if _, err := store.GetConsistent(ctx, "env/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 用变换前的内容判断值是否改变
+	version, err := store.Set(ctx, "env/a", []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		t.Fatalf("expected no new version for the same logical value, got %q", version)
+	}
+	histories, err := store.GetHistories(ctx, "env/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, histories, []string{v1, v2})
+
+	// 不需要变换的键原样保存
+	if _, err := store.Set(ctx, "plain/b", []byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(filepath.Join(tempDir, "plain", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "raw" {
+		t.Fatalf("unexpected data file content %q", data)
+	}
+
+	// OnRead 失败时返回它的错误
+	if err := os.WriteFile(filepath.Join(tempDir, "env", "a"), []byte("no header"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "env/a"); err == nil || !strings.Contains(err.Error(), "missing envelope header") {
+		t.Fatalf("expected the OnRead error, got %v", err)
+	}
+	if _, err := store.Set(ctx, "env/a", []byte("again")); err == nil {
+		t.Fatal("expected Set to fail when the current value cannot be read")
+	}
+}
+
+// namedEnvelopeTransformer 和 envelopeTransformer 相同，但是给出了编码的名字
+type namedEnvelopeTransformer struct{ envelopeTransformer }
+
+func (namedEnvelopeTransformer) Encoding(key string) string {
+	if !strings.HasPrefix(key, "env/") {
+		return EncodingIdentity
+	}
+	return "envelope"
+}
+
+func TestFileKVStore_TransformReads(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	store := NewFileKVStore(tempDir, WithTransform(envelopeTransformer{}), WithTreatEmptyAsAbsent(true))
+
+	// 空的值变换之后不为空，但是和 Get 一样按逻辑内容当作不存在
+	if _, err := store.Set(ctx, "env/empty", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "env/empty"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get: expected ErrKeyNotFound, got %v", err)
+	}
+	if exists, err := store.Exists(ctx, "env/empty"); err != nil || exists {
+		t.Errorf("Exists: expected false, got %v, %v", exists, err)
+	}
+	if _, err := store.Stat(ctx, "env/empty"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Stat: expected ErrKeyNotFound, got %v", err)
+	}
+	if _, _, err := store.GetRaw(ctx, "env/empty"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetRaw: expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 比较的是逻辑内容
+	if _, err := store.Set(ctx, "env/a", []byte("same")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set(ctx, "plain/b", []byte("same")); err != nil {
+		t.Fatal(err)
+	}
+	if equal, err := store.Equal(ctx, "env/a", "plain/b"); err != nil || !equal {
+		t.Errorf("Equal: expected true, got %v, %v", equal, err)
+	}
+
+	// GetRaw 返回文件中的内容和变换的编码
+	data, encoding, err := store.GetRaw(ctx, "env/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(envelopeHeader)+"same" || encoding != EncodingTransformed {
+		t.Errorf("expected the stored bytes with %q, got %q with %q", EncodingTransformed, data, encoding)
+	}
+	named := NewFileKVStore(tempDir, WithTransform(namedEnvelopeTransformer{}))
+	for key, expected := range map[string]string{"env/a": "envelope", "plain/b": EncodingIdentity} {
+		if _, encoding, err := named.GetRaw(ctx, key); err != nil || encoding != expected {
+			t.Errorf("%s: expected %q, got %q, %v", key, expected, encoding, err)
+		}
+	}
+}
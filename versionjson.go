@@ -0,0 +1,51 @@
+package filekv
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// versionJSON 是 Version 在 JSON 中的格式，和 Version 的内部字段无关，新增字段时不能改变已有字段的含义
+type versionJSON struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Timestamp 是从版本号得到的 RFC3339 格式的时间（UTC，精确到纳秒），版本号不是时间戳时为空
+	Timestamp string            `json:"timestamp"`
+	Meta      map[string]string `json:"meta"`
+}
+
+// MarshalJSON 把 Version 编码为 {"name", "version", "timestamp", "meta"}，这几个字段总是存在，
+// 没有元数据时 meta 为 {}。Pinned 可以从 meta 得到，Size 不会被编码。
+func (v Version) MarshalJSON() ([]byte, error) {
+	data := versionJSON{
+		Name:    v.Name,
+		Version: v.Version,
+		Meta:    v.Meta,
+	}
+	if ts, _, err := parseVersion(v.Version); err == nil {
+		data.Timestamp = time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+	if data.Meta == nil {
+		data.Meta = map[string]string{}
+	}
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON 解码 MarshalJSON 的结果，timestamp 总是从版本号得到，所以会被忽略，Pinned 根据 meta 设置
+func (v *Version) UnmarshalJSON(b []byte) error {
+	var data versionJSON
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	*v = Version{
+		Name:    data.Name,
+		Version: data.Version,
+	}
+	if len(data.Meta) > 0 {
+		v.Meta = data.Meta
+		v.Pinned = isPinnedMeta(data.Meta)
+		v.hasMeta = true
+	}
+	return nil
+}
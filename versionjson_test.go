@@ -0,0 +1,92 @@
+package filekv
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVersion_JSON(t *testing.T) {
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "filekv-version-json-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewFileKVStore(tempDir)
+	ctx := context.Background()
+	key := "test/json"
+
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	v1, err := store.SetWithTimestamp(ctx, key, []byte("value1"), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := store.SetWithTimestamp(ctx, key, []byte("value2"), timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMeta(ctx, key, v2, map[string]string{"author": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PinVersion(ctx, key, v2); err != nil {
+		t.Fatal(err)
+	}
+
+	histories, err := store.GetHistories(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(histories)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 字段固定，没有元数据时 meta 为 {}，带计数后缀的版本的时间戳和不带后缀的相同
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 2 {
+		t.Fatalf("expected 2 versions, got %s", data)
+	}
+	for i, version := range []string{v1, v2} {
+		if len(raw[i]) != 4 {
+			t.Fatalf("expected 4 fields, got %v", raw[i])
+		}
+		if raw[i]["name"] != version || raw[i]["version"] != version {
+			t.Fatalf("expected version %q, got %v", version, raw[i])
+		}
+		if raw[i]["timestamp"] != "2023-01-01T00:00:00.123456789Z" {
+			t.Fatalf("unexpected timestamp %v", raw[i]["timestamp"])
+		}
+	}
+	if meta, ok := raw[0]["meta"].(map[string]interface{}); !ok || len(meta) != 0 {
+		t.Fatalf("expected empty meta object, got %v", raw[0]["meta"])
+	}
+
+	// 解码后得到相同的 Version
+	var decoded []Version
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, histories) {
+		t.Fatalf("expected %+v, got %+v", histories, decoded)
+	}
+	if !decoded[1].Pinned || decoded[1].Meta["author"] != "alice" {
+		t.Fatalf("expected pinned version with meta, got %+v", decoded[1])
+	}
+
+	// 版本号不是时间戳时 timestamp 为空
+	data, err = json.Marshal(Version{Name: "custom", Version: "custom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"name":"custom","version":"custom","timestamp":"","meta":{}}` {
+		t.Fatalf("unexpected json %s", data)
+	}
+}